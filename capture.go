@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/nugored/cf-logs-loki-uploader/parser"
+	"github.com/spf13/pflag"
+)
+
+// runCapture downloads a log file and writes its header and a few sanitized
+// lines as a fixture, to plan or test against the fields of a distribution
+func runCapture(args []string) int {
+	fs := pflag.NewFlagSet("capture-schema", pflag.ContinueOnError)
+	bucket := fs.StringP("bucket-name", "", "", "S3 bucket of the log file (required)")
+	format := fs.StringP("input-format", "", "auto", "Format of the log file, as for the shipper (auto, w3c, json, parquet)")
+	lines := fs.IntP("lines", "", 5, "Data lines to capture")
+	output := fs.StringP("output", "", "", "Fixture file to write (parser/testdata/<file name> if empty, parsed by the parser tests)")
+	if err := fs.Parse(args); err != nil {
+		return exitFatal
+	}
+	logger := getLogger("info", os.Stdout)
+	if fs.NArg() != 1 || *bucket == "" {
+		logger.Error("usage: capture-schema --bucket-name <bucket> <key>")
+		return exitFatal
+	}
+	key := fs.Arg(0)
+	if *output == "" {
+		name := path.Base(key)
+		for _, ext := range []string{".gz", ".zst"} {
+			name = strings.TrimSuffix(name, ext)
+		}
+		*output = filepath.Join("parser", "testdata", name)
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		logger.Error("unable to load AWS SDK config", "err", err)
+		return exitFatal
+	}
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UseARNRegion = true
+	})
+	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: &key})
+	if err != nil {
+		logger.Error("unable to get object", "key", key, "err", err)
+		return exitFatal
+	}
+	defer obj.Body.Close()
+	r, err := parser.Decode(*format, key, aws.ToString(obj.ContentType), aws.ToString(obj.ContentEncoding), obj.Body)
+	if err != nil {
+		logger.Error("unable to decode object", "key", key, "err", err)
+		return exitFatal
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(*output), 0o755); err != nil {
+		logger.Error("unable to create fixture directory", "err", err)
+		return exitFatal
+	}
+	tmp := *output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		logger.Error("unable to create fixture", "err", err)
+		return exitFatal
+	}
+	n, err := parser.Capture(r, *lines, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, *output)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		logger.Error("unable to capture fixture", "key", key, "err", err)
+		return exitFatal
+	}
+	fmt.Printf("captured %d lines of %s to %s\n", n, key, *output)
+	return exitClean
+}
@@ -0,0 +1,106 @@
+// Package clock abstracts the current time, sleeps and timers so timestamp
+// assignment, batch idle flushes and push backoffs can run on a fake clock
+// in tests.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and schedules waits
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a function scheduled by AfterFunc
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Real is the wall clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                            { return time.Now() }
+func (realClock) Sleep(d time.Duration)                     { time.Sleep(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// Fake is a clock moved only by Advance and Sleep, Sleep advances it
+// without blocking so backoffs complete at once
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake returns a fake clock at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Fake) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// Advance moves the clock by d and runs the timers due, in order of their
+// due time
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && !t.at.After(c.now) {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.f() // outside the lock, the function may use the clock
+	}
+}
+
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, f: f, at: c.now.Add(d), active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	f      func()
+	at     time.Time
+	active bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.at = t.clock.now.Add(d)
+	t.active = true
+	return active
+}
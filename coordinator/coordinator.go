@@ -0,0 +1,210 @@
+// Package coordinator distributes keys listed by a single coordinator to
+// stateless worker replicas over gRPC, so shipping scales beyond one pod.
+// Workers lease keys, extend the leases with heartbeats while shipping and
+// report completion or failure, expired and failed leases are retried.
+//
+// Messages are plain structs encoded as JSON, the service is small enough
+// not to need generated protobuf code.
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+)
+
+const serviceName = "cloudfront.logs.shipper.Coordinator"
+
+// leaseWait is how long a lease request waits for a key before the worker
+// asks again
+const leaseWait = 20 * time.Second
+
+// Lease is a key handed out to a worker until it expires, the worker extends
+// it with heartbeats while shipping the file
+type Lease struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	Worker  string    `json:"worker"`
+	Attempt int       `json:"attempt"` // 1 for the first lease of the key
+	Expires time.Time `json:"expires"`
+}
+
+type LeaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+type LeaseResponse struct {
+	Lease  *Lease        `json:"lease,omitempty"` // nil if no key was queued in time
+	TTL    time.Duration `json:"ttl"`
+	Closed bool          `json:"closed"` // no more keys will be handed out
+}
+
+type CompleteRequest struct {
+	Worker string `json:"worker"`
+	ID     string `json:"id"`
+}
+
+type FailRequest struct {
+	Worker string `json:"worker"`
+	ID     string `json:"id"`
+	Error  string `json:"error"`
+}
+
+type HeartbeatRequest struct {
+	Worker string   `json:"worker"`
+	IDs    []string `json:"ids"`
+}
+
+type HeartbeatResponse struct {
+	Lost []string `json:"lost,omitempty"` // leases expired or unknown to the coordinator
+}
+
+type ListLeasesRequest struct{}
+
+type ListLeasesResponse struct {
+	Leases []Lease `json:"leases"`
+}
+
+type empty struct{}
+
+// Source hands out the queued keys as leases and tracks their outcome
+type Source interface {
+	// Lease returns a lease of the next key, ok is false once no more keys
+	// will be queued, the lease is nil if none was queued before ctx was done
+	Lease(ctx context.Context, worker string) (lease *Lease, ttl time.Duration, ok bool)
+	// Complete releases a lease whose file was shipped and deleted
+	Complete(worker, id string)
+	// Fail releases a lease whose file failed, the key may be leased again
+	Fail(worker, id, err string)
+	// Heartbeat extends the leases of a worker and returns the lost ones
+	Heartbeat(worker string, ids []string) (lost []string)
+	// Leases returns the active leases
+	Leases() []Lease
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+type server struct {
+	src Source
+}
+
+// Register adds the coordinator service backed by src to a gRPC server
+func Register(s *grpc.Server, src Source) {
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: serviceName,
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{
+			{MethodName: "Lease", Handler: handler(func(srv *server, ctx context.Context, req *LeaseRequest) (*LeaseResponse, error) {
+				ctx, cancel := context.WithTimeout(ctx, leaseWait)
+				defer cancel()
+				lease, ttl, ok := srv.src.Lease(ctx, req.Worker)
+				return &LeaseResponse{Lease: lease, TTL: ttl, Closed: !ok}, nil
+			})},
+			{MethodName: "Complete", Handler: handler(func(srv *server, ctx context.Context, req *CompleteRequest) (*empty, error) {
+				srv.src.Complete(req.Worker, req.ID)
+				return &empty{}, nil
+			})},
+			{MethodName: "Fail", Handler: handler(func(srv *server, ctx context.Context, req *FailRequest) (*empty, error) {
+				srv.src.Fail(req.Worker, req.ID, req.Error)
+				return &empty{}, nil
+			})},
+			{MethodName: "Heartbeat", Handler: handler(func(srv *server, ctx context.Context, req *HeartbeatRequest) (*HeartbeatResponse, error) {
+				return &HeartbeatResponse{Lost: srv.src.Heartbeat(req.Worker, req.IDs)}, nil
+			})},
+			{MethodName: "ListLeases", Handler: handler(func(srv *server, ctx context.Context, req *ListLeasesRequest) (*ListLeasesResponse, error) {
+				return &ListLeasesResponse{Leases: srv.src.Leases()}, nil
+			})},
+		},
+	}, &server{src: src})
+}
+
+// handler adapts a typed method to a gRPC method handler
+func handler[Req, Resp any](fn func(*server, context.Context, *Req) (*Resp, error)) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		return fn(srv.(*server), ctx, req)
+	}
+}
+
+// Client leases keys from a coordinator
+type Client struct {
+	conn   *grpc.ClientConn
+	worker string
+}
+
+// Dial connects to the coordinator at addr, without TLS as the control plane
+// is expected to run within the cluster network
+func Dial(addr, worker string) (*Client, error) {
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, worker: worker}, nil
+}
+
+// Lease returns a lease of the next key with its time to live, nil if none
+// was queued in time, and closed once the coordinator hands out no more keys
+func (c *Client) Lease(ctx context.Context) (lease *Lease, ttl time.Duration, closed bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, leaseWait+10*time.Second)
+	defer cancel()
+	resp := &LeaseResponse{}
+	if err := c.invoke(ctx, "Lease", &LeaseRequest{Worker: c.worker}, resp); err != nil {
+		return nil, 0, false, err
+	}
+	return resp.Lease, resp.TTL, resp.Closed, nil
+}
+
+// Complete reports a lease whose file was shipped and deleted
+func (c *Client) Complete(ctx context.Context, id string) error {
+	return c.invoke(ctx, "Complete", &CompleteRequest{Worker: c.worker, ID: id}, &empty{})
+}
+
+// Fail reports a lease whose file could not be shipped or deleted
+func (c *Client) Fail(ctx context.Context, id string, shipErr error) error {
+	return c.invoke(ctx, "Fail", &FailRequest{Worker: c.worker, ID: id, Error: shipErr.Error()}, &empty{})
+}
+
+// Heartbeat extends leases and returns those the coordinator no longer holds
+// for the worker
+func (c *Client) Heartbeat(ctx context.Context, ids ...string) ([]string, error) {
+	resp := &HeartbeatResponse{}
+	if err := c.invoke(ctx, "Heartbeat", &HeartbeatRequest{Worker: c.worker, IDs: ids}, resp); err != nil {
+		return nil, err
+	}
+	return resp.Lost, nil
+}
+
+// ListLeases returns the active leases of the coordinator
+func (c *Client) ListLeases(ctx context.Context) ([]Lease, error) {
+	resp := &ListLeasesResponse{}
+	if err := c.invoke(ctx, "ListLeases", &ListLeasesRequest{}, resp); err != nil {
+		return nil, err
+	}
+	return resp.Leases, nil
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req, resp any) error {
+	return c.conn.Invoke(ctx, "/"+serviceName+"/"+method, req, resp)
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
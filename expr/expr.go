@@ -0,0 +1,352 @@
+// Package expr evaluates small expressions over log entry fields for user
+// defined filters and transforms. Expressions have no loops or side effects,
+// evaluation is bounded by the size of the expression and a deadline.
+//
+//	sc-status >= 500 && startsWith(cs-uri-stem, "/api/")
+//	field("cs(User-Agent)") =~ "(?i)bot" || !has("x-host-header")
+//	lower(x-edge-location) + "-" + sc-status
+//
+// Field values are strings, comparisons with a number literal and ordering
+// comparisons of numeric strings are numeric.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/clock"
+)
+
+// ErrTimeout is returned when the evaluation exceeds its deadline
+var ErrTimeout = errors.New("expression evaluation timed out")
+
+// Deadline bounds an evaluation, the zero Deadline doesn't
+type Deadline struct {
+	At    time.Time
+	Clock clock.Clock // At is a time of, clock.Real if nil
+}
+
+// NewDeadline returns the deadline timeout from now on the clock, none for a
+// timeout of 0
+func NewDeadline(c clock.Clock, timeout time.Duration) Deadline {
+	if timeout <= 0 {
+		return Deadline{}
+	}
+	return Deadline{At: c.Now().Add(timeout), Clock: c}
+}
+
+// expired reports whether the deadline has passed
+func (d Deadline) expired() bool {
+	if d.At.IsZero() {
+		return false
+	}
+	c := d.Clock
+	if c == nil {
+		c = clock.Real
+	}
+	return c.Now().After(d.At)
+}
+
+// Program is a compiled expression, safe for concurrent use
+type Program struct {
+	src  string
+	root node
+}
+
+// Compile parses an expression
+func Compile(src string) (*Program, error) {
+	p := &parser{lex: lexer{src: src}}
+	p.advance()
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", src, err)
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("invalid expression %q: unexpected %q at %d", src, p.tok.text, p.tok.pos)
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+func (p *Program) String() string {
+	return p.src
+}
+
+// Eval evaluates the expression over the fields, the result is a string,
+// float64 or bool
+func (p *Program) Eval(fields map[string]string, deadline Deadline) (any, error) {
+	return p.root.eval(&env{fields: fields, deadline: deadline})
+}
+
+// Bool evaluates the expression as a condition, see Truthy
+func (p *Program) Bool(fields map[string]string, deadline Deadline) (bool, error) {
+	v, err := p.Eval(fields, deadline)
+	if err != nil {
+		return false, err
+	}
+	return Truthy(v), nil
+}
+
+// EvalString evaluates the expression as a field value
+func (p *Program) EvalString(fields map[string]string, deadline Deadline) (string, error) {
+	v, err := p.Eval(fields, deadline)
+	if err != nil {
+		return "", err
+	}
+	return toString(v), nil
+}
+
+// Truthy reports whether a value is true: true, non-zero numbers and strings
+// other than "" and CloudFront's "-" for empty fields
+func Truthy(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != "" && v != "-"
+	}
+	return false
+}
+
+func toString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func toNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type env struct {
+	fields   map[string]string
+	deadline Deadline
+	steps    int
+}
+
+// step checks the deadline every few evaluated nodes
+func (e *env) step() error {
+	e.steps++
+	if e.steps%16 == 0 && e.deadline.expired() {
+		return ErrTimeout
+	}
+	return nil
+}
+
+type node interface {
+	eval(e *env) (any, error)
+}
+
+type literal struct{ value any }
+
+func (n literal) eval(e *env) (any, error) {
+	return n.value, nil
+}
+
+type fieldRef struct{ name string }
+
+func (n fieldRef) eval(e *env) (any, error) {
+	return e.fields[n.name], nil
+}
+
+type not struct{ x node }
+
+func (n not) eval(e *env) (any, error) {
+	v, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	return !Truthy(v), nil
+}
+
+type logical struct {
+	and  bool
+	x, y node
+}
+
+func (n logical) eval(e *env) (any, error) {
+	if err := e.step(); err != nil {
+		return nil, err
+	}
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if Truthy(x) != n.and {
+		return !n.and, nil // short circuit
+	}
+	y, err := n.y.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	return Truthy(y), nil
+}
+
+type compare struct {
+	op      string
+	x, y    node
+	numeric bool // a side is a number literal
+}
+
+func (n compare) eval(e *env) (any, error) {
+	if err := e.step(); err != nil {
+		return nil, err
+	}
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	y, err := n.y.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	xn, xok := toNumber(x)
+	yn, yok := toNumber(y)
+	if xok && yok && (n.numeric || n.op[0] == '<' || n.op[0] == '>') {
+		switch n.op {
+		case "==":
+			return xn == yn, nil
+		case "!=":
+			return xn != yn, nil
+		case "<":
+			return xn < yn, nil
+		case "<=":
+			return xn <= yn, nil
+		case ">":
+			return xn > yn, nil
+		case ">=":
+			return xn >= yn, nil
+		}
+	}
+	if n.numeric && (n.op == "==" || n.op == "!=") {
+		return n.op == "!=", nil // not a number never equals one
+	}
+	xs, ys := toString(x), toString(y)
+	switch n.op {
+	case "==":
+		return xs == ys, nil
+	case "!=":
+		return xs != ys, nil
+	case "<":
+		return xs < ys, nil
+	case "<=":
+		return xs <= ys, nil
+	case ">":
+		return xs > ys, nil
+	case ">=":
+		return xs >= ys, nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+type match struct {
+	x      node
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (n match) eval(e *env) (any, error) {
+	if err := e.step(); err != nil {
+		return nil, err
+	}
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	return n.re.MatchString(toString(x)) != n.negate, nil
+}
+
+type concat struct{ x, y node }
+
+// eval adds numbers and concatenates anything else
+func (n concat) eval(e *env) (any, error) {
+	if err := e.step(); err != nil {
+		return nil, err
+	}
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	y, err := n.y.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	xn, xok := x.(float64)
+	yn, yok := y.(float64)
+	if xok && yok {
+		return xn + yn, nil
+	}
+	return toString(x) + toString(y), nil
+}
+
+type call struct {
+	fn   function
+	args []node
+}
+
+func (n call) eval(e *env) (any, error) {
+	if err := e.step(); err != nil {
+		return nil, err
+	}
+	args := make([]any, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return n.fn.call(e, args), nil
+}
+
+type function struct {
+	arity int
+	call  func(e *env, args []any) any
+}
+
+var functions = map[string]function{
+	"field": {1, func(e *env, args []any) any { return e.fields[toString(args[0])] }},
+	"has": {1, func(e *env, args []any) any {
+		v, ok := e.fields[toString(args[0])]
+		return ok && v != "" && v != "-"
+	}},
+	"lower":      {1, func(e *env, args []any) any { return strings.ToLower(toString(args[0])) }},
+	"upper":      {1, func(e *env, args []any) any { return strings.ToUpper(toString(args[0])) }},
+	"len":        {1, func(e *env, args []any) any { return float64(len(toString(args[0]))) }},
+	"number":     {1, func(e *env, args []any) any { n, _ := toNumber(args[0]); return n }},
+	"contains":   {2, func(e *env, args []any) any { return strings.Contains(toString(args[0]), toString(args[1])) }},
+	"startsWith": {2, func(e *env, args []any) any { return strings.HasPrefix(toString(args[0]), toString(args[1])) }},
+	"endsWith":   {2, func(e *env, args []any) any { return strings.HasSuffix(toString(args[0]), toString(args[1])) }},
+	"replace": {3, func(e *env, args []any) any {
+		return strings.ReplaceAll(toString(args[0]), toString(args[1]), toString(args[2]))
+	}},
+	"if": {3, func(e *env, args []any) any {
+		if Truthy(args[0]) {
+			return args[1]
+		}
+		return args[2]
+	}},
+}
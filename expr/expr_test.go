@@ -0,0 +1,124 @@
+package expr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/clock"
+)
+
+func TestEval(t *testing.T) {
+	fields := map[string]string{
+		"sc-status":       "500",
+		"time-taken":      "9.5",
+		"sc-bytes":        "10",
+		"x-edge-location": "FRA56-P1",
+		"cs-uri-stem":     "/api/items",
+		"x-host-header":   "-",
+		"quote":           "it's",
+	}
+	tests := []struct {
+		src  string
+		want any
+	}{
+		// precedence: || < && < ! < comparisons < +
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`"a" + "b" == "ab"`, true},
+		{`sc-status >= 500 && startsWith(cs-uri-stem, "/api/")`, true},
+		{`sc-status < 500 || lower(x-edge-location) =~ "^fra"`, true},
+
+		// numeric against a number literal or ordering numeric strings
+		{`sc-status == 500.0`, true},
+		{`sc-status == "500.0"`, false},
+		{`time-taken < sc-bytes`, true},
+		{`"9.5" < "10"`, true},
+		{`x-edge-location == 1`, false},
+		{`x-edge-location != 1`, true},
+		{`"b" > "a"`, true},
+		{`1 + 2`, 3.0},
+		{`sc-status + "-" + x-edge-location`, "500-FRA56-P1"},
+
+		// string literals
+		{`quote == 'it\'s'`, true},
+		{`'say "hi"'`, `say "hi"`},
+		{`"tab\tend"`, "tab\tend"},
+
+		// negative numbers
+		{`-1 < 0`, true},
+		{`sc-bytes > -1.5`, true},
+		{`-2 + 1`, -1.0},
+
+		// functions
+		{`has("x-host-header")`, false},
+		{`has("sc-status")`, true},
+		{`field("cs-uri-stem")`, "/api/items"},
+		{`len(cs-uri-stem)`, 10.0},
+		{`if(sc-status >= 500, "error", "ok")`, "error"},
+		{`replace(cs-uri-stem, "/", "_")`, "_api_items"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			p, err := Compile(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Eval(fields, Deadline{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Eval() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{`lower()`, "lower takes 1 arguments, got 0"},
+		{`contains("a")`, "contains takes 2 arguments, got 1"},
+		{`replace("a", "b")`, "replace takes 3 arguments, got 2"},
+		{`unknown(1)`, `unknown function "unknown"`},
+		{`sc-status =~ sc-status`, "requires a string literal pattern"},
+		{`sc-status =~ "("`, "invalid pattern"},
+		{`"open`, "unterminated string"},
+		{`(true`, "unexpected end"},
+		{`true true`, `unexpected "true"`},
+		{`sc-status - 1`, "unexpected '-'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := Compile(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Compile() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	p, err := Compile(strings.Repeat("true && ", 40) + "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := NewDeadline(fake, time.Millisecond)
+	if ok, err := p.Bool(nil, deadline); err != nil || !ok {
+		t.Fatalf("Bool() before the deadline = %v, %v", ok, err)
+	}
+	fake.Advance(time.Second)
+	if _, err := p.Bool(nil, deadline); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Bool() after the deadline error = %v, want ErrTimeout", err)
+	}
+	if _, err := p.Bool(nil, NewDeadline(fake, 0)); err != nil {
+		t.Errorf("Bool() without a deadline error = %v", err)
+	}
+}
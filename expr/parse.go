@@ -0,0 +1,327 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+// operators, longest first
+var operators = []string{"==", "!=", "<=", ">=", "=~", "!~", "&&", "||", "<", ">", "!", "+", "(", ")", ","}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// doubleQuoted returns the body of a single-quoted string as a double-quoted
+// Go string: \' is a quote, " needs no escape
+func doubleQuoted(body string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(body); i++ {
+		switch {
+		case body[i] == '\\' && i+1 < len(body):
+			if body[i+1] == '\'' {
+				b.WriteByte('\'')
+			} else {
+				b.WriteString(body[i : i+2])
+			}
+			i++
+		case body[i] == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(body[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// isIdent reports whether c may be part of a field name such as sc-status,
+// x-edge-location or cs-uri-stem
+func isIdent(c byte, first bool) bool {
+	if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return !first && (c >= '0' && c <= '9' || c == '-' || c == '.')
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case isDigit(c) || c == '-' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1]):
+		// there is no subtraction, a - before a digit is a negative number
+		l.pos++
+		for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	case c == '"' || c == '\'':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != c {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return token{}, fmt.Errorf("unterminated string at %d", start)
+		}
+		l.pos++
+		text := l.src[start:l.pos]
+		if c == '\'' {
+			text = doubleQuoted(text[1 : len(text)-1])
+		}
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return token{}, fmt.Errorf("invalid string at %d: %w", start, err)
+		}
+		return token{kind: tokString, text: s, pos: start}, nil
+	case isIdent(c, true):
+		for l.pos < len(l.src) && isIdent(l.src[l.pos], false) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected %q at %d", c, start)
+}
+
+// parser is a recursive descent parser, from lowest to highest precedence:
+// ||, &&, !, comparisons and =~, +, operands
+type parser struct {
+	lex lexer
+	tok token
+	err error
+}
+
+func (p *parser) advance() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+	if p.err != nil {
+		p.tok = token{kind: tokEOF}
+	}
+}
+
+func (p *parser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.unexpected()
+	}
+	p.advance()
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.tok.kind == tokEOF {
+		return fmt.Errorf("unexpected end")
+	}
+	return fmt.Errorf("unexpected %q at %d", p.tok.text, p.tok.pos)
+}
+
+func (p *parser) parseOr() (node, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.advance()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = logical{and: false, x: x, y: y}
+	}
+	return x, p.err
+}
+
+func (p *parser) parseAnd() (node, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.advance()
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		x = logical{and: true, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.isOp("!") {
+		p.advance()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return not{x: x}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	x, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokOp {
+		return x, nil
+	}
+	op := p.tok.text
+	switch op {
+	case "=~", "!~":
+		p.advance()
+		if p.tok.kind != tokString {
+			return nil, fmt.Errorf("%s requires a string literal pattern at %d", op, p.tok.pos)
+		}
+		re, err := regexp.Compile(p.tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern at %d: %w", p.tok.pos, err)
+		}
+		p.advance()
+		return match{x: x, re: re, negate: op == "!~"}, nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.advance()
+		y, err := p.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		_, xnum := x.(literal)
+		_, ynum := y.(literal)
+		xnum = xnum && isNumber(x)
+		ynum = ynum && isNumber(y)
+		return compare{op: op, x: x, y: y, numeric: xnum || ynum}, nil
+	}
+	return x, nil
+}
+
+func isNumber(n node) bool {
+	l, ok := n.(literal)
+	if !ok {
+		return false
+	}
+	_, ok = l.value.(float64)
+	return ok
+}
+
+func (p *parser) parseConcat() (node, error) {
+	x, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") {
+		p.advance()
+		y, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		x = concat{x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", tok.text, tok.pos)
+		}
+		p.advance()
+		return literal{n}, nil
+	case tokString:
+		p.advance()
+		return literal{tok.text}, nil
+	case tokIdent:
+		p.advance()
+		switch tok.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		}
+		if !p.isOp("(") {
+			return fieldRef{tok.text}, nil
+		}
+		fn, ok := functions[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %q at %d", tok.text, tok.pos)
+		}
+		p.advance()
+		var args []node
+		for !p.isOp(")") {
+			if len(args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		p.advance()
+		if len(args) != fn.arity {
+			return nil, fmt.Errorf("%s takes %d arguments, got %d", tok.text, fn.arity, len(args))
+		}
+		return call{fn: fn, args: args}, nil
+	case tokOp:
+		if tok.text == "(" {
+			p.advance()
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	}
+	return nil, p.unexpected()
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/loki"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+	"github.com/nugored/cf-logs-loki-uploader/parser"
+	"github.com/spf13/pflag"
+)
+
+// cli are the options and the raw flag values converted into options after
+// parsing
+type cli struct {
+	opts              models.Options
+	grafanaCloudStack *string
+	logLevel          *string
+	routes            *[]string
+	anomaly           *string
+	nsAnomalies       *[]string
+	labels            *[]string
+	nsShards          *[]string
+	nsTenants         *[]string
+	ver               *bool
+	tui               *bool
+	modifiedAfter     *string
+	modifiedBefore    *string
+	hourAfter         *string
+	hourBefore        *string
+}
+
+// newCLI defines the flags of the shipper on a flag set
+func newCLI(fs *pflag.FlagSet) *cli {
+	c := &cli{}
+	fs.StringVarP(&c.opts.BucketName, "bucket-name", "b", "", "Name of the S3 bucket with Cloudfront logs, or an access point ARN or alias, Multi-Region Access Points included (required)")
+	fs.DurationVarP(&c.opts.WaitInterval, "wait", "w", 60*time.Second, "Interval to wait between runs")
+	fs.DurationVarP(&c.opts.WaitIntervalMin, "wait-min", "", 0, "Lower bound of the wait interval tuned from recent scans, --wait is the initial interval (0 for a fixed interval)")
+	fs.DurationVarP(&c.opts.WaitIntervalMax, "wait-max", "", 0, "Upper bound of the wait interval tuned from recent scans (0 for a fixed interval)")
+	fs.IntVarP(&c.opts.MaxFilesPerCycle, "max-files-per-cycle", "", 0, "Maximum new files queued by a scan, the rest is queued by the next scans in listing order (0 for no limit)")
+	fs.StringVarP(&c.opts.LokiURL, "loki-url", "H", "", "URL to Loki API (required)")
+	fs.StringSliceVarP(&c.opts.LokiAlternateURLs, "loki-alternate-urls", "", nil, "Push URLs of other Lokis of the same data, e.g. in other regions, pushes are pinned to the healthy one of --loki-url and these with the lowest latency. Only Loki is pinned: S3 is read through --bucket-name, set a Multi-Region Access Point there to have S3 route reads to the closest replica")
+	fs.DurationVarP(&c.opts.LokiProbeInterval, "loki-probe-interval", "", time.Minute, "Interval to probe the latency of --loki-url and its alternates")
+	fs.StringVarP(&c.opts.LokiUser, "loki-user", "u", "", "User to use for Loki authentication")
+	fs.StringVarP(&c.opts.LokiTenant, "loki-tenant", "", "", "Loki tenant (X-Scope-OrgID) to push to, overridden by namespace policies")
+	fs.StringVarP(&c.opts.LokiCompression, "loki-compression", "", "snappy", "Compression of Loki pushes (snappy protobuf, or JSON with none, gzip, zstd), falls back to snappy when not supported")
+	fs.StringVarP(&c.opts.LokiHTTP2, "loki-http2", "", "auto", "HTTP/2 usage for Loki pushes (auto, force for HTTP/2 only, also h2c without TLS, off for HTTP/1.1 only)")
+	fs.IntVarP(&c.opts.LokiMaxConns, "loki-max-conns", "", 0, "Maximum connections per Loki host, reused across pushes (0 for no limit)")
+	fs.BoolVarP(&c.opts.LokiDiscoverLimits, "loki-discover-limits", "", true, "Read Loki's limits from its /config endpoint on startup, when exposed, to size batches and warnings not set explicitly")
+	fs.IntVarP(&c.opts.LokiMaxLineSize, "loki-max-line-size", "", 0, "Count lines larger than Loki's max line size, discovered if not set (0 for no limit)")
+	fs.IntVarP(&c.opts.StreamWarnThreshold, "stream-warn-threshold", "", 4000, "Warn when the estimated active streams of a tenant exceed this, below Loki's max-streams-per-user (0 to disable)")
+	fs.IntVarP(&c.opts.LokiStreamRate, "loki-stream-rate", "", 0, "Bytes per second pushed to a stream, spreading large files of a hot stream over time below Loki's per_stream_rate_limit (0 for no limit)")
+	fs.IntVarP(&c.opts.LokiStreamBurst, "loki-stream-burst", "", 0, "Bytes pushed to a stream at once with --loki-stream-rate, below Loki's per_stream_rate_limit_burst (0 for 5 times the rate, like Loki's defaults)")
+	fs.IntVarP(&c.opts.LokiInflight, "loki-inflight", "", 1, "Maximum concurrent pushes per file, streams keep their order (1 for serial pushes)")
+	fs.BoolVarP(&c.opts.PreserveOrder, "preserve-order", "", false, "Push the lines of a file in file order rather than by timestamp, concurrent pushes only within a chunk once the previous chunks were confirmed (Loki must accept out-of-order writes)")
+	fs.DurationVarP(&c.opts.LokiDNSRefresh, "loki-dns-refresh", "", 0, "Re-resolve Loki hostnames this often and rotate connections across all addresses (0 to disable)")
+	fs.StringVarP(&c.opts.ClusterName, "cluster", "c", "", "Cluster name")
+	fs.StringVarP(&c.opts.Environment, "environment", "", "", "Environment of the deployment (e.g. dev, stage, prod), set as environment label, part of the index label and selecting the environment defaults of the policy file")
+	c.grafanaCloudStack = fs.StringP("grafana-cloud-stack", "", "", "Grafana Cloud stack slug to derive Loki URL and user from, instead of --loki-url and --loki-user (GRAFANA_CLOUD_API_KEY environment variable required)")
+	c.logLevel = fs.StringP("log-level", "", "info", "Log level (info, debug)")
+	fs.StringVarP(&c.opts.InputFormat, "input-format", "", "auto", "Format of log files (auto detected from the key and object metadata, w3c, json for CloudFront standard logging v2 JSON, parquet with a registered decoder)")
+	fs.StringSliceVarP(&c.opts.FunctionLogPrefixes, "function-log-prefix", "", []string{}, "Key prefix of Lambda@Edge and CloudFront Functions logs in the bucket (namespace/...), shipped with x-edge-request-id and distribution fields to correlate with request logs, can be specified multiple times")
+	fs.StringVarP(&c.opts.Format, "format", "o", "json", "Format to ship log lines as (json, logfmt, raw)")
+	fs.StringVarP(&c.opts.KeyStyle, "key-style", "", "snake", "Keys of json lines (snake for flat snake_case, camel for flat camelCase, nested for objects grouped by prefix like cs, sc and x_edge, w3c for the W3C field names)")
+	fs.BoolVarP(&c.opts.RawTimestamp, "raw-timestamp", "", false, "Prefix raw lines with the ISO 8601 request timestamp")
+	fs.StringSliceVarP(&c.opts.FieldOrder, "field-order", "", []string{}, "Fields to write first in json and logfmt lines, followed by the remaining ones in header order")
+	fs.StringSliceVarP(&c.opts.SplitHosts, "split-host", "", []string{}, "Host header to ship into its own stream with a host label, can be specified multiple times")
+	fs.StringVarP(&c.opts.UnknownEdge, "unknown-edge", "", "default", "Lines of edge locations of unknown continent or country matching no route while continent or country routes are set (default ships them to --loki-url, route by the route of the field with value=unknown, deadletter moves them to --deadletter-prefix)")
+	c.routes = fs.StringArrayP("route", "", []string{}, "Route entries with a field value to another Loki, can be specified multiple times (field=continent|country|<field>,value=EU,url=https://...[,tenant=...]), field=malformed,value=true ships lines not matching their header, scrubbed as a whole, instead of moving them to --deadletter-prefix")
+	fs.StringVarP(&c.opts.RemoteWriteURL, "remote-write-url", "", "", "Prometheus remote-write URL to push aggregated request counters to")
+	fs.DurationVarP(&c.opts.RemoteWriteInterval, "remote-write-interval", "", time.Minute, "Interval to push aggregated request counters")
+	fs.BoolVarP(&c.opts.GDPR, "gdpr", "", false, "Attach request id and client IP hash as structured metadata and enable POST /gdpr/erase?c_ip_hash=... for Loki deletions, authenticated by the GDPR_ERASE_TOKEN bearer token")
+	fs.StringVarP(&c.opts.GDPRKeyFile, "gdpr-key-file", "", "", "File of the HMAC key client IPs are hashed with for --gdpr, GDPR_HASH_KEY environment variable if not set")
+	fs.StringVarP(&c.opts.FLE, "fle", "", "auto", "Field-level encryption fields handling (auto: drop unless FLE is used, drop, keep)")
+	fs.BoolVarP(&c.opts.Scrub, "scrub", "", true, "Hash cookies and redact credential-like values before shipping (--scrub=false to disable)")
+	fs.StringSliceVarP(&c.opts.IPAllow, "ip-allow", "", []string{}, "Only ship lines whose c-ip is within these CIDRs, can be specified multiple times")
+	fs.StringSliceVarP(&c.opts.IPDeny, "ip-deny", "", []string{}, "Filter lines whose c-ip is within these CIDRs (e.g. load tests, known scanners), can be specified multiple times")
+	fs.StringVarP(&c.opts.IPFilterAction, "ip-filter-action", "", "drop", "Action for lines filtered by --ip-allow or --ip-deny (drop, tag with ip_filtered)")
+	fs.StringSliceVarP(&c.opts.DropCountries, "drop-country", "", []string{}, "Drop lines served from edges in these countries (ISO codes) unless a route ships them, can be specified multiple times")
+	fs.StringVarP(&c.opts.DropList, "drop-list", "", "", "URL or s3://bucket/key of a JSON list of user agent and referrer substrings to drop ({\"user_agents\": [...], \"referrers\": [...]})")
+	fs.DurationVarP(&c.opts.DropListRefresh, "drop-list-refresh", "", 5*time.Minute, "Interval to reload the drop list")
+	fs.StringArrayVarP(&c.opts.Sets, "set", "", []string{}, "Set a field to an expression, can be specified multiple times (field=expression, e.g. api=startsWith(cs-uri-stem, \"/api/\"))")
+	fs.StringArrayVarP(&c.opts.Filters, "filter", "", []string{}, "Drop lines for which an expression is true, can be specified multiple times (e.g. sc-status == 200 && cs-method == \"HEAD\")")
+	fs.DurationVarP(&c.opts.ExprTimeout, "expr-timeout", "", time.Millisecond, "Time limit of the expressions of a line, failed expressions keep the line unchanged (0 for no limit)")
+	fs.BoolVarP(&c.opts.AnonymizeIPs, "anonymize-ips", "", false, "Zero the host part of client and forwarded IPs (last IPv4 octet, IPv6 after /48)")
+	fs.StringArrayVarP(&c.opts.PseudonymFields, "pseudonymize", "", []string{}, "Field to replace by a stable pseudonym, whole or the first group of a regexp (c-ip, cs-uri-stem=/users/([^/]+)), can be specified multiple times")
+	fs.StringVarP(&c.opts.PseudonymKeyFile, "pseudonym-key-file", "", "", "File of the HMAC key pseudonyms are derived with, keep it to keep pseudonyms stable across days")
+	fs.StringVarP(&c.opts.PseudonymURL, "pseudonym-url", "", "", "Tokenization endpoint POSTed {\"value\": ...} and answering {\"token\": ...}, instead of an HMAC key")
+	fs.DurationVarP(&c.opts.PseudonymTimeout, "pseudonym-timeout", "", 5*time.Second, "Timeout of tokenization requests, values are redacted on failures")
+	c.anomaly = fs.StringP("anomaly", "", "", "Thresholds to tag anomalous requests (slow=<seconds>,oversized=<bytes>,error-burst=<5xx per minute>)")
+	c.nsAnomalies = fs.StringArrayP("namespace-anomaly", "", []string{}, "Anomaly thresholds of a namespace, can be specified multiple times (namespace:slow=...,...)")
+	c.labels = fs.StringArrayP("label", "l", []string{}, "Label to add to Loki stream, can be specified multiple times (key=value)")
+	fs.IntVarP(&c.opts.Workers, "workers", "n", 4, "Number of workers to run")
+	fs.BoolVarP(&c.opts.LowMemory, "low-memory", "", false, "Low-memory profile for small edge boxes: a single worker, tiny batches, serial pushes and no caches")
+	fs.IntVarP(&c.opts.Shards, "shards", "", 0, "Spread each label set over this many streams with a __shard label, for hot streams (0 to disable)")
+	c.nsTenants = fs.StringArrayP("namespace-tenant", "", []string{}, "Loki tenant of a namespace overriding --tenant-per-namespace, can be specified multiple times (namespace:tenant)")
+	fs.BoolVarP(&c.opts.TenantPerNamespace, "tenant-per-namespace", "", false, "Push the logs of a namespace to the Loki tenant named after it instead of --loki-tenant")
+	fs.StringSliceVarP(&c.opts.BaseLabels, "base-labels", "", []string{"namespace", "cloudfront", "cluster", "environment", "index", "distribution"}, "Labels derived from the S3 key set on every stream")
+	fs.StringSliceVarP(&c.opts.LabelFields, "label-field", "", []string{}, "Field to promote to a stream label named in snake_case, e.g. sc-status as sc_status, mind the stream cardinality, user identifying fields are refused with --gdpr, can be specified multiple times")
+	fs.StringSliceVarP(&c.opts.MetadataFields, "metadata-field", "", []string{}, "Field to attach as structured metadata named in snake_case, user identifying fields are refused with --gdpr, can be specified multiple times")
+	fs.StringSliceVarP(&c.opts.DropFields, "drop-field", "", []string{}, "Field to drop from lines, after labels and structured metadata were taken from it, can be specified multiple times")
+	c.nsShards = fs.StringArrayP("namespace-shards", "", []string{}, "Number of shards of a namespace, can be specified multiple times (namespace:shards)")
+	fs.IntVarP(&c.opts.NamespaceConcurrency, "namespace-concurrency", "", 0, "Maximum number of files of a namespace processed concurrently (0 for no limit)")
+	fs.DurationVarP(&c.opts.ReconcileInterval, "reconcile-interval", "", 0, "Interval to list the whole bucket and report files older than --reconcile-age never shipped, kept or queued, missed by scans or notifications (0 to disable)")
+	fs.DurationVarP(&c.opts.ReconcileAge, "reconcile-age", "", 6*time.Hour, "Age of files reported by --reconcile-interval if still in the bucket")
+	fs.DurationVarP(&c.opts.VolumeInterval, "volume-interval", "", 10*time.Minute, "Interval to compare the lines shipped per namespace with their baseline (0 to disable)")
+	fs.Float64VarP(&c.opts.VolumeFactor, "volume-factor", "", 10, "Warn when the lines of a namespace in an interval are this many times above or below the baseline")
+	fs.IntVarP(&c.opts.VolumeBaseline, "volume-baseline", "", 12, "Number of trailing intervals averaged into the baseline")
+	fs.StringVarP(&c.opts.NamespaceHook, "namespace-hook", "", "", "URL to POST to, or command (split on spaces) to run, when a namespace is listed for the first time, e.g. to provision a tenant (NAMESPACE, CLUSTER, BUCKET and KEY environment variables for commands)")
+	fs.DurationVarP(&c.opts.NamespaceHookTimeout, "namespace-hook-timeout", "", 30*time.Second, "Time limit of a namespace hook")
+	fs.StringVarP(&c.opts.NamespacesFile, "namespaces-file", "", "", "File to persist the namespaces onboarded by the hook across restarts (hook runs again for all namespaces on restart if empty)")
+	fs.StringVarP(&c.opts.FenceKey, "fence-key", "", "", "Key of a lease object in the bucket held by one instance, so a second deployment does not ship files twice (disabled if empty, e.g. .cloudfront-logs-shipper/fence)")
+	fs.DurationVarP(&c.opts.FenceTTL, "fence-ttl", "", 2*time.Minute, "Time after the last heartbeat of the fence holder until another instance takes over")
+	fs.StringVarP(&c.opts.FenceMode, "fence-mode", "", "standby", "Action when another live instance holds the fence (standby until it is released or expires, refuse to start: restarts until then, e.g. during a rolling update)")
+	fs.StringVarP(&c.opts.SchemaURL, "schema-url", "", "", "s3://bucket/prefix/ to publish a JSON schema of the shipped fields and their types to, one <version>.json per file header")
+	fs.StringVarP(&c.opts.SnapshotURL, "snapshot-url", "", "", "s3://bucket/prefix/ to upload the run state snapshot to on panics and fatal errors, besides stderr")
+	fs.StringVarP(&c.opts.ActivityEvents, "activity-events", "", "", "Sink of file lifecycle events as JSON (file_queued, file_started, file_shipped, file_failed, file_deadlettered): stdout as NDJSON with the logs moved to stderr, an http(s) URL to post NDJSON batches to, or nats://[user:password@]host:port/subject, tls:// for TLS (disabled if empty)")
+	fs.StringVarP(&c.opts.AlertWebhook, "alert-webhook", "", "", "URL to post alerts to when a file fails or Loki pushes fail after all retries, e.g. a Slack incoming webhook or Alertmanager's /api/v2/alerts (disabled if empty)")
+	fs.StringVarP(&c.opts.AlertFormat, "alert-format", "", "slack", "Payload of --alert-webhook (slack, alertmanager)")
+	fs.DurationVarP(&c.opts.AlertInterval, "alert-interval", "", 15*time.Minute, "Minimum time between alerts of the same kind and file or Loki URL")
+	fs.StringVarP(&c.opts.CountersFile, "counters-file", "", "", "File to persist shipped lines and bytes per tenant across restarts (reset on restart if empty)")
+	fs.StringVarP(&c.opts.IngestMode, "ingest-mode", "", "poll", "How new files are found (poll listing the bucket on the scan interval, sqs consuming S3 event notifications from --sqs-queue-url)")
+	fs.StringVarP(&c.opts.SQSQueueURL, "sqs-queue-url", "", "", "URL of the SQS queue receiving the s3:ObjectCreated notifications of the bucket, in sqs ingest mode")
+	fs.DurationVarP(&c.opts.SQSVisibility, "sqs-visibility", "", 5*time.Minute, "Visibility timeout of received notifications, extended while their files are shipped")
+	fs.StringVarP(&c.opts.NotificationBucket, "notification-bucket", "", "", "Name of the bucket behind the --bucket-name access point, which S3 notifications carry, in sqs ingest mode")
+	fs.BoolVarP(&c.opts.NoListBucket, "no-list-bucket", "", false, "Run without s3:ListBucket in sqs ingest mode, with only s3:GetObject and s3:DeleteObject: reads denied are skipped without deleting the file, it may be gone already or unreadable (e.g. without kms:Decrypt)")
+	fs.DurationVarP(&c.opts.RepublishAfter, "republish-after", "", time.Hour, "Scanner role: publish a file again when it is still listed this long after it was published (0 to never)")
+	fs.DurationVarP(&c.opts.ReplayWindow, "replay-window", "", 24*time.Hour, "Skip files re-delivered with the same key and ETag within this time after they were shipped (0 to disable)")
+	fs.IntVarP(&c.opts.ReplayMaxKeys, "replay-max-keys", "", 100000, "Maximum number of shipped files remembered to skip re-deliveries")
+	fs.StringVarP(&c.opts.ReplayFile, "replay-file", "", "", "File to persist shipped files remembered to skip re-deliveries across restarts (in memory only if empty)")
+	fs.IntVarP(&c.opts.QueueCapacity, "queue-capacity", "", 0, "Maximum number of files queued for the workers (0 for 10 per worker)")
+	fs.StringVarP(&c.opts.QueueOverflow, "queue-overflow", "", "block", "Policy when the queue is full (block the scan, drop the rest of the scan cycle, spill keys to --queue-spill-file)")
+	fs.StringVarP(&c.opts.QueueSpillFile, "queue-spill-file", "", "", "File of keys spilled while the queue is full, queued by the next scan")
+	fs.StringVarP(&c.opts.QueueFile, "queue-file", "", "", "File to persist queued files across restarts (in memory only if empty)")
+	fs.BoolVarP(&c.opts.Strict, "strict", "", false, "Fail files whose #Fields header differs from the expected fields, or with a line not matching it, moving them to --deadletter-prefix after 3 attempts")
+	fs.StringSliceVarP(&c.opts.ExpectedFields, "expected-fields", "", models.StandardFields, "Expected #Fields header in strict mode")
+	fs.StringVarP(&c.opts.TimestampPrecision, "timestamp-precision", "", "ns", "Precision of Loki timestamps (ns, s)")
+	fs.DurationVarP(&c.opts.EntryMaxAge, "entry-max-age", "", 0, "Maximum age of request times used as Loki timestamps, older entries are handled by --old-entries (0 for no limit)")
+	fs.StringVarP(&c.opts.OldEntries, "old-entries", "", "clamp", "Entries older than --entry-max-age or rejected by Loki as too old (clamp to push them with the ingestion time, drop)")
+	fs.StringVarP(&c.opts.MetadataTimezone, "metadata-timezone", "", "", "Timezone to attach request date and hour structured metadata in (e.g. UTC, omitted if empty)")
+	fs.BoolVarP(&c.opts.Provenance, "provenance-metadata", "", false, "Attach the S3 key and line number in the file of each entry as source_key and source_line structured metadata")
+	fs.BoolVarP(&c.opts.DeliveryHour, "delivery-hour-metadata", "", false, "Attach the delivery hour of the file name (UTC, e.g. 2024-05-01T13) as delivery_hour structured metadata")
+	fs.StringVarP(&c.opts.EmptyFiles, "empty-files", "", "delete", "Action on files without data lines, not pushed to Loki (delete, keep in the bucket, tag to keep them with the S3 tag cloudfront-logs-shipper=empty)")
+	fs.BoolVarP(&c.opts.FileSummary, "file-summary", "", false, "Ship a JSON summary entry per file (lines, 4xx and 5xx counts, p95 time-taken) to its stream with stream=\"summary\"")
+	fs.IntVarP(&c.opts.BatchLines, "batch-lines", "", 100, "Maximum number of lines pushed to Loki at once")
+	fs.IntVarP(&c.opts.BatchBytes, "batch-bytes", "", 1<<20, "Maximum size of lines pushed to Loki at once (0 for no limit)")
+	fs.StringVarP(&c.opts.Idempotency, "idempotency", "", "off", "Attach a key of the file, its ETag and the first line of the chunk to pushes so replayed batches can be identified (off, metadata as batch_id structured metadata, header as X-Idempotency-Key)")
+	fs.DurationVarP(&c.opts.BatchIdle, "batch-idle", "", 0, "Flush partially filled batches after no lines arrived for this long (0 to disable)")
+	fs.IntVarP(&c.opts.Port, "port", "p", 8080, "Port to expose metrics on")
+	fs.StringVarP(&c.opts.CheckpointFile, "checkpoint-file", "", "", "File to persist shipped line offsets of partially shipped files (in memory only if empty)")
+	fs.BoolVarP(&c.opts.PurgeVersions, "purge-versions", "", false, "Delete all versions of shipped files on versioned buckets")
+	fs.DurationVarP(&c.opts.DeleteWindow, "delete-window", "", 0, "Delete shipped files together in DeleteObjects calls of up to 1000 keys sent in the background after this long, files are settled once their call answered (0 for one DeleteObject call per file)")
+	fs.DurationVarP(&c.opts.SettleTime, "settle-time", "", 0, "Only process files whose delivery hour started at least this long ago (0 to disable)")
+	fs.DurationVarP(&c.opts.FileTimeout, "file-timeout", "", 0, "Stop shipping a file after this long, flushing its shipped lines, and resume it from its checkpoint on a later scan (0 for no limit)")
+	fs.DurationVarP(&c.opts.SLOLatency, "slo-latency", "", 0, "Delivery objective: ship files within this long of their LastModified, exporting conformance and burn rate metrics (0 to disable)")
+	fs.Float64VarP(&c.opts.SLOTarget, "slo-target", "", 0.99, "Share of files the delivery objective expects shipped within --slo-latency")
+	fs.DurationSliceVarP(&c.opts.SLOWindows, "slo-windows", "", []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour}, "Windows of the delivery objective conformance and burn rate metrics")
+	fs.Float64VarP(&c.opts.MaxDecompressedRatio, "max-decompressed-ratio", "", 0, "Move files decompressing to more than this many times their stored size to --deadletter-prefix, against gzip bombs (0 for no limit)")
+	fs.Int64VarP(&c.opts.MaxDecompressedBytes, "max-decompressed-bytes", "", 0, "Move files decompressing to more than this many bytes, or returning as many with --s3-select-fields, to --deadletter-prefix (0 for no limit)")
+	fs.BoolVarP(&c.opts.VerifyChecksums, "verify-checksums", "", false, "Download files whole and verify them against their S3 checksum or ETag before parsing, downloading them again on a mismatch (not with S3 Select)")
+	fs.Int64VarP(&c.opts.VerifyMaxBytes, "verify-checksums-max-bytes", "", 64<<20, "Largest file downloaded whole by --verify-checksums, larger ones are verified while parsed and fail before their deletion on a mismatch")
+	fs.StringVarP(&c.opts.DeadLetterPrefix, "deadletter-prefix", "", "deadletter/", "Prefix of the files re-attempted by the retry-deadletter subcommand, and of files moved over the decompressed size limits or failing --strict, and of the malformed lines of files")
+	fs.BoolVarP(&c.opts.Once, "once", "", false, "Process the bucket once, print a JSON summary and exit")
+	fs.BoolVarP(&c.opts.SelfCheck, "self-check", "", false, "Check the S3 permissions of the role and the Loki credentials on startup, and exit with a report of what is missing, s3:DeleteObject is probed by deleting a missing key on unversioned buckets")
+	fs.StringVarP(&c.opts.Role, "role", "", "standalone", "Role of the process (standalone, coordinator listing S3 for workers, worker shipping keys leased from the coordinator, scanner listing S3 into --sqs-queue-url, processor shipping files from --sqs-queue-url)")
+	fs.DurationVarP(&c.opts.LeaseTTL, "lease-ttl", "", 2*time.Minute, "Time a worker holds a leased file without heartbeat before the coordinator leases it again")
+	fs.IntVarP(&c.opts.LeaseRetries, "lease-retries", "", 3, "Times the coordinator leases a failed or expired file again before waiting for the next scan")
+	fs.StringVarP(&c.opts.PolicyFile, "policy-file", "", "", "JSON file of per-namespace labels, tenant, filters and quotas, e.g. a mounted ConfigMap, reloaded on changes")
+	fs.DurationVarP(&c.opts.PolicyRefresh, "policy-refresh", "", 30*time.Second, "Interval to check the policy file for changes")
+	fs.StringVarP(&c.opts.RedisURL, "redis-url", "", "", "Redis to share file leases and processed files between replicas listing the same bucket (redis://host:6379/0)")
+	fs.DurationVarP(&c.opts.ClaimLeaseTTL, "claim-lease-ttl", "", 10*time.Minute, "Time a file lease is held in Redis without renewal")
+	fs.DurationVarP(&c.opts.ClaimDoneTTL, "claim-done-ttl", "", 7*24*time.Hour, "Time a processed file is remembered in Redis")
+	fs.StringVarP(&c.opts.CoordinatorAddr, "coordinator-addr", "", ":9095", "gRPC address the coordinator listens on and workers connect to")
+	c.ver = fs.BoolP("version", "v", false, "Show version and exit")
+	c.tui = fs.BoolP("tui", "", false, "Show the queue, the files being shipped, the throughput and the recent errors in the terminal instead of logs, for local debugging")
+	fs.BoolVarP(&c.opts.Backfill, "backfill", "", false, "Backfill profile to reprocess old logs: throttled, larger batches, files kept in the bucket")
+	fs.StringVarP(&c.opts.BackfillTenant, "backfill-tenant", "", "", "Loki tenant to backfill into, the --loki-tenant if empty")
+	fs.IntVarP(&c.opts.BackfillRate, "backfill-rate", "", 1000, "Maximum lines per second shipped in backfill mode (0 for no limit)")
+	fs.BoolVarP(&c.opts.Shadow, "shadow", "", false, "Shadow mode to validate a migration next to another shipper: files are shipped but never deleted, remembered by the required --checkpoint-file across restarts")
+	fs.DurationVarP(&c.opts.SlowStart, "slow-start", "", 0, "Period to ramp up the files shipped concurrently and the push rate over after startup and after Loki recovered from throttling or errors (0 to disable)")
+	fs.IntVarP(&c.opts.SlowStartRate, "slow-start-rate", "", 1000, "Lines per second pushed at the start of a slow start ramp, doubled 8 times over it (0 to only ramp up concurrency)")
+	fs.StringSliceVarP(&c.opts.Prefixes, "prefix", "", []string{}, "Key prefixes listed concurrently, can be specified multiple times (whole bucket if empty)")
+	fs.StringSliceVarP(&c.opts.Excludes, "exclude", "", []string{}, "Keys of non-log artifacts to neither process nor delete, globs matched against the key and its base name or re:<regexp>, can be specified multiple times (e.g. */manifest.json, _SUCCESS, re:\\.csv(\\.metadata)?$)")
+	fs.StringSliceVarP(&c.opts.S3SelectFields, "s3-select-fields", "", []string{}, "Read only these fields of files with S3 Select, to cut transfer of heavily filtered pipelines (all expected fields if empty)")
+	fs.StringVarP(&c.opts.S3SelectWhere, "s3-select-where", "", "", "Read only lines matching this S3 Select SQL condition, fields in braces (e.g. {sc-status} >= '400' AND {cs-method} <> 'HEAD')")
+	fs.StringVarP(&c.opts.KeyGlob, "key-glob", "", "", "Only process keys matching this glob (e.g. ns/*/E2ABC*.2024-05-01-*)")
+	c.modifiedAfter = fs.StringP("modified-after", "", "", "Only process files last modified at or after this time (RFC 3339)")
+	c.modifiedBefore = fs.StringP("modified-before", "", "", "Only process files last modified before this time (RFC 3339)")
+	c.hourAfter = fs.StringP("hour-after", "", "", "Only process files whose name hour is at or after this time (RFC 3339)")
+	c.hourBefore = fs.StringP("hour-before", "", "", "Only process files whose name hour is before this time (RFC 3339)")
+	return c
+}
+
+// convert applies defaults depending on other flags and converts the raw
+// flag values into options
+func (c *cli) convert(fs *pflag.FlagSet) error {
+	opts := &c.opts
+	if opts.Backfill {
+		// larger batches unless set explicitly
+		if !fs.Changed("batch-lines") {
+			opts.BatchLines = 1000
+		}
+		if !fs.Changed("batch-bytes") {
+			opts.BatchBytes = 4 << 20
+		}
+	}
+	if opts.Role == "processor" && !fs.Changed("ingest-mode") {
+		opts.IngestMode = "sqs"
+	}
+	if opts.LowMemory {
+		// one small file at a time unless set explicitly
+		for flag, value := range map[string]int{
+			"workers":                    1,
+			"batch-lines":                20,
+			"batch-bytes":                64 << 10,
+			"loki-inflight":              1,
+			"queue-capacity":             2,
+			"replay-max-keys":            1000,
+			"verify-checksums-max-bytes": 1 << 20,
+		} {
+			if !fs.Changed(flag) {
+				_ = fs.Set(flag, strconv.Itoa(value))
+			}
+		}
+	}
+
+	for _, r := range []struct {
+		flag  string
+		value string
+		dst   *time.Time
+	}{
+		{"modified-after", *c.modifiedAfter, &opts.ModifiedAfter},
+		{"modified-before", *c.modifiedBefore, &opts.ModifiedBefore},
+		{"hour-after", *c.hourAfter, &opts.HourAfter},
+		{"hour-before", *c.hourBefore, &opts.HourBefore},
+	} {
+		if r.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, r.value)
+		if err != nil {
+			return fmt.Errorf("invalid time range --%s: %w", r.flag, err)
+		}
+		*r.dst = t
+	}
+
+	if opts.FileTimeout > 0 && opts.FileTimeout < time.Minute {
+		return fmt.Errorf("--file-timeout must be at least 1m, lines are refused a push timeout before it")
+	}
+	if (opts.Strict || opts.MaxDecompressedRatio > 0 || opts.MaxDecompressedBytes > 0) && !strings.HasSuffix(opts.DeadLetterPrefix, "/") {
+		return fmt.Errorf("--deadletter-prefix %q must end with /", opts.DeadLetterPrefix)
+	}
+	if opts.ActivityEvents == "stdout" && (opts.Once || *c.tui) {
+		// the summary and the screen are written to stdout too
+		return fmt.Errorf("--activity-events=stdout is not supported with --once or --tui")
+	}
+	if opts.Shadow && opts.CheckpointFile == "" {
+		// shadowed files are never deleted, without it they are all shipped again on restart
+		return fmt.Errorf("--shadow requires --checkpoint-file")
+	}
+	if opts.LokiStreamRate > 0 && opts.LokiStreamBurst <= 0 {
+		opts.LokiStreamBurst = 5 * opts.LokiStreamRate
+	}
+	if opts.ReconcileInterval > 0 {
+		if opts.NoListBucket {
+			return fmt.Errorf("--reconcile-interval lists the bucket, not supported with --no-list-bucket")
+		}
+		if opts.ReconcileAge <= 0 {
+			return fmt.Errorf("--reconcile-age must be positive")
+		}
+	}
+	if len(opts.LokiAlternateURLs) > 0 && opts.LokiProbeInterval <= 0 {
+		return fmt.Errorf("--loki-probe-interval must be positive with --loki-alternate-urls")
+	}
+	if opts.SLOLatency > 0 {
+		if opts.SLOTarget <= 0 || opts.SLOTarget >= 1 {
+			return fmt.Errorf("--slo-target must be between 0 and 1, got %g", opts.SLOTarget)
+		}
+		for _, w := range opts.SLOWindows {
+			if w < time.Minute {
+				return fmt.Errorf("--slo-windows must be at least 1m, got %s", w)
+			}
+		}
+	}
+
+	opts.Labels = make(map[string]string)
+	for _, label := range *c.labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return fmt.Errorf("invalid label format %q (k=v)", label)
+		}
+		opts.Labels[parts[0]] = parts[1]
+	}
+
+	for _, route := range *c.routes {
+		r, err := parseRoute(route)
+		if err != nil {
+			return fmt.Errorf("invalid route %q: %w", route, err)
+		}
+		opts.Routes = append(opts.Routes, r)
+	}
+	malformedRouted := slices.ContainsFunc(opts.Routes, func(r models.Route) bool {
+		return r.Field == "malformed" && r.Value == "true"
+	})
+	if !malformedRouted && !strings.HasSuffix(opts.DeadLetterPrefix, "/") {
+		return fmt.Errorf("--deadletter-prefix %q must end with /, malformed lines are moved there without a route for them (field=malformed,value=true)", opts.DeadLetterPrefix)
+	}
+	switch opts.UnknownEdge {
+	case "default":
+	case "deadletter":
+		if !strings.HasSuffix(opts.DeadLetterPrefix, "/") {
+			return fmt.Errorf("--deadletter-prefix %q must end with / with --unknown-edge=deadletter", opts.DeadLetterPrefix)
+		}
+	case "route":
+		// residency routes fail closed: each needs a fallback route
+		for _, r := range opts.Routes {
+			if r.Field != "continent" && r.Field != "country" {
+				continue
+			}
+			if !slices.ContainsFunc(opts.Routes, func(f models.Route) bool { return f.Field == r.Field && f.Value == "unknown" }) {
+				return fmt.Errorf("--unknown-edge=route requires a route with field=%s,value=unknown", r.Field)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported --unknown-edge %q", opts.UnknownEdge)
+	}
+
+	if *c.anomaly != "" {
+		a, err := parser.ParseAnomaly(*c.anomaly)
+		if err != nil {
+			return fmt.Errorf("invalid anomaly thresholds %q: %w", *c.anomaly, err)
+		}
+		opts.Anomaly = a
+	}
+	opts.NamespaceAnomaly = make(map[string]models.Anomaly)
+	for _, nsAnomaly := range *c.nsAnomalies {
+		parts := strings.SplitN(nsAnomaly, ":", 2)
+		if len(parts) < 2 || len(parts[0]) == 0 {
+			return fmt.Errorf("invalid namespace anomaly format %q (namespace:thresholds)", nsAnomaly)
+		}
+		a, err := parser.ParseAnomaly(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid anomaly thresholds %q: %w", nsAnomaly, err)
+		}
+		opts.NamespaceAnomaly[parts[0]] = a
+	}
+
+	opts.NamespaceShards = make(map[string]int)
+	for _, nsShard := range *c.nsShards {
+		parts := strings.SplitN(nsShard, ":", 2)
+		if len(parts) < 2 || len(parts[0]) == 0 {
+			return fmt.Errorf("invalid namespace shards format %q (namespace:shards)", nsShard)
+		}
+		k, err := strconv.Atoi(parts[1])
+		if err != nil || k < 0 {
+			return fmt.Errorf("invalid number of shards %q", nsShard)
+		}
+		opts.NamespaceShards[parts[0]] = k
+	}
+
+	opts.NamespaceTenants = make(map[string]string)
+	for _, nsTenant := range *c.nsTenants {
+		parts := strings.SplitN(nsTenant, ":", 2)
+		if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return fmt.Errorf("invalid namespace tenant format %q (namespace:tenant)", nsTenant)
+		}
+		opts.NamespaceTenants[parts[0]] = parts[1]
+	}
+	return nil
+}
+
+// tune sizes the options not set explicitly to the limits of Loki
+func (c *cli) tune(fs *pflag.FlagSet, limits loki.Limits, logger *slog.Logger) {
+	opts := &c.opts
+	if limits.MaxLineSize > 0 && !fs.Changed("loki-max-line-size") {
+		opts.LokiMaxLineSize = int(limits.MaxLineSize)
+		logger.Info("tuned to Loki limits", "loki-max-line-size", opts.LokiMaxLineSize)
+	}
+	if limits.MaxStreams > 0 && !fs.Changed("stream-warn-threshold") {
+		// warn well before pushes are rejected
+		opts.StreamWarnThreshold = limits.MaxStreams * 8 / 10
+		logger.Info("tuned to Loki limits", "stream-warn-threshold", opts.StreamWarnThreshold)
+	}
+	// stay below the per-stream limits, pushes over them are rejected
+	if limits.PerStreamRate > 0 && !fs.Changed("loki-stream-rate") {
+		opts.LokiStreamRate = int(limits.PerStreamRate * 9 / 10)
+		opts.LokiStreamBurst = max(int(limits.PerStreamBurst*9/10), opts.LokiStreamRate)
+		logger.Info("tuned to Loki limits", "loki-stream-rate", opts.LokiStreamRate, "loki-stream-burst", opts.LokiStreamBurst)
+	}
+	// entries older than the window are rejected, clamp or drop them before
+	if limits.RejectOldMaxAge > 0 && !fs.Changed("entry-max-age") {
+		opts.EntryMaxAge = limits.RejectOldMaxAge * 9 / 10
+		logger.Info("tuned to Loki limits", "entry-max-age", opts.EntryMaxAge)
+	}
+	// a push larger than the burst size is rejected however often it is retried
+	burst := int(limits.IngestionBurstMB * (1 << 20) * 9 / 10)
+	if burst > 0 && (opts.BatchBytes == 0 || opts.BatchBytes > burst) {
+		if fs.Changed("batch-bytes") {
+			logger.Warn("batch size exceeds Loki's ingestion burst size", "batch-bytes", opts.BatchBytes, "burst-bytes", int(limits.IngestionBurstMB*(1<<20)))
+			return
+		}
+		opts.BatchBytes = burst
+		logger.Info("tuned to Loki limits", "batch-bytes", opts.BatchBytes)
+	}
+}
+
+// parseRoute parses a route from comma separated key=value pairs
+func parseRoute(s string) (models.Route, error) {
+	var r models.Route
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) < 2 {
+			return r, fmt.Errorf("invalid pair %q (k=v)", kv)
+		}
+		switch parts[0] {
+		case "field":
+			r.Field = parts[1]
+		case "value":
+			r.Value = parts[1]
+		case "url":
+			r.URL = parts[1]
+		case "tenant":
+			r.Tenant = parts[1]
+		case "compression":
+			r.Compression = parts[1]
+		default:
+			return r, fmt.Errorf("unknown key %q", parts[0])
+		}
+	}
+	if r.Field == "" || r.URL == "" {
+		return r, fmt.Errorf("field and url are required")
+	}
+	return r, nil
+}
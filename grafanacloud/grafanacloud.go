@@ -0,0 +1,58 @@
+// Package grafanacloud derives the Loki push settings of a Grafana Cloud stack.
+package grafanacloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API is the grafana.com API used to look up stacks
+var API = "https://grafana.com/api"
+
+// Stack holds the Loki push settings of a stack
+type Stack struct {
+	LokiURL  string // push URL
+	LokiUser string // logs instance ID, also the tenant
+}
+
+type instance struct {
+	HLInstanceID  int    `json:"hlInstanceId"`
+	HLInstanceURL string `json:"hlInstanceUrl"`
+}
+
+// Resolve looks up the logs instance of the stack with the API key (a Cloud
+// Access Policy token with stacks:read and logs:write scopes)
+func Resolve(ctx context.Context, slug, apiKey string) (Stack, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/instances/%s", API, slug), nil)
+	if err != nil {
+		return Stack{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("User-Agent", "cloudfront-logs-shipper")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Stack{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return Stack{}, fmt.Errorf("grafana.com returned HTTP status %s for stack %q", resp.Status, slug)
+	}
+	var inst instance
+	if err := json.NewDecoder(resp.Body).Decode(&inst); err != nil {
+		return Stack{}, fmt.Errorf("failed to decode stack %q: %w", slug, err)
+	}
+	if inst.HLInstanceURL == "" || inst.HLInstanceID == 0 {
+		return Stack{}, fmt.Errorf("stack %q has no logs instance", slug)
+	}
+	return Stack{
+		LokiURL:  strings.TrimSuffix(inst.HLInstanceURL, "/") + "/loki/api/v1/push",
+		LokiUser: strconv.Itoa(inst.HLInstanceID),
+	}, nil
+}
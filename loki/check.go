@@ -0,0 +1,35 @@
+package loki
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// CheckPush pushes an empty request to the default Loki and every route,
+// which checks their credentials without shipping a line
+func CheckPush(opts models.Options, logger *slog.Logger) error {
+	tenant := opts.LokiTenant
+	if opts.Backfill && opts.BackfillTenant != "" {
+		tenant = opts.BackfillTenant
+	}
+	targets := []struct{ url, tenant string }{{opts.LokiURL, tenant}}
+	for _, r := range opts.Routes {
+		targets = append(targets, struct{ url, tenant string }{r.URL, r.Tenant})
+	}
+	codec := snappyCodec{}
+	buf, err := codec.encode(&logproto.PushRequest{}, nil)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		c := newLokiClient(t.url, opts, logger)
+		c.Tenant = t.tenant
+		if _, err := c.req(buf, codec, ""); err != nil {
+			return fmt.Errorf("test push to %s failed: %w", t.url, err)
+		}
+	}
+	return nil
+}
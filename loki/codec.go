@@ -0,0 +1,134 @@
+package loki
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// codec encodes push requests, labels holds the label sets of the streams by
+// their formatted labels for encodings not using the formatted string
+type codec interface {
+	name() string
+	contentType() string
+	contentEncoding() string
+	encode(req *logproto.PushRequest, labels map[string]map[string]string) ([]byte, error)
+}
+
+// codecs by --loki-compression value
+var codecs = map[string]codec{
+	"snappy": snappyCodec{},
+	"none":   jsonCodec{},
+	"gzip":   jsonCodec{compression: "gzip"},
+	"zstd":   jsonCodec{compression: "zstd"},
+}
+
+// downgraded holds the URLs not supporting their configured codec, pushes to
+// them fall back to snappy which every Loki supports
+var downgraded sync.Map
+
+// snappyCodec is the native Loki encoding, snappy compressed protobuf
+type snappyCodec struct{}
+
+func (snappyCodec) name() string            { return "snappy" }
+func (snappyCodec) contentType() string     { return "application/x-protobuf" }
+func (snappyCodec) contentEncoding() string { return "" }
+
+func (snappyCodec) encode(req *logproto.PushRequest, _ map[string]map[string]string) ([]byte, error) {
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, buf), nil
+}
+
+// jsonCodec is the JSON push API, optionally compressed as Content-Encoding
+type jsonCodec struct {
+	compression string
+}
+
+type jsonStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]any           `json:"values"`
+}
+
+func (c jsonCodec) name() string {
+	if c.compression == "" {
+		return "none"
+	}
+	return c.compression
+}
+func (jsonCodec) contentType() string       { return "application/json" }
+func (c jsonCodec) contentEncoding() string { return c.compression }
+
+func (c jsonCodec) encode(req *logproto.PushRequest, labels map[string]map[string]string) ([]byte, error) {
+	streams := make([]jsonStream, 0, len(req.Streams))
+	for _, s := range req.Streams {
+		js := jsonStream{
+			Stream: labels[s.Labels],
+			Values: make([][]any, 0, len(s.Entries)),
+		}
+		for _, e := range s.Entries {
+			v := []any{strconv.FormatInt(e.Timestamp.UnixNano(), 10), e.Line}
+			if len(e.StructuredMetadata) > 0 {
+				md := make(map[string]string, len(e.StructuredMetadata))
+				for _, l := range e.StructuredMetadata {
+					md[l.Name] = l.Value
+				}
+				v = append(v, md)
+			}
+			js.Values = append(js.Values, v)
+		}
+		streams = append(streams, js)
+	}
+	body := map[string]any{"streams": streams}
+
+	// compressed bodies are encoded straight into the compressor, without
+	// holding the uncompressed body as well
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch c.compression {
+	case "":
+		return json.Marshal(body)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c.compression)
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ValidateCompression checks the compression of Loki and all routes is known
+func ValidateCompression(opts models.Options) error {
+	if _, ok := codecs[opts.LokiCompression]; !ok {
+		return fmt.Errorf("unsupported loki compression %q", opts.LokiCompression)
+	}
+	for _, r := range opts.Routes {
+		if _, ok := codecs[r.Compression]; !ok && r.Compression != "" {
+			return fmt.Errorf("unsupported compression %q of route to %s", r.Compression, r.URL)
+		}
+	}
+	return nil
+}
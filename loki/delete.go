@@ -0,0 +1,81 @@
+package loki
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// Destination is a Loki push URL and a tenant of it, empty for none
+type Destination struct {
+	URL    string
+	Tenant string
+}
+
+// Delete sends a log deletion request for the query to every destination, a
+// zero start or end is left to the Loki defaults. A failed request doesn't
+// stop the others.
+func Delete(opts models.Options, destinations []Destination, query string, start, end time.Time) error {
+	client := &http.Client{Transport: transportFor(opts)}
+	userAgent := userAgentOf(opts)
+	var errs []error
+	for _, d := range destinations {
+		if err := deleteRequest(client, userAgent, d.URL, opts.LokiUser, opts.LokiPassword, d.Tenant, query, start, end); err != nil {
+			errs = append(errs, fmt.Errorf("delete request to %s (tenant %q) failed: %w", d.URL, d.Tenant, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func deleteRequest(client *http.Client, userAgent, pushURL, user, password, tenant, query string, start, end time.Time) error {
+	u, err := url.Parse(strings.TrimSuffix(pushURL, "/loki/api/v1/push") + "/loki/api/v1/delete")
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("query", query)
+	if !start.IsZero() {
+		q.Set("start", strconv.FormatInt(start.Unix(), 10))
+	}
+	if !end.IsZero() {
+		q.Set("end", strconv.FormatInt(end.Unix(), 10))
+	}
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	identify(req, userAgent)
+	if user != "" && password != "" {
+		req.SetBasicAuth(user, password)
+	}
+	if tenant != "" {
+		req.Header.Set("X-Scope-OrgID", tenant)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1024))
+		line := ""
+		if scanner.Scan() {
+			line = scanner.Text()
+		}
+		return fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
+	}
+	return nil
+}
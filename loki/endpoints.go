@@ -0,0 +1,153 @@
+package loki
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// endpoint is a Loki the default pushes may be pinned to, with the latency
+// and health of its last probe
+type endpoint struct {
+	url     string
+	latency time.Duration
+	healthy bool
+}
+
+var (
+	endpointsMu sync.Mutex
+	endpoints   []*endpoint // --loki-url followed by the alternates
+	pinned      string      // url of the endpoint batches push to
+)
+
+// switchFactor is how much faster another healthy endpoint must be to move
+// off a healthy pinned one, so close latencies don't flap
+const switchFactor = 0.8
+
+// StartPinning probes --loki-url and its alternates now and then every probe
+// interval, pinning the pushes of new batches to the healthy endpoint of the
+// lowest latency. It is a no-op without alternates. Only Loki endpoints are
+// pinned, S3 is read through the bucket or access point of --bucket-name.
+func StartPinning(opts models.Options, logger *slog.Logger) {
+	if len(opts.LokiAlternateURLs) == 0 {
+		return
+	}
+	endpointsMu.Lock()
+	for _, u := range append([]string{opts.LokiURL}, opts.LokiAlternateURLs...) {
+		endpoints = append(endpoints, &endpoint{url: u})
+	}
+	pinned = opts.LokiURL
+	endpointsMu.Unlock()
+
+	client := &http.Client{Transport: transportFor(opts), Timeout: timeout}
+	userAgent := userAgentOf(opts)
+	probeEndpoints(client, userAgent, logger)
+	go func() {
+		for range time.Tick(opts.LokiProbeInterval) {
+			probeEndpoints(client, userAgent, logger)
+		}
+	}()
+}
+
+// pinnedURL returns the url the pushes to --loki-url go to
+func pinnedURL(lokiURL string) string {
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	if len(endpoints) == 0 || endpoints[0].url != lokiURL {
+		return lokiURL
+	}
+	return pinned
+}
+
+// probeEndpoints measures the latency of the endpoints and pins the closest
+// healthy one, keeping the pinned one while none is healthy
+func probeEndpoints(client *http.Client, userAgent string, logger *slog.Logger) {
+	endpointsMu.Lock()
+	urls := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		urls[i] = e.url
+	}
+	endpointsMu.Unlock()
+
+	results := make([]endpoint, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = probe(client, userAgent, u)
+		}()
+	}
+	wg.Wait()
+
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	var current, best *endpoint
+	for i, e := range endpoints {
+		e.latency, e.healthy = results[i].latency, results[i].healthy
+		if e.url == pinned {
+			current = e
+		}
+		if e.healthy && (best == nil || e.latency < best.latency) {
+			best = e
+		}
+	}
+	if best == nil || best == current {
+		return
+	}
+	if current != nil && current.healthy && float64(best.latency) > switchFactor*float64(current.latency) {
+		return
+	}
+	logger.Info("pinning Loki pushes to another endpoint", "from", pinned, "to", best.url, "latency", best.latency)
+	pinned = best.url
+}
+
+// probe requests /ready of the Loki of a push url, any answer but a 5xx
+// counts as healthy as gateways may not expose it
+func probe(client *http.Client, userAgent, pushURL string) endpoint {
+	e := endpoint{url: pushURL}
+	u := strings.TrimSuffix(pushURL, "/loki/api/v1/push") + "/ready"
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return e
+	}
+	identify(req, userAgent)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return e
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	e.latency = time.Since(start)
+	e.healthy = resp.StatusCode/100 != 5
+	return e
+}
+
+// WriteEndpointMetrics writes the probed latency and health of the Loki
+// endpoints and which one pushes are pinned to
+func WriteEndpointMetrics(w io.Writer) {
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	for _, e := range endpoints {
+		healthy, active := 0, 0
+		if e.healthy {
+			healthy = 1
+		}
+		if e.url == pinned {
+			active = 1
+		}
+		fmt.Fprintf(w, "cloudfront_logs_shipper_loki_endpoint_latency_seconds{url=%q} %g\n", e.url, e.latency.Seconds())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_loki_endpoint_healthy{url=%q} %d\n", e.url, healthy)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_loki_endpoint_active{url=%q} %d\n", e.url, active)
+	}
+}
@@ -0,0 +1,70 @@
+package loki
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+const (
+	idempotencyMetadata = "batch_id"
+	idempotencyHeader   = "X-Idempotency-Key"
+)
+
+// ValidateIdempotency checks where batch idempotency keys are attached
+func ValidateIdempotency(opts models.Options) error {
+	switch opts.Idempotency {
+	case "off", "metadata", "header":
+		return nil
+	}
+	return fmt.Errorf("unsupported idempotency mode %q", opts.Idempotency)
+}
+
+// idempotencyKey identifies a chunk of a file by the object version and the
+// line it starts at, a chunk shipped again from the same line after a resume
+// gets the same key however the lines before it were split
+func idempotencyKey(source string, first int) string {
+	h := sha256.Sum256([]byte(source + "\n" + strconv.Itoa(first)))
+	return hex.EncodeToString(h[:16])
+}
+
+// SetSource sets the file and ETag the lines of the batch come from, and the
+// line of the file the first line added is, so its chunks are identified by
+// idempotency keys
+func (b *batch) SetSource(key, etag string, offset int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.source = key + "\n" + etag
+	b.first = offset
+	b.batchID = idempotencyKey(b.source, b.first)
+}
+
+// nextChunk moves on to the next chunk once the lines pending, added or
+// skipped, were flushed, caller must hold the lock
+func (b *batch) nextChunk(lines int) {
+	b.first += lines
+	if b.source != "" {
+		b.batchID = idempotencyKey(b.source, b.first)
+	}
+}
+
+// stamp attaches the idempotency key of the chunk to an entry
+func (b *batch) stamp(entry *logproto.Entry) {
+	if b.idempotency != "metadata" || b.batchID == "" {
+		return
+	}
+	entry.StructuredMetadata = append(entry.StructuredMetadata, logproto.LabelAdapter{Name: idempotencyMetadata, Value: b.batchID})
+}
+
+// header returns the idempotency key sent as a header with the pushes of the
+// pending chunk, caller must hold the lock
+func (b *batch) header() string {
+	if b.idempotency != "header" {
+		return ""
+	}
+	return b.batchID
+}
@@ -0,0 +1,30 @@
+package loki
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+	"github.com/prometheus/common/version"
+)
+
+// instance is the X-Client-Instance header, the host name of the pod
+var instance = sync.OnceValue(func() string {
+	name, _ := os.Hostname()
+	return name
+})
+
+// userAgentOf returns the User-Agent sent with every request to Loki, so
+// Loki-side rate limits and debugging can tell shipper fleets apart
+func userAgentOf(opts models.Options) string {
+	return fmt.Sprintf("cloudfront-logs-shipper/%s (cluster=%s)", version.Version, opts.ClusterName)
+}
+
+func identify(req *http.Request, userAgent string) {
+	req.Header.Set("User-Agent", userAgent)
+	if instance := instance(); instance != "" {
+		req.Header.Set("X-Client-Instance", instance)
+	}
+}
@@ -0,0 +1,117 @@
+package loki
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+// pushAttempts is the sends of a push failing with retryable errors before
+// its batch fails
+const pushAttempts = 3
+
+// statusError is a push Loki answered with a non-2xx status
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+var (
+	rejectedMu sync.Mutex
+	rejected   = make(map[string]int64) // lines by tenant
+)
+
+// invalid reports whether Loki rejected a push as invalid, retrying it
+// unchanged fails again
+func invalid(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.status == 400
+}
+
+// push sends a request. Loki ingests the valid entries of a push and answers
+// 400 naming the streams of the invalid ones: only the streams named are
+// handled again, restamped if too old or dropped, the others were ingested
+// and are not pushed again. It returns the request of the streams accepted,
+// and the error if Loki named no stream or the only one.
+func (c *lokiClient) push(req *logproto.PushRequest, labels map[string]map[string]string, key string) (*logproto.PushRequest, error) {
+	err := c.send(req, labels, key)
+	if err == nil || !invalid(err) {
+		return req, err
+	}
+	named := make([]bool, len(req.Streams))
+	found := false
+	for i, stream := range req.Streams {
+		named[i] = strings.Contains(err.Error(), stream.Labels)
+		found = found || named[i]
+	}
+	if !found {
+		if !tooOld(err) {
+			return req, err // not about the entries, nothing was ingested
+		}
+		// only the entries older than the cutoff are pushed again
+		for i := range named {
+			named[i] = true
+		}
+	}
+	accepted := &logproto.PushRequest{}
+	for i, stream := range req.Streams {
+		if !named[i] {
+			accepted.Streams = append(accepted.Streams, stream)
+			continue
+		}
+		if stream, ok := c.restamp(stream, err, labels, key); ok {
+			accepted.Streams = append(accepted.Streams, stream)
+			continue
+		}
+		if len(req.Streams) < 2 {
+			return req, err
+		}
+		c.reject(stream, err)
+	}
+	return accepted, nil
+}
+
+// pushAgain pushes a request until it is accepted, up to pushAttempts times,
+// so a push failing after the retries of send does not fail the whole batch:
+// the other pushes of the flush were accepted and shipping the file again
+// from its checkpoint would send them again
+func (c *lokiClient) pushAgain(req *logproto.PushRequest, labels map[string]map[string]string, key string) (*logproto.PushRequest, error) {
+	for attempt := 1; ; attempt++ {
+		accepted, err := c.push(req, labels, key)
+		if err == nil || invalid(err) || attempt == pushAttempts {
+			return accepted, err
+		}
+		c.logger.Warn("push failed, pushing its streams again", "url", c.LokiURL, "attempt", attempt, "err", err)
+	}
+}
+
+// reject drops the entries of an invalid stream
+func (c *lokiClient) reject(stream logproto.Stream, err error) {
+	c.logger.Error("Loki rejected stream, dropping its lines", "labels", stream.Labels, "lines", len(stream.Entries), "err", err)
+	rejectedMu.Lock()
+	defer rejectedMu.Unlock()
+	rejected[c.Tenant] += int64(len(stream.Entries))
+}
+
+// WriteRejectedMetrics writes the lines of invalid streams dropped by tenant
+func WriteRejectedMetrics(w io.Writer) {
+	rejectedMu.Lock()
+	defer rejectedMu.Unlock()
+	tenants := make([]string, 0, len(rejected))
+	for tenant := range rejected {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		fmt.Fprintf(w, "cloudfront_logs_shipper_loki_rejected_lines_total{tenant=%q} %d\n", tenant, rejected[tenant])
+	}
+}
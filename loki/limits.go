@@ -0,0 +1,103 @@
+package loki
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Limits are the ingestion limits of Loki relevant to pushes, zero if
+// unlimited or unknown
+type Limits struct {
+	MaxLineSize      uint64 // bytes
+	MaxStreams       int    // active streams per tenant
+	IngestionRateMB  float64
+	IngestionBurstMB float64 // also the largest push accepted
+	PerStreamRate    uint64  // bytes per second
+	PerStreamBurst   uint64  // bytes
+	RejectOldMaxAge  time.Duration
+}
+
+// DiscoverLimits reads the limits from the /config endpoint of the default
+// Loki, it is often not exposed by gateways or hosted Loki
+func DiscoverLimits(opts models.Options) (Limits, error) {
+	var limits Limits
+	u := strings.TrimSuffix(opts.LokiURL, "/loki/api/v1/push") + "/config"
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return limits, err
+	}
+	identify(req, userAgentOf(opts))
+	if opts.LokiUser != "" && opts.LokiPassword != "" {
+		req.SetBasicAuth(opts.LokiUser, opts.LokiPassword)
+	}
+	if opts.LokiTenant != "" {
+		req.Header.Set("X-Scope-OrgID", opts.LokiTenant)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return limits, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return limits, fmt.Errorf("unexpected status %s from %s", resp.Status, u)
+	}
+
+	var config struct {
+		Limits struct {
+			MaxLineSize      string  `yaml:"max_line_size"`
+			MaxStreams       int     `yaml:"max_global_streams_per_user"`
+			IngestionRateMB  float64 `yaml:"ingestion_rate_mb"`
+			IngestionBurstMB float64 `yaml:"ingestion_burst_size_mb"`
+			PerStreamRate    string  `yaml:"per_stream_rate_limit"`
+			PerStreamBurst   string  `yaml:"per_stream_rate_limit_burst"`
+			RejectOld        bool    `yaml:"reject_old_samples"`
+			RejectOldMaxAge  string  `yaml:"reject_old_samples_max_age"`
+		} `yaml:"limits_config"`
+	}
+	if err := yaml.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return limits, fmt.Errorf("failed to parse Loki config: %w", err)
+	}
+	l := config.Limits
+	for _, size := range []struct {
+		name  string
+		value string
+		dst   *uint64
+	}{
+		{"max_line_size", l.MaxLineSize, &limits.MaxLineSize},
+		{"per_stream_rate_limit", l.PerStreamRate, &limits.PerStreamRate},
+		{"per_stream_rate_limit_burst", l.PerStreamBurst, &limits.PerStreamBurst},
+	} {
+		if size.value == "" {
+			continue
+		}
+		// a byte size like 256KB, or plain bytes
+		if *size.dst, err = strconv.ParseUint(size.value, 10, 64); err != nil {
+			if *size.dst, err = humanize.ParseBytes(size.value); err != nil {
+				return limits, fmt.Errorf("invalid %s %q: %w", size.name, size.value, err)
+			}
+		}
+	}
+	if l.RejectOld && l.RejectOldMaxAge != "" {
+		// a duration like 1w
+		age, err := model.ParseDuration(l.RejectOldMaxAge)
+		if err != nil {
+			return limits, fmt.Errorf("invalid reject_old_samples_max_age %q: %w", l.RejectOldMaxAge, err)
+		}
+		limits.RejectOldMaxAge = time.Duration(age)
+	}
+	limits.MaxStreams = l.MaxStreams
+	limits.IngestionRateMB = l.IngestionRateMB
+	limits.IngestionBurstMB = l.IngestionBurstMB
+	return limits, nil
+}
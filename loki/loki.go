@@ -4,18 +4,19 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
+	"github.com/nugored/cf-logs-loki-uploader/clock"
 	"github.com/nugored/cf-logs-loki-uploader/models"
 
-	"github.com/golang/snappy"
 	"github.com/grafana/dskit/backoff"
 	"github.com/grafana/loki/v3/pkg/logproto"
 )
@@ -28,65 +29,428 @@ const (
 )
 
 type batch struct {
-	stream *logproto.Stream
-	lines  int
-	client *lokiClient
+	mu       sync.Mutex
+	labels   map[string]string
+	targets  []*target // default Loki followed by one per route
+	lines    int
+	bytes    int
+	shipped  int // lines flushed successfully
+	maxLines int
+	maxBytes int
+	maxIdle  time.Duration
+	idle     clock.Timer // flushes a partially filled batch when no lines arrive
+	clock    clock.Clock // of the deadline and idle flushes
+	err      error       // error of the last idle flush, returned by the next call
+	closed   bool
+	pipe     *pipeline // pushes chunks asynchronously, nil to push synchronously
+	warn     int       // active streams per tenant to warn above
+	deadline time.Time // lines are refused once it is near, zero for none
+
+	idempotency string // where chunk keys are attached (off, metadata, header)
+	source      string // file and ETag the lines come from, chunks are not keyed if empty
+	first       int    // line of the source the pending chunk starts at
+	batchID     string // idempotency key of the pending chunk
+}
+
+// target is a Loki endpoint with the streams pending to be pushed to it
+type target struct {
+	client  *lokiClient
+	stream  *logproto.Stream
+	streams map[string]*logproto.Stream  // streams with extra labels, by extra labels
+	labels  map[string]map[string]string // label sets of the streams, by formatted labels
+	lines   int
+	ordered bool // entries are pushed in the order they were added, not by timestamp
 }
 
 func NewBatch(labels map[string]string, opts models.Options, logger *slog.Logger) *batch {
+	b := &batch{
+		labels:   labels,
+		maxLines: opts.BatchLines,
+		maxBytes: opts.BatchBytes,
+		maxIdle:  opts.BatchIdle,
+		clock:    clock.Real,
+
+		idempotency: opts.Idempotency,
+	}
+	if b.maxLines <= 0 {
+		b.maxLines = 100
+	}
+	b.warn = opts.StreamWarnThreshold
+	if opts.LokiInflight > 1 {
+		b.pipe = newPipeline(opts.LokiInflight, opts.PreserveOrder)
+	}
+	b.targets = append(b.targets, b.newTarget(newLokiClient(pinnedURL(opts.LokiURL), opts, logger)))
+	b.targets[0].client.codec = codecs[opts.LokiCompression]
+	b.targets[0].client.Tenant = opts.LokiTenant
+	if opts.Backfill && opts.BackfillTenant != "" {
+		b.targets[0].client.Tenant = opts.BackfillTenant
+	}
+	for _, r := range opts.Routes {
+		client := newLokiClient(r.URL, opts, logger)
+		client.Tenant = r.Tenant
+		if c, ok := codecs[r.Compression]; ok {
+			client.codec = c
+		} else {
+			client.codec = b.targets[0].client.codec
+		}
+		b.targets = append(b.targets, b.newTarget(client))
+	}
+	for _, t := range b.targets {
+		t.client.clampOld = opts.OldEntries == "clamp"
+		t.client.maxAge = opts.EntryMaxAge
+		t.ordered = opts.PreserveOrder
+	}
+	if b.maxIdle > 0 {
+		b.idle = b.clock.AfterFunc(b.maxIdle, b.idleFlush)
+		b.idle.Stop()
+	}
+	return b
+}
+
+// SetClock replaces the clock of the batch and its clients, for tests
+func (b *batch) SetClock(c clock.Clock) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clock = c
+	for _, t := range b.targets {
+		t.client.clock = c
+	}
+	if b.idle != nil {
+		b.idle.Stop()
+		b.idle = c.AfterFunc(b.maxIdle, b.idleFlush)
+		b.idle.Stop()
+	}
+}
+
+// ErrDeadline is returned by AddTo once the deadline of the batch is near,
+// the pending lines are flushed and Shipped counts them
+var ErrDeadline = errors.New("file deadline reached")
+
+// SetDeadline makes the batch refuse lines from a push timeout before t on,
+// so the lines added before are flushed in time
+func (b *batch) SetDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadline = t
+}
+
+func (b *batch) newTarget(client *lokiClient) *target {
+	t := &target{
+		client: client,
+		stream: &logproto.Stream{
+			Labels: formatLabels(b.labels),
+		},
+		streams: make(map[string]*logproto.Stream),
+		labels:  make(map[string]map[string]string),
+	}
+	t.labels[t.stream.Labels] = b.labels
+	return t
+}
+
+func formatLabels(labels map[string]string) string {
 	ls := make([]string, 0, len(labels))
 	for l, v := range labels {
 		ls = append(ls, fmt.Sprintf("%s=%q", l, v))
 	}
 	sort.Strings(ls)
-	return &batch{
-		stream: &logproto.Stream{
-			Labels: fmt.Sprintf("{%s}", strings.Join(ls, ", ")),
-		},
-		client: newLokiClient(opts.LokiURL, opts.LokiUser, opts.LokiPassword, logger),
-	}
+	return fmt.Sprintf("{%s}", strings.Join(ls, ", "))
 }
 
 func (b *batch) Add(ts time.Time, line string) error {
-	b.stream.Entries = append(b.stream.Entries, logproto.Entry{
+	return b.AddTo(0, nil, ts, line, nil)
+}
+
+// AddTo adds a line to the stream with the batch labels extended by extra.
+// Route is the index of the matching route plus one, 0 for the default Loki.
+// Metadata is attached to the entry as structured metadata.
+// All streams of all routes are pushed together on flush.
+func (b *batch) AddTo(route int, extra map[string]string, ts time.Time, line string, metadata map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.takeErr(); err != nil {
+		return err
+	}
+	if !b.deadline.IsZero() && b.deadline.Sub(b.clock.Now()) < timeout {
+		if err := b.flush(); err != nil {
+			return err
+		}
+		if b.pipe != nil {
+			if err := b.pipe.wait(); err != nil {
+				return err
+			}
+		}
+		return ErrDeadline
+	}
+	t := b.targets[route]
+	stream := t.stream
+	if len(extra) > 0 {
+		key := streamKey(extra)
+		var ok bool
+		stream, ok = t.streams[key]
+		if !ok {
+			labels := make(map[string]string, len(b.labels)+len(extra))
+			for k, v := range b.labels {
+				labels[k] = v
+			}
+			for k, v := range extra {
+				labels[k] = v
+			}
+			stream = &logproto.Stream{Labels: formatLabels(labels)}
+			t.streams[key] = stream
+			t.labels[stream.Labels] = labels
+		}
+	}
+	entry := logproto.Entry{
 		Timestamp: ts,
 		Line:      line,
-	})
+	}
+	if len(metadata) > 0 {
+		entry.StructuredMetadata = make([]logproto.LabelAdapter, 0, len(metadata)+1)
+		for k, v := range metadata {
+			entry.StructuredMetadata = append(entry.StructuredMetadata, logproto.LabelAdapter{Name: k, Value: v})
+		}
+	}
+	b.stamp(&entry)
+	if len(entry.StructuredMetadata) > 1 {
+		sort.Slice(entry.StructuredMetadata, func(i, j int) bool {
+			return entry.StructuredMetadata[i].Name < entry.StructuredMetadata[j].Name
+		})
+	}
+	stream.Entries = append(stream.Entries, entry)
+	t.lines++
 	b.lines++
-	if b.lines >= 100 {
-		return b.Flush()
+	b.bytes += len(line)
+	// flush in bounded chunks regardless of the file size
+	if b.lines >= b.maxLines || (b.maxBytes > 0 && b.bytes >= b.maxBytes) {
+		return b.flush()
+	}
+	if b.idle != nil {
+		b.idle.Reset(b.maxIdle)
 	}
 	return nil
 }
 
+// Skip counts a line that is not pushed, it is confirmed as shipped with the
+// lines added before it
+func (b *batch) Skip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines++
+}
+
+func streamKey(extra map[string]string) string {
+	if len(extra) == 1 {
+		for k, v := range extra {
+			return k + "\xff" + v
+		}
+	}
+	ks := make([]string, 0, len(extra))
+	for k, v := range extra {
+		ks = append(ks, k+"\xff"+v)
+	}
+	sort.Strings(ks)
+	return strings.Join(ks, "\xfe")
+}
+
+// Flush pushes pending lines of all targets, targets pushed successfully are
+// not sent again when a flush is retried after an error
 func (b *batch) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.takeErr(); err != nil {
+		return err
+	}
+	if err := b.flush(); err != nil {
+		return err
+	}
+	if b.pipe != nil {
+		return b.pipe.wait()
+	}
+	return nil
+}
+
+// Close stops the idle timer, pending lines are not flushed
+func (b *batch) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.idle != nil {
+		b.idle.Stop()
+	}
+	if b.pipe != nil && !b.closed {
+		b.pipe.close()
+	}
+	b.closed = true
+}
+
+// idleFlush is called by the idle timer when no line was added for maxIdle
+func (b *batch) idleFlush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil && !b.closed {
+		b.err = b.flush()
+	}
+}
+
+// takeErr returns and clears the error of an idle flush or a failed pipelined
+// push, caller must hold the lock
+func (b *batch) takeErr() error {
+	err := b.err
+	b.err = nil
+	if err == nil && b.pipe != nil {
+		err = b.pipe.failed()
+	}
+	return err
+}
+
+func (b *batch) flush() error {
+	if b.idle != nil {
+		b.idle.Stop()
+	}
 	if b.lines == 0 {
 		return nil
 	}
+	if b.pipe != nil {
+		b.pipeline()
+		return nil
+	}
 
-	buf, err := b.encode()
-	if err != nil {
-		return err
+	// a failing target does not stop the others, only the targets not
+	// pushed are sent again when the flush is retried
+	var errs []error
+	for _, t := range b.targets {
+		if t.lines == 0 {
+			continue
+		}
+		t.observe(b.warn)
+		accepted, err := t.client.pushAgain(t.request(), t.labels, b.header())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		countShipped(t.client.Tenant, accepted)
+		t.reset()
 	}
-	if err = b.client.send(buf); err != nil {
+	if err := errors.Join(errs...); err != nil {
 		return err
 	}
 
+	b.shipped += b.lines
+	b.nextChunk(b.lines)
 	b.lines = 0
-	b.stream.Entries = b.stream.Entries[:0]
+	b.bytes = 0
 	return nil
 }
 
-func (b *batch) encode() ([]byte, error) {
-	req := logproto.PushRequest{
-		Streams: []logproto.Stream{*b.stream},
+// pipeline queues the pending lines as a chunk of pushes, one per lane of
+// each target, caller must hold the lock
+func (b *batch) pipeline() {
+	seq := b.pipe.begin(b.lines)
+	// after a failure the later chunks of an ordered pipeline are dropped,
+	// they are shipped again from the checkpoint
+	dropped := b.pipe.ordered && b.pipe.waitPrevious(seq) != nil
+	for i, t := range b.targets {
+		if t.lines == 0 {
+			continue
+		}
+		t.observe(b.warn)
+		reqs := make(map[int]*logproto.PushRequest)
+		labels := make(map[string]map[string]string) // the label sets of the target keep growing
+		for _, stream := range t.all() {
+			if len(stream.Entries) == 0 {
+				continue
+			}
+			if dropped {
+				stream.Entries = nil
+				continue
+			}
+			t.sort(stream)
+			lane := b.pipe.laneOf(i, stream.Labels)
+			if reqs[lane] == nil {
+				reqs[lane] = &logproto.PushRequest{}
+			}
+			reqs[lane].Streams = append(reqs[lane].Streams, *stream)
+			labels[stream.Labels] = t.labels[stream.Labels]
+			stream.Entries = nil // owned by the push now
+		}
+		for lane, req := range reqs {
+			b.pipe.send(lane, &push{seq: seq, client: t.client, req: req, labels: labels, key: b.header()})
+		}
+		t.lines = 0
 	}
-	buf, err := proto.Marshal(&req)
-	if err != nil {
-		return nil, err
+	b.pipe.seal(seq)
+	b.nextChunk(b.lines)
+	b.lines = 0
+	b.bytes = 0
+}
+
+// Pending returns the number of lines added but not yet confirmed by Loki
+func (b *batch) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pipe != nil {
+		_, pending := b.pipe.counts()
+		return b.lines + pending
 	}
+	return b.lines
+}
 
-	return snappy.Encode(nil, buf), nil
+// Shipped returns the number of lines successfully pushed to Loki
+func (b *batch) Shipped() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pipe != nil {
+		shipped, _ := b.pipe.counts()
+		return shipped
+	}
+	return b.shipped
+}
+
+// observe records the streams with entries as active streams of the tenant
+func (t *target) observe(threshold int) {
+	for _, stream := range t.all() {
+		if len(stream.Entries) > 0 {
+			activeStreams.observe(t.client.Tenant, stream.Labels, threshold, t.client.logger)
+		}
+	}
+}
+
+// all returns the streams of the target, the one without extra labels first
+func (t *target) all() []*logproto.Stream {
+	streams := make([]*logproto.Stream, 0, 1+len(t.streams))
+	streams = append(streams, t.stream)
+	for _, stream := range t.streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func (t *target) reset() {
+	t.lines = 0
+	t.stream.Entries = t.stream.Entries[:0]
+	for _, stream := range t.streams {
+		stream.Entries = stream.Entries[:0]
+	}
+}
+
+// sort orders the entries of a stream by timestamp unless the target keeps
+// the order of the file
+func (t *target) sort(stream *logproto.Stream) {
+	if !t.ordered {
+		sortEntries(stream)
+	}
+}
+
+func (t *target) request() *logproto.PushRequest {
+	req := &logproto.PushRequest{
+		Streams: make([]logproto.Stream, 0, 1+len(t.streams)),
+	}
+	for _, stream := range t.all() {
+		if len(stream.Entries) > 0 {
+			t.sort(stream)
+			req.Streams = append(req.Streams, *stream)
+		}
+	}
+	return req
 }
 
 type lokiClient struct {
@@ -95,38 +459,78 @@ type lokiClient struct {
 	LokiURL      string
 	LokiUser     string
 	LokiPassword string
+	Tenant       string // X-Scope-OrgID, optional
+	codec        codec
+	clampOld     bool          // push entries rejected as too old with the current time
+	maxAge       time.Duration // of entries accepted by Loki, 0 if unknown
+	clock        clock.Clock
+	pacer        *pacer
+	userAgent    string
 }
 
-func newLokiClient(lokiURL, lokiUser, lokiPassword string, logger *slog.Logger) *lokiClient {
+// newLokiClient returns a client of a Loki push URL with the credentials,
+// transport, pacing and identity of the options
+func newLokiClient(lokiURL string, opts models.Options, logger *slog.Logger) *lokiClient {
 	return &lokiClient{
-		http:         &http.Client{},
+		http:         &http.Client{Transport: transportFor(opts)},
 		logger:       logger,
 		LokiURL:      lokiURL,
-		LokiUser:     lokiUser,
-		LokiPassword: lokiPassword,
+		LokiUser:     opts.LokiUser,
+		LokiPassword: opts.LokiPassword,
+		codec:        snappyCodec{},
+		clock:        clock.Real,
+		pacer:        pacerFor(opts),
+		userAgent:    userAgentOf(opts),
 	}
 }
 
-func (c *lokiClient) send(buf []byte) error {
+func (c *lokiClient) send(push *logproto.PushRequest, labels map[string]map[string]string, key string) error {
+	codec := c.codec
+	if codec == nil {
+		codec = snappyCodec{}
+	}
+	if _, ok := downgraded.Load(c.LokiURL); ok {
+		codec = snappyCodec{}
+	}
+	buf, err := codec.encode(push, labels)
+	if err != nil {
+		return err
+	}
+	c.pacer.wait(c, push)
+
 	backoff := backoff.New(context.Background(), backoff.Config{
 		MinBackoff: minBackoff,
 		MaxBackoff: maxBackoff,
 		MaxRetries: maxRetries,
 	})
 	var status int
-	var err error
 	for {
-		status, err = c.req(buf)
+		status, err = c.req(buf, codec, key)
+		observe(status, err)
+
+		// Loki rejects encodings it does not support, fall back to snappy
+		if (status == 400 || status == 415) && codec.name() != "snappy" && strings.Contains(err.Error(), "not supported") {
+			c.logger.Warn("compression not supported by Loki, falling back to snappy", "url", c.LokiURL, "compression", codec.name())
+			downgraded.Store(c.LokiURL, true)
+			codec = snappyCodec{}
+			if buf, err = codec.encode(push, labels); err != nil {
+				return err
+			}
+			continue
+		}
 
 		// Only retry 429s, 5xx, and connection-level errors.
 		if status > 0 && status != 429 && status/100 != 5 {
 			break
 		}
 		c.logger.Error("error sending batch, will retry", "status", status, "err", err)
-		backoff.Wait()
+		if delay := backoff.NextDelay(); backoff.Ongoing() {
+			c.clock.Sleep(delay)
+		}
 
 		// Make sure it sends at least once before checking for retry.
 		if !backoff.Ongoing() {
+			gaveUp(c.LokiURL, status, err)
 			break
 		}
 	}
@@ -134,7 +538,7 @@ func (c *lokiClient) send(buf []byte) error {
 	return err
 }
 
-func (c *lokiClient) req(buf []byte) (int, error) {
+func (c *lokiClient) req(buf []byte, codec codec, key string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
@@ -143,12 +547,21 @@ func (c *lokiClient) req(buf []byte) (int, error) {
 		return -1, err
 	}
 	// snappy-encoded protobufs over http by default.
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	req.Header.Set("User-Agent", "cloudfront-logs-shipper")
+	req.Header.Set("Content-Type", codec.contentType())
+	if enc := codec.contentEncoding(); enc != "" {
+		req.Header.Set("Content-Encoding", enc)
+	}
+	identify(req, c.userAgent)
+	if key != "" {
+		req.Header.Set(idempotencyHeader, key)
+	}
 
 	if c.LokiUser != "" && c.LokiPassword != "" {
 		req.SetBasicAuth(c.LokiUser, c.LokiPassword)
 	}
+	if c.Tenant != "" {
+		req.Header.Set("X-Scope-OrgID", c.Tenant)
+	}
 
 	resp, err := c.http.Do(req.WithContext(ctx))
 	if err != nil {
@@ -156,12 +569,16 @@ func (c *lokiClient) req(buf []byte) (int, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode/100 != 2 {
-		scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1024))
+		// Loki names every invalid stream on one line
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, 16<<10))
 		line := ""
 		if scanner.Scan() {
 			line = scanner.Text()
 		}
-		err = fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
+		err = &statusError{
+			status: resp.StatusCode,
+			msg:    fmt.Sprintf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line),
+		}
 	}
 
 	return resp.StatusCode, err
@@ -0,0 +1,73 @@
+package loki
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/clock"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// newTestLoki returns a Loki answering the pushes with statuses in turn,
+// 204 once they are used up, and the number of pushes received
+func newTestLoki(t *testing.T, statuses ...int) (string, *atomic.Int64) {
+	var pushes atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := pushes.Add(1); int(n) <= len(statuses) {
+			http.Error(w, "unavailable", statuses[n-1])
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &pushes
+}
+
+func TestIdleFlush(t *testing.T) {
+	url, pushes := newTestLoki(t)
+	b := NewBatch(map[string]string{"job": "test"}, models.Options{LokiURL: url, BatchIdle: time.Second}, slog.Default())
+	defer b.Close()
+	c := clock.NewFake(time.Now())
+	b.SetClock(c)
+
+	if err := b.Add(c.Now(), "line"); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(999 * time.Millisecond)
+	if n := pushes.Load(); n != 0 {
+		t.Fatalf("pushed %d times before the idle time", n)
+	}
+	c.Advance(time.Millisecond)
+	if n := pushes.Load(); n != 1 {
+		t.Fatalf("pushed %d times after the idle time, want 1", n)
+	}
+	if n := b.Shipped(); n != 1 {
+		t.Errorf("shipped %d lines, want 1", n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	url, pushes := newTestLoki(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	b := NewBatch(map[string]string{"job": "test"}, models.Options{LokiURL: url}, slog.Default())
+	defer b.Close()
+	start := time.Now()
+	c := clock.NewFake(start)
+	b.SetClock(c)
+
+	if err := b.Add(c.Now(), "line"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := pushes.Load(); n != 3 {
+		t.Errorf("pushed %d times, want 3", n)
+	}
+	if waited := c.Now().Sub(start); waited < 2*minBackoff {
+		t.Errorf("backed off %v, want at least %v", waited, 2*minBackoff)
+	}
+}
@@ -0,0 +1,138 @@
+package loki
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+	"golang.org/x/time/rate"
+)
+
+var (
+	pacersMu sync.Mutex
+	pacers   = make(map[pacerKey]*pacer)
+)
+
+// pacerKey are the options a pacer is built from
+type pacerKey struct {
+	limit rate.Limit
+	burst int
+}
+
+// pacer spreads the pushes of each stream over time below Loki's per-stream
+// rate limit, so a large file mapping to a single hot stream is not rejected
+// for pushing it all at once
+type pacer struct {
+	limit rate.Limit // bytes per second, 0 to disable
+	burst int
+
+	mu      sync.Mutex
+	streams map[string]*pacedStream // by Loki URL, tenant and labels
+	pruned  time.Time
+	waits   int64
+	waited  time.Duration
+}
+
+type pacedStream struct {
+	limiter *rate.Limiter
+	last    time.Time
+}
+
+// pacerFor returns the pacer shared by the Loki clients of the same stream
+// rate and burst, created by the first of them
+func pacerFor(opts models.Options) *pacer {
+	key := pacerKey{rate.Limit(opts.LokiStreamRate), opts.LokiStreamBurst}
+	pacersMu.Lock()
+	defer pacersMu.Unlock()
+	p, ok := pacers[key]
+	if !ok {
+		p = &pacer{limit: key.limit, burst: key.burst, streams: make(map[string]*pacedStream)}
+		pacers[key] = p
+	}
+	return p
+}
+
+// wait blocks until each stream of a push fits in the rate of its stream,
+// pushes larger than the burst size take several bursts
+func (p *pacer) wait(c *lokiClient, req *logproto.PushRequest) {
+	if p == nil || p.limit <= 0 {
+		return
+	}
+	for _, stream := range req.Streams {
+		limiter := p.limiter(c.LokiURL + "\x00" + c.Tenant + "\x00" + stream.Labels)
+		now := time.Now()
+		var delay time.Duration // of the last reservation, after the others
+		for n := streamBytes(stream); n > 0; n -= p.burst {
+			delay = limiter.ReserveN(now, min(n, p.burst)).DelayFrom(now)
+		}
+		if delay <= 0 {
+			continue
+		}
+		c.clock.Sleep(delay)
+		p.mu.Lock()
+		p.waits++
+		p.waited += delay
+		p.mu.Unlock()
+	}
+}
+
+func (p *pacer) limiter(key string) *rate.Limiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.Sub(p.pruned) > time.Minute {
+		for k, s := range p.streams {
+			if now.Sub(s.last) > activeWindow {
+				delete(p.streams, k)
+			}
+		}
+		p.pruned = now
+	}
+	s, ok := p.streams[key]
+	if !ok {
+		s = &pacedStream{limiter: rate.NewLimiter(p.limit, p.burst)}
+		p.streams[key] = s
+	}
+	s.last = now
+	return s.limiter
+}
+
+// streamBytes is the size of a stream as counted by Loki's rate limits, the
+// lines and their structured metadata
+func streamBytes(stream logproto.Stream) int {
+	var n int
+	for _, e := range stream.Entries {
+		n += len(e.Line)
+		for _, m := range e.StructuredMetadata {
+			n += len(m.Name) + len(m.Value)
+		}
+	}
+	return n
+}
+
+// writePacingMetrics writes the waits of all pacers, nothing when pacing is off
+func writePacingMetrics(w io.Writer) {
+	pacersMu.Lock()
+	defer pacersMu.Unlock()
+	var paced bool
+	var waits int64
+	var waited time.Duration
+	for _, p := range pacers {
+		if p.limit <= 0 {
+			continue
+		}
+		paced = true
+		p.mu.Lock()
+		waits += p.waits
+		waited += p.waited
+		p.mu.Unlock()
+	}
+	if !paced {
+		return
+	}
+	fmt.Fprintf(w, "cloudfront_logs_shipper_loki_paced_pushes_total %d\n", waits)
+	fmt.Fprintf(w, "cloudfront_logs_shipper_loki_paced_seconds_total %g\n", waited.Seconds())
+}
@@ -0,0 +1,176 @@
+package loki
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+// pipeline pushes flushed chunks asynchronously with a bounded number of
+// pushes in flight. A stream is always pushed by the same lane, so chunks of
+// a stream arrive at Loki in order. An ordered pipeline pushes a chunk only
+// once the previous ones were confirmed, so chunks of a file arrive in order.
+type pipeline struct {
+	lanes    []chan *push
+	inflight chan struct{}
+	ordered  bool
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	err       error
+	next      uint64 // sequence of the next chunk
+	confirmed uint64 // chunks before this one were all pushed
+	chunks    map[uint64]*chunk
+	shipped   int // lines of all confirmed chunks
+	pending   int // lines of chunks not confirmed yet
+}
+
+type chunk struct {
+	lines  int
+	parts  int  // pushes in flight
+	sealed bool // all pushes of the chunk were queued
+}
+
+type push struct {
+	seq    uint64
+	client *lokiClient
+	req    *logproto.PushRequest
+	labels map[string]map[string]string
+	key    string // idempotency key header, optional
+}
+
+func newPipeline(inflight int, ordered bool) *pipeline {
+	p := &pipeline{
+		lanes:    make([]chan *push, inflight),
+		inflight: make(chan struct{}, inflight),
+		ordered:  ordered,
+		chunks:   make(map[uint64]*chunk),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for i := range p.lanes {
+		p.lanes[i] = make(chan *push, inflight)
+		go p.run(p.lanes[i])
+	}
+	return p
+}
+
+func (p *pipeline) run(lane chan *push) {
+	for push := range lane {
+		// a failing push is sent again on its own, the other pushes of its
+		// chunk were accepted. Once the pipeline failed the file is shipped
+		// again from the last confirmed chunk, queued pushes are not sent.
+		err := p.failed()
+		if err == nil {
+			var accepted *logproto.PushRequest
+			accepted, err = push.client.pushAgain(push.req, push.labels, push.key)
+			if err == nil {
+				countShipped(push.client.Tenant, accepted)
+			}
+		}
+		<-p.inflight
+		p.complete(push.seq, err)
+	}
+}
+
+// begin registers a new chunk of lines and returns its sequence
+func (p *pipeline) begin(lines int) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seq := p.next
+	p.next++
+	p.chunks[seq] = &chunk{lines: lines}
+	p.pending += lines
+	return seq
+}
+
+// waitPrevious blocks until the chunks before seq were confirmed or a push
+// failed
+func (p *pipeline) waitPrevious(seq uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.err == nil && p.confirmed < seq {
+		p.cond.Wait()
+	}
+	return p.err
+}
+
+// laneOf returns the lane pushing a stream of a target
+func (p *pipeline) laneOf(target int, labels string) int {
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(target)))
+	h.Write([]byte(labels))
+	return int(h.Sum32() % uint32(len(p.lanes)))
+}
+
+// send queues a push of a chunk, blocking while too many pushes are in flight
+func (p *pipeline) send(lane int, push *push) {
+	p.mu.Lock()
+	p.chunks[push.seq].parts++
+	p.mu.Unlock()
+	p.inflight <- struct{}{}
+	p.lanes[lane] <- push
+}
+
+// seal marks all pushes of a chunk as queued
+func (p *pipeline) seal(seq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.chunks[seq].sealed = true
+	p.advance()
+}
+
+func (p *pipeline) complete(seq uint64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	p.chunks[seq].parts--
+	p.advance()
+}
+
+// advance confirms completed chunks in order, caller must hold the lock
+func (p *pipeline) advance() {
+	for p.err == nil && p.confirmed < p.next {
+		c := p.chunks[p.confirmed]
+		if !c.sealed || c.parts > 0 {
+			break
+		}
+		p.shipped += c.lines
+		p.pending -= c.lines
+		delete(p.chunks, p.confirmed)
+		p.confirmed++
+	}
+	p.cond.Broadcast()
+}
+
+// wait blocks until all queued chunks were confirmed or a push failed
+func (p *pipeline) wait() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.err == nil && p.confirmed < p.next {
+		p.cond.Wait()
+	}
+	return p.err
+}
+
+func (p *pipeline) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *pipeline) counts() (shipped, pending int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.shipped, p.pending
+}
+
+// close stops the lanes once the queued pushes were sent
+func (p *pipeline) close() {
+	for _, lane := range p.lanes {
+		close(lane)
+	}
+}
@@ -0,0 +1,43 @@
+package loki
+
+import "sync/atomic"
+
+var (
+	overloaded atomic.Bool  // the last push was throttled or failed on Loki's side
+	recoveries atomic.Int64 // pushes accepted after Loki was overloaded
+)
+
+// observe tracks whether Loki is overloaded from the outcome of a push
+func observe(status int, err error) {
+	switch {
+	case err == nil:
+		if overloaded.Swap(false) {
+			recoveries.Add(1)
+		}
+	case status == 429 || status/100 == 5:
+		overloaded.Store(true)
+	}
+}
+
+// Recoveries returns the number of times Loki accepted pushes again after
+// throttling them or failing, so callers can ramp up gradually
+func Recoveries() int64 {
+	return recoveries.Load()
+}
+
+// pushFailed is called with the URL of pushes failing after all retries
+var pushFailed atomic.Pointer[func(url string, err error)]
+
+// OnPushFailure sets a function called when a push to Loki failed after all
+// its retries on throttling, server or connection errors
+func OnPushFailure(f func(url string, err error)) {
+	pushFailed.Store(&f)
+}
+
+// gaveUp reports a push failing after all retries to the OnPushFailure
+// function
+func gaveUp(url string, status int, err error) {
+	if f := pushFailed.Load(); f != nil && err != nil && (status <= 0 || status == 429 || status/100 == 5) {
+		(*f)(url, err)
+	}
+}
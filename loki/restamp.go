@@ -0,0 +1,95 @@
+package loki
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+// restamped counts lines pushed again with the ingestion time after Loki
+// rejected their event time as too old
+var restamped atomic.Int64
+
+// tooOld reports whether Loki rejected a push for timestamps outside its
+// ingestion window (reject_old_samples_max_age, or out of order)
+func tooOld(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "too old") || strings.Contains(msg, "greater_than_max_sample_age") || strings.Contains(msg, "too far behind")
+}
+
+// oldestAcceptable is the cutoff Loki reports with entries rejected as too
+// old or too far behind
+var oldestAcceptable = regexp.MustCompile(`oldest acceptable timestamp is: ([0-9TZ:.+-]+)`)
+
+// cutoff returns the oldest timestamp Loki accepts: the latest it reported,
+// so no rejected entry is missed, or the one of the max age
+func (c *lokiClient) cutoff(err error) (time.Time, bool) {
+	var cutoff time.Time
+	for _, m := range oldestAcceptable.FindAllStringSubmatch(err.Error(), -1) {
+		if t, err := time.Parse(time.RFC3339, m[1]); err == nil && t.After(cutoff) {
+			cutoff = t
+		}
+	}
+	if cutoff.IsZero() && c.maxAge > 0 {
+		cutoff = c.clock.Now().Add(-c.maxAge)
+	}
+	return cutoff, !cutoff.IsZero()
+}
+
+// restamp pushes the entries of a stream rejected as too old again with the
+// current time, if old entries are clamped, and returns the stream accepted.
+// Loki ingests the other entries of a partially rejected push, only those
+// older than the cutoff are pushed again so none is duplicated.
+func (c *lokiClient) restamp(stream logproto.Stream, err error, labels map[string]map[string]string, key string) (logproto.Stream, bool) {
+	if !c.clampOld || !tooOld(err) {
+		return stream, false
+	}
+	cutoff, ok := c.cutoff(err)
+	if !ok {
+		c.logger.Warn("Loki rejected entries as too old without a cutoff, set --entry-max-age to push them again", "labels", stream.Labels)
+		return stream, false
+	}
+	now := c.clock.Now()
+	accepted := make([]logproto.Entry, len(stream.Entries))
+	var old []logproto.Entry
+	for i, e := range stream.Entries {
+		if e.Timestamp.Before(cutoff) {
+			e.Timestamp = now
+			old = append(old, e)
+		}
+		accepted[i] = e
+	}
+	if len(old) > 0 {
+		again := stream
+		again.Entries = old
+		if err := c.send(&logproto.PushRequest{Streams: []logproto.Stream{again}}, labels, key); err != nil {
+			return stream, false
+		}
+		c.logger.Warn("Loki rejected entries as too old, pushed with the ingestion time", "labels", stream.Labels, "lines", len(old), "cutoff", cutoff)
+		restamped.Add(int64(len(old)))
+	}
+	stream.Entries = accepted
+	return stream, true
+}
+
+// sortEntries orders the entries of a stream by timestamp, keeping the order
+// of entries of the same time, so streams are pushed in non-decreasing order
+func sortEntries(stream *logproto.Stream) {
+	less := func(i, j int) bool {
+		return stream.Entries[i].Timestamp.Before(stream.Entries[j].Timestamp)
+	}
+	if !sort.SliceIsSorted(stream.Entries, less) {
+		sort.SliceStable(stream.Entries, less)
+	}
+}
+
+// WriteRestampedMetrics writes the lines pushed with the ingestion time
+func WriteRestampedMetrics(w io.Writer) {
+	fmt.Fprintf(w, "cloudfront_logs_shipper_loki_restamped_lines_total %d\n", restamped.Load())
+}
@@ -0,0 +1,76 @@
+package loki
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+// Shipped are the lines and bytes confirmed by Loki for a tenant
+type Shipped struct {
+	Lines int64 `json:"lines"`
+	Bytes int64 `json:"bytes"`
+}
+
+var (
+	shippedMu sync.Mutex
+	shipped   = make(map[string]Shipped) // by tenant
+)
+
+// countShipped adds the entries of a confirmed push to the tenant counters
+func countShipped(tenant string, push *logproto.PushRequest) {
+	var s Shipped
+	for _, stream := range push.Streams {
+		s.Lines += int64(len(stream.Entries))
+		for _, entry := range stream.Entries {
+			s.Bytes += int64(len(entry.Line))
+		}
+	}
+	shippedMu.Lock()
+	defer shippedMu.Unlock()
+	total := shipped[tenant]
+	total.Lines += s.Lines
+	total.Bytes += s.Bytes
+	shipped[tenant] = total
+}
+
+// ShippedByTenant returns a copy of the shipped counters by tenant
+func ShippedByTenant() map[string]Shipped {
+	shippedMu.Lock()
+	defer shippedMu.Unlock()
+	m := make(map[string]Shipped, len(shipped))
+	for tenant, s := range shipped {
+		m[tenant] = s
+	}
+	return m
+}
+
+// RestoreShipped adds counters persisted by a previous run, so the counters
+// keep increasing across restarts
+func RestoreShipped(m map[string]Shipped) {
+	shippedMu.Lock()
+	defer shippedMu.Unlock()
+	for tenant, s := range m {
+		total := shipped[tenant]
+		total.Lines += s.Lines
+		total.Bytes += s.Bytes
+		shipped[tenant] = total
+	}
+}
+
+// WriteShippedMetrics writes the shipped lines and bytes by tenant
+func WriteShippedMetrics(w io.Writer) {
+	m := ShippedByTenant()
+	tenants := make([]string, 0, len(m))
+	for tenant := range m {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		fmt.Fprintf(w, "cloudfront_logs_shipper_shipped_lines_total{tenant=%q} %d\n", tenant, m[tenant].Lines)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_shipped_bytes_total{tenant=%q} %d\n", tenant, m[tenant].Bytes)
+	}
+}
@@ -0,0 +1,93 @@
+package loki
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// activeWindow is the duration after which a stream without pushes is no
+// longer counted as active, roughly Loki's chunk idle period
+const activeWindow = time.Hour
+
+// activeStreams estimates the active streams per tenant from the label sets
+// pushed, to warn before Loki rejects pushes over max-streams-per-user
+var activeStreams = &streamTracker{
+	seen:   make(map[string]map[string]time.Time),
+	warned: make(map[string]bool),
+}
+
+type streamTracker struct {
+	mu       sync.Mutex
+	seen     map[string]map[string]time.Time // last push of a label set, by tenant
+	warned   map[string]bool                 // tenants over the threshold
+	warnings int64
+	pruned   time.Time
+}
+
+// observe records a push of a label set to a tenant and warns once when the
+// active streams of the tenant exceed the threshold, 0 disables the warning
+func (s *streamTracker) observe(tenant, labels string, threshold int, logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.seen[tenant] == nil {
+		s.seen[tenant] = make(map[string]time.Time)
+	}
+	s.seen[tenant][labels] = now
+	if now.Sub(s.pruned) > time.Minute {
+		s.prune(now)
+	}
+	if threshold <= 0 {
+		return
+	}
+	active := len(s.seen[tenant])
+	if active <= threshold {
+		s.warned[tenant] = false
+		return
+	}
+	if !s.warned[tenant] {
+		s.warned[tenant] = true
+		s.warnings++
+		logger.Warn("estimated active Loki streams exceed threshold, reduce labels before Loki rejects pushes",
+			"tenant", tenant, "streams", active, "threshold", threshold)
+	}
+}
+
+// prune forgets label sets not pushed within the active window, caller must
+// hold the lock
+func (s *streamTracker) prune(now time.Time) {
+	for tenant, seen := range s.seen {
+		for labels, last := range seen {
+			if now.Sub(last) > activeWindow {
+				delete(seen, labels)
+			}
+		}
+		if len(seen) == 0 {
+			delete(s.seen, tenant)
+		}
+	}
+	s.pruned = now
+}
+
+// WriteStreamMetrics writes the estimated active streams per tenant and the
+// number of threshold warnings
+func WriteStreamMetrics(w io.Writer) {
+	s := activeStreams
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	tenants := make([]string, 0, len(s.seen))
+	for tenant := range s.seen {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		fmt.Fprintf(w, "cloudfront_logs_shipper_loki_active_streams{tenant=%q} %d\n", tenant, len(s.seen[tenant]))
+	}
+	fmt.Fprintf(w, "cloudfront_logs_shipper_loki_stream_warnings_total %d\n", s.warnings)
+	writePacingMetrics(w)
+}
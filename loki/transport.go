@@ -0,0 +1,162 @@
+package loki
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[transportKey]http.RoundTripper)
+	connections  atomic.Int64
+)
+
+// transportKey are the options a transport is built from
+type transportKey struct {
+	http2      string
+	maxConns   int
+	dnsRefresh time.Duration
+}
+
+// ConnectionsOpened returns the number of connections opened to Loki
+func ConnectionsOpened() int64 {
+	return connections.Load()
+}
+
+// transportFor returns the transport shared by the Loki clients of the same
+// connection options, created by the first of them
+func transportFor(opts models.Options) http.RoundTripper {
+	key := transportKey{opts.LokiHTTP2, opts.LokiMaxConns, opts.LokiDNSRefresh}
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if t, ok := transports[key]; ok {
+		return t
+	}
+	t := newTransport(opts)
+	transports[key] = t
+	return t
+}
+
+func newTransport(opts models.Options) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	switch opts.LokiHTTP2 {
+	case "force":
+		// HTTP/2 only, also without TLS (h2c), with pings detecting
+		// dead multiplexed connections
+		t.ForceAttemptHTTP2 = true
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+		t.HTTP2 = &http.HTTP2Config{
+			SendPingTimeout: 30 * time.Second,
+			PingTimeout:     15 * time.Second,
+		}
+	case "off":
+		// HTTP/1.1 only, some ingress controllers collapse on multiplexed pushes
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if opts.LokiMaxConns > 0 {
+		t.MaxIdleConnsPerHost = opts.LokiMaxConns
+		t.MaxConnsPerHost = opts.LokiMaxConns
+	}
+
+	dial := (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	if opts.LokiDNSRefresh > 0 {
+		d := &rotatingDialer{
+			refresh: opts.LokiDNSRefresh,
+			hosts:   make(map[string]*resolved),
+			changed: t.CloseIdleConnections,
+		}
+		dial = d.DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			connections.Add(1)
+		}
+		return conn, err
+	}
+	return t
+}
+
+// rotatingDialer re-resolves hostnames periodically and rotates connections
+// across all returned addresses, so replaced gateways behind DNS are noticed
+type rotatingDialer struct {
+	mu      sync.Mutex
+	dialer  net.Dialer
+	refresh time.Duration
+	hosts   map[string]*resolved
+	changed func() // called when the addresses of a host changed
+}
+
+type resolved struct {
+	addrs []string
+	next  int
+	at    time.Time
+}
+
+func (d *rotatingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, ip := range addrs {
+		if conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// lookup returns the addresses of the host starting with the next one in turn
+func (d *rotatingDialer) lookup(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	r, ok := d.hosts[host]
+	d.mu.Unlock()
+
+	if !ok || time.Since(r.at) > d.refresh {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil && !ok {
+			return nil, err
+		}
+		d.mu.Lock()
+		if err == nil {
+			slices.Sort(addrs)
+			if ok && !slices.Equal(r.addrs, addrs) && d.changed != nil {
+				defer d.changed() // drop idle connections to removed addresses
+			}
+			r = &resolved{addrs: addrs, at: time.Now()}
+			d.hosts[host] = r
+		} else {
+			r.at = time.Now() // keep the stale addresses, retry after refresh
+		}
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(r.addrs)
+	rotated := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		rotated = append(rotated, r.addrs[(r.next+i)%n])
+	}
+	r.next = (r.next + 1) % max(n, 1)
+	return rotated, nil
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,36 +17,56 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/nugored/cf-logs-loki-uploader/models"
+	"github.com/nugored/cf-logs-loki-uploader/coordinator"
+	"github.com/nugored/cf-logs-loki-uploader/grafanacloud"
+	"github.com/nugored/cf-logs-loki-uploader/loki"
 	"github.com/nugored/cf-logs-loki-uploader/parser"
+	"github.com/nugored/cf-logs-loki-uploader/systemd"
 	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
 
 	"github.com/prometheus/common/version"
 )
 
+// exit codes of --once runs
+const (
+	exitClean   = 0
+	exitFatal   = 1
+	exitPartial = 2
+)
+
 func main() {
 
 	// 0. Parameters
-	var opts models.Options
-	opts.Labels = make(map[string]string)
-	pflag.StringVarP(&opts.BucketName, "bucket-name", "b", "", "Name of the S3 bucket with Cloudfront logs (required)")
-	pflag.DurationVarP(&opts.WaitInterval, "wait", "w", 60*time.Second, "Interval to wait between runs")
-	pflag.StringVarP(&opts.LokiURL, "loki-url", "H", "", "URL to Loki API (required)")
-	pflag.StringVarP(&opts.LokiUser, "loki-user", "u", "", "User to use for Loki authentication")
-	pflag.StringVarP(&opts.ClusterName, "cluster", "c", "", "Cluster name")
-	var logLevel = pflag.StringP("log-level", "", "info", "Log level (info, debug)")
-	pflag.StringVarP(&opts.Format, "format", "o", "raw", "Format to parse and ship log lines as (logfmt, json, raw)")
-	var labels = pflag.StringArrayP("label", "l", []string{}, "Label to add to Loki stream, can be specified multiple times (key=value)")
-	pflag.IntVarP(&opts.Workers, "workers", "n", 4, "Number of workers to run")
-	pflag.IntVarP(&opts.Port, "port", "p", 8080, "Port to expose metrics on")
-	var ver = pflag.BoolP("version", "v", false, "Show version and exit")
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		os.Exit(runPlan(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "capture-schema" {
+		os.Exit(runCapture(os.Args[2:]))
+	}
+	// retry-deadletter takes the flags of a regular run
+	retryDeadLetter := len(os.Args) > 1 && os.Args[1] == "retry-deadletter"
+	if retryDeadLetter {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	c := newCLI(pflag.CommandLine)
 	pflag.Parse()
+	opts := &c.opts
 
-	if *ver {
+	if *c.ver {
 		fmt.Println(version.Print("cloudfront-logs-shipper"))
 		os.Exit(0)
 	}
-	logger := getLogger(*logLevel)
+	var logs *tuiLog
+	var out io.Writer = os.Stdout
+	if opts.ActivityEvents == "stdout" {
+		out = os.Stderr // stdout is the event stream
+	}
+	if *c.tui {
+		logs = &tuiLog{}
+		out = logs
+	}
+	logger := getLogger(*c.logLevel, out)
 
 	if opts.BucketName == "" {
 		logger.Error("--bucket-name is required")
@@ -55,27 +78,60 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := c.convert(pflag.CommandLine); err != nil {
+		logger.Error("invalid options", "err", err)
+		os.Exit(1)
+	}
+	if retryDeadLetter && opts.ActivityEvents == "stdout" {
+		logger.Error("invalid options", "err", "--activity-events=stdout would mix with the outcomes of retry-deadletter")
+		os.Exit(1)
+	}
+
+	if *c.grafanaCloudStack != "" {
+		apiKey := os.Getenv("GRAFANA_CLOUD_API_KEY")
+		if apiKey == "" {
+			logger.Error("GRAFANA_CLOUD_API_KEY environment variable is required")
+			os.Exit(1)
+		}
+		stack, err := grafanacloud.Resolve(context.Background(), *c.grafanaCloudStack, apiKey)
+		if err != nil {
+			logger.Error("unable to resolve Grafana Cloud stack", "stack", *c.grafanaCloudStack, "err", err)
+			os.Exit(1)
+		}
+		opts.LokiURL = stack.LokiURL
+		opts.LokiUser = stack.LokiUser
+		opts.LokiPassword = apiKey
+		logger.Info("using Grafana Cloud stack", "stack", *c.grafanaCloudStack, "loki-url", opts.LokiURL, "loki-user", opts.LokiUser)
+	}
+
 	if opts.LokiURL == "" {
 		logger.Error("--loki-url is required")
 		os.Exit(1)
 	}
 
-	if opts.LokiUser != "" && os.Getenv("LOKI_PASSWORD") == "" {
+	if opts.LokiPassword == "" {
+		opts.LokiPassword = os.Getenv("LOKI_PASSWORD")
+	}
+	if opts.GDPR {
+		opts.GDPRKey = os.Getenv("GDPR_HASH_KEY")
+		opts.GDPRToken = os.Getenv("GDPR_ERASE_TOKEN")
+	}
+	if opts.LokiUser != "" && opts.LokiPassword == "" {
 		logger.Error("LOKI_PASSWORD environment variable is required")
 		os.Exit(1)
 	}
-	opts.LokiPassword = os.Getenv("LOKI_PASSWORD")
 
-	for _, label := range *labels {
-		parts := strings.SplitN(label, "=", 2)
-		if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
-			logger.Error("invalid label format (k=v)", "label", label)
-			os.Exit(1)
+	if opts.LokiDiscoverLimits {
+		limits, err := loki.DiscoverLimits(*opts)
+		if err != nil {
+			logger.Info("Loki limits not discoverable, using configured sizes", "err", err)
+		} else {
+			c.tune(pflag.CommandLine, limits, logger)
 		}
-		opts.Labels[parts[0]] = parts[1]
 	}
 
 	logger.Info("Starting cloudfront-logs-shipper", "version", version.Version, "metrics-port", opts.Port)
+	loki.StartPinning(*opts, logger)
 
 	cfg, err := config.LoadDefaultConfig(
 		context.TODO(),
@@ -85,59 +141,315 @@ func main() {
 		os.Exit(1)
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
-	parser := parser.NewParser(opts, s3Client, logger)
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UseARNRegion = true // access points may live in another region
+	})
+	parser, err := parser.NewParser(*opts, s3Client, logger)
+	if err != nil {
+		logger.Error("unable to create parser", "err", err)
+		os.Exit(1)
+	}
+
+	if opts.SelfCheck {
+		if err := parser.SelfCheck(context.Background()); err != nil {
+			logger.Error("self-check failed, fix the permissions or run without --self-check")
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if retryDeadLetter {
+		os.Exit(runRetryDeadLetter(parser, opts.DeadLetterPrefix, logger))
+	}
+
+	if opts.FenceKey != "" && opts.Role != "worker" {
+		held, err := parser.RenewFence(context.Background())
+		if err != nil {
+			logger.Error("unable to acquire fence", "key", opts.FenceKey, "err", err)
+			os.Exit(1)
+		}
+		if !held && opts.FenceMode == "refuse" {
+			logger.Error("another instance holds the fence, refusing to run", "key", opts.FenceKey)
+			os.Exit(1)
+		}
+		if !held {
+			logger.Warn("another instance holds the fence, standing by", "key", opts.FenceKey)
+		}
+		go func() {
+			for range time.Tick(opts.FenceTTL / 3) {
+				held, err := parser.RenewFence(context.Background())
+				if err != nil {
+					logger.Error("unable to renew fence", "key", opts.FenceKey, "err", err)
+				}
+				if !held && opts.FenceMode == "refuse" {
+					parser.Stop() // files are shipped by the instance holding the fence
+					return
+				}
+			}
+		}()
+	}
 
 	sgnl := make(chan os.Signal, 1)
 	signal.Notify(sgnl, syscall.SIGINT, syscall.SIGTERM)
 	waitTimer := time.NewTimer(0)
+	start := time.Now()
+	var fatal bool
 
 	go func() {
+		defer parser.OnPanic()
 		for {
 			select {
 			case <-waitTimer.C:
-				waitTimer.Reset(opts.WaitInterval)
+				if opts.Role == "worker" {
+					continue // files are leased from the coordinator
+				}
+				if opts.IngestMode == "sqs" {
+					continue // files are notified through SQS
+				}
+				waitTimer.Reset(parser.ScanInterval())
+				if !parser.Fenced() {
+					continue // standing by for the fence
+				}
 				if err := parser.Scan(); err != nil {
 					logger.Error("scan S3 failed", "err", err)
+					parser.RecordError("", err)
+					parser.DumpSnapshot(fmt.Sprintf("scan failed: %v", err))
+					fatal = true
 					parser.Stop()
 					return
 				}
+				if opts.Once {
+					parser.Stop() // workers drain the queue and exit
+					return
+				}
 			case <-sgnl:
 				logger.Info("received SIGINT or SIGTERM, shutting down...")
+				systemd.Notify("STOPPING=1")
 				parser.Stop()
 				return
 			}
 		}
 	}()
 
+	if opts.IngestMode == "sqs" {
+		go func() {
+			defer parser.OnPanic()
+			parser.Consume()
+			if opts.Once {
+				parser.Stop() // workers drain the queue and exit
+			}
+		}()
+	}
+
 	go func() {
 		http.Handle("/metrics", parser.Metrics())
+		http.Handle("/admin/queue", parser.QueueHandler())
+		if opts.GDPR {
+			http.Handle("/gdpr/erase", parser.EraseHandler())
+		}
 		if err := http.ListenAndServe(fmt.Sprintf(":%d", opts.Port), nil); err != nil {
 			logger.Error("metrics server failed", "err", err)
 			parser.Stop()
 		}
 	}()
 
+	if opts.QueueFile != "" {
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				if err := parser.SaveQueue(); err != nil {
+					logger.Error("unable to save queue", "err", err)
+				}
+			}
+		}()
+	}
+
+	if opts.ReplayFile != "" {
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				if err := parser.SaveReplays(); err != nil {
+					logger.Error("unable to save replay window", "err", err)
+				}
+			}
+		}()
+	}
+
+	if opts.NamespacesFile != "" {
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				if err := parser.SaveNamespaces(); err != nil {
+					logger.Error("unable to save namespaces", "err", err)
+				}
+			}
+		}()
+	}
+
+	if opts.CountersFile != "" {
+		go func() {
+			for range time.Tick(5 * time.Second) {
+				if err := parser.SaveCounters(); err != nil {
+					logger.Error("unable to save counters", "err", err)
+				}
+			}
+		}()
+	}
+
+	if opts.ReconcileInterval > 0 {
+		go func() {
+			for range time.Tick(opts.ReconcileInterval) {
+				if !parser.Fenced() {
+					continue // reconciled by the fence holder
+				}
+				if err := parser.Reconcile(); err != nil {
+					logger.Error("bucket reconciliation failed", "err", err)
+				}
+			}
+		}()
+	}
+
+	if opts.VolumeInterval > 0 {
+		go func() {
+			for range time.Tick(opts.VolumeInterval) {
+				parser.CheckVolume()
+			}
+		}()
+	}
+
+	if opts.PolicyFile != "" {
+		go func() {
+			for range time.Tick(opts.PolicyRefresh) {
+				if err := parser.RefreshPolicies(); err != nil {
+					logger.Error("unable to refresh namespace policies", "err", err)
+				}
+			}
+		}()
+	}
+
+	if opts.DropList != "" {
+		go func() {
+			for range time.Tick(opts.DropListRefresh) {
+				if err := parser.RefreshDropList(context.Background()); err != nil {
+					logger.Error("unable to refresh drop list", "err", err)
+				}
+			}
+		}()
+	}
+
+	if opts.RemoteWriteURL != "" {
+		go func() {
+			for range time.Tick(opts.RemoteWriteInterval) {
+				if err := parser.PushAggregates(); err != nil {
+					logger.Error("remote-write of aggregates failed", "err", err)
+				}
+			}
+		}()
+	}
+
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		go func() {
+			// a scan happens every wait interval, allow retries of slow pushes on top
+			within := 3 * max(opts.WaitInterval, opts.WaitIntervalMax)
+			for range time.Tick(interval / 2) {
+				if parser.Alive(within) {
+					systemd.Notify("WATCHDOG=1")
+				}
+			}
+		}()
+	}
+
+	if opts.Role == "coordinator" {
+		lis, err := net.Listen("tcp", opts.CoordinatorAddr)
+		if err != nil {
+			logger.Error("unable to listen for workers", "addr", opts.CoordinatorAddr, "err", err)
+			os.Exit(1)
+		}
+		srv := grpc.NewServer()
+		coordinator.Register(srv, parser)
+		go func() {
+			if err := srv.Serve(lis); err != nil {
+				logger.Error("coordinator server failed", "err", err)
+				parser.Stop()
+			}
+		}()
+		opts.Workers = 0 // workers run in their own replicas
+	}
+
 	var wg sync.WaitGroup
+	if opts.Role == "scanner" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer parser.OnPanic()
+			parser.Publish()
+		}()
+		opts.Workers = 0 // files are shipped by processors
+	}
+
 	for i := 0; i < opts.Workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			defer parser.OnPanic()
 			if err := parser.Worker(); err != nil {
+				parser.DumpSnapshot(fmt.Sprintf("worker failed: %v", err))
 				parser.Stop() // pod restart instead of deletion of not-shipped file
 			}
 		}()
 	}
+	if logs != nil {
+		go runTUI(parser, opts.BucketName, logs, start)
+	}
+	if _, err := systemd.Notify("READY=1"); err != nil {
+		logger.Warn("unable to notify systemd", "err", err)
+	}
+	if opts.Role == "coordinator" {
+		parser.Drain()
+	}
 	wg.Wait()
+	parser.FlushDeletes()
+	if err := parser.SaveQueue(); err != nil {
+		logger.Error("unable to save queue", "err", err)
+	}
+	if err := parser.SaveCounters(); err != nil {
+		logger.Error("unable to save counters", "err", err)
+	}
+	if err := parser.SaveReplays(); err != nil {
+		logger.Error("unable to save replay window", "err", err)
+	}
+	if err := parser.SaveNamespaces(); err != nil {
+		logger.Error("unable to save namespaces", "err", err)
+	}
+	if err := parser.ReleaseFence(context.Background()); err != nil {
+		logger.Error("unable to release fence", "err", err)
+	}
+	parser.WaitAlerts()
+	parser.CloseActivity()
 
+	if opts.Once {
+		if opts.RemoteWriteURL != "" {
+			if err := parser.PushAggregates(); err != nil {
+				logger.Error("remote-write of aggregates failed", "err", err)
+			}
+		}
+		summary := parser.Summary(time.Since(start))
+		if err := json.NewEncoder(os.Stdout).Encode(summary); err != nil {
+			logger.Error("unable to write summary", "err", err)
+		}
+		switch {
+		case fatal:
+			os.Exit(exitFatal)
+		case summary.FilesFailed > 0:
+			os.Exit(exitPartial)
+		}
+		os.Exit(exitClean)
+	}
 }
 
-func getLogger(logLevel string) *slog.Logger {
+func getLogger(logLevel string, w io.Writer) *slog.Logger {
 	var l = slog.LevelInfo
 	if logLevel == "debug" {
 		l = slog.LevelDebug
 	}
-	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
 		Level:     l,
 		AddSource: logLevel == "debug",
 		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
@@ -157,3 +469,26 @@ func getLogger(logLevel string) *slog.Logger {
 		},
 	}))
 }
+
+// runRetryDeadLetter re-attempts the dead-lettered files and prints the
+// outcome of each as a JSON line
+func runRetryDeadLetter(p *parser.Parser, prefix string, logger *slog.Logger) int {
+	enc := json.NewEncoder(os.Stdout)
+	failed := 0
+	err := p.RetryDeadLetter(context.Background(), prefix, func(outcome parser.DeadLetterOutcome) {
+		if !outcome.Shipped {
+			failed++
+		}
+		if err := enc.Encode(outcome); err != nil {
+			logger.Error("unable to write outcome", "err", err)
+		}
+	})
+	if err != nil {
+		logger.Error("unable to retry dead-lettered files", "err", err)
+		return exitFatal
+	}
+	if failed > 0 {
+		return exitPartial
+	}
+	return exitClean
+}
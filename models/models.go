@@ -8,3 +8,15 @@ type W3CLog struct {
 	HeaderFields []string
 	Records      []LogEntry
 }
+
+// StandardFields are the fields of the CloudFront standard log file format,
+// in the order CloudFront writes them.
+var StandardFields = []string{
+	"date", "time", "x-edge-location", "sc-bytes", "c-ip", "cs-method", "cs(Host)",
+	"cs-uri-stem", "sc-status", "cs(Referer)", "cs(User-Agent)", "cs-uri-query",
+	"cs(Cookie)", "x-edge-result-type", "x-edge-request-id", "x-host-header",
+	"cs-protocol", "cs-bytes", "time-taken", "x-forwarded-for", "ssl-protocol",
+	"ssl-cipher", "x-edge-response-result-type", "cs-protocol-version", "fle-status",
+	"fle-encrypted-fields", "c-port", "time-to-first-byte", "x-edge-detailed-result-type",
+	"sc-content-type", "sc-content-len", "sc-range-start", "sc-range-end",
+}
@@ -3,14 +3,174 @@ package models
 import "time"
 
 type Options struct {
-	BucketName   string
-	WaitInterval time.Duration
-	Format       string
-	LokiURL      string
-	LokiUser     string
-	LokiPassword string
-	ClusterName  string
-	Labels       map[string]string
-	Workers      int
-	Port         int
+	BucketName           string
+	WaitInterval         time.Duration
+	WaitIntervalMin      time.Duration
+	WaitIntervalMax      time.Duration
+	MaxFilesPerCycle     int
+	InputFormat          string
+	FunctionLogPrefixes  []string
+	Format               string
+	KeyStyle             string
+	LokiURL              string
+	LokiAlternateURLs    []string
+	LokiProbeInterval    time.Duration
+	LokiUser             string
+	LokiTenant           string
+	LokiPassword         string
+	ClusterName          string
+	Environment          string
+	Labels               map[string]string
+	Workers              int
+	LowMemory            bool
+	Port                 int
+	CheckpointFile       string
+	PurgeVersions        bool
+	DeleteWindow         time.Duration
+	SettleTime           time.Duration
+	FileTimeout          time.Duration
+	MaxDecompressedRatio float64
+	MaxDecompressedBytes int64
+	DeadLetterPrefix     string
+	VerifyChecksums      bool
+	VerifyMaxBytes       int64
+	SLOLatency           time.Duration
+	SLOTarget            float64
+	SLOWindows           []time.Duration
+	Once                 bool
+	SelfCheck            bool
+	RawTimestamp         bool
+	FieldOrder           []string
+	SplitHosts           []string
+	Routes               []Route
+	UnknownEdge          string // default, route or deadletter
+	RemoteWriteURL       string
+	RemoteWriteInterval  time.Duration
+	GDPR                 bool
+	GDPRKeyFile          string
+	GDPRKey              string // GDPR_HASH_KEY, without a key file
+	GDPRToken            string // GDPR_ERASE_TOKEN
+	FLE                  string
+	Scrub                bool
+	AnonymizeIPs         bool
+	PseudonymFields      []string
+	PseudonymKeyFile     string
+	PseudonymURL         string
+	PseudonymTimeout     time.Duration
+	Anomaly              Anomaly
+	NamespaceAnomaly     map[string]Anomaly
+	NamespaceConcurrency int
+	QueueFile            string
+	QueueCapacity        int
+	QueueOverflow        string
+	QueueSpillFile       string
+	ReplayWindow         time.Duration
+	ReplayMaxKeys        int
+	ReplayFile           string
+	VolumeInterval       time.Duration
+	ReconcileInterval    time.Duration
+	ReconcileAge         time.Duration
+	VolumeFactor         float64
+	VolumeBaseline       int
+	NamespaceHook        string
+	NamespaceHookTimeout time.Duration
+	NamespacesFile       string
+	FenceKey             string
+	FenceTTL             time.Duration
+	FenceMode            string
+	SnapshotURL          string
+	AlertWebhook         string
+	AlertFormat          string
+	AlertInterval        time.Duration
+	ActivityEvents       string
+	SchemaURL            string
+	CountersFile         string
+	IngestMode           string
+	SQSQueueURL          string
+	SQSVisibility        time.Duration
+	NotificationBucket   string
+	NoListBucket         bool
+	RepublishAfter       time.Duration
+	Role                 string
+	CoordinatorAddr      string
+	LeaseTTL             time.Duration
+	LeaseRetries         int
+	RedisURL             string
+	ClaimLeaseTTL        time.Duration
+	ClaimDoneTTL         time.Duration
+	PolicyFile           string
+	PolicyRefresh        time.Duration
+	Strict               bool
+	ExpectedFields       []string
+	TimestampPrecision   string
+	EntryMaxAge          time.Duration
+	OldEntries           string
+	MetadataTimezone     string
+	DeliveryHour         bool
+	Provenance           bool
+	FileSummary          bool
+	EmptyFiles           string
+	BatchIdle            time.Duration
+	BatchLines           int
+	BatchBytes           int
+	Idempotency          string
+	LokiDNSRefresh       time.Duration
+	LokiHTTP2            string
+	LokiMaxConns         int
+	LokiCompression      string
+	LokiInflight         int
+	LokiStreamRate       int
+	LokiStreamBurst      int
+	PreserveOrder        bool
+	Shards               int
+	NamespaceShards      map[string]int
+	NamespaceTenants     map[string]string
+	TenantPerNamespace   bool
+	BaseLabels           []string
+	LabelFields          []string
+	MetadataFields       []string
+	DropFields           []string
+	LokiDiscoverLimits   bool
+	LokiMaxLineSize      int
+	StreamWarnThreshold  int
+	Backfill             bool
+	BackfillTenant       string
+	BackfillRate         int
+	Shadow               bool
+	SlowStart            time.Duration
+	SlowStartRate        int
+	S3SelectFields       []string
+	S3SelectWhere        string
+	KeyGlob              string
+	Excludes             []string
+	Prefixes             []string
+	IPAllow              []string
+	IPDeny               []string
+	IPFilterAction       string
+	DropCountries        []string
+	DropList             string
+	DropListRefresh      time.Duration
+	Sets                 []string
+	Filters              []string
+	ExprTimeout          time.Duration
+	ModifiedAfter        time.Time
+	ModifiedBefore       time.Time
+	HourAfter            time.Time
+	HourBefore           time.Time
+}
+
+// Anomaly thresholds above which entries are tagged, 0 disables a check
+type Anomaly struct {
+	Slow       float64 // time-taken in seconds
+	Oversized  int64   // sc-bytes
+	ErrorBurst int     // 5xx responses per minute within a file
+}
+
+// Route sends entries with a field matching a value to a different Loki
+type Route struct {
+	Field       string
+	Value       string
+	URL         string
+	Tenant      string
+	Compression string // defaults to LokiCompression
 }
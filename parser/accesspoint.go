@@ -0,0 +1,42 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// accessPoint reports whether the bucket identifier is an access point ARN,
+// including Multi-Region Access Points, or an access point alias. The S3
+// client resolves and signs them itself, with SigV4A for Multi-Region Access
+// Points.
+func accessPoint(bucket string) bool {
+	return arn.IsARN(bucket) || strings.HasSuffix(bucket, "-s3alias")
+}
+
+// validateBucket checks that an ARN given as bucket identifier is the one of
+// an S3 access point
+func validateBucket(opts models.Options) error {
+	if !arn.IsARN(opts.BucketName) {
+		return nil
+	}
+	a, err := arn.Parse(opts.BucketName)
+	if err != nil {
+		return fmt.Errorf("invalid bucket ARN: %w", err)
+	}
+	if a.Service != "s3" || !strings.HasPrefix(a.Resource, "accesspoint/") {
+		return fmt.Errorf("bucket ARN %q is not an S3 access point (arn:aws:s3:<region>:<account>:accesspoint/<name>)", opts.BucketName)
+	}
+	return nil
+}
+
+// notifiedBucket returns the bucket name S3 event notifications carry, the
+// one behind an access point
+func (s *Parser) notifiedBucket() string {
+	if s.opts.NotificationBucket != "" {
+		return s.opts.NotificationBucket
+	}
+	return s.opts.BucketName
+}
@@ -0,0 +1,233 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// activityBuffer is the events waiting for the sink, later ones are dropped
+// rather than slowing down shipping
+const activityBuffer = 1000
+
+// ActivityEvent is a lifecycle event of a file. Its JSON form is stable,
+// fields are only ever added.
+type ActivityEvent struct {
+	Type    string    `json:"type"` // file_queued, file_started, file_shipped, file_failed or file_deadlettered
+	Time    time.Time `json:"time"`
+	Cluster string    `json:"cluster"`
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key"`
+	Attempt int       `json:"attempt,omitempty"` // of file_started, since the start
+	Error   string    `json:"error,omitempty"`   // of file_failed
+}
+
+// activity streams file lifecycle events to stdout as NDJSON, to a webhook
+// as NDJSON batches, or to a NATS subject, for external orchestration and
+// audit systems
+type activity struct {
+	cluster string
+	bucket  string
+	events  chan ActivityEvent
+	done    chan struct{}
+	send    func(events []ActivityEvent) error
+	nats    *nats.Conn // nil unless events are published to NATS
+	mu      sync.RWMutex
+	closed  bool // events are no longer queued
+	sent    atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// newActivity parses the sink: stdout, an http(s) webhook URL or
+// nats|tls://[user:password@]host:port/subject
+func newActivity(opts models.Options, logger *slog.Logger) (*activity, error) {
+	if opts.ActivityEvents == "" {
+		return nil, nil
+	}
+	a := &activity{
+		cluster: opts.ClusterName,
+		bucket:  opts.BucketName,
+		events:  make(chan ActivityEvent, activityBuffer),
+		done:    make(chan struct{}),
+	}
+	if opts.ActivityEvents == "stdout" {
+		a.send = sendStdout
+	} else {
+		u, err := url.Parse(opts.ActivityEvents)
+		if err != nil {
+			return nil, fmt.Errorf("invalid activity events sink: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https":
+			client := &http.Client{Timeout: 10 * time.Second}
+			a.send = func(events []ActivityEvent) error { return postEvents(client, u.String(), events) }
+		case "nats", "tls":
+			subject := strings.TrimPrefix(u.Path, "/")
+			if subject == "" {
+				return nil, fmt.Errorf("activity events NATS URL %q has no subject", opts.ActivityEvents)
+			}
+			server := *u
+			server.Path = ""
+			// connects in the background, publishes are buffered meanwhile
+			if a.nats, err = nats.Connect(server.String(),
+				nats.Name("cloudfront-logs-shipper"),
+				nats.RetryOnFailedConnect(true),
+				nats.MaxReconnects(-1),
+			); err != nil {
+				return nil, fmt.Errorf("failed to connect to NATS %s: %w", server.Redacted(), err)
+			}
+			a.send = func(events []ActivityEvent) error { return publishEvents(a.nats, subject, events) }
+		default:
+			return nil, fmt.Errorf("unsupported activity events sink %q (stdout, http(s)://, nats://, tls://)", opts.ActivityEvents)
+		}
+	}
+	go a.run(logger)
+	return a, nil
+}
+
+// run sends the queued events in batches until the activity is closed
+func (a *activity) run(logger *slog.Logger) {
+	defer close(a.done)
+	for event := range a.events {
+		batch := []ActivityEvent{event}
+	more:
+		for len(batch) < 100 {
+			select {
+			case e, ok := <-a.events:
+				if !ok {
+					break more
+				}
+				batch = append(batch, e)
+			default:
+				break more
+			}
+		}
+		if err := a.send(batch); err != nil {
+			a.failed.Add(int64(len(batch)))
+			logger.Error("failed to send activity events", "events", len(batch), "err", err)
+			continue
+		}
+		a.sent.Add(int64(len(batch)))
+	}
+}
+
+// emit queues an event of a file, dropped if the sink falls behind
+func (a *activity) emit(kind, key string, attempt int, err error) {
+	if a == nil {
+		return
+	}
+	event := ActivityEvent{Type: kind, Time: time.Now().UTC(), Cluster: a.cluster, Bucket: a.bucket, Key: key, Attempt: attempt}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.events <- event:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// CloseActivity sends the queued activity events, before exiting
+func (s *Parser) CloseActivity() {
+	if s.activity == nil {
+		return
+	}
+	s.activity.mu.Lock()
+	s.activity.closed = true
+	close(s.activity.events)
+	s.activity.mu.Unlock()
+	select {
+	case <-s.activity.done:
+	case <-time.After(10 * time.Second):
+	}
+	if s.activity.nats != nil {
+		s.activity.nats.Close()
+	}
+}
+
+func (a *activity) writeMetrics(w io.Writer) {
+	if a == nil {
+		return
+	}
+	fmt.Fprintf(w, "cloudfront_logs_shipper_activity_events_total{result=\"sent\"} %d\n", a.sent.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_activity_events_total{result=\"dropped\"} %d\n", a.dropped.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_activity_events_total{result=\"failed\"} %d\n", a.failed.Load())
+}
+
+func appendEvents(buf []byte, events []ActivityEvent) ([]byte, error) {
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	return buf, nil
+}
+
+func sendStdout(events []ActivityEvent) error {
+	buf, err := appendEvents(nil, events)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(buf)
+	return err
+}
+
+func postEvents(client *http.Client, u string, events []ActivityEvent) error {
+	body, err := appendEvents(nil, events)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, req.URL.Redacted())
+	}
+	return nil
+}
+
+// publishEvents publishes each event as a message of the subject, and waits
+// until the server got them
+func publishEvents(nc *nats.Conn, subject string, events []ActivityEvent) error {
+	for _, e := range events {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := nc.Publish(subject, payload); err != nil {
+			return err
+		}
+	}
+	return nc.FlushTimeout(10 * time.Second)
+}
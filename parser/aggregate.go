@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+type aggregateKey struct {
+	distribution string
+	status       string
+	cacheResult  string
+}
+
+// aggregate counts shipped requests by distribution, status and cache result,
+// pushed as cumulative counters so dashboards can use rate() instead of LogQL
+type aggregate struct {
+	mu     sync.Mutex
+	counts map[aggregateKey]float64
+}
+
+func newAggregate() *aggregate {
+	return &aggregate{
+		counts: make(map[aggregateKey]float64),
+	}
+}
+
+// fileCounts stages the requests of a file until Loki confirmed their lines,
+// an attempt failing only counts the lines its retry skips, so the requests
+// of a retried file are counted once
+type fileCounts struct {
+	aggregate    *aggregate
+	distribution string
+	pending      []pendingCount // lines not confirmed yet, in order
+}
+
+type pendingCount struct {
+	line int
+	key  aggregateKey
+}
+
+// file returns the staged counts of a file, nil without aggregates
+func (a *aggregate) file(distribution string) *fileCounts {
+	if a == nil {
+		return nil
+	}
+	return &fileCounts{aggregate: a, distribution: distribution}
+}
+
+// add stages the request of a line of the file
+func (f *fileCounts) add(line int, entry models.LogEntry) {
+	if f == nil {
+		return
+	}
+	f.pending = append(f.pending, pendingCount{line: line, key: aggregateKey{
+		distribution: f.distribution,
+		status:       entry["sc-status"],
+		cacheResult:  entry["x-edge-result-type"],
+	}})
+}
+
+// confirm counts the staged requests of the lines up to shipped
+func (f *fileCounts) confirm(shipped int) {
+	if f == nil {
+		return
+	}
+	n := 0
+	for n < len(f.pending) && f.pending[n].line <= shipped {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	f.aggregate.mu.Lock()
+	for _, c := range f.pending[:n] {
+		f.aggregate.counts[c.key]++
+	}
+	f.aggregate.mu.Unlock()
+	f.pending = f.pending[n:]
+}
+
+func (a *aggregate) series(cluster string, now time.Time) []prompb.TimeSeries {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ts := now.UnixMilli()
+	series := make([]prompb.TimeSeries, 0, len(a.counts))
+	for k, v := range a.counts {
+		series = append(series, prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "cloudfront_requests_total"},
+				{Name: "cache_result", Value: k.cacheResult},
+				{Name: "cluster", Value: cluster},
+				{Name: "distribution", Value: k.distribution},
+				{Name: "status", Value: k.status},
+			},
+			Samples: []prompb.Sample{{Value: v, Timestamp: ts}},
+		})
+	}
+	return series
+}
+
+// PushAggregates sends the request counters to the remote-write endpoint
+func (s *Parser) PushAggregates() error {
+	return s.remoteWrite.Push(s.aggregate.series(s.opts.ClusterName, time.Now()))
+}
@@ -0,0 +1,156 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/loki"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// alerter posts alerts on failures metrics may not surface in time, e.g.
+// during a Prometheus outage, to a Slack incoming webhook or the
+// Alertmanager API. An alert of a kind and subject is posted at most once
+// per interval.
+type alerter struct {
+	url      string
+	format   string // slack or alertmanager
+	cluster  string
+	interval time.Duration
+	mu       sync.Mutex
+	last     map[string]time.Time // by kind and subject
+	posting  sync.WaitGroup
+	sent     atomic.Int64
+	failed   atomic.Int64
+}
+
+func newAlerter(opts models.Options) (*alerter, error) {
+	if opts.AlertWebhook == "" {
+		return nil, nil
+	}
+	switch opts.AlertFormat {
+	case "slack", "alertmanager":
+	default:
+		return nil, fmt.Errorf("unsupported alert format %q", opts.AlertFormat)
+	}
+	return &alerter{
+		url:      opts.AlertWebhook,
+		format:   opts.AlertFormat,
+		cluster:  opts.ClusterName,
+		interval: opts.AlertInterval,
+		last:     make(map[string]time.Time),
+	}, nil
+}
+
+// setupAlerts creates the alerter and alerts on Loki pushes failing after
+// all their retries
+func (s *Parser) setupAlerts(opts models.Options) error {
+	a, err := newAlerter(opts)
+	if err != nil || a == nil {
+		return err
+	}
+	s.alerts = a
+	loki.OnPushFailure(func(url string, err error) {
+		s.alert("LokiPushFailed", url, "Loki rejected a push after all retries", err)
+	})
+	return nil
+}
+
+// alert posts an alert in the background unless one of the same kind and
+// subject was posted within the interval
+func (s *Parser) alert(kind, subject, summary string, err error) {
+	a := s.alerts
+	if a == nil {
+		return
+	}
+	id := kind + "\xff" + subject
+	now := time.Now()
+	a.mu.Lock()
+	if last, ok := a.last[id]; ok && now.Sub(last) < a.interval {
+		a.mu.Unlock()
+		return
+	}
+	a.last[id] = now
+	a.mu.Unlock()
+	a.posting.Add(1)
+	go func() {
+		defer a.posting.Done()
+		if err := a.post(kind, subject, summary, err, now); err != nil {
+			a.failed.Add(1)
+			s.logger.Error("failed to post alert", "alert", kind, "err", err)
+			return
+		}
+		a.sent.Add(1)
+	}()
+}
+
+// WaitAlerts waits for the alerts being posted, before exiting
+func (s *Parser) WaitAlerts() {
+	if s.alerts != nil {
+		s.alerts.posting.Wait()
+	}
+}
+
+func (a *alerter) post(kind, subject, summary string, cause error, at time.Time) error {
+	description := ""
+	if cause != nil {
+		description = cause.Error()
+	}
+	var payload any
+	switch a.format {
+	case "slack":
+		payload = map[string]string{
+			"text": fmt.Sprintf("*%s* on %s: %s\n`%s`\n%s", kind, a.cluster, summary, subject, description),
+		}
+	case "alertmanager":
+		payload = []map[string]any{{
+			"labels": map[string]string{
+				"alertname": kind,
+				"cluster":   a.cluster,
+				"subject":   subject,
+				"service":   "cloudfront-logs-shipper",
+			},
+			"annotations": map[string]string{
+				"summary":     summary,
+				"description": description,
+			},
+			"startsAt": at.UTC().Format(time.RFC3339),
+		}}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (a *alerter) writeMetrics(w io.Writer) {
+	if a == nil {
+		return
+	}
+	fmt.Fprintf(w, "cloudfront_logs_shipper_alerts_total{result=\"sent\"} %d\n", a.sent.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_alerts_total{result=\"failed\"} %d\n", a.failed.Load())
+}
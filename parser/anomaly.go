@@ -0,0 +1,79 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// errorBurst counts 5xx responses per minute within a file
+type errorBurst struct {
+	minute string
+	errors int
+}
+
+// thresholds returns the anomaly thresholds of a namespace
+func (s *Parser) thresholds(namespace string) models.Anomaly {
+	if a, ok := s.opts.NamespaceAnomaly[namespace]; ok {
+		return a
+	}
+	return s.opts.Anomaly
+}
+
+// tagAnomalies adds slow, oversized and error_burst fields for entries above
+// the thresholds, error bursts are tagged from the Nth 5xx of a minute on
+func tagAnomalies(entry models.LogEntry, a models.Anomaly, burst *errorBurst) {
+	if a.Slow > 0 {
+		if taken, err := strconv.ParseFloat(entry["time-taken"], 64); err == nil && taken > a.Slow {
+			entry["slow"] = "true"
+		}
+	}
+	if a.Oversized > 0 {
+		if bytes, err := strconv.ParseInt(entry["sc-bytes"], 10, 64); err == nil && bytes > a.Oversized {
+			entry["oversized"] = "true"
+		}
+	}
+	if a.ErrorBurst > 0 && strings.HasPrefix(entry["sc-status"], "5") {
+		minute := entry["date"] + entry["time"]
+		if len(minute) > 2 {
+			minute = minute[:len(minute)-2] // cut seconds
+		}
+		if minute != burst.minute {
+			burst.minute = minute
+			burst.errors = 0
+		}
+		burst.errors++
+		if burst.errors >= a.ErrorBurst {
+			entry["error_burst"] = "true"
+		}
+	}
+}
+
+// ParseAnomaly parses thresholds from comma separated key=value pairs
+// (slow=<seconds>,oversized=<bytes>,error-burst=<5xx per minute>)
+func ParseAnomaly(s string) (models.Anomaly, error) {
+	var a models.Anomaly
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) < 2 {
+			return a, fmt.Errorf("invalid pair %q (k=v)", kv)
+		}
+		var err error
+		switch parts[0] {
+		case "slow":
+			a.Slow, err = strconv.ParseFloat(parts[1], 64)
+		case "oversized":
+			a.Oversized, err = strconv.ParseInt(parts[1], 10, 64)
+		case "error-burst":
+			a.ErrorBurst, err = strconv.Atoi(parts[1])
+		default:
+			return a, fmt.Errorf("unknown key %q", parts[0])
+		}
+		if err != nil {
+			return a, fmt.Errorf("invalid %s: %w", parts[0], err)
+		}
+	}
+	return a, nil
+}
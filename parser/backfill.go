@@ -0,0 +1,49 @@
+package parser
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// backfill keeps shipped files in the bucket and remembers them so later
+// scans don't ship them again. The set is in memory only: after a restart
+// files are shipped again, unless --checkpoint-file kept their offsets and
+// their lines are skipped.
+type backfill struct {
+	throttle *rate.Limiter // nil for no limit
+	mu       sync.Mutex
+	shipped  map[string]bool
+}
+
+func newBackfill(rateLimit int) *backfill {
+	b := &backfill{shipped: make(map[string]bool)}
+	if rateLimit > 0 {
+		b.throttle = rate.NewLimiter(rate.Limit(rateLimit), rateLimit)
+	}
+	return b
+}
+
+// wait blocks until a line may be shipped within the rate limit
+func (b *backfill) wait(ctx context.Context) error {
+	if b == nil || b.throttle == nil {
+		return nil
+	}
+	return b.throttle.Wait(ctx)
+}
+
+func (b *backfill) done(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.shipped[key] = true
+}
+
+func (b *backfill) has(key string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.shipped[key]
+}
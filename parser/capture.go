@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Capture copies the first #Fields header of a log file and up to lines of
+// its data lines to w, sanitized: cookies are hashed, credentials redacted
+// and client addresses have their host part zeroed. It returns the lines
+// written.
+func Capture(r io.Reader, lines int, w io.Writer) (int, error) {
+	var header []string
+	var n int
+	scanner := bufio.NewScanner(r)
+	for n < lines && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#Fields:") {
+			if header != nil {
+				break // concatenated file, the fixture has a single header
+			}
+			header = strings.Fields(line)[1:]
+			if _, err := fmt.Fprintf(w, "#Version: 1.0\n#Fields: %s\n", strings.Join(header, " ")); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") || header == nil {
+			continue
+		}
+		entry, err := parseDataLine(line, header)
+		if err != nil {
+			continue // not a line of the captured header
+		}
+		scrub(entry)
+		if ip, ok := entry["c-ip"]; ok {
+			entry["c-ip"] = zeroHost(ip)
+		}
+		if xff, ok := entry["x-forwarded-for"]; ok && xff != "-" {
+			hops := strings.Split(strings.ReplaceAll(xff, "%20", ""), ",")
+			for i, hop := range hops {
+				hops[i] = zeroHost(strings.TrimSpace(hop))
+			}
+			entry["x-forwarded-for"] = strings.Join(hops, ",")
+		}
+		if _, err := fmt.Fprintln(w, rawLine(header, entry)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+	if header == nil {
+		return n, errors.New("no #Fields header found")
+	}
+	return n, nil
+}
@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nugored/cf-logs-loki-uploader/clock"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// TestFixtures parses the fixtures written by capture-schema, every data line
+// must match its header and be shipped by the default options
+func TestFixtures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no fixtures in testdata")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			s := &Parser{
+				opts:   models.Options{Scrub: true, FLE: "drop"},
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			s.SetClock(clock.Real)
+			var header []string
+			lines := 0
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				line := scanner.Text()
+				if strings.HasPrefix(line, "#Fields:") {
+					header = strings.Fields(line)[1:]
+					continue
+				}
+				if strings.HasPrefix(line, "#") {
+					continue
+				}
+				lines++
+				if header == nil {
+					t.Fatalf("line %d: data line before the #Fields header", lines)
+				}
+				entry, err := parseDataLine(line, header)
+				if err != nil {
+					t.Fatalf("line %d: %v", lines, err)
+				}
+				if _, ok := s.prepare(entry, nil); !ok {
+					t.Errorf("line %d: dropped by prepare", lines)
+				}
+				if _, ok := s.timestamp(entry); !ok {
+					t.Errorf("line %d: no timestamp", lines)
+				}
+				if cookie := entry["cs(Cookie)"]; cookie != "" && cookie != "-" && !strings.HasPrefix(cookie, "sha256:") {
+					t.Errorf("line %d: cookie not hashed: %q", lines, cookie)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if lines == 0 {
+				t.Error("no data lines")
+			}
+		})
+	}
+}
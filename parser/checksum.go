@@ -0,0 +1,322 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// checksumAttempts is the downloads of a file before a mismatch fails it
+const checksumAttempts = 3
+
+var (
+	checksumHashesMu sync.RWMutex
+	checksumHashes   = map[string]func() hash.Hash{
+		"CRC32":  func() hash.Hash { return crc32.NewIEEE() },
+		"CRC32C": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+		"SHA1":   sha1.New,
+		"SHA256": sha256.New,
+	}
+)
+
+// RegisterChecksum adds or replaces the hash of a checksum algorithm, e.g.
+// CRC64NVME, usually from the init function of a package compiled in. The
+// checksum of an object is read from its x-amz-checksum-<algorithm> header,
+// or its checksum-<algorithm> user metadata, base64 encoded.
+func RegisterChecksum(algorithm string, newHash func() hash.Hash) {
+	checksumHashesMu.Lock()
+	defer checksumHashesMu.Unlock()
+	checksumHashes[strings.ToUpper(algorithm)] = newHash
+}
+
+// checksum is the expected digest of an object, of the digests of its parts
+// for a multipart upload
+type checksum struct {
+	algorithm string
+	newHash   func() hash.Hash
+	digest    []byte
+	parts     int // 0 unless multipart
+}
+
+// checksums counts the verifications of downloaded files
+type checksums struct {
+	ok           atomic.Int64
+	mismatches   atomic.Int64
+	unverifiable atomic.Int64 // without a checksum or ETag digest
+}
+
+func (c *checksums) writeMetrics(w io.Writer) {
+	if c == nil {
+		return
+	}
+	fmt.Fprintf(w, "cloudfront_logs_shipper_checksum_verifications_total{result=\"ok\"} %d\n", c.ok.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_checksum_verifications_total{result=\"mismatch\"} %d\n", c.mismatches.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_checksum_verifications_total{result=\"unverifiable\"} %d\n", c.unverifiable.Load())
+}
+
+// expectedChecksum picks the checksum of an object: an S3 checksum, then a
+// registered one in user metadata, then the ETag, an MD5 digest unless the
+// object is encrypted with KMS or a customer key
+func expectedChecksum(obj *s3.GetObjectOutput) (checksum, bool) {
+	checksumHashesMu.RLock()
+	defer checksumHashesMu.RUnlock()
+	values := map[string]*string{
+		"SHA256": obj.ChecksumSHA256,
+		"SHA1":   obj.ChecksumSHA1,
+		"CRC32C": obj.ChecksumCRC32C,
+		"CRC32":  obj.ChecksumCRC32,
+	}
+	algorithms := []string{"SHA256", "SHA1", "CRC32C", "CRC32"}
+	var registered []string
+	for algorithm := range checksumHashes {
+		if _, ok := values[algorithm]; !ok {
+			registered = append(registered, algorithm)
+			if v, ok := obj.Metadata["checksum-"+strings.ToLower(algorithm)]; ok {
+				values[algorithm] = &v
+			}
+		}
+	}
+	slices.Sort(registered)
+	for _, algorithm := range append(algorithms, registered...) {
+		newHash, ok := checksumHashes[algorithm]
+		if !ok || values[algorithm] == nil {
+			continue
+		}
+		value, parts := splitParts(*values[algorithm])
+		digest, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || parts < 0 {
+			continue
+		}
+		return checksum{algorithm: algorithm, newHash: newHash, digest: digest, parts: parts}, true
+	}
+
+	switch obj.ServerSideEncryption {
+	case types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+		return checksum{}, false
+	}
+	if obj.SSECustomerAlgorithm != nil {
+		return checksum{}, false
+	}
+	value, parts := splitParts(strings.Trim(aws.ToString(obj.ETag), `"`))
+	digest, err := hex.DecodeString(value)
+	if err != nil || len(digest) != md5.Size || parts < 0 {
+		return checksum{}, false
+	}
+	return checksum{algorithm: "ETag", newHash: md5.New, digest: digest, parts: parts}, true
+}
+
+// splitParts splits the part count off a multipart checksum, -1 if invalid
+func splitParts(value string) (string, int) {
+	i := strings.LastIndex(value, "-")
+	if i < 0 {
+		return value, 0
+	}
+	parts, err := strconv.Atoi(value[i+1:])
+	if err != nil || parts < 1 {
+		return value, -1
+	}
+	return value[:i], parts
+}
+
+// matches verifies a body, split in parts of the size of the first for a
+// multipart upload like the SDK uploaders do
+func (c checksum) matches(body []byte, partSize int64) bool {
+	if c.parts == 0 {
+		h := c.newHash()
+		h.Write(body)
+		return bytes.Equal(h.Sum(nil), c.digest)
+	}
+	if partSize <= 0 || int64(c.parts-1)*partSize >= int64(len(body)) {
+		return false
+	}
+	outer := c.newHash()
+	for i := range c.parts {
+		start, end := int64(i)*partSize, int64(len(body))
+		if i < c.parts-1 {
+			end = start + partSize
+		}
+		h := c.newHash()
+		h.Write(body[start:end])
+		outer.Write(h.Sum(nil))
+	}
+	return bytes.Equal(outer.Sum(nil), c.digest)
+}
+
+// streamHash hashes a body while it is read, in parts of the size of the
+// first for a multipart upload
+type streamHash struct {
+	sum      checksum
+	partSize int64
+	part     hash.Hash
+	outer    hash.Hash // of the part digests, nil unless multipart
+	n        int64     // bytes of the current part
+	parts    int
+}
+
+func newStreamHash(sum checksum, partSize int64) *streamHash {
+	h := &streamHash{sum: sum, partSize: partSize, part: sum.newHash()}
+	if sum.parts > 0 {
+		h.outer = sum.newHash()
+	}
+	return h
+}
+
+func (h *streamHash) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if h.outer != nil && h.n+int64(len(chunk)) > h.partSize {
+			chunk = p[:h.partSize-h.n]
+		}
+		h.part.Write(chunk)
+		h.n += int64(len(chunk))
+		p = p[len(chunk):]
+		if h.outer != nil && h.n == h.partSize {
+			h.outer.Write(h.part.Sum(nil))
+			h.part.Reset()
+			h.n = 0
+			h.parts++
+		}
+	}
+	return written, nil
+}
+
+// matches reports whether the body read matches the checksum, once it was
+// read whole
+func (h *streamHash) matches() bool {
+	if h.outer == nil {
+		return bytes.Equal(h.part.Sum(nil), h.sum.digest)
+	}
+	if h.n > 0 {
+		h.outer.Write(h.part.Sum(nil))
+		h.n = 0
+		h.parts++
+	}
+	return h.parts == h.sum.parts && bytes.Equal(h.outer.Sum(nil), h.sum.digest)
+}
+
+// streamedObject verifies a file too large to be downloaded whole while it
+// is parsed, the returned function fails it before its deletion on a
+// mismatch, it is not downloaded again
+func (s *Parser) streamedObject(ctx context.Context, fn string, obj *s3.GetObjectOutput) (*s3.GetObjectOutput, func() error, error) {
+	sum, ok := expectedChecksum(obj)
+	if !ok {
+		s.checksums.unverifiable.Add(1)
+		return obj, func() error { return nil }, nil
+	}
+	var partSize int64
+	if sum.parts > 0 {
+		var err error
+		if partSize, err = s.partSize(ctx, fn, obj); err != nil {
+			obj.Body.Close()
+			return nil, nil, err
+		}
+	}
+	h := newStreamHash(sum, partSize)
+	obj.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(obj.Body, h), obj.Body}
+	return obj, func() error {
+		if !h.matches() {
+			s.checksums.mismatches.Add(1)
+			return fmt.Errorf("%w: %s does not match its %s checksum", ErrChecksum, fn, sum.algorithm)
+		}
+		s.checksums.ok.Add(1)
+		return nil
+	}, nil
+}
+
+// verifiedObject downloads a file whole and verifies it against its
+// checksum before it is parsed, downloading it again on a mismatch or a
+// failed read. Retries get the same version, or the same ETag if the bucket
+// is not versioned. It returns the bytes downloaded by failed attempts.
+// Files larger than --verify-checksums-max-bytes are verified while they are
+// parsed instead, by the returned function.
+func (s *Parser) verifiedObject(ctx context.Context, fn string, obj *s3.GetObjectOutput) (*s3.GetObjectOutput, int64, func() error, error) {
+	if size := obj.ContentLength; size == nil || *size > s.opts.VerifyMaxBytes {
+		obj, verify, err := s.streamedObject(ctx, fn, obj)
+		return obj, 0, verify, err
+	}
+	verified := func() error { return nil }
+	var wasted int64
+	for attempt := 1; ; attempt++ {
+		body, err := io.ReadAll(obj.Body)
+		obj.Body.Close()
+		switch {
+		case err != nil && strings.Contains(err.Error(), "checksum did not match"):
+			// the SDK verifies whole-object checksums too
+			s.checksums.mismatches.Add(1)
+			err = fmt.Errorf("%w: %w", ErrChecksum, err)
+		case err != nil:
+			err = fmt.Errorf("%w: %w", ErrIncompleteRead, err)
+		default:
+			obj.Body = io.NopCloser(bytes.NewReader(body))
+			sum, ok := expectedChecksum(obj)
+			if !ok {
+				s.checksums.unverifiable.Add(1)
+				return obj, wasted, verified, nil
+			}
+			var partSize int64
+			if sum.parts > 0 {
+				if partSize, err = s.partSize(ctx, fn, obj); err != nil {
+					return nil, wasted, nil, err
+				}
+			}
+			if sum.matches(body, partSize) {
+				s.checksums.ok.Add(1)
+				return obj, wasted, verified, nil
+			}
+			s.checksums.mismatches.Add(1)
+			err = fmt.Errorf("%w: %s does not match its %s checksum", ErrChecksum, fn, sum.algorithm)
+		}
+		if attempt == checksumAttempts {
+			return nil, wasted, nil, fmt.Errorf("%w, after %d downloads", err, attempt)
+		}
+		s.logger.Warn("downloaded file failed verification, downloading it again", "key", fn, "attempt", attempt, "err", err)
+		wasted += int64(len(body))
+		input := &s3.GetObjectInput{
+			Bucket:       &s.opts.BucketName,
+			Key:          &fn,
+			VersionId:    obj.VersionId,
+			ChecksumMode: types.ChecksumModeEnabled,
+		}
+		if obj.VersionId == nil {
+			input.IfMatch = obj.ETag
+		}
+		if obj, err = s.s3Client.GetObject(ctx, input); err != nil {
+			return nil, wasted, nil, fmt.Errorf("failed to get object %s: %w", fn, err)
+		}
+	}
+}
+
+// partSize returns the size of the first part of a multipart upload
+func (s *Parser) partSize(ctx context.Context, fn string, obj *s3.GetObjectOutput) (int64, error) {
+	head, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:     &s.opts.BucketName,
+		Key:        &fn,
+		VersionId:  obj.VersionId,
+		PartNumber: aws.Int32(1),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the part size of %s: %w", fn, err)
+	}
+	return aws.ToInt64(head.ContentLength), nil
+}
@@ -0,0 +1,143 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+	"github.com/redis/go-redis/v9"
+)
+
+// claimStore coordinates replicas listing the same bucket: a key is shipped
+// by the replica holding its lease, and not again once marked as processed
+type claimStore interface {
+	// acquire takes the lease of a key for ttl, false if another replica holds
+	// it or already shipped it, checked atomically with taking the lease
+	acquire(ctx context.Context, key string) (bool, error)
+	// extend renews a held lease, false if it was lost
+	extend(ctx context.Context, key string) (bool, error)
+	// release gives up a held lease
+	release(ctx context.Context, key string) error
+	// markProcessed records the key as shipped
+	markProcessed(ctx context.Context, key string) error
+}
+
+// redisClaims keeps leases and processed keys in Redis with TTLs
+type redisClaims struct {
+	client   *redis.Client
+	prefix   string
+	owner    string // lease value of this replica
+	leaseTTL time.Duration
+	doneTTL  time.Duration
+}
+
+// acquireScript takes a lease unless the key was processed or is leased, a
+// replica marking the key processed between both checks would otherwise see
+// it shipped twice
+var acquireScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return 0
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0`)
+
+// releaseScript deletes a lease only if this replica still holds it
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// extendScript renews a lease only if this replica still holds it
+var extendScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+func newRedisClaims(opts models.Options) (*redisClaims, error) {
+	ropts, err := redis.ParseURL(opts.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get replica name: %w", err)
+	}
+	return &redisClaims{
+		client:   redis.NewClient(ropts),
+		prefix:   "cf-logs-shipper:" + opts.BucketName + ":",
+		owner:    host + ":" + strconv.Itoa(os.Getpid()),
+		leaseTTL: opts.ClaimLeaseTTL,
+		doneTTL:  opts.ClaimDoneTTL,
+	}, nil
+}
+
+func (r *redisClaims) acquire(ctx context.Context, key string) (bool, error) {
+	n, err := acquireScript.Run(ctx, r.client, []string{r.prefix + "lease:" + key, r.prefix + "done:" + key}, r.owner, r.leaseTTL.Milliseconds()).Int()
+	return n == 1, err
+}
+
+func (r *redisClaims) extend(ctx context.Context, key string) (bool, error) {
+	n, err := extendScript.Run(ctx, r.client, []string{r.prefix + "lease:" + key}, r.owner, r.leaseTTL.Milliseconds()).Int()
+	return n == 1, err
+}
+
+func (r *redisClaims) release(ctx context.Context, key string) error {
+	return releaseScript.Run(ctx, r.client, []string{r.prefix + "lease:" + key}, r.owner).Err()
+}
+
+func (r *redisClaims) markProcessed(ctx context.Context, key string) error {
+	return r.client.Set(ctx, r.prefix+"done:"+key, r.owner, r.doneTTL).Err()
+}
+
+// claim takes the lease of a key before it is shipped and keeps extending it,
+// false if another replica holds it, already shipped it, or the store failed.
+// The returned function releases the lease, marking the key as processed if
+// it was shipped.
+func (s *Parser) claim(ctx context.Context, key string) (func(shipped bool), bool) {
+	if s.claims == nil {
+		return func(bool) {}, true
+	}
+	ok, err := s.claims.acquire(ctx, key)
+	if err != nil {
+		s.logger.Error("failed to lease file, skipping", "key", key, "err", err)
+		return nil, false
+	}
+	if !ok {
+		s.logger.Debug("file leased or already processed by another replica", "key", key)
+		return nil, false
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.opts.ClaimLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if ok, err := s.claims.extend(ctx, key); err != nil || !ok {
+					s.logger.Warn("failed to extend file lease, it may be shipped twice", "key", key, "err", err)
+				}
+			}
+		}
+	}()
+	return func(shipped bool) {
+		close(stop)
+		if shipped {
+			if err := s.claims.markProcessed(ctx, key); err != nil {
+				s.logger.Error("failed to mark file as processed", "key", key, "err", err)
+			}
+		}
+		if err := s.claims.release(ctx, key); err != nil {
+			s.logger.Error("failed to release file lease", "key", key, "err", err)
+		}
+	}, true
+}
@@ -0,0 +1,384 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/coordinator"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// leases are the keys handed out to workers by a coordinator. Failed and
+// expired leases are retried before new keys, up to a number of attempts.
+type leases struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	retries  int
+	prefix   string                        // of lease ids, unique per coordinator run
+	seq      int                           // of the last lease id
+	active   map[string]*coordinator.Lease // by id
+	retry    []string                      // keys to lease again before new ones
+	attempts map[string]int                // leases of keys not completed yet
+	expired  int64
+	retried  int64
+}
+
+// held are the leases a worker is shipping, by key
+type held struct {
+	mu     sync.Mutex
+	leases map[string]heldLease
+}
+
+type heldLease struct {
+	id     string
+	stop   chan struct{}      // stops the heartbeats
+	ctx    context.Context    // canceled once the lease is lost
+	cancel context.CancelFunc // of ctx
+}
+
+// errLeaseLost fails a file whose lease expired and may have been handed to
+// another worker
+var errLeaseLost = errors.New("lease lost")
+
+// setupRole validates the role and connects a worker to its coordinator
+func (s *Parser) setupRole(opts models.Options) error {
+	if opts.Role != "standalone" && opts.Role != "processor" && opts.NamespaceConcurrency > 0 {
+		return fmt.Errorf("namespace-concurrency is only supported by the standalone and processor roles")
+	}
+	switch opts.Role {
+	case "standalone", "scanner": // scanners need an SQS queue, see setupNotifications
+	case "processor":
+		if opts.IngestMode != "sqs" {
+			return fmt.Errorf("processors consume SQS, use the sqs ingest mode")
+		}
+	case "coordinator":
+		if opts.LeaseTTL <= 0 {
+			return fmt.Errorf("lease-ttl must be positive")
+		}
+		s.leases = &leases{
+			ttl:      opts.LeaseTTL,
+			retries:  opts.LeaseRetries,
+			prefix:   strconv.FormatInt(time.Now().UnixNano(), 36),
+			active:   make(map[string]*coordinator.Lease),
+			attempts: make(map[string]int),
+		}
+	case "worker":
+		worker, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get worker name: %w", err)
+		}
+		if s.remote, err = coordinator.Dial(opts.CoordinatorAddr, worker); err != nil {
+			return fmt.Errorf("failed to connect to coordinator %s: %w", opts.CoordinatorAddr, err)
+		}
+		s.held = &held{leases: make(map[string]heldLease)}
+	default:
+		return fmt.Errorf("unsupported role %q", opts.Role)
+	}
+	return nil
+}
+
+// Lease hands out a retried or the next queued key to a worker
+func (s *Parser) Lease(ctx context.Context, worker string) (*coordinator.Lease, time.Duration, bool) {
+	l := s.leases
+	l.mu.Lock()
+	s.expireLeases()
+	if len(l.retry) > 0 {
+		key := l.retry[0]
+		l.retry = l.retry[1:]
+		lease := s.grant(key, worker)
+		l.mu.Unlock()
+		return lease, l.ttl, true
+	}
+	l.mu.Unlock()
+
+	select {
+	case fn, ok := <-s.queue:
+		if !ok {
+			// failing or expiring leases may still be retried
+			l.mu.Lock()
+			outstanding := len(l.active) > 0
+			l.mu.Unlock()
+			if !outstanding {
+				return nil, 0, false
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			return nil, 0, true
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return s.grant(*fn, worker), l.ttl, true
+	case <-ctx.Done():
+		return nil, 0, true
+	}
+}
+
+// grant creates a lease of a key, caller must hold the lock
+func (s *Parser) grant(key, worker string) *coordinator.Lease {
+	l := s.leases
+	l.seq++
+	l.attempts[key]++
+	lease := &coordinator.Lease{
+		ID:      l.prefix + "-" + strconv.Itoa(l.seq),
+		Key:     key,
+		Worker:  worker,
+		Attempt: l.attempts[key],
+		Expires: time.Now().Add(l.ttl),
+	}
+	l.active[lease.ID] = lease
+	s.logger.Debug("leased file", "key", key, "worker", worker, "attempt", lease.Attempt)
+	granted := *lease
+	return &granted
+}
+
+// release removes an active lease of a worker, nil if it is unknown or
+// expired, caller must hold the lock
+func (l *leases) release(worker, id string) *coordinator.Lease {
+	lease, ok := l.active[id]
+	if !ok || lease.Worker != worker {
+		return nil
+	}
+	delete(l.active, id)
+	return lease
+}
+
+// Complete records a file shipped and deleted by a worker
+func (s *Parser) Complete(worker, id string) {
+	l := s.leases
+	l.mu.Lock()
+	lease := l.release(worker, id)
+	if lease != nil {
+		delete(l.attempts, lease.Key)
+		s.replays.done(lease.Key)
+	}
+	l.mu.Unlock()
+	if lease == nil {
+		return // expired and retried, or leased before a restart of the coordinator
+	}
+	s.pending.remove(lease.Key)
+	s.stats.filesOK.Add(1)
+	s.progress.Store(time.Now().UnixNano())
+}
+
+// Fail records a file a worker failed to ship, it is leased again
+func (s *Parser) Fail(worker, id, shipErr string) {
+	l := s.leases
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lease := l.release(worker, id)
+	if lease == nil {
+		return
+	}
+	s.logger.Error("worker failed to ship file", "key", lease.Key, "worker", worker, "attempt", lease.Attempt, "err", shipErr)
+	s.retryLease(lease.Key)
+}
+
+// Heartbeat extends the leases of a worker
+func (s *Parser) Heartbeat(worker string, ids []string) []string {
+	l := s.leases
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.expireLeases()
+	var lost []string
+	for _, id := range ids {
+		lease, ok := l.active[id]
+		if !ok || lease.Worker != worker {
+			lost = append(lost, id)
+			continue
+		}
+		lease.Expires = time.Now().Add(l.ttl)
+	}
+	return lost
+}
+
+// Leases returns the active leases sorted by key
+func (s *Parser) Leases() []coordinator.Lease {
+	l := s.leases
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]coordinator.Lease, 0, len(l.active))
+	for _, lease := range l.active {
+		list = append(list, *lease)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// expireLeases retries the keys of leases not extended in time, caller must
+// hold the lock
+func (s *Parser) expireLeases() {
+	l := s.leases
+	now := time.Now()
+	for id, lease := range l.active {
+		if now.Before(lease.Expires) {
+			continue
+		}
+		delete(l.active, id)
+		l.expired++
+		s.logger.Warn("lease expired", "key", lease.Key, "worker", lease.Worker, "attempt", lease.Attempt)
+		s.retryLease(lease.Key)
+	}
+}
+
+// retryLease queues a key to be leased again, or gives up after the maximum
+// number of attempts until a later scan lists it again, caller must hold the
+// lock
+func (s *Parser) retryLease(key string) {
+	l := s.leases
+	if l.attempts[key] > l.retries {
+		delete(l.attempts, key)
+		s.pending.remove(key)
+		s.stats.filesFailed.Add(1)
+		s.logger.Error("giving up on file after failed leases", "key", key, "attempts", l.retries+1)
+		s.alert("FileGivenUp", key, fmt.Sprintf("gave up on file after %d failed leases", l.retries+1), nil)
+		return
+	}
+	l.retried++
+	l.retry = append(l.retry, key)
+}
+
+// Drain blocks a coordinator until it was stopped, all queued keys were
+// leased and all leases were completed or given up
+func (s *Parser) Drain() {
+	for {
+		l := s.leases
+		l.mu.Lock()
+		s.expireLeases()
+		idle := len(l.active) == 0 && len(l.retry) == 0
+		l.mu.Unlock()
+		if s.stop.Load() && len(s.queue) == 0 && idle {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (l *leases) writeMetrics(w io.Writer) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(w, "cloudfront_logs_shipper_leased_files %d\n", len(l.active))
+	fmt.Fprintf(w, "cloudfront_logs_shipper_lease_retry_queue_length %d\n", len(l.retry))
+	fmt.Fprintf(w, "cloudfront_logs_shipper_leases_expired_total %d\n", l.expired)
+	fmt.Fprintf(w, "cloudfront_logs_shipper_leases_retried_total %d\n", l.retried)
+}
+
+// lease returns the next key leased from the coordinator of a worker and
+// keeps extending the lease until it is reported, or returns nil once the
+// coordinator hands out no more keys or the worker was stopped
+func (s *Parser) lease() *string {
+	for !s.stop.Load() {
+		lease, ttl, closed, err := s.remote.Lease(context.Background())
+		if err != nil {
+			s.logger.Warn("failed to lease file from coordinator, will retry", "err", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if closed {
+			return nil
+		}
+		if lease == nil {
+			continue
+		}
+		h := heldLease{id: lease.ID, stop: make(chan struct{})}
+		h.ctx, h.cancel = context.WithCancel(context.Background())
+		s.held.mu.Lock()
+		s.held.leases[lease.Key] = h
+		s.held.mu.Unlock()
+		if ttl > 0 {
+			go s.heartbeat(lease.Key, h, ttl)
+		}
+		return &lease.Key
+	}
+	return nil
+}
+
+// heartbeat extends a held lease every third of its time to live
+func (s *Parser) heartbeat(key string, h heldLease, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			lost, err := s.remote.Heartbeat(context.Background(), h.id)
+			if err != nil {
+				s.logger.Warn("failed to extend lease", "key", key, "err", err)
+				continue
+			}
+			if len(lost) > 0 {
+				// neither completed nor failed, the coordinator handed it
+				// out again
+				s.held.mu.Lock()
+				delete(s.held.leases, key)
+				s.held.mu.Unlock()
+				h.cancel()
+				s.logger.Warn("lease lost, shipping of the file stopped", "key", key)
+				return
+			}
+		}
+	}
+}
+
+// leaseContext returns the context of a file, canceled once its lease is lost
+func (s *Parser) leaseContext(ctx context.Context, key string) context.Context {
+	if s.remote == nil {
+		return ctx
+	}
+	s.held.mu.Lock()
+	defer s.held.mu.Unlock()
+	if h, ok := s.held.leases[key]; ok {
+		return h.ctx
+	}
+	return ctx
+}
+
+// report tells the coordinator of a worker about the outcome of a leased key,
+// and acknowledges the S3 notification of the key in sqs ingest mode
+func (s *Parser) report(key string, shipErr error) {
+	if shipErr != nil {
+		s.activity.emit("file_failed", key, 0, shipErr)
+	} else {
+		s.activity.emit("file_shipped", key, 0, nil)
+	}
+	s.settle(key, shipErr)
+}
+
+// settle completes the lease and the notification of a key done with,
+// shipped or not
+func (s *Parser) settle(key string, shipErr error) {
+	s.acknowledge(key, shipErr)
+	if s.remote == nil {
+		return
+	}
+	s.held.mu.Lock()
+	h, ok := s.held.leases[key]
+	delete(s.held.leases, key)
+	s.held.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(h.stop)
+	h.cancel()
+	var err error
+	if shipErr != nil {
+		err = s.remote.Fail(context.Background(), h.id, shipErr)
+	} else {
+		err = s.remote.Complete(context.Background(), h.id)
+	}
+	if err != nil {
+		s.logger.Error("failed to report file to coordinator", "key", key, "err", err)
+	}
+}
@@ -0,0 +1,48 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nugored/cf-logs-loki-uploader/loki"
+)
+
+// restoreCounters loads the shipped counters by tenant of a previous run
+func restoreCounters(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read counters file %s: %w", path, err)
+	}
+	var m map[string]loki.Shipped
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("failed to parse counters file %s: %w", path, err)
+	}
+	loki.RestoreShipped(m)
+	return nil
+}
+
+// SaveCounters persists the shipped counters by tenant to the counters file,
+// if configured, so they don't reset on restarts
+func (s *Parser) SaveCounters() error {
+	path := s.opts.CountersFile
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(loki.ShippedByTenant())
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// DeadLetterOutcome is the result of re-attempting a dead-lettered file
+type DeadLetterOutcome struct {
+	Key      string  `json:"key"`
+	Shipped  bool    `json:"shipped"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// RetryDeadLetter re-attempts every file below a dead-letter prefix with the
+// current configuration, one at a time. Files are labeled as their key
+// without the prefix and deleted once shipped, outcomes are passed to report
+// as they happen.
+func (s *Parser) RetryDeadLetter(ctx context.Context, prefix string, report func(DeadLetterOutcome)) error {
+	if prefix == "" || !strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("dead-letter prefix %q must end with /", prefix)
+	}
+	s.stripPrefix = prefix
+	paginator := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &s.opts.BucketName,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list prefix %q: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			if obj.Key == nil || obj.Size == nil || *obj.Size == 0 || strings.HasSuffix(*obj.Key, "/") {
+				continue
+			}
+			report(s.retryDeadLetter(ctx, *obj.Key))
+		}
+	}
+	return nil
+}
+
+// deadLetter moves a file below the dead-letter prefix, where scans skip it
+// and retry-deadletter re-attempts it from the lines already shipped. Backfill
+// and shadow modes keep it in place, not queued again.
+func (s *Parser) deadLetter(ctx context.Context, key string) error {
+	if s.backfill != nil {
+		s.backfill.done(key)
+		return nil
+	}
+	dst := s.opts.DeadLetterPrefix + key
+	if _, err := s.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     &s.opts.BucketName,
+		Key:        &dst,
+		CopySource: aws.String(s.opts.BucketName + "/" + url.PathEscape(key)),
+	}); err != nil {
+		return fmt.Errorf("failed to copy object to %s: %w", dst, err)
+	}
+	if err := s.deleteFile(ctx, key, nil); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	s.logger.Warn("moved file to the dead-letter prefix", "key", key, "to", dst)
+	s.activity.emit("file_deadlettered", key, 0, nil)
+	return s.offsets.move(key, dst)
+}
+
+func (s *Parser) retryDeadLetter(ctx context.Context, key string) DeadLetterOutcome {
+	start := time.Now()
+	outcome := DeadLetterOutcome{Key: key}
+	if !strings.Contains(strings.TrimPrefix(key, s.stripPrefix), "/") {
+		outcome.Error = "key has no namespace below the dead-letter prefix (prefix/namespace/...)"
+		return outcome
+	}
+	versionID, err := s.parseFile(ctx, key)
+	if err == nil && s.backfill == nil { // kept in backfill and shadow modes
+		if err = s.deleteFile(ctx, key, versionID); err != nil {
+			err = fmt.Errorf("failed to delete file: %w", err)
+		}
+	}
+	if err != nil {
+		s.stats.filesFailed.Add(1)
+		outcome.Error = err.Error()
+	} else {
+		outcome.Shipped = true
+		if !s.objectLock.kept(key) { // the checkpoint keeps tagged files as shipped
+			if err := s.offsets.delete(key); err != nil {
+				s.logger.Error("failed to update checkpoint", "key", key, "err", err)
+			}
+		}
+	}
+	outcome.Duration = time.Since(start).Seconds()
+	return outcome
+}
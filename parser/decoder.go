@@ -0,0 +1,130 @@
+package parser
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// Decoder opens an object as W3C log text, decompressing or converting it
+type Decoder func(r io.Reader) (io.ReadCloser, error)
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]Decoder{
+		"gzip": func(r io.Reader) (io.ReadCloser, error) {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+			}
+			return gz, nil
+		},
+		"zstd": func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+			}
+			return zr.IOReadCloser(), nil
+		},
+		"plain": func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		},
+	}
+	// decoder names by Content-Encoding, Content-Type and file extension,
+	// parquet has no built-in decoder, one can be added with RegisterDecoder
+	decoderEncodings = map[string]string{
+		"gzip":   "gzip",
+		"x-gzip": "gzip",
+		"zstd":   "zstd",
+	}
+	decoderTypes = map[string]string{
+		"application/gzip":               "gzip",
+		"application/x-gzip":             "gzip",
+		"application/zstd":               "zstd",
+		"application/vnd.apache.parquet": "parquet",
+		"application/x-parquet":          "parquet",
+		"application/json":               "json",
+		"application/x-ndjson":           "json",
+		"text/plain":                     "plain",
+	}
+	decoderExtensions = map[string]string{
+		".gz":      "gzip",
+		".zst":     "zstd",
+		".zstd":    "zstd",
+		".parquet": "parquet",
+		".log":     "plain",
+		".txt":     "plain",
+	}
+	// extensions of JSON logs, compressed or not, the json decoder detects
+	// the compression
+	jsonSuffixes = []string{".json", ".jsonl", ".ndjson", ".json.gz", ".jsonl.gz", ".ndjson.gz", ".json.zst"}
+)
+
+func validateInputFormat(opts models.Options) error {
+	switch opts.InputFormat {
+	case "auto", "w3c", "json", "parquet":
+		return nil
+	}
+	return fmt.Errorf("unsupported input format %q", opts.InputFormat)
+}
+
+// RegisterDecoder adds or replaces the decoder of a name, e.g. parquet,
+// usually from the init function of a package compiled in
+func RegisterDecoder(name string, d Decoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[name] = d
+}
+
+// decoderName picks the decoder of an object in an input format: json and
+// parquet force their decoder, w3c only decompresses, and auto also detects
+// JSON and Parquet logs. Compressed JSON logs are detected by their file
+// extension, others by their Content-Encoding, then Content-Type, then file
+// extension, gzip like CloudFront standard logs if none is known.
+func decoderName(format, key, contentType, contentEncoding string) string {
+	switch format {
+	case "json", "parquet", "function":
+		return format
+	case "auto":
+		for _, suffix := range jsonSuffixes {
+			if strings.HasSuffix(strings.ToLower(key), suffix) {
+				return "json"
+			}
+		}
+	}
+	allowed := func(name string) bool {
+		return format == "auto" || name != "json" && name != "parquet"
+	}
+	if name, ok := decoderEncodings[strings.ToLower(contentEncoding)]; ok {
+		return name
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if name, ok := decoderTypes[mediaType]; ok && allowed(name) {
+			return name
+		}
+	}
+	if name, ok := decoderExtensions[strings.ToLower(path.Ext(key))]; ok && allowed(name) {
+		return name
+	}
+	return "gzip"
+}
+
+// Decode opens an object of an input format (auto, w3c, json, parquet) as
+// W3C log text with the decoder picked by its metadata and key
+func Decode(format, key, contentType, contentEncoding string, r io.Reader) (io.ReadCloser, error) {
+	name := decoderName(format, key, contentType, contentEncoding)
+	decodersMu.RLock()
+	d, ok := decoders[name]
+	decodersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no %s decoder registered, it can be added with RegisterDecoder", name)
+	}
+	return d(r)
+}
@@ -0,0 +1,163 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxDeleteKeys is the most keys a DeleteObjects call takes
+const maxDeleteKeys = 1000
+
+// deleteBatch accumulates the deletes of shipped files into DeleteObjects
+// calls, sent in the background once full or a window after their first key.
+// Callers get the outcome of their key in a callback, the file is only
+// forgotten once deleted.
+type deleteBatch struct {
+	window  time.Duration
+	send    func(ctx context.Context, objects []types.ObjectIdentifier) (*s3.DeleteObjectsOutput, error)
+	mu      sync.Mutex
+	pending []*deleteRequest
+	timer   *time.Timer
+	sending sync.WaitGroup // batches being sent
+	calls   atomic.Int64   // DeleteObjects calls
+	keys    atomic.Int64   // keys deleted by them
+}
+
+type deleteRequest struct {
+	object types.ObjectIdentifier
+	done   func(error)
+}
+
+// newDeleteBatch returns nil without --delete-window, files are then deleted
+// one DeleteObject call each
+func (s *Parser) newDeleteBatch() *deleteBatch {
+	if s.opts.DeleteWindow <= 0 {
+		return nil
+	}
+	return &deleteBatch{
+		window: s.opts.DeleteWindow,
+		send: func(ctx context.Context, objects []types.ObjectIdentifier) (*s3.DeleteObjectsOutput, error) {
+			return s.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket: &s.opts.BucketName,
+				Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			})
+		},
+	}
+}
+
+// delete queues a key and returns, done is called with the outcome of the
+// key once its batch was sent
+func (d *deleteBatch) delete(key string, versionID *string, done func(error)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending = append(d.pending, &deleteRequest{
+		object: types.ObjectIdentifier{Key: &key, VersionId: versionID},
+		done:   done,
+	})
+	switch {
+	case len(d.pending) >= maxDeleteKeys:
+		d.background(d.take())
+	case len(d.pending) == 1:
+		d.timer = time.AfterFunc(d.window, d.expire)
+	}
+}
+
+// take returns the pending requests, caller must hold the lock
+func (d *deleteBatch) take() []*deleteRequest {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	batch := d.pending
+	d.pending = nil
+	return batch
+}
+
+// background sends a batch in its own goroutine, caller must hold the lock
+// so close waits for it
+func (d *deleteBatch) background(batch []*deleteRequest) {
+	if len(batch) == 0 {
+		return
+	}
+	d.sending.Add(1)
+	go func() {
+		defer d.sending.Done()
+		d.flush(batch)
+	}()
+}
+
+func (d *deleteBatch) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.background(d.take())
+}
+
+// close sends the pending deletes and waits for the batches being sent
+func (d *deleteBatch) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	batch := d.take()
+	d.mu.Unlock()
+	d.flush(batch)
+	d.sending.Wait()
+}
+
+// FlushDeletes sends the deletes still waiting for their window, before
+// exiting
+func (s *Parser) FlushDeletes() {
+	s.deletes.close()
+}
+
+// flush deletes the keys of a batch and answers each request with the error
+// of its key
+func (d *deleteBatch) flush(batch []*deleteRequest) {
+	if len(batch) == 0 {
+		return
+	}
+	objects := make([]types.ObjectIdentifier, len(batch))
+	for i, req := range batch {
+		objects[i] = req.object
+	}
+	d.calls.Add(1)
+	out, err := d.send(context.Background(), objects)
+	if err != nil {
+		for _, req := range batch {
+			req.done(fmt.Errorf("failed to delete objects: %w", err))
+		}
+		return
+	}
+	failed := make(map[string]error, len(out.Errors))
+	for _, e := range out.Errors {
+		failed[objectID(e.Key, e.VersionId)] = fmt.Errorf("%s: %s", aws.ToString(e.Code), aws.ToString(e.Message))
+	}
+	for _, req := range batch {
+		err := failed[objectID(req.object.Key, req.object.VersionId)]
+		if err == nil {
+			d.keys.Add(1)
+		}
+		req.done(err)
+	}
+}
+
+// objectID identifies a key and version in the errors of a batch
+func objectID(key, versionID *string) string {
+	return aws.ToString(key) + "\x00" + aws.ToString(versionID)
+}
+
+func (d *deleteBatch) writeMetrics(w io.Writer) {
+	if d == nil {
+		return
+	}
+	fmt.Fprintf(w, "cloudfront_logs_shipper_s3_delete_batches_total %d\n", d.calls.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_s3_batched_deletes_total %d\n", d.keys.Load())
+}
@@ -0,0 +1,118 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// dropList holds user agent and referrer substrings of lines to drop, loaded
+// from a URL or S3 object as {"user_agents": [...], "referrers": [...]}
+type dropList struct {
+	mu         sync.RWMutex
+	UserAgents []string `json:"user_agents"`
+	Referrers  []string `json:"referrers"`
+}
+
+// dropListClient fetches drop lists from HTTP URLs
+var dropListClient = &http.Client{Timeout: 30 * time.Second}
+
+// maxDropListSize is the size of the largest drop list loaded
+const maxDropListSize = 8 << 20
+
+// RefreshDropList reloads the drop list, the previous list is kept on error
+func (s *Parser) RefreshDropList(ctx context.Context) error {
+	if s.dropList == nil {
+		return nil
+	}
+	body, err := s.fetchDropList(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch drop list: %w", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxDropListSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to fetch drop list: %w", err)
+	}
+	if len(data) > maxDropListSize {
+		return fmt.Errorf("drop list exceeds %d bytes", maxDropListSize)
+	}
+	var list dropList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to decode drop list: %w", err)
+	}
+	s.dropList.mu.Lock()
+	defer s.dropList.mu.Unlock()
+	s.dropList.UserAgents = lower(list.UserAgents)
+	s.dropList.Referrers = lower(list.Referrers)
+	return nil
+}
+
+// fetchDropList opens the drop list from an s3://bucket/key or HTTP URL
+func (s *Parser) fetchDropList(ctx context.Context) (io.ReadCloser, error) {
+	u, err := url.Parse(s.opts.DropList)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "s3" {
+		key := strings.TrimPrefix(u.Path, "/")
+		obj, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &u.Host, Key: &key})
+		if err != nil {
+			return nil, err
+		}
+		return obj.Body, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.opts.DropList, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dropListClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func lower(values []string) []string {
+	for i, v := range values {
+		values[i] = strings.ToLower(v)
+	}
+	return values
+}
+
+// dropped reports whether the decoded user agent or referrer of the entry
+// contains a listed substring, case-insensitively
+func (d *dropList) dropped(entry models.LogEntry) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return matchAny(entry["cs(User-Agent)"], d.UserAgents) || matchAny(entry["cs(Referer)"], d.Referrers)
+}
+
+func matchAny(value string, substrings []string) bool {
+	if len(substrings) == 0 || value == "" || value == "-" {
+		return false
+	}
+	if v, err := url.PathUnescape(value); err == nil {
+		value = v // CloudFront URL-encodes spaces and other characters
+	}
+	value = strings.ToLower(value)
+	for _, sub := range substrings {
+		if strings.Contains(value, sub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// deadLetterRoute is the route of lines dead-lettered as their edge location
+// is unknown to continent or country routes, with --unknown-edge=deadletter
+const deadLetterRoute = -1
+
+// errUnknownEdge fails a dead-lettered file retried with lines of unknown
+// edges, which would be dead-lettered again
+var errUnknownEdge = errors.New("unknown edge location")
+
+// edgeContinents maps the airport code prefix of CloudFront edge locations
+// (x-edge-location, e.g. FRA56-P1) to a continent
+var edgeContinents = map[string]string{
+	// Europe
+	"AMS": "EU", "ARN": "EU", "ATH": "EU", "BCN": "EU", "BER": "EU", "BRU": "EU", "BTS": "EU",
+	"BUD": "EU", "CDG": "EU", "CPH": "EU", "DUB": "EU", "DUS": "EU", "FCO": "EU", "FRA": "EU",
+	"HAM": "EU", "HEL": "EU", "IST": "EU", "KBP": "EU", "LHR": "EU", "LIS": "EU", "LJU": "EU",
+	"LYS": "EU", "MAD": "EU", "MAN": "EU", "MRS": "EU", "MUC": "EU", "MXP": "EU", "OSL": "EU",
+	"OTP": "EU", "PMO": "EU", "PRG": "EU", "SOF": "EU", "TXL": "EU", "VIE": "EU", "WAW": "EU",
+	"ZAG": "EU", "ZRH": "EU",
+	// North America
+	"ATL": "NA", "BNA": "NA", "BOS": "NA", "CLT": "NA", "CMH": "NA", "DEN": "NA", "DFW": "NA",
+	"DTW": "NA", "EWR": "NA", "HIO": "NA", "IAD": "NA", "IAH": "NA", "IND": "NA", "JAX": "NA",
+	"JFK": "NA", "LAX": "NA", "MCI": "NA", "MEX": "NA", "MIA": "NA", "MSP": "NA", "ORD": "NA",
+	"PHL": "NA", "PHX": "NA", "PIT": "NA", "QRO": "NA", "SEA": "NA", "SFO": "NA", "SLC": "NA",
+	"YTO": "NA", "YUL": "NA", "YVR": "NA",
+	// South America
+	"BOG": "SA", "EZE": "SA", "FOR": "SA", "GIG": "SA", "GRU": "SA", "LIM": "SA", "POA": "SA",
+	"SCL": "SA",
+	// Asia
+	"BKK": "AS", "BLR": "AS", "BOM": "AS", "CCU": "AS", "CGK": "AS", "DEL": "AS", "HAN": "AS",
+	"HKG": "AS", "HYD": "AS", "ICN": "AS", "KIX": "AS", "KUL": "AS", "MAA": "AS", "MNL": "AS",
+	"NRT": "AS", "PEK": "AS", "PVG": "AS", "SGN": "AS", "SIN": "AS", "SZX": "AS", "TPE": "AS",
+	"ZHY": "AS",
+	// Middle East
+	"BAH": "ME", "DXB": "ME", "FJR": "ME", "TLV": "ME",
+	// Africa
+	"CAI": "AF", "CPT": "AF", "JNB": "AF", "LOS": "AF", "NBO": "AF",
+	// Oceania
+	"AKL": "OC", "BNE": "OC", "MEL": "OC", "PER": "OC", "SYD": "OC",
+}
+
+// edgeCountries maps the airport code prefix of CloudFront edge locations to
+// the ISO 3166 country code of the edge, a proxy for the client country
+var edgeCountries = map[string]string{
+	// Europe
+	"AMS": "NL", "ARN": "SE", "ATH": "GR", "BCN": "ES", "BER": "DE", "BRU": "BE", "BTS": "SK",
+	"BUD": "HU", "CDG": "FR", "CPH": "DK", "DUB": "IE", "DUS": "DE", "FCO": "IT", "FRA": "DE",
+	"HAM": "DE", "HEL": "FI", "IST": "TR", "KBP": "UA", "LHR": "GB", "LIS": "PT", "LJU": "SI",
+	"LYS": "FR", "MAD": "ES", "MAN": "GB", "MRS": "FR", "MUC": "DE", "MXP": "IT", "OSL": "NO",
+	"OTP": "RO", "PMO": "IT", "PRG": "CZ", "SOF": "BG", "TXL": "DE", "VIE": "AT", "WAW": "PL",
+	"ZAG": "HR", "ZRH": "CH",
+	// North America
+	"ATL": "US", "BNA": "US", "BOS": "US", "CLT": "US", "CMH": "US", "DEN": "US", "DFW": "US",
+	"DTW": "US", "EWR": "US", "HIO": "US", "IAD": "US", "IAH": "US", "IND": "US", "JAX": "US",
+	"JFK": "US", "LAX": "US", "MCI": "US", "MEX": "MX", "MIA": "US", "MSP": "US", "ORD": "US",
+	"PHL": "US", "PHX": "US", "PIT": "US", "QRO": "MX", "SEA": "US", "SFO": "US", "SLC": "US",
+	"YTO": "CA", "YUL": "CA", "YVR": "CA",
+	// South America
+	"BOG": "CO", "EZE": "AR", "FOR": "BR", "GIG": "BR", "GRU": "BR", "LIM": "PE", "POA": "BR",
+	"SCL": "CL",
+	// Asia
+	"BKK": "TH", "BLR": "IN", "BOM": "IN", "CCU": "IN", "CGK": "ID", "DEL": "IN", "HAN": "VN",
+	"HKG": "HK", "HYD": "IN", "ICN": "KR", "KIX": "JP", "KUL": "MY", "MAA": "IN", "MNL": "PH",
+	"NRT": "JP", "PEK": "CN", "PVG": "CN", "SGN": "VN", "SIN": "SG", "SZX": "CN", "TPE": "TW",
+	"ZHY": "CN",
+	// Middle East
+	"BAH": "BH", "DXB": "AE", "FJR": "AE", "TLV": "IL",
+	// Africa
+	"CAI": "EG", "CPT": "ZA", "JNB": "ZA", "LOS": "NG", "NBO": "KE",
+	// Oceania
+	"AKL": "NZ", "BNE": "AU", "MEL": "AU", "PER": "AU", "SYD": "AU",
+}
+
+// edgeContinent returns the continent of an edge location or "" if unknown
+func edgeContinent(location string) string {
+	if len(location) < 3 {
+		return ""
+	}
+	return edgeContinents[location[:3]]
+}
+
+// edgeCountry returns the country of an edge location or "" if unknown
+func edgeCountry(location string) string {
+	if len(location) < 3 {
+		return ""
+	}
+	return edgeCountries[location[:3]]
+}
+
+// fieldValue returns a field of the entry, supporting the derived continent
+// and country fields computed from the edge location
+func fieldValue(entry models.LogEntry, name string) string {
+	if v, ok := entry[name]; ok {
+		return v
+	}
+	switch name {
+	case "continent":
+		return edgeContinent(entry["x-edge-location"])
+	case "country":
+		return edgeCountry(entry["x-edge-location"])
+	}
+	return ""
+}
+
+// route returns the index of the first matching route plus one, or 0 to ship
+// the entry to the default Loki. An entry of an unknown edge matching no route
+// while continent or country routes are set goes by --unknown-edge.
+func (s *Parser) route(entry models.LogEntry) int {
+	unknown := ""
+	for i, r := range s.opts.Routes {
+		v := fieldValue(entry, r.Field)
+		if v == r.Value {
+			return i + 1
+		}
+		if v == "" && (r.Field == "continent" || r.Field == "country") {
+			unknown = r.Field
+		}
+	}
+	if unknown == "" {
+		return 0
+	}
+	location := entry["x-edge-location"]
+	s.unknownEdges.Add(1)
+	if code, _, _ := strings.Cut(location, "-"); len(code) >= 3 {
+		location = code[:3]
+	}
+	if _, warned := s.warnedEdges.LoadOrStore(location, true); !warned {
+		s.logger.Warn("edge location of unknown "+unknown, "location", location, "action", s.opts.UnknownEdge)
+	}
+	switch s.opts.UnknownEdge {
+	case "route":
+		for i, r := range s.opts.Routes {
+			if r.Field == unknown && r.Value == "unknown" {
+				return i + 1
+			}
+		}
+	case "deadletter":
+		return deadLetterRoute
+	}
+	return 0
+}
+
+// deadLetterUnrouted writes the lines of unknown edges of a file below the
+// dead-letter prefix as a file of its header, retried once the edge tables
+// know them or --unknown-edge changed
+func (s *Parser) deadLetterUnrouted(ctx context.Context, fn string, header, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	if s.stripPrefix != "" && strings.HasPrefix(fn, s.stripPrefix) {
+		return fmt.Errorf("%w: %d lines not routed with --unknown-edge=deadletter", errUnknownEdge, len(lines))
+	}
+	dst := s.opts.DeadLetterPrefix + fn + ".unrouted"
+	if err := s.putLines(ctx, dst, header, lines); err != nil {
+		return fmt.Errorf("failed to dead-letter lines of unknown edges to %s: %w", dst, err)
+	}
+	s.logger.Warn("moved lines of unknown edges to the dead-letter prefix", "key", fn, "lines", len(lines), "to", dst)
+	return nil
+}
+
+// dropCountry reports whether the entry is served from a country whose
+// traffic is dropped, routes are matched before so a route can still ship it
+// to another tenant
+func (s *Parser) dropCountry(entry models.LogEntry, route int) bool {
+	if route > 0 || len(s.opts.DropCountries) == 0 {
+		return false
+	}
+	return slices.Contains(s.opts.DropCountries, fieldValue(entry, "country"))
+}
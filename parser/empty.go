@@ -0,0 +1,62 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// tagKey is the key of the S3 object tags of files kept in the bucket
+const tagKey = "cloudfront-logs-shipper"
+
+// emptyTag is the S3 object tag of empty files with --empty-files=tag
+var emptyTag = types.Tag{Key: aws.String(tagKey), Value: aws.String("empty")}
+
+// emptyFiles remembers the files without data lines kept in the bucket, so
+// later scans don't queue them again
+type emptyFiles struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func (e *emptyFiles) keep(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.keys[key] = true
+}
+
+func (e *emptyFiles) kept(key string) bool {
+	if e == nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.keys[key]
+}
+
+// emptyFile handles a file with only directives, or no header, by the empty
+// files action instead of pushing it: delete, keep or tag and keep it
+func (s *Parser) emptyFile(ctx context.Context, fn string, lf logFile, versionID *string) {
+	s.emptyCount.Add(1)
+	s.stats.filesSkipped.Add(1)
+	s.logger.Info("file has no data lines", "key", fn, "distribution", lf.Distribution, "action", s.opts.EmptyFiles)
+	if s.empties == nil {
+		return // deleted
+	}
+	s.empties.keep(fn)
+	if s.opts.EmptyFiles != "tag" {
+		return
+	}
+	if _, err := s.s3Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:    &s.opts.BucketName,
+		Key:       &fn,
+		VersionId: versionID,
+		Tagging:   &types.Tagging{TagSet: []types.Tag{emptyTag}},
+	}); err != nil {
+		s.logger.Warn("failed to tag empty file", "key", fn, "err", fmt.Errorf("failed to put object tagging: %w", err))
+	}
+}
@@ -0,0 +1,190 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// encoder appends a log entry to dst, keys in order are written first
+type encoder func(dst []byte, entry models.LogEntry, order []string) []byte
+
+// encoders by output format
+var encoders = map[string]encoder{
+	"json":   appendJSON,
+	"logfmt": appendLogfmt,
+}
+
+// newEncoder returns the encoder of the output format, nil for raw lines
+func newEncoder(opts models.Options) (encoder, error) {
+	if opts.Format == "raw" {
+		return nil, nil
+	}
+	encode, ok := encoders[opts.Format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format %q", opts.Format)
+	}
+	if opts.Format == "json" {
+		if encode, ok = jsonEncoder(opts.KeyStyle); !ok {
+			return nil, fmt.Errorf("unsupported key style %q", opts.KeyStyle)
+		}
+	}
+	return encode, nil
+}
+
+// fieldOrder returns the configured fields followed by the remaining header
+// fields, so identical requests produce identical lines compressing well
+func fieldOrder(configured, header []string) []string {
+	if len(configured) == 0 {
+		return header
+	}
+	order := make([]string, 0, len(configured)+len(header))
+	seen := make(map[string]bool, len(configured))
+	for _, f := range configured {
+		if !seen[f] {
+			seen[f] = true
+			order = append(order, f)
+		}
+	}
+	for _, f := range header {
+		if !seen[f] {
+			order = append(order, f)
+		}
+	}
+	return order
+}
+
+// appendRaw appends a W3C line rebuilt from the prepared entry, prefixed with the ISO 8601
+// request timestamp from the date and time fields when prefix is set
+func appendRaw(dst []byte, line string, entry models.LogEntry, prefix bool) []byte {
+	if date, tm := entry["date"], entry["time"]; prefix && date != "" && tm != "" {
+		dst = append(dst, date...)
+		dst = append(dst, 'T')
+		dst = append(dst, tm...)
+		dst = append(dst, "Z "...)
+	}
+	return append(dst, line...)
+}
+
+// appendJSON encodes the entry as a JSON object into dst, writing the keys in
+// the given order first (usually the header fields) and any others sorted
+func appendJSON(dst []byte, entry models.LogEntry, order []string) []byte {
+	dst = append(dst, '{')
+	dst = appendFields(dst, entry, order, appendJSONField)
+	return append(dst, '}')
+}
+
+// appendLogfmt encodes the entry as key=value pairs, quoting values as needed
+func appendLogfmt(dst []byte, entry models.LogEntry, order []string) []byte {
+	return appendFields(dst, entry, order, appendLogfmtField)
+}
+
+func appendFields(dst []byte, entry models.LogEntry, order []string, field func([]byte, int, string, string) []byte) []byte {
+	written := 0
+	for _, k := range order {
+		v, ok := entry[k]
+		if !ok {
+			continue
+		}
+		dst = field(dst, written, k, v)
+		written++
+	}
+	if written < len(entry) {
+		known := make(map[string]bool, len(order))
+		for _, k := range order {
+			known[k] = true
+		}
+		rest := make([]string, 0, len(entry)-written)
+		for k := range entry {
+			if !known[k] {
+				rest = append(rest, k)
+			}
+		}
+		sort.Strings(rest)
+		for _, k := range rest {
+			dst = field(dst, written, k, entry[k])
+			written++
+		}
+	}
+	return dst
+}
+
+func appendJSONField(dst []byte, i int, k, v string) []byte {
+	if i > 0 {
+		dst = append(dst, ',')
+	}
+	dst = appendJSONString(dst, k)
+	dst = append(dst, ':')
+	return appendJSONString(dst, v)
+}
+
+func appendLogfmtField(dst []byte, i int, k, v string) []byte {
+	if i > 0 {
+		dst = append(dst, ' ')
+	}
+	dst = append(dst, k...)
+	dst = append(dst, '=')
+	if !needsQuoting(v) {
+		return append(dst, v...)
+	}
+	return appendJSONString(dst, v)
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c == '=' || c == '"' || c == '\\' || c >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// appendJSONString writes s as a quoted JSON string, replacing invalid UTF-8
+// like encoding/json does
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `�`...)
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
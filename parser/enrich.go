@@ -0,0 +1,63 @@
+package parser
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// Enricher adds or changes fields of an entry, e.g. from an internal asset or
+// customer lookup. Enrichers run after the built-in transforms, an error is
+// counted and logged and the entry is shipped as is.
+type Enricher interface {
+	Enrich(entry models.LogEntry) error
+}
+
+// EnricherFunc adapts a function to an Enricher
+type EnricherFunc func(entry models.LogEntry) error
+
+func (f EnricherFunc) Enrich(entry models.LogEntry) error {
+	return f(entry)
+}
+
+var (
+	enrichersMu sync.Mutex
+	enrichers   []namedEnricher
+)
+
+type namedEnricher struct {
+	name string
+	Enricher
+}
+
+// RegisterEnricher adds an enricher run for every entry, usually from the
+// init function of a package compiled in. Enrichers run in registration order,
+// registering a name twice panics.
+func RegisterEnricher(name string, e Enricher) {
+	enrichersMu.Lock()
+	defer enrichersMu.Unlock()
+	for _, r := range enrichers {
+		if r.name == name {
+			panic(fmt.Sprintf("enricher %q registered twice", name))
+		}
+	}
+	enrichers = append(enrichers, namedEnricher{name: name, Enricher: e})
+}
+
+// registeredEnrichers returns the enrichers registered so far
+func registeredEnrichers() []namedEnricher {
+	enrichersMu.Lock()
+	defer enrichersMu.Unlock()
+	return append([]namedEnricher(nil), enrichers...)
+}
+
+// enrich runs the registered enrichers on the entry
+func (s *Parser) enrich(entry models.LogEntry) {
+	for _, e := range s.enrichers {
+		if err := e.Enrich(entry); err != nil {
+			s.enrichErrors.Add(1)
+			s.logger.Debug("enrichment failed", "enricher", e.name, "err", err)
+		}
+	}
+}
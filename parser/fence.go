@@ -0,0 +1,206 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// errFenceLost fails the files of an instance which lost the fence, they are
+// shipped by the instance holding it
+var errFenceLost = errors.New("fence held by another instance")
+
+// fence is a lease object in the bucket held by one instance at a time, so an
+// accidental second deployment does not ship files twice or race deletes.
+// The instance holding it rewrites it as heartbeat, it is taken over once
+// the heartbeat is older than the time to live.
+type fence struct {
+	key  string
+	ttl  time.Duration
+	id   string
+	held atomic.Bool
+}
+
+type fenceRecord struct {
+	Instance  string    `json:"instance"`
+	Host      string    `json:"host"`
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+func newFence(opts models.Options) (*fence, error) {
+	if opts.FenceKey == "" || opts.Role == "worker" {
+		return nil, nil // workers lease files from their coordinator
+	}
+	switch opts.FenceMode {
+	case "refuse", "standby":
+	default:
+		return nil, fmt.Errorf("unsupported fence mode %q", opts.FenceMode)
+	}
+	if opts.FenceTTL <= 0 {
+		return nil, fmt.Errorf("fence-ttl must be positive")
+	}
+	host, _ := os.Hostname()
+	return &fence{
+		key: opts.FenceKey,
+		ttl: opts.FenceTTL,
+		id:  host + "-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+	}, nil
+}
+
+// Fenced reports whether this instance may list and ship files, it holds the
+// fence or no fence is configured
+func (s *Parser) Fenced() bool {
+	return s.fence == nil || s.fence.held.Load()
+}
+
+// RenewFence acquires the fence if it is free or expired, or extends it if
+// held, and returns whether this instance holds it. The fence is written
+// conditionally on the version read, an instance writing it concurrently
+// loses.
+func (s *Parser) RenewFence(ctx context.Context) (bool, error) {
+	f := s.fence
+	if f == nil {
+		return true, nil
+	}
+	holder, etag, err := s.readFence(ctx)
+	if err != nil {
+		return f.held.Load(), err
+	}
+	if holder != nil && holder.Instance != f.id && time.Since(holder.Heartbeat) < f.ttl {
+		s.lostFence(holder)
+		return false, nil
+	}
+	won, err := s.writeFence(ctx, etag)
+	if err != nil {
+		return f.held.Load(), err
+	}
+	if !won {
+		s.lostFence(nil)
+		return false, nil
+	}
+	if !f.held.Swap(true) {
+		s.logger.Info("acquired fence", "key", f.key, "instance", f.id)
+	}
+	return true, nil
+}
+
+// lostFence records the fence as held by another instance
+func (s *Parser) lostFence(holder *fenceRecord) {
+	if !s.fence.held.Swap(false) {
+		return
+	}
+	if holder == nil {
+		s.logger.Error("fence taken over by another instance", "key", s.fence.key)
+	} else {
+		s.logger.Error("fence taken over by another instance", "key", s.fence.key, "instance", holder.Instance, "host", holder.Host)
+	}
+	s.dropQueued()
+}
+
+// dropQueued hands the queued files back once the fence is lost, files being
+// shipped are left to the workers
+func (s *Parser) dropQueued() {
+	for {
+		select {
+		case fn, ok := <-s.queue:
+			if !ok || fn == nil {
+				return
+			}
+			s.unfence(*fn)
+		default:
+			return
+		}
+	}
+}
+
+// unfence hands a file back to the fence holder without shipping or deleting
+// it: its notification is released and the holder lists it again
+func (s *Parser) unfence(key string) {
+	s.replays.forget(key)
+	s.pending.remove(key)
+	s.settle(key, errFenceLost)
+}
+
+// ReleaseFence deletes the fence if this instance holds it, so a replacement
+// does not wait for it to expire
+func (s *Parser) ReleaseFence(ctx context.Context) error {
+	f := s.fence
+	if f == nil || !f.held.Swap(false) {
+		return nil
+	}
+	holder, _, err := s.readFence(ctx)
+	if err != nil || holder == nil || holder.Instance != f.id {
+		return err
+	}
+	_, err = s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &s.opts.BucketName, Key: &f.key})
+	return err
+}
+
+// readFence returns the current holder of the fence and the etag of its
+// version, nil if there is none
+func (s *Parser) readFence(ctx context.Context) (*fenceRecord, *string, error) {
+	obj, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &s.opts.BucketName, Key: &s.fence.key})
+	if err != nil {
+		if strings.Contains(err.Error(), "NoSuchKey") {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to read fence %s: %w", s.fence.key, err)
+	}
+	defer obj.Body.Close()
+	var holder fenceRecord
+	if err := json.NewDecoder(obj.Body).Decode(&holder); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse fence %s: %w", s.fence.key, err)
+	}
+	return &holder, obj.ETag, nil
+}
+
+// writeFence writes the fence if it is still the version of etag, or does
+// not exist without etag, and reports whether it was written
+func (s *Parser) writeFence(ctx context.Context, etag *string) (bool, error) {
+	host, _ := os.Hostname()
+	data, err := json.Marshal(fenceRecord{Instance: s.fence.id, Host: host, Heartbeat: time.Now()})
+	if err != nil {
+		return false, err
+	}
+	input := &s3.PutObjectInput{
+		Bucket: &s.opts.BucketName,
+		Key:    &s.fence.key,
+		Body:   bytes.NewReader(data),
+	}
+	if etag != nil {
+		input.IfMatch = etag
+	} else {
+		input.IfNoneMatch = aws.String("*")
+	}
+	_, err = s.s3Client.PutObject(ctx, input)
+	if err != nil {
+		if strings.Contains(err.Error(), "PreconditionFailed") || strings.Contains(err.Error(), "ConditionalRequestConflict") {
+			return false, nil // written by another instance since it was read
+		}
+		return false, fmt.Errorf("failed to write fence %s: %w", s.fence.key, err)
+	}
+	return true, nil
+}
+
+func (f *fence) writeMetrics(w io.Writer) {
+	if f == nil {
+		return
+	}
+	held := 0
+	if f.held.Load() {
+		held = 1
+	}
+	fmt.Fprintf(w, "cloudfront_logs_shipper_fence_held %d\n", held)
+}
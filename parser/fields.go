@@ -0,0 +1,77 @@
+package parser
+
+import (
+	"slices"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// namespaceTenant returns the Loki tenant of a namespace, empty for the
+// default tenant, a policy tenant still takes precedence
+func (s *Parser) namespaceTenant(namespace string) string {
+	if tenant, ok := s.opts.NamespaceTenants[namespace]; ok {
+		return tenant
+	}
+	if s.opts.TenantPerNamespace {
+		return namespace
+	}
+	return ""
+}
+
+// baseLabels keeps the configured labels derived from the S3 key, all of
+// them if none is configured as a stream needs at least one label
+func (s *Parser) baseLabels(labels map[string]string) {
+	if len(s.opts.BaseLabels) == 0 {
+		return
+	}
+	for name := range labels {
+		if !slices.Contains(s.opts.BaseLabels, name) {
+			delete(labels, name)
+		}
+	}
+}
+
+// fieldLabels returns the fields promoted to stream labels, empty values
+// are not promoted
+func (s *Parser) fieldLabels(entry models.LogEntry) map[string]string {
+	var labels map[string]string
+	for _, f := range s.opts.LabelFields {
+		v := entry[f]
+		if v == "" || v == "-" {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(s.opts.LabelFields))
+		}
+		labels[snakeKey(f)] = v
+	}
+	return labels
+}
+
+// fieldMetadata adds the fields attached as structured metadata
+func (s *Parser) fieldMetadata(entry models.LogEntry, metadata map[string]string) map[string]string {
+	for _, f := range s.opts.MetadataFields {
+		v, ok := entry[f]
+		if !ok {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string, len(s.opts.MetadataFields))
+		}
+		metadata[snakeKey(f)] = v
+	}
+	return metadata
+}
+
+// dropFields removes the dropped fields, and those of the namespace policy,
+// from the entry
+func (s *Parser) dropFields(entry models.LogEntry, policy *policy) {
+	for _, f := range s.opts.DropFields {
+		delete(entry, f)
+	}
+	if policy != nil {
+		for _, f := range policy.drop {
+			delete(entry, f)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// fieldUsage tracks the fields of a file, a field is populated once a line
+// has a value for it, like cs(Cookie) with cookie logging enabled
+type fieldUsage struct {
+	populated map[string]bool
+	empty     []string // fields of the headers without a value yet
+}
+
+func newFieldUsage() *fieldUsage {
+	return &fieldUsage{populated: make(map[string]bool)}
+}
+
+// header adds the fields of a header, concatenated files may have several
+func (u *fieldUsage) header(fields []string) {
+	for _, f := range fields {
+		if _, ok := u.populated[f]; !ok {
+			u.populated[f] = false
+			u.empty = append(u.empty, f)
+		}
+	}
+}
+
+// add marks the fields a line has a value for, only fields still empty are
+// looked up
+func (u *fieldUsage) add(entry models.LogEntry) {
+	for i := 0; i < len(u.empty); {
+		if v, ok := entry[u.empty[i]]; ok && v != "-" && v != "" {
+			u.populated[u.empty[i]] = true
+			u.empty = slices.Delete(u.empty, i, i+1)
+			continue
+		}
+		i++
+	}
+}
+
+// fieldFiles counts the files shipped by field, for tracking which optional
+// fields distributions log
+type fieldFiles struct {
+	mu        sync.Mutex
+	present   map[string]int64 // files whose header had the field
+	populated map[string]int64 // files with a value for the field
+}
+
+func newFieldFiles() *fieldFiles {
+	return &fieldFiles{present: make(map[string]int64), populated: make(map[string]int64)}
+}
+
+func (f *fieldFiles) record(u *fieldUsage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for field, populated := range u.populated {
+		f.present[field]++
+		if populated {
+			f.populated[field]++
+		}
+	}
+}
+
+func (f *fieldFiles) writeMetrics(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fields := make([]string, 0, len(f.present))
+	for field := range f.present {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	for _, field := range fields {
+		fmt.Fprintf(w, "cloudfront_logs_shipper_field_files_total{field=%q,state=\"present\"} %d\n", field, f.present[field])
+		fmt.Fprintf(w, "cloudfront_logs_shipper_field_files_total{field=%q,state=\"populated\"} %d\n", field, f.populated[field])
+	}
+}
@@ -0,0 +1,33 @@
+package parser
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// logFile is the metadata encoded in a standard CloudFront log file name
+// (distribution-id.YYYY-MM-DD-HH.unique-id.gz)
+type logFile struct {
+	Distribution string
+	Hour         time.Time // start of the delivery hour, UTC
+	ID           string
+}
+
+// parseLogFileName extracts metadata from the file name of a key, ok is false
+// for names not following the standard pattern
+func parseLogFileName(key string) (logFile, bool) {
+	parts := strings.Split(path.Base(key), ".")
+	if len(parts) < 3 || parts[0] == "" {
+		return logFile{}, false
+	}
+	hour, err := time.Parse("2006-01-02-15", parts[1])
+	if err != nil {
+		return logFile{}, false
+	}
+	return logFile{
+		Distribution: parts[0],
+		Hour:         hour,
+		ID:           parts[2],
+	}, true
+}
@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"encoding/json"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/loki"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// fileSummary aggregates the lines of a file for its summary entry
+type fileSummary struct {
+	lines        int
+	clientErrors int // 4xx
+	errors       int // 5xx
+	timeTaken    []float64
+}
+
+// newFileSummary returns the aggregates of a file, nil without
+// --file-summary
+func (s *Parser) newFileSummary() *fileSummary {
+	if !s.opts.FileSummary {
+		return nil
+	}
+	return &fileSummary{}
+}
+
+// add counts a data line, whether it is shipped or dropped
+func (f *fileSummary) add(entry models.LogEntry) {
+	if f == nil {
+		return
+	}
+	f.lines++
+	switch status := entry["sc-status"]; {
+	case len(status) == 3 && status[0] == '4':
+		f.clientErrors++
+	case len(status) == 3 && status[0] == '5':
+		f.errors++
+	}
+	if v, err := strconv.ParseFloat(entry["time-taken"], 64); err == nil {
+		f.timeTaken = append(f.timeTaken, v)
+	}
+}
+
+// shipSummary pushes the summary of a shipped file as a single entry of the
+// file's stream labels with stream="summary", a failure only loses the
+// summary
+func (s *Parser) shipSummary(fn, etag string, f *fileSummary, skip int, labels map[string]string, opts models.Options) {
+	if f == nil {
+		return
+	}
+	summary := struct {
+		Key          string  `json:"key"`
+		Lines        int     `json:"lines"`
+		ClientErrors int     `json:"client_errors"`
+		Errors       int     `json:"errors"`
+		TimeTakenP95 float64 `json:"time_taken_p95"`
+		ResumedAfter int     `json:"resumed_after,omitempty"` // lines shipped by an earlier attempt, not counted
+	}{Key: fn, Lines: f.lines, ClientErrors: f.clientErrors, Errors: f.errors, ResumedAfter: skip}
+	if len(f.timeTaken) > 0 {
+		slices.Sort(f.timeTaken)
+		summary.TimeTakenP95 = f.timeTaken[int(math.Ceil(0.95*float64(len(f.timeTaken))))-1]
+	}
+	line, err := json.Marshal(summary)
+	if err != nil {
+		return
+	}
+
+	labels = maps.Clone(labels)
+	labels["stream"] = "summary"
+	b := loki.NewBatch(labels, opts, s.logger)
+	b.SetSource(fn+"#summary", etag, skip)
+	defer b.Close()
+	err = b.Add(time.Now(), string(line))
+	if err == nil {
+		err = b.Flush()
+	}
+	if err != nil {
+		s.summaryFails.Add(1)
+		s.logger.Error("failed to ship file summary", "key", fn, "err", err)
+	}
+}
@@ -0,0 +1,145 @@
+package parser
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// function log lines are converted to W3C lines with these fields, so they
+// correlate with request logs by x-edge-request-id
+const functionLogFields = "#Fields: date time x-edge-request-id distribution message\n"
+
+var (
+	// CloudFront request ids and distribution ids logged by functions
+	edgeRequestIDPattern   = regexp.MustCompile(`[A-Za-z0-9_-]{50,60}==`)
+	distributionIDPattern  = regexp.MustCompile(`(?i)distribution_?id["':= ]+(E[A-Z0-9]{11,14})\b`)
+	lambdaRequestIDPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+)
+
+func init() {
+	decoders["function"] = decodeFunctionLog
+}
+
+// functionLog reports whether a key is a log of Lambda@Edge or CloudFront
+// Functions, e.g. exported from CloudWatch Logs
+func (s *Parser) functionLog(key string) bool {
+	for _, prefix := range s.opts.FunctionLogPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeFunctionLog converts Lambda@Edge and CloudFront Functions log lines
+// to W3C lines. CloudFront Functions prefix lines with the request id and log
+// the distribution on START, Lambda@Edge lines are correlated by the request
+// and distribution ids the function logs, following lines of the invocation
+// inherit them.
+func decodeFunctionLog(r io.Reader) (io.ReadCloser, error) {
+	src, err := decompressed(r)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		pw.CloseWithError(writeFunctionLog(pw, src))
+	}()
+	return pr, nil
+}
+
+// invocation holds the correlation fields of a function invocation
+type invocation struct {
+	requestID    string
+	distribution string
+}
+
+func writeFunctionLog(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("#Version: 1.0\n" + functionLogFields)
+	invocations := make(map[string]*invocation) // by CloudFront or Lambda request id
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		ts, msg := splitTimestamp(line)
+
+		var key string // of the invocation, forgotten once it ended
+		var ended bool
+		if id := lambdaRequestIDPattern.FindString(msg); id != "" {
+			// Lambda@Edge, the CloudFront ids are only known if logged
+			key, ended = id, strings.HasPrefix(msg, "REPORT ")
+		} else if id, rest, ok := strings.Cut(msg, " "); ok && edgeRequestIDPattern.MatchString(id) {
+			// CloudFront Functions, every line starts with the request id
+			key, ended, msg = id, rest == "END", rest
+		}
+		inv := invocations[key]
+		if inv == nil {
+			inv = &invocation{}
+			if key != "" {
+				invocations[key] = inv
+			}
+		}
+		if inv.requestID == "" {
+			if edgeRequestIDPattern.MatchString(key) {
+				inv.requestID = key
+			} else {
+				inv.requestID = edgeRequestIDPattern.FindString(msg)
+			}
+		}
+		if m := distributionIDPattern.FindStringSubmatch(msg); inv.distribution == "" && m != nil {
+			inv.distribution = m[1]
+		}
+		if ended {
+			delete(invocations, key)
+		}
+
+		date, tm := "-", "-"
+		if !ts.IsZero() {
+			date, tm = ts.Format("2006-01-02"), ts.Format("15:04:05.000")
+		}
+		for i, v := range []string{date, tm, inv.requestID, inv.distribution, strings.TrimSpace(msg)} {
+			if i > 0 {
+				bw.WriteByte('\t')
+			}
+			if v == "" {
+				v = "-"
+			}
+			bw.WriteString(w3cEscaper.Replace(v))
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// splitTimestamp splits the RFC 3339 timestamp CloudWatch Logs exports and
+// Lambda prefix lines with
+func splitTimestamp(line string) (time.Time, string) {
+	first, rest, ok := strings.Cut(line, " ")
+	if tab, after, found := strings.Cut(line, "\t"); found && (!ok || len(tab) < len(first)) {
+		first, rest, ok = tab, after, true
+	}
+	if !ok {
+		return time.Time{}, line
+	}
+	ts, err := time.Parse(time.RFC3339Nano, first)
+	if err != nil {
+		return time.Time{}, line
+	}
+	// Lambda lines exported from CloudWatch Logs carry both timestamps
+	if _, msg := splitTimestamp(rest); msg != rest {
+		rest = msg
+	}
+	return ts.UTC(), rest
+}
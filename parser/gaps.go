@@ -0,0 +1,57 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// gaps tracks the latest delivery hour seen per distribution and counts hours
+// with no delivered file, which may indicate files deleted without shipping
+type gaps struct {
+	mu      sync.Mutex
+	last    map[string]time.Time
+	missing map[string]int
+}
+
+func newGaps() *gaps {
+	return &gaps{
+		last:    make(map[string]time.Time),
+		missing: make(map[string]int),
+	}
+}
+
+// observe records a delivered file and returns the number of hours missing
+// between it and the previous file of the same distribution
+func (g *gaps) observe(distribution string, hour time.Time) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	last, ok := g.last[distribution]
+	if ok && !hour.After(last) {
+		return 0
+	}
+	g.last[distribution] = hour
+	if !ok {
+		return 0
+	}
+	missing := int(hour.Sub(last)/time.Hour) - 1
+	if missing > 0 {
+		g.missing[distribution] += missing
+	}
+	return missing
+}
+
+func (g *gaps) writeMetrics(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	dists := make([]string, 0, len(g.last))
+	for d := range g.last {
+		dists = append(dists, d)
+	}
+	sort.Strings(dists)
+	for _, d := range dists {
+		fmt.Fprintf(w, "cloudfront_logs_shipper_delivery_gap_hours_total{distribution=%q} %d\n", d, g.missing[d])
+	}
+}
@@ -0,0 +1,213 @@
+package parser
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/loki"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// identifyingFields are fields that can identify a user, with --gdpr they must
+// never become stream labels
+var identifyingFields = map[string]bool{
+	"c-ip":            true,
+	"c-port":          true,
+	"x-forwarded-for": true,
+	"cs(Cookie)":      true,
+	"cs(Referer)":     true,
+	"cs(User-Agent)":  true,
+	"cs-uri-query":    true,
+}
+
+// validateGDPR checks the labels configured, static or promoted from fields,
+// and the structured metadata fields do not collide with user identifying
+// fields, only their hash is attached. Erase requests select the lines by the
+// cluster label, so every stream must keep it.
+func validateGDPR(opts models.Options) error {
+	if opts.ClusterName == "" {
+		return fmt.Errorf("--cluster is required, erase requests select lines by the cluster label")
+	}
+	if len(opts.BaseLabels) > 0 && !slices.Contains(opts.BaseLabels, "cluster") {
+		return fmt.Errorf("--base-labels must keep the cluster label, erase requests select lines by it")
+	}
+	if relabelsCluster(opts.Labels, opts.ClusterName) {
+		return fmt.Errorf("label cluster overrides --cluster, erase requests select lines by it")
+	}
+	for k := range opts.Labels {
+		if identifyingFields[k] {
+			return fmt.Errorf("label %q is a user identifying field", k)
+		}
+	}
+	for _, f := range opts.LabelFields {
+		if identifyingFields[f] {
+			return fmt.Errorf("label field %q is a user identifying field", f)
+		}
+		if snakeKey(f) == "cluster" {
+			return fmt.Errorf("label field %q overrides the cluster label, erase requests select lines by it", f)
+		}
+	}
+	for _, f := range opts.MetadataFields {
+		if identifyingFields[f] {
+			return fmt.Errorf("metadata field %q is a user identifying field", f)
+		}
+	}
+	return nil
+}
+
+// relabelsCluster reports whether labels set the cluster label to another
+// value than the cluster name
+func relabelsCluster(labels map[string]string, cluster string) bool {
+	v, ok := labels["cluster"]
+	return ok && v != cluster
+}
+
+// newGDPRKey returns the HMAC key client IPs are hashed with, nil without
+// --gdpr, an unkeyed hash of the IPv4 space is reversed in minutes
+func newGDPRKey(opts models.Options) ([]byte, error) {
+	if !opts.GDPR {
+		return nil, nil
+	}
+	if opts.GDPRToken == "" {
+		return nil, fmt.Errorf("GDPR_ERASE_TOKEN environment variable is required with --gdpr")
+	}
+	key := []byte(opts.GDPRKey)
+	if opts.GDPRKeyFile != "" {
+		var err error
+		if key, err = os.ReadFile(opts.GDPRKeyFile); err != nil {
+			return nil, fmt.Errorf("failed to read gdpr key: %w", err)
+		}
+	}
+	if key = bytes.TrimSpace(key); len(key) < 16 {
+		return nil, fmt.Errorf("gdpr key must have at least 16 bytes, set --gdpr-key-file or GDPR_HASH_KEY")
+	}
+	return key, nil
+}
+
+// hashIP returns the keyed hash of a client IP used to find its lines for
+// erasure
+func (s *Parser) hashIP(ip string) string {
+	mac := hmac.New(sha256.New, s.gdprKey)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authorized reports whether the request carries the erase bearer token
+func (s *Parser) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.GDPRToken)) == 1
+}
+
+// EraseHandler issues Loki delete requests for all lines of a client IP, or of
+// its hash as found in the c_ip_hash structured metadata:
+//
+//	POST /gdpr/erase?c_ip=<c-ip>[&start=<RFC3339>][&end=<RFC3339>]
+//	POST /gdpr/erase?c_ip_hash=<HMAC-SHA256 of c-ip>[&start=<RFC3339>][&end=<RFC3339>]
+//
+// Requests need the Authorization: Bearer <GDPR_ERASE_TOKEN> header. The
+// deletion is done asynchronously by the Loki compactor, which must have
+// retention and deletion enabled.
+func (s *Parser) EraseHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		hash := r.URL.Query().Get("c_ip_hash")
+		if ip := r.URL.Query().Get("c_ip"); ip != "" {
+			hash = s.hashIP(ip)
+		}
+		if len(hash) != sha256.Size*2 {
+			http.Error(w, "c_ip or a hex encoded c_ip_hash is required", http.StatusBadRequest)
+			return
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			http.Error(w, "c_ip or a hex encoded c_ip_hash is required", http.StatusBadRequest)
+			return
+		}
+		var start, end time.Time
+		if v := r.URL.Query().Get("start"); v != "" {
+			var err error
+			if start, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "invalid start: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.URL.Query().Get("end"); v != "" {
+			var err error
+			if end, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "invalid end: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		query := fmt.Sprintf(`{cluster=%q} | c_ip_hash=%q`, s.opts.ClusterName, hash)
+		if err := loki.Delete(s.opts, s.eraseDestinations(), query, start, end); err != nil {
+			s.logger.Error("erase request failed", "c_ip_hash", hash, "err", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		s.logger.Info("erase requested", "c_ip_hash", hash, "query", query)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// eraseDestinations returns every Loki and tenant lines may have been pushed
+// to: the default tenant, the backfill, namespace and policy tenants on the
+// default Loki, the namespaces shipped so far with --tenant-per-namespace,
+// and the routes
+func (s *Parser) eraseDestinations() []loki.Destination {
+	tenants := []string{s.opts.LokiTenant}
+	if s.opts.BackfillTenant != "" {
+		tenants = append(tenants, s.opts.BackfillTenant)
+	}
+	for _, tenant := range s.opts.NamespaceTenants {
+		tenants = append(tenants, tenant)
+	}
+	if s.policies != nil {
+		s.policies.mu.RLock()
+		for ns, p := range s.policies.byName {
+			if p != nil && p.tenant != "" {
+				tenants = append(tenants, p.tenant)
+			} else if s.opts.TenantPerNamespace {
+				tenants = append(tenants, ns)
+			}
+		}
+		if s.policies.environment != nil && s.policies.environment.Tenant != "" {
+			tenants = append(tenants, s.policies.environment.Tenant)
+		}
+		s.policies.mu.RUnlock()
+	}
+	if s.opts.TenantPerNamespace {
+		// the shipped counters are kept by tenant, across restarts with
+		// --counters-file
+		for tenant := range loki.ShippedByTenant() {
+			tenants = append(tenants, tenant)
+		}
+	}
+	slices.Sort(tenants)
+	var destinations []loki.Destination
+	for _, tenant := range slices.Compact(tenants) {
+		destinations = append(destinations, loki.Destination{URL: s.opts.LokiURL, Tenant: tenant})
+	}
+	for _, r := range s.opts.Routes {
+		d := loki.Destination{URL: r.URL, Tenant: r.Tenant}
+		if !slices.Contains(destinations, d) {
+			destinations = append(destinations, d)
+		}
+	}
+	return destinations
+}
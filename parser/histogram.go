@@ -0,0 +1,50 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// histogram counts observations in cumulative buckets like a Prometheus
+// histogram
+type histogram struct {
+	mu      sync.Mutex
+	name    string
+	buckets []float64 // upper bounds, ascending
+	counts  []int64   // per bucket, not cumulative
+	sum     float64
+	count   int64
+}
+
+func newHistogram(name string, buckets ...float64) *histogram {
+	return &histogram{name: name, buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) writeMetrics(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	var cumulative int64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
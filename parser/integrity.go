@@ -0,0 +1,159 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var errNoSuchKey = errors.New("no such key")
+
+// errReadDenied is returned for a read denied without s3:ListBucket, the
+// file may be gone or unreadable: it is skipped, never deleted
+var errReadDenied = errors.New("read denied, file may be missing")
+
+// object is the body of a file as W3C log text
+type object struct {
+	io.Reader
+	closers   []io.Closer
+	versionID *string
+	etag      string
+	size      *int64                // bytes stored, nil if unknown
+	modified  *time.Time            // LastModified, nil if unknown
+	tagged    bool                  // the object carries tags
+	check     func(lines int) error // guards the deletion after the body was read
+	transfer  func() transfer       // bytes read so far
+}
+
+func (o *object) Close() error {
+	var errs []error
+	for _, c := range o.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// openObject opens a file with the decoder picked by its metadata, or as an
+// S3 Select query if configured, function logs are always read whole
+func (s *Parser) openObject(ctx context.Context, fn string) (*object, error) {
+	if s.query != nil && !s.functionLog(fn) {
+		return s.selectObject(ctx, fn)
+	}
+	input := &s3.GetObjectInput{
+		Bucket: &s.opts.BucketName,
+		Key:    &fn,
+	}
+	if s.checksums != nil {
+		input.ChecksumMode = types.ChecksumModeEnabled
+	}
+	obj, err := s.s3Client.GetObject(ctx, input)
+	if err != nil {
+		if strings.Contains(err.Error(), "NoSuchKey") {
+			return nil, errNoSuchKey
+		}
+		if s.deniedAsMissing(err) {
+			return nil, fmt.Errorf("%w: %w", errReadDenied, err)
+		}
+		return nil, fmt.Errorf("failed to get object %s: %w", fn, err)
+	}
+	var wasted int64 // downloaded by attempts failing the checksum
+	verify := func() error { return nil }
+	if s.checksums != nil {
+		if obj, wasted, verify, err = s.verifiedObject(ctx, fn, obj); err != nil {
+			return nil, err
+		}
+	}
+	raw := &countingReader{r: obj.Body}
+	format := s.opts.InputFormat
+	if s.functionLog(fn) {
+		format = "function"
+	}
+	body, err := Decode(format, fn, aws.ToString(obj.ContentType), aws.ToString(obj.ContentEncoding), raw)
+	if err != nil {
+		obj.Body.Close()
+		return nil, err
+	}
+	decoded := &countingReader{r: body}
+	return &object{
+		Reader:    s.sizeGuard(fn, raw, decoded, obj.ContentLength),
+		closers:   []io.Closer{body, obj.Body},
+		versionID: obj.VersionId,
+		etag:      aws.ToString(obj.ETag),
+		size:      obj.ContentLength,
+		modified:  obj.LastModified,
+		tagged:    aws.ToInt32(obj.TagCount) > 0,
+		check: func(lines int) error {
+			if err := s.checkRead(raw, obj.ContentLength, lines); err != nil {
+				return err
+			}
+			return verify()
+		},
+		transfer: func() transfer {
+			return transfer{downloaded: wasted + raw.n, decompressed: decoded.n}
+		},
+	}, nil
+}
+
+// countingReader counts the bytes read from an object body
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sizeGuard fails the reads of a file once it decompressed to more than the
+// max bytes, or the max ratio of its stored size, zero limits are ignored
+func (s *Parser) sizeGuard(fn string, raw, decoded *countingReader, contentLength *int64) io.Reader {
+	ratio, limit := s.opts.MaxDecompressedRatio, s.opts.MaxDecompressedBytes
+	if ratio <= 0 && limit <= 0 {
+		return decoded
+	}
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := decoded.Read(p)
+		if limit > 0 && decoded.n > limit {
+			return n, fmt.Errorf("%w: %s decompressed to more than %d bytes", ErrDecompressedSize, fn, limit)
+		}
+		stored := max(raw.n, aws.ToInt64(contentLength))
+		if ratio > 0 && stored > 0 && float64(decoded.n) > ratio*float64(stored) {
+			return n, fmt.Errorf("%w: %s decompressed to more than %g times its %d bytes", ErrDecompressedSize, fn, ratio, stored)
+		}
+		return n, err
+	})
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// checkRead guards the deletion of a file: the whole body must have been
+// read, or at least one line if its length is unknown
+func (s *Parser) checkRead(raw *countingReader, contentLength *int64, lines int) error {
+	// decoders may stop at the end of the compressed stream
+	if _, err := io.Copy(io.Discard, raw); err != nil {
+		return fmt.Errorf("%w: %w", ErrIncompleteRead, err)
+	}
+	if contentLength == nil {
+		if lines == 0 {
+			return fmt.Errorf("%w: no lines read and unknown content length", ErrIncompleteRead)
+		}
+		return nil
+	}
+	if raw.n != *contentLength {
+		return fmt.Errorf("%w: %d of %d bytes read", ErrIncompleteRead, raw.n, *contentLength)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// scanWindow is the number of recent scans the interval is tuned from
+const scanWindow = 10
+
+// scanInterval tunes the interval between scans within bounds from the
+// recent scans: it grows when most scans found nothing, and shrinks when
+// every scan found files and the workers kept up, so files don't wait
+type scanInterval struct {
+	mu       sync.Mutex
+	min, max time.Duration
+	current  time.Duration
+	recent   []bool // whether each recent scan found files
+}
+
+func newScanInterval(opts models.Options) (*scanInterval, error) {
+	if opts.WaitIntervalMin <= 0 && opts.WaitIntervalMax <= 0 {
+		return nil, nil
+	}
+	if opts.WaitIntervalMin <= 0 || opts.WaitIntervalMax < opts.WaitIntervalMin {
+		return nil, fmt.Errorf("auto wait interval needs 0 < wait-min <= wait-max")
+	}
+	return &scanInterval{
+		min:     opts.WaitIntervalMin,
+		max:     opts.WaitIntervalMax,
+		current: min(max(opts.WaitInterval, opts.WaitIntervalMin), opts.WaitIntervalMax),
+	}, nil
+}
+
+// observe records the outcome of a scan, backlog is the number of files
+// still queued when it started
+func (i *scanInterval) observe(found, backlog int) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.recent = append(i.recent, found > 0)
+	if len(i.recent) > scanWindow {
+		i.recent = i.recent[1:]
+	}
+	empty := 0
+	for _, f := range i.recent {
+		if !f {
+			empty++
+		}
+	}
+	switch {
+	case empty*2 > len(i.recent):
+		i.current = min(i.current*5/4, i.max)
+	case empty == 0 && backlog == 0:
+		i.current = max(i.current*3/4, i.min)
+	}
+}
+
+// ScanInterval returns the interval to wait until the next scan
+func (s *Parser) ScanInterval() time.Duration {
+	if s.interval == nil {
+		return s.opts.WaitInterval
+	}
+	s.interval.mu.Lock()
+	defer s.interval.mu.Unlock()
+	return s.interval.current
+}
+
+func (i *scanInterval) writeMetrics(w io.Writer) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	fmt.Fprintf(w, "cloudfront_logs_shipper_scan_interval_seconds %g\n", i.current.Seconds())
+}
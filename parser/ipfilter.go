@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// ipFilter matches client IPs against allow and deny CIDR lists
+type ipFilter struct {
+	allow []netip.Prefix // only these are shipped unfiltered when not empty
+	deny  []netip.Prefix
+	tag   bool // tag filtered lines with ip_filtered instead of dropping them
+}
+
+func newIPFilter(opts models.Options) (*ipFilter, error) {
+	if len(opts.IPAllow) == 0 && len(opts.IPDeny) == 0 {
+		return nil, nil
+	}
+	f := &ipFilter{}
+	switch opts.IPFilterAction {
+	case "drop":
+	case "tag":
+		f.tag = true
+	default:
+		return nil, fmt.Errorf("unsupported ip-filter-action %q", opts.IPFilterAction)
+	}
+	var err error
+	if f.allow, err = parsePrefixes(opts.IPAllow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePrefixes(opts.IPDeny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// filtered reports whether the client IP of the entry is denied or not
+// allowed, unparsable IPs are only filtered by an allowlist
+func (f *ipFilter) filtered(entry models.LogEntry) bool {
+	addr, err := netip.ParseAddr(entry["c-ip"])
+	if err != nil {
+		return len(f.allow) > 0
+	}
+	addr = addr.Unmap()
+	if len(f.allow) > 0 && !contains(f.allow, addr) {
+		return true
+	}
+	return contains(f.deny, addr)
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterIP reports whether the line of the entry is dropped, filtered lines
+// are tagged instead in tag mode. It runs before anonymization of the IP.
+func (s *Parser) filterIP(entry models.LogEntry) bool {
+	if s.ipFilter == nil || !s.ipFilter.filtered(entry) {
+		return false
+	}
+	s.ipFiltered.Add(1)
+	if s.ipFilter.tag {
+		entry["ip_filtered"] = "true"
+		return false
+	}
+	return true
+}
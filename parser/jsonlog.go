@@ -0,0 +1,142 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+func init() {
+	decoders["json"] = decodeJSONLog
+}
+
+// decodeJSONLog converts CloudFront standard logging v2 JSON records, one
+// object per line, to W3C log text. The fields of the first record become the
+// #Fields header, a record with other fields starts a new header.
+func decodeJSONLog(r io.Reader) (io.ReadCloser, error) {
+	src, err := decompressed(r)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		pw.CloseWithError(writeW3C(pw, json.NewDecoder(src)))
+	}()
+	return pr, nil
+}
+
+// compressionMagic are the leading bytes of compressed objects
+var compressionMagic = map[string][]byte{
+	"gzip": {0x1f, 0x8b},
+	"zstd": {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// decompressed detects gzip or zstd compression by the leading bytes, for
+// objects delivered compressed or as is
+func decompressed(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	for name, prefix := range compressionMagic {
+		if bytes.HasPrefix(magic, prefix) {
+			decodersMu.RLock()
+			d := decoders[name]
+			decodersMu.RUnlock()
+			return d(br)
+		}
+	}
+	return io.NopCloser(br), nil
+}
+
+// writeW3C writes the records of a JSON stream as W3C lines
+func writeW3C(w io.Writer, dec *json.Decoder) error {
+	dec.UseNumber()
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString("#Version: 1.0\n"); err != nil {
+		return err
+	}
+	var header []string
+	for n := 1; ; n++ {
+		names, values, err := readRecord(dec)
+		if err == io.EOF {
+			return bw.Flush()
+		}
+		if err != nil {
+			return fmt.Errorf("invalid JSON log record %d: %w", n, err)
+		}
+		if !slices.Equal(header, names) {
+			header = names
+			bw.WriteString("#Fields: " + strings.Join(header, " ") + "\n")
+		}
+		for i, v := range values {
+			if i > 0 {
+				bw.WriteByte('\t')
+			}
+			bw.WriteString(v)
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+}
+
+// readRecord reads the next object keeping the order of its fields, values
+// are escaped like in W3C logs
+func readRecord(dec *json.Decoder) (names, values []string, err error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tok == json.Delim('[') || tok == json.Delim(']') {
+		return readRecord(dec) // records wrapped in an array
+	}
+	if tok != json.Delim('{') {
+		return nil, nil, fmt.Errorf("expected an object, got %v", tok)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		name, _ := tok.(string)
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, nil, err
+		}
+		names = append(names, strings.ReplaceAll(name, " ", "%20"))
+		values = append(values, w3cValue(v))
+	}
+	if _, err := dec.Token(); err != nil { // closing brace
+		return nil, nil, err
+	}
+	return names, values, nil
+}
+
+// w3cValue formats a JSON value as a W3C field, - if empty and whitespace
+// percent encoded as CloudFront does
+func w3cValue(v any) string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return "-"
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = fmt.Sprint(v)
+	default:
+		data, _ := json.Marshal(v)
+		s = string(data)
+	}
+	if s == "" {
+		return "-"
+	}
+	return w3cEscaper.Replace(s)
+}
+
+var w3cEscaper = strings.NewReplacer(" ", "%20", "\t", "%09", "\n", "%0A", "\r", "%0D")
@@ -0,0 +1,159 @@
+package parser
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// nestedGroups are the W3C field prefixes grouped into objects by the nested
+// key style, longest first
+var nestedGroups = []struct{ prefix, group string }{
+	{"x-edge-", "x_edge"},
+	{"cs-", "cs"},
+	{"cs(", "cs"},
+	{"sc-", "sc"},
+	{"c-", "c"},
+}
+
+// snakeKey converts a W3C field name to snake_case, e.g. cs(User-Agent) to
+// cs_user_agent, names of added fields already are
+func snakeKey(name string) string {
+	var b strings.Builder
+	sep := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'A' && c <= 'Z':
+			c += 'a' - 'A'
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		default:
+			sep = b.Len() > 0
+			continue
+		}
+		if sep {
+			b.WriteByte('_')
+			sep = false
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// camelKey converts a W3C field name to camelCase, e.g. cs(User-Agent) to
+// csUserAgent
+func camelKey(name string) string {
+	words := strings.Split(snakeKey(name), "_")
+	for i := 1; i < len(words); i++ {
+		if words[i] != "" {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// nestedKey returns the group of a W3C field name and its snake_case name
+// within the group, or no group for names without a grouped prefix
+func nestedKey(name string) (group, key string) {
+	for _, g := range nestedGroups {
+		if rest, ok := strings.CutPrefix(name, g.prefix); ok && rest != "" {
+			return g.group, snakeKey(rest)
+		}
+	}
+	return "", snakeKey(name)
+}
+
+// keyCache memoizes converted key names, the set of field names is small
+type keyCache struct {
+	convert func(string) string
+	names   sync.Map
+}
+
+func (c *keyCache) name(k string) string {
+	if v, ok := c.names.Load(k); ok {
+		return v.(string)
+	}
+	v := c.convert(k)
+	c.names.Store(k, v)
+	return v
+}
+
+// renamedJSON encodes entries as flat JSON objects with converted keys
+func renamedJSON(convert func(string) string) encoder {
+	cache := &keyCache{convert: convert}
+	field := func(dst []byte, i int, k, v string) []byte {
+		return appendJSONField(dst, i, cache.name(k), v)
+	}
+	return func(dst []byte, entry models.LogEntry, order []string) []byte {
+		dst = append(dst, '{')
+		dst = appendFields(dst, entry, order, field)
+		return append(dst, '}')
+	}
+}
+
+// appendNestedJSON encodes the entry as a JSON object with the fields of a
+// prefix grouped into an object, written where the first of them is
+func appendNestedJSON(dst []byte, entry models.LogEntry, order []string) []byte {
+	keys := make([]string, 0, len(entry))
+	appendFields(nil, entry, order, func(dst []byte, _ int, k, _ string) []byte {
+		keys = append(keys, k)
+		return dst
+	})
+	written := make(map[string]bool, len(nestedGroups))
+	dst = append(dst, '{')
+	n := 0
+	for _, k := range keys {
+		group, key := nestedKeys.split(k)
+		if group == "" {
+			dst = appendJSONField(dst, n, key, entry[k])
+			n++
+			continue
+		}
+		if written[group] {
+			continue
+		}
+		written[group] = true
+		if n > 0 {
+			dst = append(dst, ',')
+		}
+		n++
+		dst = appendJSONString(dst, group)
+		dst = append(dst, ':', '{')
+		i := 0
+		for _, member := range keys {
+			if g, key := nestedKeys.split(member); g == group {
+				dst = appendJSONField(dst, i, key, entry[member])
+				i++
+			}
+		}
+		dst = append(dst, '}')
+	}
+	return append(dst, '}')
+}
+
+// nestedKeys memoizes the group and name of keys of the nested key style
+var nestedKeys = &keyCache{convert: func(k string) string {
+	group, key := nestedKey(k)
+	return group + "." + key
+}}
+
+func (c *keyCache) split(k string) (group, key string) {
+	group, key, _ = strings.Cut(c.name(k), ".")
+	return group, key
+}
+
+// jsonEncoder returns the JSON encoder of a key style
+func jsonEncoder(style string) (encoder, bool) {
+	switch style {
+	case "snake":
+		return renamedJSON(snakeKey), true
+	case "camel":
+		return renamedJSON(camelKey), true
+	case "nested":
+		return appendNestedJSON, true
+	case "w3c":
+		return appendJSON, true
+	}
+	return nil, false
+}
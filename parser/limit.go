@@ -0,0 +1,142 @@
+package parser
+
+import (
+	"strings"
+	"sync"
+)
+
+// namespaceOf returns the namespace of a key, its first path segment
+func namespaceOf(key string) string {
+	ns, _, _ := strings.Cut(key, "/")
+	return ns
+}
+
+// limiter bounds the number of files of a namespace processed concurrently,
+// keys over the limit are deferred so workers can pick up other namespaces
+type limiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	max      int
+	active   map[string]int
+	deferred []*string
+	pending  map[string]bool // deferred keys, a key re-listed meanwhile is dropped
+	freed    chan struct{}   // wakes a worker waiting on the queue once a slot is released
+}
+
+func newLimiter(max int) *limiter {
+	l := &limiter{
+		max:     max,
+		active:  make(map[string]int),
+		pending: make(map[string]bool),
+		freed:   make(chan struct{}, 1),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *limiter) acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ns := namespaceOf(key)
+	if l.active[ns] >= l.max {
+		return false
+	}
+	l.active[ns]++
+	return true
+}
+
+func (l *limiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ns := namespaceOf(key)
+	if l.active[ns]--; l.active[ns] <= 0 {
+		delete(l.active, ns)
+	}
+	l.cond.Broadcast()
+	if len(l.deferred) > 0 {
+		select {
+		case l.freed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (l *limiter) deferKey(key *string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending[*key] {
+		return
+	}
+	l.pending[*key] = true
+	l.deferred = append(l.deferred, key)
+}
+
+// takeDeferred returns the first deferred key whose namespace has room,
+// caller must hold the lock
+func (l *limiter) takeDeferred() *string {
+	for i, key := range l.deferred {
+		ns := namespaceOf(*key)
+		if l.active[ns] >= l.max {
+			continue
+		}
+		l.active[ns]++
+		l.deferred = append(l.deferred[:i], l.deferred[i+1:]...)
+		delete(l.pending, *key)
+		return key
+	}
+	return nil
+}
+
+// next returns the next key to process from the deferred keys or the queue,
+// or nil once the queue is closed and all deferred keys were processed
+func (s *Parser) next() *string {
+	if s.remote != nil {
+		return s.lease()
+	}
+	if s.limiter == nil {
+		return <-s.queue
+	}
+	l := s.limiter
+	for {
+		l.mu.Lock()
+		key := l.takeDeferred()
+		l.mu.Unlock()
+		if key != nil {
+			return key
+		}
+
+		// a deferred key is taken as soon as its namespace has room, not
+		// only once another key was queued
+		var fn *string
+		var ok bool
+		select {
+		case fn, ok = <-s.queue:
+		case <-l.freed:
+			continue
+		}
+		if !ok {
+			break
+		}
+		if l.acquire(*fn) {
+			return fn
+		}
+		l.deferKey(fn)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.deferred) > 0 {
+		if key := l.takeDeferred(); key != nil {
+			return key
+		}
+		l.cond.Wait()
+	}
+	return nil
+}
+
+// done releases the namespace slot of a processed key
+func (s *Parser) done(key string) {
+	if s.limiter != nil {
+		s.limiter.release(key)
+	}
+}
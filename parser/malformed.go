@@ -0,0 +1,125 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// cookieField matches a field of cookie pairs, name=value separated by ; and
+// an optional space, plain or URL encoded
+var cookieField = regexp.MustCompile(`^[^\s=;&]+=[^\s;&]*(?:;(?:%20| )?[^\s=;&]+=[^\s;&]*)*$`)
+
+// addressToken matches candidates of IPv4 and IPv6 addresses in a line
+var addressToken = regexp.MustCompile(`[0-9A-Fa-f:.]{3,}`)
+
+// malformedEntry returns the values of a line not matching its header by
+// their position in the header, as far as they go
+func malformedEntry(line string, header []string) models.LogEntry {
+	values := strings.Split(line, "\t")
+	entry := make(models.LogEntry, len(header))
+	for i, name := range header {
+		if i >= len(values) {
+			break
+		}
+		entry[name] = values[i]
+	}
+	return entry
+}
+
+// malformedFiltered reports whether a line not matching its header is
+// dropped by the IP filter or the drop list, applied to its values by their
+// position in the header. An allowlist drops lines without a valid IP there.
+func (s *Parser) malformedFiltered(line string, header []string) bool {
+	entry := malformedEntry(line, header)
+	if s.ipFilter != nil && s.ipFilter.filtered(entry) && !s.ipFilter.tag {
+		s.ipFiltered.Add(1)
+		return true
+	}
+	if s.dropList != nil && s.dropList.dropped(entry) {
+		s.dropListed.Add(1)
+		return true
+	}
+	return false
+}
+
+// malformedRoute returns the index plus one of the route set for malformed
+// lines (field=malformed,value=true), 0 if there is none
+func (s *Parser) malformedRoute() int {
+	for i, r := range s.opts.Routes {
+		if r.Field == "malformed" && r.Value == "true" {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// scrubLine scrubs a line which could not be parsed into fields like the
+// fields of parsed lines: with --scrub credential-like values are redacted
+// and fields of cookie pairs hashed, with pseudonymized fields or
+// --anonymize-ips every address is pseudonymized or anonymized
+func (s *Parser) scrubLine(line string) string {
+	values := strings.Split(line, "\t")
+	for i, v := range values {
+		if s.opts.Scrub {
+			if v != "-" && cookieField.MatchString(v) {
+				v = hashValue(v)
+			}
+			v = credentialParam.ReplaceAllString(v, "${1}REDACTED")
+		}
+		if s.pseudonyms != nil || s.opts.AnonymizeIPs {
+			v = addressToken.ReplaceAllStringFunc(v, func(token string) string {
+				if _, err := netip.ParseAddr(token); err != nil {
+					return token
+				}
+				if s.pseudonyms != nil {
+					return s.pseudonyms.token(token)
+				}
+				return s.anonymizeIP(token)
+			})
+		}
+		values[i] = v
+	}
+	return strings.Join(values, "\t")
+}
+
+// deadLetterLines writes the malformed lines of a file below the dead-letter
+// prefix as a file of its header, so retry-deadletter ships them once a
+// route is set for them. Lines of a dead-lettered file stay where they are.
+func (s *Parser) deadLetterLines(ctx context.Context, fn string, header, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	if s.stripPrefix != "" && strings.HasPrefix(fn, s.stripPrefix) {
+		return fmt.Errorf("%w: %d lines, set a route with field=malformed,value=true to ship them", ErrMalformedLine, len(lines))
+	}
+	dst := s.opts.DeadLetterPrefix + fn + ".malformed"
+	if err := s.putLines(ctx, dst, header, lines); err != nil {
+		return fmt.Errorf("failed to dead-letter malformed lines to %s: %w", dst, err)
+	}
+	s.deadLines.Add(int64(len(lines)))
+	s.logger.Warn("moved malformed lines to the dead-letter prefix", "key", fn, "lines", len(lines), "to", dst)
+	return nil
+}
+
+// putLines writes lines as a W3C file of header to a key of the bucket
+func (s *Parser) putLines(ctx context.Context, key string, header, lines []string) error {
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "#Version: 1.0\n#Fields: %s\n", strings.Join(header, " "))
+	for _, line := range lines {
+		data.WriteString(line)
+		data.WriteByte('\n')
+	}
+	_, err := s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &s.opts.BucketName,
+		Key:    &key,
+		Body:   bytes.NewReader(data.Bytes()),
+	})
+	return err
+}
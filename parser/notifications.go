@@ -0,0 +1,352 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+	"github.com/nugored/cf-logs-loki-uploader/sqs"
+)
+
+// notifications are S3 event notifications received from SQS, a message is
+// deleted once all the files it announced were shipped, and kept hidden from
+// other consumers while they are being shipped
+type notifications struct {
+	mu         sync.Mutex
+	client     *sqs.Client
+	visibility time.Duration
+	messages   map[string]*notification // by key of a file announced
+	received   atomic.Int64
+	deleted    atomic.Int64
+	released   atomic.Int64 // made visible again after a file failed
+	published  atomic.Int64 // files sent by a scanner
+	unsent     atomic.Int64 // files a scanner failed to send
+}
+
+type notification struct {
+	receipt   string
+	remaining int  // files not shipped or failed yet
+	failed    bool // a file failed, the message is received again
+}
+
+// s3Event is the body of an S3 event notification
+type s3Event struct {
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	EventSource string    `json:"eventSource"`
+	EventName   string    `json:"eventName"`
+	EventTime   time.Time `json:"eventTime"`
+	S3          struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+func (s *Parser) setupNotifications(opts models.Options) error {
+	switch opts.IngestMode {
+	case "poll":
+		if opts.Role != "scanner" {
+			return nil
+		}
+	case "sqs":
+		if opts.Role == "scanner" {
+			return fmt.Errorf("scanners list S3, use the poll ingest mode")
+		}
+	default:
+		return fmt.Errorf("unsupported ingest mode %q", opts.IngestMode)
+	}
+	if opts.SQSQueueURL == "" {
+		return fmt.Errorf("sqs-queue-url is required in sqs ingest mode and by scanners")
+	}
+	if opts.Role == "worker" {
+		return fmt.Errorf("sqs ingest mode is not supported by workers, use it on the coordinator")
+	}
+	if opts.NoListBucket && (opts.IngestMode != "sqs" || opts.Role != "standalone" && opts.Role != "processor") {
+		return fmt.Errorf("no-list-bucket is only supported by the standalone and processor roles in sqs ingest mode")
+	}
+	if opts.IngestMode == "sqs" && accessPoint(opts.BucketName) && opts.NotificationBucket == "" {
+		return fmt.Errorf("notification-bucket is required in sqs ingest mode with an access point, S3 notifications name the bucket")
+	}
+	if opts.SQSVisibility < 10*time.Second {
+		return fmt.Errorf("sqs-visibility must be at least 10s")
+	}
+	s3opts := s.s3Client.Options()
+	client, err := sqs.NewClient(opts.SQSQueueURL, s3opts.Region, s3opts.Credentials)
+	if err != nil {
+		return err
+	}
+	s.events = &notifications{
+		client:     client,
+		visibility: opts.SQSVisibility,
+		messages:   make(map[string]*notification),
+	}
+	return nil
+}
+
+// Consume queues the files announced by S3 event notifications until the
+// parser is stopped, or in once mode until no more messages are received
+func (s *Parser) Consume() {
+	n := s.events
+	ctx := context.Background()
+	for _, key := range s.restore {
+		s.pending.remove(key) // the messages of restored keys are received again
+	}
+	s.restore = nil
+	go s.extendVisibility()
+	for !s.stop.Load() {
+		if !s.Fenced() {
+			time.Sleep(time.Second) // standing by for the fence
+			continue
+		}
+		msgs, err := n.client.Receive(ctx, 10, 20*time.Second, n.visibility)
+		if err != nil {
+			s.logger.Error("failed to receive S3 notifications, will retry", "err", err)
+			s.RecordError("", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		s.progress.Store(time.Now().UnixNano())
+		if len(msgs) == 0 && s.opts.Once {
+			return
+		}
+		n.received.Add(int64(len(msgs)))
+		for _, msg := range msgs {
+			s.handleNotification(ctx, msg)
+		}
+	}
+}
+
+// handleNotification queues the new files of a message
+func (s *Parser) handleNotification(ctx context.Context, msg sqs.Message) {
+	n := s.events
+	var event s3Event
+	if err := json.Unmarshal([]byte(msg.Body), &event); err != nil {
+		s.logger.Warn("ignoring message which is not an S3 notification", "id", msg.ID, "err", err)
+		s.deleteNotification(ctx, msg.ReceiptHandle)
+		return
+	}
+	var keys []string
+	for _, r := range event.Records {
+		if r.EventSource == scannerEventSource && r.S3.Bucket.Name == s.opts.BucketName {
+			// selected by the scanner, which does not know the object sizes
+			if key, err := url.QueryUnescape(r.S3.Object.Key); err == nil {
+				keys = append(keys, key)
+			}
+			continue
+		}
+		if !strings.HasPrefix(r.EventName, "ObjectCreated:") || r.S3.Bucket.Name != s.notifiedBucket() || r.S3.Object.Size == 0 {
+			continue
+		}
+		// keys are URL encoded with spaces as +
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			s.logger.Warn("ignoring invalid key in S3 notification", "key", r.S3.Object.Key, "err", err)
+			continue
+		}
+		obj := types.Object{Key: &key, LastModified: &r.EventTime}
+		if s.excluded(key) || !s.selected(obj) {
+			s.excludedKeys.Add(1)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	m := &notification{receipt: msg.ReceiptHandle}
+	var queued []string
+	n.mu.Lock()
+	for _, key := range keys {
+		if !s.pending.add(key) {
+			continue // queued by an earlier message or listed twice
+		}
+		n.messages[key] = m
+		m.remaining++
+		queued = append(queued, key)
+	}
+	n.mu.Unlock()
+	if len(queued) == 0 {
+		s.deleteNotification(ctx, msg.ReceiptHandle) // test event, other bucket or duplicate
+		return
+	}
+	for _, key := range queued {
+		if s.stop.Load() {
+			break // received again after the visibility timeout
+		}
+		s.onboard(key)
+		if !s.enqueue(&key) {
+			// dropped by the overflow policy, releasing the message would
+			// only receive it again while the queue is full
+			s.logger.Warn("dropping notified file, the queue is full", "key", key)
+			s.acknowledge(key, nil)
+		}
+	}
+}
+
+// acknowledge records the outcome of a notified file, the message is deleted
+// once all its files were shipped, or made visible again once one failed
+func (s *Parser) acknowledge(key string, shipErr error) {
+	n := s.events
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	m, ok := n.messages[key]
+	if !ok {
+		n.mu.Unlock()
+		return
+	}
+	delete(n.messages, key)
+	m.remaining--
+	m.failed = m.failed || shipErr != nil
+	done, failed := m.remaining == 0, m.failed
+	n.mu.Unlock()
+	if !done {
+		return
+	}
+	ctx := context.Background()
+	if failed {
+		// received again right away instead of after the visibility timeout
+		if err := n.client.ChangeVisibility(ctx, m.receipt, 0); err != nil {
+			s.logger.Warn("failed to release S3 notification", "err", err)
+			return
+		}
+		n.released.Add(1)
+		return
+	}
+	s.deleteNotification(ctx, m.receipt)
+}
+
+func (s *Parser) deleteNotification(ctx context.Context, receipt string) {
+	if err := s.events.client.Delete(ctx, receipt); err != nil {
+		s.logger.Error("failed to delete S3 notification, files may be shipped again", "err", err)
+		return
+	}
+	s.events.deleted.Add(1)
+}
+
+// extendVisibility keeps the messages of files being shipped hidden from
+// other consumers
+func (s *Parser) extendVisibility() {
+	n := s.events
+	for range time.Tick(n.visibility / 2) {
+		n.mu.Lock()
+		receipts := make(map[string]bool)
+		for _, m := range n.messages {
+			receipts[m.receipt] = true
+		}
+		n.mu.Unlock()
+		for receipt := range receipts {
+			if err := n.client.ChangeVisibility(context.Background(), receipt, n.visibility); err != nil {
+				s.logger.Warn("failed to extend S3 notification visibility", "err", err)
+			}
+		}
+	}
+}
+
+func (n *notifications) writeMetrics(w io.Writer) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	outstanding := len(n.messages)
+	n.mu.Unlock()
+	fmt.Fprintf(w, "cloudfront_logs_shipper_sqs_messages_received_total %d\n", n.received.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_sqs_messages_deleted_total %d\n", n.deleted.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_sqs_messages_released_total %d\n", n.released.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_sqs_files_in_flight %d\n", outstanding)
+	fmt.Fprintf(w, "cloudfront_logs_shipper_sqs_files_published_total %d\n", n.published.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_sqs_files_unsent_total %d\n", n.unsent.Load())
+}
+
+// scannerEventSource marks the notifications of files listed by a scanner
+const scannerEventSource = "cloudfront-logs-shipper:scanner"
+
+// Publish sends the queued files to SQS as notifications until the parser is
+// stopped, for processors to consume. Published files stay pending, so the
+// next scans do not publish them again until --republish-after.
+func (s *Parser) Publish() {
+	n := s.events
+	ctx := context.Background()
+	for fn := range s.queue {
+		keys := []string{*fn}
+	batch:
+		for len(keys) < 10 {
+			select {
+			case fn, ok := <-s.queue:
+				if !ok {
+					break batch
+				}
+				keys = append(keys, *fn)
+			default:
+				break batch
+			}
+		}
+		bodies := make([]string, len(keys))
+		for i, key := range keys {
+			bodies[i] = s.scannerEvent(key)
+		}
+		failed, err := n.client.SendBatch(ctx, bodies)
+		if err != nil {
+			s.logger.Error("failed to publish files, listed again by the next scan", "files", len(keys), "err", err)
+			s.RecordError("", err)
+			failed = make([]int, len(keys))
+			for i := range failed {
+				failed[i] = i
+			}
+		}
+		for _, key := range keys {
+			s.replays.forget(key) // not shipped yet, never a replay
+		}
+		for _, i := range failed {
+			s.pending.remove(keys[i])
+		}
+		n.unsent.Add(int64(len(failed)))
+		n.published.Add(int64(len(keys) - len(failed)))
+		s.progress.Store(time.Now().UnixNano())
+	}
+}
+
+// scannerEvent returns the notification of a file listed by a scanner
+func (s *Parser) scannerEvent(key string) string {
+	var event s3Event
+	event.Records = make([]s3EventRecord, 1)
+	r := &event.Records[0]
+	r.EventSource = scannerEventSource
+	r.EventName = "ObjectCreated:Scanned"
+	r.EventTime = time.Now().UTC()
+	r.S3.Bucket.Name = s.opts.BucketName
+	r.S3.Object.Key = url.QueryEscape(key)
+	data, _ := json.Marshal(event)
+	return string(data)
+}
+
+// expirePublished makes the files published longer than --republish-after
+// ago listable again, in case their notification was lost
+func (s *Parser) expirePublished() {
+	if s.opts.Role != "scanner" || s.opts.RepublishAfter <= 0 {
+		return
+	}
+	s.pending.expire(time.Now().Add(-s.opts.RepublishAfter))
+}
+
+// deniedAsMissing reports whether a read was denied for a file which may be
+// gone: without s3:ListBucket S3 answers 403 instead of 404 for missing keys,
+// like files of notifications received again after they were shipped. A
+// missing kms:Decrypt is denied alike, so such files are never deleted.
+func (s *Parser) deniedAsMissing(err error) bool {
+	return s.opts.NoListBucket && (strings.Contains(err.Error(), "AccessDenied") || strings.Contains(err.Error(), "Forbidden"))
+}
@@ -0,0 +1,142 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// processedTag is the S3 object tag of shipped files kept by Object Lock
+var processedTag = types.Tag{Key: aws.String(tagKey), Value: aws.String("processed")}
+
+// objectLock falls back to tagging shipped files as processed once a delete
+// was denied by Object Lock retention. Tagged files are remembered so later
+// scans don't ship them again, until a complete scan no longer lists them.
+// After a restart the tag is read back when a tagged file is opened.
+type objectLock struct {
+	active    atomic.Bool
+	mu        sync.Mutex
+	processed map[string]int64 // the scan which last listed a tagged file
+	scan      int64            // of the current scan
+}
+
+func newObjectLock() *objectLock {
+	return &objectLock{processed: make(map[string]int64)}
+}
+
+// locked reports whether a delete was denied by Object Lock retention, in
+// governance or compliance mode
+func locked(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "object lock") || strings.Contains(msg, "worm protected")
+}
+
+// kept reports whether a shipped file was tagged instead of deleted
+func (l *objectLock) kept(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.processed[key]
+	return ok
+}
+
+// listed reports whether a listed file was tagged instead of deleted, and
+// keeps remembering it
+func (l *objectLock) listed(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.processed[key]; !ok {
+		return false
+	}
+	l.processed[key] = l.scan
+	return true
+}
+
+// beginScan starts a scan of the bucket
+func (l *objectLock) beginScan() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.scan++
+}
+
+// endScan forgets the tagged files a complete scan no longer listed, deleted
+// by a lifecycle rule once their retention expired
+func (l *objectLock) endScan(complete bool) {
+	if !complete {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, scan := range l.processed {
+		if scan < l.scan {
+			delete(l.processed, key)
+		}
+	}
+}
+
+// remember records a file as tagged by the current or a previous run
+func (l *objectLock) remember(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.processed[key] = l.scan
+}
+
+func (l *objectLock) writeMetrics(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(w, "cloudfront_logs_shipper_object_lock_kept_files %d\n", len(l.processed))
+}
+
+// tagProcessed tags a shipped file as processed and remembers it, switching
+// to tagging for all files on the first Object Lock denial
+func (s *Parser) tagProcessed(ctx context.Context, key string, versionID *string, cause error) error {
+	if cause != nil && s.objectLock.active.CompareAndSwap(false, true) {
+		s.logger.Warn("deleting files is denied by Object Lock retention, shipped files are tagged as processed and kept from now on",
+			"key", key, "tag", tagKey+"=processed", "err", cause)
+		if s.opts.CheckpointFile == "" && s.query != nil {
+			// S3 Select doesn't tell whether a file carries tags
+			s.logger.Warn("kept files are shipped again after a restart with S3 Select without --checkpoint-file")
+		}
+	}
+	if _, err := s.s3Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:    &s.opts.BucketName,
+		Key:       &key,
+		VersionId: versionID,
+		Tagging:   &types.Tagging{TagSet: []types.Tag{processedTag}},
+	}); err != nil {
+		return fmt.Errorf("failed to tag file kept by Object Lock: %w", err)
+	}
+	s.objectLock.remember(key)
+	return nil
+}
+
+// taggedProcessed reports whether an opened file carrying tags was tagged as
+// processed by a previous run, it is remembered and kept as shipped
+func (s *Parser) taggedProcessed(ctx context.Context, key string, versionID *string) bool {
+	tags, err := s.s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:    &s.opts.BucketName,
+		Key:       &key,
+		VersionId: versionID,
+	})
+	if err != nil {
+		s.logger.Warn("failed to read the tags of a file", "key", key, "err", err)
+		return false
+	}
+	if !slices.ContainsFunc(tags.TagSet, func(t types.Tag) bool {
+		return aws.ToString(t.Key) == tagKey && aws.ToString(t.Value) == "processed"
+	}) {
+		return false
+	}
+	if s.objectLock.active.CompareAndSwap(false, true) {
+		s.logger.Warn("found a file tagged as processed by a previous run, shipped files are tagged and kept from now on", "key", key)
+	}
+	s.objectLock.remember(key)
+	return true
+}
@@ -0,0 +1,90 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// offsets tracks how many data lines of each file were already shipped, so a
+// retry after a mid-file failure can skip them instead of sending duplicates.
+type offsets struct {
+	mu   sync.Mutex
+	path string // optional checkpoint file, offsets are kept in memory only if empty
+	m    map[string]int
+}
+
+func newOffsets(path string) (*offsets, error) {
+	o := &offsets{
+		path: path,
+		m:    make(map[string]int),
+	}
+	if path == "" {
+		return o, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &o.m); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w", path, err)
+	}
+	return o, nil
+}
+
+func (o *offsets) get(key string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.m[key]
+}
+
+func (o *offsets) set(key string, lines int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.m[key] = lines
+	return o.save()
+}
+
+func (o *offsets) delete(key string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.m[key]; !ok {
+		return nil
+	}
+	delete(o.m, key)
+	return o.save()
+}
+
+// move keeps the offset of a file under another key, the file was moved
+func (o *offsets) move(from, to string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	lines, ok := o.m[from]
+	if !ok {
+		return nil
+	}
+	delete(o.m, from)
+	o.m[to] = lines
+	return o.save()
+}
+
+// save writes the checkpoint atomically, caller must hold the lock
+func (o *offsets) save() error {
+	if o.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(o.m)
+	if err != nil {
+		return err
+	}
+	tmp := o.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path)
+}
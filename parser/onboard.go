@@ -0,0 +1,189 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// onboarding invokes a hook for namespaces never seen before, e.g. to create
+// a Loki tenant or Grafana datasource for a new team. Namespaces whose hook
+// failed are retried when the next file of them is listed. Hooks should be
+// idempotent, without a namespaces file every namespace is new after a
+// restart.
+type onboarding struct {
+	mu       sync.Mutex
+	hook     string // http(s) URL to POST to, or a command split on spaces
+	timeout  time.Duration
+	path     string          // optional file to persist the known namespaces
+	known    map[string]bool // namespaces whose hook succeeded
+	running  map[string]bool
+	dirty    bool
+	failures atomic.Int64
+}
+
+// onboardEvent is POSTed as JSON to a hook URL, or passed to a hook command
+// as NAMESPACE, CLUSTER, BUCKET and KEY environment variables
+type onboardEvent struct {
+	Namespace string `json:"namespace"`
+	Cluster   string `json:"cluster"`
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"` // first file listed of the namespace
+}
+
+func newOnboarding(hook, path string, timeout time.Duration) (*onboarding, error) {
+	if hook == "" {
+		return nil, nil
+	}
+	o := &onboarding{
+		hook:    hook,
+		timeout: timeout,
+		path:    path,
+		known:   make(map[string]bool),
+		running: make(map[string]bool),
+	}
+	if path == "" {
+		return o, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read namespaces file %s: %w", path, err)
+	}
+	var known []string
+	if err := json.Unmarshal(data, &known); err != nil {
+		return nil, fmt.Errorf("failed to parse namespaces file %s: %w", path, err)
+	}
+	for _, ns := range known {
+		o.known[ns] = true
+	}
+	return o, nil
+}
+
+// onboard runs the hook in the background for a namespace not seen before
+func (s *Parser) onboard(key string) {
+	o := s.onboarding
+	if o == nil {
+		return
+	}
+	namespace, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return
+	}
+	o.mu.Lock()
+	if o.known[namespace] || o.running[namespace] {
+		o.mu.Unlock()
+		return
+	}
+	o.running[namespace] = true
+	o.mu.Unlock()
+
+	go func() {
+		event := onboardEvent{Namespace: namespace, Cluster: s.opts.ClusterName, Bucket: s.opts.BucketName, Key: key}
+		err := o.run(event)
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		delete(o.running, namespace)
+		if err != nil {
+			o.failures.Add(1)
+			s.logger.Error("namespace hook failed, will retry", "namespace", namespace, "err", err)
+			return
+		}
+		s.logger.Info("new namespace onboarded", "namespace", namespace)
+		o.known[namespace] = true
+		o.dirty = true
+	}()
+}
+
+func (o *onboarding) run(event onboardEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	if strings.HasPrefix(o.hook, "http://") || strings.HasPrefix(o.hook, "https://") {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.hook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("unexpected status %s: %s", resp.Status, msg)
+		}
+		return nil
+	}
+	args := strings.Fields(o.hook)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"NAMESPACE="+event.Namespace,
+		"CLUSTER="+event.Cluster,
+		"BUCKET="+event.Bucket,
+		"KEY="+event.Key,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// SaveNamespaces persists the onboarded namespaces to the namespaces file,
+// if configured
+func (s *Parser) SaveNamespaces() error {
+	o := s.onboarding
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.path == "" || !o.dirty {
+		return nil
+	}
+	known := make([]string, 0, len(o.known))
+	for ns := range o.known {
+		known = append(known, ns)
+	}
+	sort.Strings(known)
+	data, err := json.Marshal(known)
+	if err != nil {
+		return err
+	}
+	tmp := o.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+	o.dirty = false
+	return nil
+}
+
+func (o *onboarding) writeMetrics(w io.Writer) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintf(w, "cloudfront_logs_shipper_onboarded_namespaces %d\n", len(o.known))
+	fmt.Fprintf(w, "cloudfront_logs_shipper_namespace_hook_failures_total %d\n", o.failures.Load())
+}
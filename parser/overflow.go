@@ -0,0 +1,338 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// overflow handles keys listed while the queue is full
+type overflow struct {
+	policy    string // block, drop or spill
+	mu        sync.Mutex
+	path      string // spill file, keys queued by the next scan
+	spilled   int
+	loose     int // keys spilled alone since the last block
+	dropped   atomic.Int64
+	corrupted atomic.Int64 // bytes of spill records truncated at startup
+	logger    *slog.Logger
+}
+
+func newOverflow(policy, path string, logger *slog.Logger) (*overflow, error) {
+	switch policy {
+	case "block", "drop":
+	case "spill":
+		if path == "" {
+			return nil, fmt.Errorf("queue-spill-file is required with the spill overflow policy")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported queue overflow policy %q", policy)
+	}
+	return &overflow{policy: policy, path: path, logger: logger}, nil
+}
+
+// unspilled returns the restored keys not in the spill file, spilled keys
+// are queued by the first scan from the spill file
+func (o *overflow) unspilled(restore []string) ([]string, error) {
+	if o.policy != "spill" {
+		return restore, nil
+	}
+	keys, err := o.recoverSpill()
+	if err != nil {
+		return nil, err
+	}
+	o.spilled = len(keys)
+	spilled := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		spilled[key] = true
+	}
+	return slices.DeleteFunc(restore, func(key string) bool { return spilled[key] }), nil
+}
+
+// enqueue queues a key, returns false if the scan should stop listing
+func (s *Parser) enqueue(key *string) bool {
+	o := s.overflow
+	if o.policy == "block" {
+		s.queue <- key
+		s.activity.emit("file_queued", *key, 0, nil)
+		return true
+	}
+	select {
+	case s.queue <- key:
+		s.activity.emit("file_queued", *key, 0, nil)
+		return true
+	default:
+	}
+	if o.policy == "drop" {
+		// listed again by the next scan
+		o.dropped.Add(1)
+		s.replays.forget(*key)
+		s.pending.remove(*key)
+		return false
+	}
+	if err := o.spill(*key); err != nil {
+		s.logger.Error("failed to spill queued file, waiting for the queue", "key", *key, "err", err)
+		s.queue <- key
+	}
+	s.activity.emit("file_queued", *key, 0, nil)
+	return true
+}
+
+// spill appends a key to the spill file, it stays pending. Keys spilled
+// alone are compacted into a block every spillBlock keys.
+func (o *overflow) spill(key string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, err := os.OpenFile(o.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	var record []byte
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		record = append(record, spillMagic...)
+	}
+	if _, err := f.Write(appendSpillRecord(record, key)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	o.spilled++
+	o.loose++
+	if o.loose >= spillBlock {
+		if err := o.compact(); err != nil {
+			// the keys are in the file, only less compressed
+			o.logger.Warn("failed to compact spill file", "path", o.path, "err", err)
+		}
+	}
+	return nil
+}
+
+// compact replaces the keys spilled alone after the last block by a block
+func (o *overflow) compact() error {
+	f, err := o.read()
+	if err != nil || f.legacy {
+		return err
+	}
+	data := append(f.data[:f.loose:f.loose], appendSpillBlock(nil, f.keys[f.blocks:])...)
+	if err := writeFile(o.path, data); err != nil {
+		return err
+	}
+	o.loose = 0
+	return nil
+}
+
+// take returns and removes the spilled keys
+func (o *overflow) take() ([]string, error) {
+	if o.policy != "spill" {
+		return nil, nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, err := o.read()
+	if err != nil || len(f.keys) == 0 {
+		return nil, err
+	}
+	if err := os.Truncate(o.path, 0); err != nil {
+		return nil, fmt.Errorf("failed to truncate spill file %s: %w", o.path, err)
+	}
+	o.spilled = 0
+	o.loose = 0
+	return f.keys, nil
+}
+
+// recoverSpill reads the spill file at startup: a tail of records corrupted by a
+// crash mid-write is truncated, the keys are listed again by a scan, and a
+// file of the former line format is rewritten as a block
+func (o *overflow) recoverSpill() ([]string, error) {
+	f, err := o.read()
+	if err != nil {
+		return nil, err
+	}
+	if f.legacy {
+		if err := writeFile(o.path, appendSpillBlock([]byte(spillMagic), f.keys)); err != nil {
+			return nil, fmt.Errorf("failed to convert spill file %s: %w", o.path, err)
+		}
+		return f.keys, nil
+	}
+	if size := int64(len(f.data)); size > f.valid {
+		o.logger.Warn("truncating corrupted records of spill file", "path", o.path, "keys", len(f.keys), "bytes", size-f.valid)
+		o.corrupted.Add(size - f.valid)
+		if err := os.Truncate(o.path, f.valid); err != nil {
+			return nil, fmt.Errorf("failed to truncate spill file %s: %w", o.path, err)
+		}
+	}
+	o.loose = len(f.keys) - f.blocks
+	return f.keys, nil
+}
+
+// spillFile is a spill file read up to its first corrupted record
+type spillFile struct {
+	data   []byte
+	keys   []string
+	valid  int64 // size of the valid records
+	loose  int64 // offset of the keys spilled alone after the last block
+	blocks int   // keys of the blocks, before the loose ones
+	legacy bool  // of the former line format
+}
+
+// read returns the keys of the spill file up to the first corrupted record
+func (o *overflow) read() (spillFile, error) {
+	data, err := os.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return spillFile{}, nil
+	}
+	if err != nil {
+		return spillFile{}, fmt.Errorf("failed to read spill file %s: %w", o.path, err)
+	}
+	f := spillFile{data: data}
+	if len(data) == 0 {
+		return f, nil
+	}
+	if !bytes.HasPrefix(data, []byte(spillMagic)) {
+		for _, line := range strings.Split(string(data), "\n") {
+			if key := strings.TrimSpace(line); key != "" {
+				f.keys = append(f.keys, key)
+			}
+		}
+		f.valid, f.legacy = int64(len(data)), true
+		return f, nil
+	}
+	f.keys, f.valid, f.loose, f.blocks = readSpillRecords(data, len(spillMagic))
+	return f, nil
+}
+
+// writeFile replaces a file atomically
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// spillMagic starts a spill file of records. A record is the length and a
+// CRC-32C of its payload, big-endian, then the payload: a kind byte followed
+// by a key spilled alone, or by a block of keys compressed with zstd, each
+// after its uvarint length.
+const spillMagic = "CFSPILL1"
+
+// kinds of spill records
+const (
+	spillKey  = 'k' // a key spilled alone
+	spillKeys = 'z' // a block of keys
+)
+
+// spillBlock is the number of keys spilled alone compacted into a block
+const spillBlock = 256
+
+var (
+	spillCRC     = crc32.MakeTable(crc32.Castagnoli)
+	spillEncoder = sync.OnceValue(func() *zstd.Encoder {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return e
+	})
+	spillDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		return d
+	})
+)
+
+// appendSpillRecord appends the record of a key spilled alone
+func appendSpillRecord(dst []byte, key string) []byte {
+	return appendRecord(dst, append([]byte{spillKey}, key...))
+}
+
+// appendSpillBlock appends the record of a block of keys, nothing for none
+func appendSpillBlock(dst []byte, keys []string) []byte {
+	if len(keys) == 0 {
+		return dst
+	}
+	var block []byte
+	for _, key := range keys {
+		block = binary.AppendUvarint(block, uint64(len(key)))
+		block = append(block, key...)
+	}
+	return appendRecord(dst, spillEncoder().EncodeAll(block, []byte{spillKeys}))
+}
+
+func appendRecord(dst, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = binary.BigEndian.AppendUint32(dst, crc32.Checksum(payload, spillCRC))
+	return append(dst, payload...)
+}
+
+// readSpillRecords returns the keys of the records from off up to the first
+// corrupted one, the offset after the last valid record, the offset of the
+// keys after the last block and the number of keys before
+func readSpillRecords(data []byte, off int) (keys []string, valid, loose int64, blocks int) {
+	loose = int64(off)
+	for {
+		recordKeys, n, ok := readSpillRecord(data[off:])
+		if !ok {
+			return keys, int64(off), loose, blocks
+		}
+		keys = append(keys, recordKeys...)
+		off += n
+		if data[off-n+8] == spillKeys {
+			loose, blocks = int64(off), len(keys)
+		}
+	}
+}
+
+// readSpillRecord returns the keys of the record data starts with and the
+// record size, ok is false at the end or for a truncated or corrupted record
+func readSpillRecord(data []byte) (keys []string, n int, ok bool) {
+	if len(data) < 9 {
+		return nil, 0, false
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if size < 2 || size > len(data)-8 {
+		return nil, 0, false
+	}
+	payload := data[8 : 8+size]
+	if crc32.Checksum(payload, spillCRC) != binary.BigEndian.Uint32(data[4:]) {
+		return nil, 0, false
+	}
+	switch payload[0] {
+	case spillKey:
+		return []string{string(payload[1:])}, 8 + size, true
+	case spillKeys:
+		block, err := spillDecoder().DecodeAll(payload[1:], nil)
+		if err != nil {
+			return nil, 0, false
+		}
+		for len(block) > 0 {
+			l, w := binary.Uvarint(block)
+			if w <= 0 || l == 0 || l > uint64(len(block)-w) {
+				return nil, 0, false
+			}
+			keys = append(keys, string(block[w:w+int(l)]))
+			block = block[w+int(l):]
+		}
+		return keys, 8 + size, len(keys) > 0
+	}
+	return nil, 0, false
+}
+
+func (o *overflow) writeMetrics(w io.Writer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintf(w, "cloudfront_logs_shipper_queue_overflow_dropped_total %d\n", o.dropped.Load())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_queue_spilled_files %d\n", o.spilled)
+	if o.policy == "spill" {
+		fmt.Fprintf(w, "cloudfront_logs_shipper_queue_spill_corrupted_bytes_total %d\n", o.corrupted.Load())
+	}
+}
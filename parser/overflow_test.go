@@ -0,0 +1,184 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func newTestOverflow(t *testing.T) *overflow {
+	t.Helper()
+	o, err := newOverflow("spill", filepath.Join(t.TempDir(), "spill"), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestReadSpillRecord(t *testing.T) {
+	key := appendSpillRecord(nil, "ns/E2EXAMPLE.2024-05-01-12.a1b2c3d4.gz")
+	block := appendSpillBlock(nil, []string{"ns/a.gz", "ns/b.gz", "ns/c\nd.gz"})
+	corrupted := slices.Clone(key)
+	corrupted[len(corrupted)-1] ^= 0xff
+	tests := []struct {
+		name string
+		data []byte
+		keys []string
+		ok   bool
+	}{
+		{"key", key, []string{"ns/E2EXAMPLE.2024-05-01-12.a1b2c3d4.gz"}, true},
+		{"block", block, []string{"ns/a.gz", "ns/b.gz", "ns/c\nd.gz"}, true},
+		{"empty", nil, nil, false},
+		{"truncated header", key[:6], nil, false},
+		{"truncated payload", key[:len(key)-1], nil, false},
+		{"checksum mismatch", corrupted, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, n, ok := readSpillRecord(tt.data)
+			if ok != tt.ok || !slices.Equal(keys, tt.keys) {
+				t.Fatalf("readSpillRecord() = %q, %v, want %q, %v", keys, ok, tt.keys, tt.ok)
+			}
+			if ok && n != len(tt.data) {
+				t.Errorf("readSpillRecord() size = %d, want %d", n, len(tt.data))
+			}
+		})
+	}
+}
+
+func TestRecoverSpill(t *testing.T) {
+	keys := []string{"ns/a.gz", "ns/b.gz", "ns/c.gz"}
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		want    []string
+	}{
+		{"intact", func(data []byte) []byte { return data }, keys},
+		{"truncated tail", func(data []byte) []byte { return data[:len(data)-3] }, keys[:2]},
+		{"corrupted tail", func(data []byte) []byte { data[len(data)-1] ^= 0xff; return data }, keys[:2]},
+		{"torn header", func(data []byte) []byte { return append(data, 0, 0, 0) }, keys},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOverflow(t)
+			for _, key := range keys {
+				if err := o.spill(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := os.ReadFile(o.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(o.path, tt.corrupt(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := o.recoverSpill()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("recoverSpill() = %q, want %q", got, tt.want)
+			}
+			// the corrupted tail is gone, spilling goes on after the valid records
+			if err := o.spill("ns/d.gz"); err != nil {
+				t.Fatal(err)
+			}
+			taken, err := o.take()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := append(slices.Clone(tt.want), "ns/d.gz"); !slices.Equal(taken, want) {
+				t.Errorf("take() = %q, want %q", taken, want)
+			}
+		})
+	}
+}
+
+func TestRecoverLegacySpill(t *testing.T) {
+	o := newTestOverflow(t)
+	if err := os.WriteFile(o.path, []byte("ns/a.gz\nns/b.gz\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := o.recoverSpill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ns/a.gz", "ns/b.gz"}; !slices.Equal(got, want) {
+		t.Fatalf("recoverSpill() = %q, want %q", got, want)
+	}
+	f, err := o.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.legacy || !slices.Equal(f.keys, got) || f.blocks != len(got) {
+		t.Errorf("converted file: legacy %v, keys %q, blocks %d", f.legacy, f.keys, f.blocks)
+	}
+}
+
+func TestSpillCompaction(t *testing.T) {
+	o := newTestOverflow(t)
+	var keys []string
+	for i := range 3*spillBlock + 10 {
+		key := fmt.Sprintf("namespace/E2EXAMPLE.2024-05-01-12.%08x.gz", i)
+		keys = append(keys, key)
+		if err := o.spill(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := o.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.blocks != 3*spillBlock || o.loose != 10 {
+		t.Errorf("blocks of %d keys, %d loose, want %d and 10", f.blocks, o.loose, 3*spillBlock)
+	}
+	var plain int
+	for _, key := range keys {
+		plain += len(key)
+	}
+	if len(f.data) >= plain {
+		t.Errorf("spill file of %d bytes, not smaller than the %d bytes of the keys", len(f.data), plain)
+	}
+	taken, err := o.take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(taken, keys) {
+		t.Errorf("take() returned %d keys, want the %d spilled in order", len(taken), len(keys))
+	}
+}
+
+func TestPendingQueueFile(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "queue")
+	if err := os.WriteFile(path, []byte(`["ns/a.gz","ns/b.gz"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPending(path, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.add("ns/c.gz")
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:len(queueMagic)]) != queueMagic {
+		t.Fatalf("queue file not converted: %q", data)
+	}
+	p, err = newPending(path, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ns/a.gz", "ns/b.gz", "ns/c.gz"}; !slices.Equal(p.list(), want) {
+		t.Errorf("list() = %q, want %q", p.list(), want)
+	}
+}
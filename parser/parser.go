@@ -2,31 +2,145 @@ package parser
 
 import (
 	"bufio"
-	"compress/gzip"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"log/slog"
 	"net/http"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/nugored/cf-logs-loki-uploader/clock"
+	"github.com/nugored/cf-logs-loki-uploader/coordinator"
+	"github.com/nugored/cf-logs-loki-uploader/expr"
 	"github.com/nugored/cf-logs-loki-uploader/loki"
 	"github.com/nugored/cf-logs-loki-uploader/models"
+	"github.com/nugored/cf-logs-loki-uploader/remotewrite"
 )
 
+// ErrUnconfirmed is returned when a file was parsed but Loki did not confirm
+// all of its lines, the file is kept
+var ErrUnconfirmed = errors.New("shipped but unconfirmed")
+
+// ErrIncompleteRead is returned when the body of a file ended before its
+// content length, the file is kept
+var ErrIncompleteRead = errors.New("incomplete read")
+
+// ErrChecksum is returned when the body of a file did not match its
+// checksum on any download attempt, the file is kept
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ErrMalformedLine is returned in strict mode when a data line does not
+// match its header
+var ErrMalformedLine = errors.New("malformed line")
+
+// strictAttempts is the attempts of a file failing strict checks before it
+// is moved to the dead-letter prefix
+const strictAttempts = 3
+
+// ErrDecompressedSize is returned when a file decompresses beyond the max
+// bytes or ratio, the file is moved to the dead-letter prefix
+var ErrDecompressedSize = errors.New("decompressed size limit exceeded")
+
 type Parser struct {
-	opts     models.Options
-	s3Client *s3.Client
-	logger   *slog.Logger
-	queue    chan *string
-	stop     bool
+	opts         models.Options
+	s3Client     *s3.Client
+	logger       *slog.Logger
+	queue        chan *string
+	offsets      *offsets
+	gaps         *gaps
+	stop         atomic.Bool
+	versioned    bool
+	lag          atomic.Int64 // seconds between end of delivery hour and shipping of the last file
+	stats        stats
+	encode       encoder
+	hosts        map[string]bool // hosts split into their own stream
+	limiter      *limiter
+	pending      *pending
+	restore      []string // keys queued before a restart, queued on first scan
+	aggregate    *aggregate
+	remoteWrite  *remotewrite.Client
+	schemaDrift  atomic.Int64        // files failed in strict mode for an unexpected header
+	schemas      *schemas            // nil without --schema-url
+	fieldFiles   *fieldFiles         // files shipped by header field
+	transfers    *transfers          // bytes read by distribution
+	slo          *slo                // nil without --slo-latency
+	clock        clock.Clock         // of timestamps and batches, fake in tests
+	empties      *emptyFiles         // nil unless empty files are kept
+	deletes      *deleteBatch        // nil without --delete-window
+	objectLock   *objectLock         // shipped files tagged instead of deleted
+	checksums    *checksums          // nil without --verify-checksums
+	reconciled   *reconciliation     // nil without --reconcile-interval
+	emptyCount   atomic.Int64        // files without data lines
+	deniedReads  atomic.Int64        // files skipped for a read denied without s3:ListBucket
+	malformed    atomic.Int64        // lines not matching their header
+	deadLines    atomic.Int64        // malformed lines moved to the dead-letter prefix
+	unknownEdges atomic.Int64        // lines of edge locations missing from the edge tables
+	warnedEdges  sync.Map            // edge codes warned about as unknown
+	unconfirmed  atomic.Int64        // files parsed whose lines were not all confirmed by Loki
+	tooOld       atomic.Int64        // entries older than the max age
+	slowStart    *slowStart          // nil without a slow start ramp
+	pseudonyms   *pseudonymizer      // nil without pseudonymized fields
+	gdprKey      []byte              // HMAC key of client IP hashes, nil without --gdpr
+	interval     *scanInterval       // nil unless the wait interval is tuned
+	budget       atomic.Int64        // files the current scan may still queue
+	filesPerScan *histogram          // new files found by a scan
+	fileDuration *histogram          // seconds to ship a file
+	truncated    atomic.Int64        // files whose body ended before their content length
+	deadlines    atomic.Int64        // files stopped at the per-file timeout
+	summaryFails atomic.Int64        // file summaries not shipped
+	alerts       *alerter            // nil without --alert-webhook
+	activity     *activity           // nil without --activity-events
+	oversized    atomic.Int64        // lines larger than Loki's max line size
+	location     *time.Location      // timezone of date and hour metadata, nil to omit them
+	progress     atomic.Int64        // unix nanoseconds of the last scan, flush or shipped file
+	backfill     *backfill           // nil unless in backfill or shadow mode
+	ipFilter     *ipFilter           // nil without CIDR lists
+	ipFiltered   atomic.Int64        // lines dropped or tagged by the IP filter
+	dropList     *dropList           // nil without --drop-list
+	dropListed   atomic.Int64        // lines dropped by the drop list
+	enrichers    []namedEnricher     // registered when the parser was created
+	enrichErrors atomic.Int64        // entries an enricher failed for
+	userExprs    *userExprs          // nil without --set and --filter
+	exprErrors   atomic.Int64        // failed or timed out user expressions
+	exprFiltered atomic.Int64        // lines dropped by --filter
+	leases       *leases             // keys handed out to workers, coordinator only
+	remote       *coordinator.Client // coordinator to lease keys from, worker only
+	held         *held               // leases being shipped, worker only
+	claims       claimStore          // nil without a store shared by replicas
+	policies     *policies           // nil without --policy-file
+	replays      *replays            // nil without a replay window
+	overflow     *overflow           // keys listed while the queue is full
+	volume       *volume             // nil without volume alerts
+	onboarding   *onboarding         // nil without a namespace hook
+	excludes     []exclude           // keys of non-log artifacts
+	fence        *fence              // nil without a fence key
+	events       *notifications      // nil unless ingesting S3 event notifications
+	query        *selectQuery        // nil unless reading files with S3 Select
+	stripPrefix  string              // of dead-lettered keys, labeled without it
+	state        *runState           // files being shipped and last errors, for snapshots
+	excludedKeys atomic.Int64        // listed keys matching an exclude pattern
+	listLatency  *histogram          // seconds of ListObjectsV2 calls
+	objectAge    *histogram          // seconds since last modification when queued
+	objectSize   *histogram          // bytes of queued objects
 }
 
 func parseDataLine(line string, headerFields []string) (models.LogEntry, error) {
-	fields := strings.Fields(line) // Simple space split
+	// CloudFront separates fields with tabs, a value may contain spaces.
+	// Lines whose tabs do not split them into the header fields are split on
+	// whitespace as before tabs were recognized.
+	var fields []string
+	if strings.Contains(line, "\t") {
+		fields = strings.Split(line, "\t")
+	}
+	if len(fields) != len(headerFields) {
+		fields = strings.Fields(line)
+	}
 
 	if len(fields) != len(headerFields) {
 		return nil, fmt.Errorf("field count mismatch: expected %d, got %d", len(headerFields), len(fields))
@@ -39,75 +153,611 @@ func parseDataLine(line string, headerFields []string) (models.LogEntry, error)
 	return entry, nil
 }
 
-func NewParser(opts models.Options, s3Client *s3.Client, logger *slog.Logger) *Parser {
+func NewParser(opts models.Options, s3Client *s3.Client, logger *slog.Logger) (*Parser, error) {
+	if opts.GDPR {
+		if err := validateGDPR(opts); err != nil {
+			return nil, err
+		}
+	}
+	switch opts.FLE {
+	case "auto", "drop", "keep":
+	default:
+		return nil, fmt.Errorf("unsupported fle mode %q", opts.FLE)
+	}
+	switch opts.OldEntries {
+	case "clamp", "drop":
+	default:
+		return nil, fmt.Errorf("unsupported old entries action %q", opts.OldEntries)
+	}
+	if err := loki.ValidateCompression(opts); err != nil {
+		return nil, err
+	}
+	if err := loki.ValidateIdempotency(opts); err != nil {
+		return nil, err
+	}
+	if err := validateBucket(opts); err != nil {
+		return nil, err
+	}
+	if err := validateSelection(opts); err != nil {
+		return nil, err
+	}
+	if err := validateInputFormat(opts); err != nil {
+		return nil, err
+	}
+	ipFilter, err := newIPFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+	userExprs, err := newUserExprs(opts)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.LokiHTTP2 {
+	case "auto", "force", "off":
+	default:
+		return nil, fmt.Errorf("unsupported loki-http2 mode %q", opts.LokiHTTP2)
+	}
+	switch opts.TimestampPrecision {
+	case "ns", "s":
+	default:
+		return nil, fmt.Errorf("unsupported timestamp precision %q", opts.TimestampPrecision)
+	}
+	var location *time.Location
+	if opts.MetadataTimezone != "" {
+		var err error
+		if location, err = time.LoadLocation(opts.MetadataTimezone); err != nil {
+			return nil, fmt.Errorf("invalid metadata timezone: %w", err)
+		}
+	}
+	encode, err := newEncoder(opts)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := newOffsets(opts.CheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := newPending(opts.QueueFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := restoreCounters(opts.CountersFile); err != nil {
+		return nil, err
+	}
+	replays, err := newReplays(opts.ReplayFile, opts.ReplayWindow, opts.ReplayMaxKeys)
+	if err != nil {
+		return nil, err
+	}
+	overflow, err := newOverflow(opts.QueueOverflow, opts.QueueSpillFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Once && opts.QueueOverflow == "spill" {
+		return nil, fmt.Errorf("the spill overflow policy needs further scans, not supported with once")
+	}
+	restore, err := overflow.unspilled(pending.list())
+	if err != nil {
+		return nil, err
+	}
+	onboarding, err := newOnboarding(opts.NamespaceHook, opts.NamespacesFile, opts.NamespaceHookTimeout)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := newExcludes(opts.Excludes)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxDecompressedRatio > 0 || opts.MaxDecompressedBytes > 0 {
+		// files over the limits are moved there
+		excludes = append(excludes, exclude{re: regexp.MustCompile("^" + regexp.QuoteMeta(opts.DeadLetterPrefix))})
+	}
+	fence, err := newFence(opts)
+	if err != nil {
+		return nil, err
+	}
+	query, err := newSelectQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+	capacity := opts.QueueCapacity
+	if capacity <= 0 {
+		capacity = 10 * opts.Workers
+	}
 	parser := &Parser{
-		opts:     opts,
-		s3Client: s3Client,
-		logger:   logger,
-		queue:    make(chan *string, 10*opts.Workers),
+		opts:       opts,
+		s3Client:   s3Client,
+		logger:     logger,
+		queue:      make(chan *string, capacity),
+		offsets:    offsets,
+		pending:    pending,
+		restore:    restore,
+		overflow:   overflow,
+		volume:     newVolume(opts),
+		onboarding: onboarding,
+		excludes:   excludes,
+		fence:      fence,
+		query:      query,
+		state:      newRunState(),
+		gaps:       newGaps(),
+		encode:     encode,
+		location:   location,
+		ipFilter:   ipFilter,
+		enrichers:  registeredEnrichers(),
+		userExprs:  userExprs,
+		replays:    replays,
+		hosts:      make(map[string]bool),
+	}
+	// buckets from a fast list to a slow paginated prefix, from a file
+	// picked up within a scan interval to a day of backlog, and from a
+	// quiet distribution to a busy one
+	parser.listLatency = newHistogram("cloudfront_logs_shipper_list_duration_seconds", 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+	parser.objectAge = newHistogram("cloudfront_logs_shipper_object_age_seconds", 60, 300, 900, 1800, 3600, 7200, 21600, 86400)
+	parser.objectSize = newHistogram("cloudfront_logs_shipper_object_size_bytes", 1<<10, 16<<10, 128<<10, 1<<20, 8<<20, 64<<20, 512<<20)
+	parser.filesPerScan = newHistogram("cloudfront_logs_shipper_scan_files", 0, 1, 5, 10, 50, 100, 500, 1000, 5000)
+	parser.fileDuration = newHistogram("cloudfront_logs_shipper_file_duration_seconds", 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300)
+	if opts.NamespaceConcurrency > 0 {
+		parser.limiter = newLimiter(opts.NamespaceConcurrency)
+	}
+	if opts.RemoteWriteURL != "" {
+		parser.aggregate = newAggregate()
+		parser.remoteWrite = remotewrite.NewClient(opts.RemoteWriteURL)
+	}
+	switch {
+	case opts.Backfill:
+		parser.backfill = newBackfill(opts.BackfillRate)
+	case opts.Shadow:
+		// files are kept like in backfill mode, without its throttle
+		parser.backfill = newBackfill(0)
+		logger.Info("shadow mode, shipped files are kept in the bucket")
+	}
+	parser.slowStart = newSlowStart(opts)
+	if err := parser.setupAlerts(opts); err != nil {
+		return nil, err
+	}
+	if parser.activity, err = newActivity(opts, logger); err != nil {
+		return nil, err
+	}
+	parser.fieldFiles = newFieldFiles()
+	parser.transfers = newTransfers()
+	parser.slo = newSLO(opts)
+	parser.clock = clock.Real
+	parser.deletes = parser.newDeleteBatch()
+	parser.objectLock = newObjectLock()
+	if opts.VerifyChecksums {
+		parser.checksums = &checksums{}
+	}
+	if opts.ReconcileInterval > 0 {
+		parser.reconciled = &reconciliation{}
+	}
+	switch opts.EmptyFiles {
+	case "delete":
+	case "keep", "tag":
+		parser.empties = &emptyFiles{keys: make(map[string]bool)}
+	default:
+		return nil, fmt.Errorf("unsupported empty files action %q", opts.EmptyFiles)
+	}
+	if opts.SchemaURL != "" {
+		parser.schemas = &schemas{published: make(map[string]bool)}
+	}
+	if parser.gdprKey, err = newGDPRKey(opts); err != nil {
+		return nil, err
 	}
-	return parser
+	if parser.pseudonyms, err = newPseudonymizer(opts); err != nil {
+		return nil, err
+	}
+	if parser.interval, err = newScanInterval(opts); err != nil {
+		return nil, err
+	}
+	if opts.DropList != "" {
+		parser.dropList = &dropList{}
+		if err := parser.RefreshDropList(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	for _, host := range opts.SplitHosts {
+		parser.hosts[host] = true
+	}
+	if err := parser.setupRole(opts); err != nil {
+		return nil, err
+	}
+	if err := parser.setupNotifications(opts); err != nil {
+		return nil, err
+	}
+	if opts.PolicyFile != "" {
+		parser.policies = &policies{}
+		if err := parser.RefreshPolicies(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.RedisURL != "" {
+		if opts.ClaimLeaseTTL <= 0 {
+			return nil, fmt.Errorf("claim-lease-ttl must be positive")
+		}
+		if parser.claims, err = newRedisClaims(opts); err != nil {
+			return nil, err
+		}
+	}
+	parser.progress.Store(time.Now().UnixNano())
+	parser.versioned = parser.detectVersioning(context.Background())
+	if parser.versioned {
+		logger.Info("bucket versioning detected, deleting processed versions", "purge-versions", opts.PurgeVersions)
+	}
+	return parser, nil
+}
+
+// SetClock replaces the clock of timestamps and batches, for tests
+func (s *Parser) SetClock(c clock.Clock) {
+	s.clock = c
 }
 
 // Stop gracefully all workers
 func (s *Parser) Stop() {
-	if s.stop {
-		return
+	if s.stop.CompareAndSwap(false, true) {
+		close(s.queue)
 	}
-	s.stop = true
-	close(s.queue)
 }
 
 func (s *Parser) Scan() error {
+	if s.opts.IngestMode == "sqs" {
+		return nil // files are notified through SQS, the bucket may not be listable
+	}
 	num := 0
 	ctx := context.Background()
-	maxKeys := int32(1000) //no pager, tune interval to have less files per run
-	output, err := s.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket:  &s.opts.BucketName,
-		MaxKeys: &maxKeys,
-	})
+	backlog := len(s.queue)
+
+	start := time.Now()
+	s.expirePublished()
+	for i, key := range s.restore {
+		if s.stop.Load() {
+			break
+		}
+		if !s.enqueue(&key) {
+			s.restore = s.restore[i+1:] // dropped keys were removed from pending
+			return nil
+		}
+		num++
+	}
+	if len(s.restore) > 0 {
+		s.logger.Info("restored queued files", "files", len(s.restore))
+		s.restore = nil
+	}
+	spilled, err := s.overflow.take()
 	if err != nil {
 		return err
 	}
-
-	start := time.Now()
-	for _, obj := range output.Contents {
-		if obj.Key == nil || obj.Size== nil || *obj.Size==0 || s.stop || strings.HasSuffix(*obj.Key, "/") {
-			continue
+	for _, key := range spilled {
+		if s.stop.Load() {
+			break
 		}
-		s.queue <- obj.Key
+		s.pending.add(key)
+		s.enqueue(&key) // spilled again if the queue is still full
 		num++
 	}
+
+	s.budget.Store(int64(s.opts.MaxFilesPerCycle))
+	prefixes := s.opts.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	// one lister per prefix, all feeding the bounded queue
+	var wg sync.WaitGroup
+	var found atomic.Int64
+	var stopped atomic.Bool // a lister stopped before the end of its prefix
+	errs := make([]error, len(prefixes))
+	s.objectLock.beginScan()
+	for i, prefix := range prefixes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, complete, err := s.scanPrefix(ctx, prefix)
+			found.Add(int64(n))
+			if !complete {
+				stopped.Store(true)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to list prefix %q: %w", prefix, err)
+			}
+		}()
+	}
+	wg.Wait()
+	num += int(found.Load())
+	err = errors.Join(errs...)
+	s.objectLock.endScan(err == nil && !stopped.Load())
+	if err != nil {
+		return err
+	}
+
+	s.progress.Store(time.Now().UnixNano())
+	s.filesPerScan.observe(float64(num))
+	s.interval.observe(num, backlog)
 	if num > 0 {
 		s.logger.Info("new files", "found", num, "duration", time.Since(start), "queue", len(s.queue))
 	}
+	if s.opts.MaxFilesPerCycle > 0 && s.budget.Load() < 0 {
+		s.logger.Info("reached the files per scan cycle, the rest is queued by the next scans", "max", s.opts.MaxFilesPerCycle)
+	}
 	return nil
 }
 
+// takeBudget reports whether the current scan may queue another listed
+// file, files beyond the cap stay in the bucket for the next scans
+func (s *Parser) takeBudget() bool {
+	if s.opts.MaxFilesPerCycle <= 0 {
+		return true
+	}
+	return s.budget.Add(-1) >= 0
+}
+
+// scanPrefix queues the new files below a prefix and returns their number,
+// complete is false if the listing stopped before the end of the prefix
+func (s *Parser) scanPrefix(ctx context.Context, prefix string) (num int, complete bool, err error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: &s.opts.BucketName,
+	}
+	if prefix != "" {
+		input.Prefix = &prefix
+	}
+	// every page is listed, files kept in the bucket (backfill, shadow, kept
+	// empty files, Object Lock) would otherwise fill the first one for good
+	pages := s3.NewListObjectsV2Paginator(s.s3Client, input)
+	for pages.HasMorePages() && !s.stop.Load() {
+		start := time.Now()
+		output, err := pages.NextPage(ctx)
+		s.listLatency.observe(time.Since(start).Seconds())
+		if err != nil {
+			return num, false, err
+		}
+		if !s.queuePage(ctx, prefix, output.Contents, &num) {
+			return num, false, nil
+		}
+	}
+	return num, !s.stop.Load(), nil
+}
+
+// queuePage queues the new files of a listed page, it returns false once
+// the scan should stop listing
+func (s *Parser) queuePage(ctx context.Context, prefix string, objects []types.Object, num *int) bool {
+	for _, obj := range objects {
+		// empty objects and folder placeholders are neither processed nor deleted
+		if obj.Key == nil || obj.Size == nil || *obj.Size == 0 || s.stop.Load() || strings.HasSuffix(*obj.Key, "/") {
+			continue
+		}
+		if s.excluded(*obj.Key) || (s.fence != nil && *obj.Key == s.fence.key) {
+			s.excludedKeys.Add(1)
+			continue
+		}
+		if !s.selected(obj) {
+			s.stats.filesSkipped.Add(1)
+			continue
+		}
+		if lf, ok := parseLogFileName(*obj.Key); ok {
+			if time.Since(lf.Hour) < s.opts.SettleTime {
+				s.stats.filesSkipped.Add(1)
+				continue // CloudFront may still deliver more files for this hour
+			}
+			if missing := s.gaps.observe(lf.Distribution, lf.Hour); missing > 0 {
+				s.logger.Warn("gap in delivered files, logs may be lost", "distribution", lf.Distribution, "missing_hours", missing, "key", *obj.Key)
+			}
+		}
+		s.onboard(*obj.Key)
+		if s.backfill.has(*obj.Key) {
+			continue // kept in the bucket by backfill or shadow mode
+		}
+		if s.empties.kept(*obj.Key) || s.objectLock.listed(*obj.Key) {
+			continue
+		}
+		if s.pending.has(*obj.Key) {
+			continue // still queued from a previous scan
+		}
+		if !s.takeBudget() {
+			return false // listed again in order by the next scan
+		}
+		if obj.ETag != nil && !s.replays.queue(*obj.Key, *obj.ETag) {
+			s.skipReplay(ctx, *obj.Key)
+			continue // re-delivered unchanged
+		}
+		if !s.pending.add(*obj.Key) {
+			continue
+		}
+		if !s.enqueue(obj.Key) {
+			s.logger.Warn("queue full, dropping the rest of the scan cycle", "prefix", prefix, "capacity", cap(s.queue))
+			return false
+		}
+		if obj.LastModified != nil {
+			s.objectAge.observe(time.Since(*obj.LastModified).Seconds())
+		}
+		s.objectSize.observe(float64(*obj.Size))
+		*num++
+	}
+	return true
+}
+
 func (s *Parser) Worker() error {
 	ctx := context.Background() // limit time to process file? will restart of processing help?
+	s.stats.workers.Add(1)
+	defer s.stats.workers.Add(-1)
 
-	for fn := range s.queue {
+	for fn := s.next(); fn != nil; fn = s.next() {
+		if !s.Fenced() {
+			s.done(*fn)
+			s.unfence(*fn)
+			continue
+		}
+		if err := s.slowStart.acquire(ctx); err != nil {
+			s.done(*fn)
+			return err
+		}
+		release, ok := s.claim(ctx, *fn)
+		if !ok {
+			s.slowStart.release()
+			s.done(*fn)
+			s.replays.forget(*fn)
+			s.pending.remove(*fn)
+			s.report(*fn, fmt.Errorf("file claimed by another replica or claim store failed"))
+			continue
+		}
 
-		if err := s.parseFile(ctx, *fn); err != nil {
+		s.state.begin(*fn)
+		s.activity.emit("file_started", *fn, s.state.attemptsOf(*fn), nil)
+		s.stats.busy.Add(1)
+		started := time.Now()
+		leaseCtx := s.leaseContext(ctx, *fn)
+		fileCtx, cancel := s.fileContext(leaseCtx)
+		versionID, err := s.parseFile(fileCtx, *fn)
+		expired := s.timedOut(fileCtx, err)
+		lost := leaseCtx.Err() != nil
+		cancel()
+		s.stats.busy.Add(-1)
+		s.state.end(*fn, err)
+		s.slowStart.release()
+		s.done(*fn)
+		release(err == nil && !lost)
+		if lost {
+			// neither deleted nor completed, the worker leasing it now ships
+			// it from its checkpoint
+			s.logger.Warn("lease lost, file left to the coordinator", "key", *fn, "err", err)
+			s.replays.forget(*fn)
+			s.pending.remove(*fn)
+			s.report(*fn, errLeaseLost)
+			continue
+		}
+		if expired && !s.opts.Once { // a run-once reports it as failed
+			s.logger.Warn("file deadline reached, shipping resumes from its checkpoint", "key", *fn, "timeout", s.opts.FileTimeout, "err", err)
+			s.deadlines.Add(1)
+			s.replays.forget(*fn)
+			s.pending.remove(*fn) // listed again by a later scan
+			s.report(*fn, err)
+			continue
+		}
+		if errors.Is(err, errNoSuchKey) || errors.Is(err, errReadDenied) {
+			// the notification is acknowledged, nothing is deleted: a delete
+			// of a missing key leaves a delete marker on versioned buckets,
+			// and a file whose read was denied stays in the bucket
+			s.replays.forget(*fn)
+			s.pending.remove(*fn)
+			s.settle(*fn, nil)
+			continue
+		}
+		strict := errors.Is(err, ErrSchemaDrift) || errors.Is(err, ErrMalformedLine)
+		exhausted := strict && s.state.attemptsOf(*fn) >= strictAttempts
+		if strict && !exhausted && !s.opts.Once { // a run-once reports it as failed
+			// the same content fails again, a restart would loop on it: the
+			// file is attempted again by a later scan or delivery
+			s.logger.Error("file failed strict checks", "key", *fn, "attempt", s.state.attemptsOf(*fn), "err", err)
+			s.RecordError(*fn, err)
+			s.report(*fn, err)
+			s.replays.forget(*fn)
+			s.pending.remove(*fn)
+			continue
+		}
+		if exhausted || errors.Is(err, ErrDecompressedSize) {
+			reason := "file exceeds the decompressed size limits"
+			if exhausted {
+				reason = fmt.Sprintf("file failed strict checks %d times", s.state.attemptsOf(*fn))
+			}
+			s.logger.Error(reason, "key", *fn, "err", err)
+			s.alert("FileFailed", *fn, reason, err)
+			s.RecordError(*fn, err)
+			s.stats.filesFailed.Add(1)
+			s.report(*fn, err)
+			s.replays.forget(*fn)
+			s.pending.remove(*fn)
+			if err := s.deadLetter(ctx, *fn); err != nil {
+				s.logger.Error("failed to move file to the dead-letter prefix", "key", *fn, "err", err)
+			}
+			continue
+		}
+		if err != nil {
 			s.logger.Error("failed to ship file", "key", *fn, "err", err)
+			s.alert("FileFailed", *fn, fmt.Sprintf("failed to ship file after %d attempts", s.state.attemptsOf(*fn)), err)
+			s.RecordError(*fn, err)
+			s.stats.filesFailed.Add(1)
+			s.report(*fn, err)
+			s.replays.forget(*fn)
+			if s.opts.Once {
+				s.pending.remove(*fn)
+				continue // report the failure in the summary, keep the file
+			}
 			return err // pod restart instead of deletion of not-shipped file
 		}
+		s.fileDuration.observe(time.Since(started).Seconds())
 
-		if _, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
-			Bucket: &s.opts.BucketName,
-			Key:    fn,
-		}); err != nil {
-			s.logger.Error("failed to delete file", "key", *fn, "err", err)
+		if s.empties.kept(*fn) || s.objectLock.kept(*fn) {
+			s.replays.done(*fn)
+			s.pending.remove(*fn)
+			s.report(*fn, nil)
+			continue
 		}
-
+		if s.backfill != nil {
+			s.backfill.done(*fn) // the checkpoint keeps the file as shipped
+			s.replays.done(*fn)
+			s.pending.remove(*fn)
+			s.report(*fn, nil)
+			continue
+		}
+		if !s.Fenced() {
+			// shipped, the fence holder resumes it from its checkpoint
+			s.logger.Warn("fence lost while shipping, file kept for the fence holder", "key", *fn)
+			s.replays.forget(*fn)
+			s.pending.remove(*fn)
+			s.report(*fn, errFenceLost)
+			continue
+		}
+		if leaseCtx.Err() != nil {
+			s.logger.Warn("lease lost after shipping, file left to the coordinator", "key", *fn)
+			s.replays.forget(*fn)
+			s.pending.remove(*fn)
+			s.report(*fn, errLeaseLost)
+			continue
+		}
+		s.deleteShipped(ctx, *fn, versionID)
 	}
 	return nil
 }
 
-func (s *Parser) parseFile(ctx context.Context, fn string) error {
-	start := time.Now()
+// deleted settles a shipped file once its delete completed
+func (s *Parser) deleted(fn string, err error) {
+	if err != nil {
+		s.logger.Error("failed to delete file", "key", fn, "err", err)
+		s.RecordError(fn, fmt.Errorf("failed to delete file: %w", err))
+		s.replays.forget(fn)
+		s.pending.remove(fn)
+		s.report(fn, fmt.Errorf("failed to delete file: %w", err))
+		return
+	}
+	s.replays.done(fn)
+	s.pending.remove(fn)
+	s.report(fn, nil)
+	if s.objectLock.kept(fn) {
+		return // the checkpoint keeps the file as shipped
+	}
+	if err := s.offsets.delete(fn); err != nil {
+		s.logger.Error("failed to update checkpoint", "key", fn, "err", err)
+	}
+}
+
+// fileContext bounds the processing of a file by the per-file timeout
+func (s *Parser) fileContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.opts.FileTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.opts.FileTimeout)
+}
+
+// timedOut reports whether shipping a file stopped at its own deadline rather
+// than failed, its shipped lines are checkpointed. A push timing out is a
+// failure, only the per-file timeout having expired counts.
+func (s *Parser) timedOut(fileCtx context.Context, err error) bool {
+	if err == nil || s.opts.FileTimeout <= 0 {
+		return false
+	}
+	return errors.Is(err, loki.ErrDeadline) || errors.Is(err, context.DeadlineExceeded) && fileCtx.Err() != nil
+}
 
+// fileLabels returns the stream labels, namespace and file name metadata of
+// a key
+func (s *Parser) fileLabels(fn string) (map[string]string, string, logFile) {
+	fn = strings.TrimPrefix(fn, s.stripPrefix)
 	parts := strings.Split(fn, "/")
 	namespace := parts[0]
 	cloudfrontObjectName := parts[1]
@@ -119,45 +769,138 @@ func (s *Parser) parseFile(ctx context.Context, fn string) error {
 
 	labels["cluster"] = s.opts.ClusterName
 	labels["index"] = fmt.Sprintf("%s-%s", s.opts.ClusterName, namespace)
+	if env := s.opts.Environment; env != "" {
+		labels["environment"] = env
+		labels["index"] = fmt.Sprintf("%s-%s-%s", s.opts.ClusterName, env, namespace)
+	}
+
+	lf, ok := parseLogFileName(fn)
+	if ok {
+		labels["distribution"] = lf.Distribution
+	} else {
+		s.logger.Debug("nonconforming log file name", "key", fn)
+	}
+	s.baseLabels(labels)
 
 	for k, v := range s.opts.Labels {
 		labels[k] = v
 	}
+	return labels, namespace, lf
+}
 
-	b := loki.NewBatch(labels, s.opts, s.logger)
+// parseFile ships the file to Loki and returns the processed object version
+func (s *Parser) parseFile(ctx context.Context, fn string) (*string, error) {
+	start := time.Now()
 
-	obj, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &s.opts.BucketName,
-		Key:    &fn,
-	})
-	if err != nil {
-		if strings.Contains(err.Error(), "NoSuchKey") {
-			s.logger.Debug("skipping non-existent file", "key", fn)
-			return nil
-		}
-		return fmt.Errorf("failed to get object %s: %w", fn, err)
+	labels, namespace, lf := s.fileLabels(fn)
+
+	// the policy is fixed for the file, changes apply to the next one
+	policy := s.policy(namespace)
+	opts := s.opts
+	if tenant := s.namespaceTenant(namespace); tenant != "" {
+		opts.LokiTenant = tenant
 	}
-	defer obj.Body.Close()
+	opts = policy.batchOptions(labels, opts)
+	b := loki.NewBatch(labels, opts, s.logger)
+	b.SetClock(s.clock)
+	if deadline, ok := ctx.Deadline(); ok {
+		b.SetDeadline(deadline)
+	}
+	defer b.Close()
 
-	gzreader, err := gzip.NewReader(obj.Body)
+	obj, err := s.openObject(ctx, fn)
+	if errors.Is(err, errNoSuchKey) {
+		s.logger.Debug("skipping non-existent file", "key", fn)
+		s.stats.filesSkipped.Add(1)
+		if err := s.offsets.delete(fn); err != nil {
+			return nil, err
+		}
+		return nil, errNoSuchKey
+	}
+	if errors.Is(err, errReadDenied) {
+		s.logger.Warn("read denied, file skipped and kept in the bucket", "key", fn, "err", err)
+		s.deniedReads.Add(1)
+		s.stats.filesSkipped.Add(1)
+		return nil, err
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+		return nil, err
+	}
+	defer obj.Close()
+	defer func() { s.transfers.add(lf.Distribution, obj.transfer()) }()
+	if obj.tagged && s.taggedProcessed(ctx, fn, obj.versionID) {
+		s.logger.Info("file tagged as processed, kept in the bucket", "key", fn)
+		s.stats.filesSkipped.Add(1)
+		return obj.versionID, nil
 	}
-	defer gzreader.Close()
 
 	var lineCount int
+	skip := s.offsets.get(fn) // lines shipped by a previous failed attempt
+	shipped := skip
+	if skip > 0 {
+		s.logger.Info("resuming partially shipped file", "key", fn, "skip", skip)
+	}
+	b.SetSource(fn, obj.etag, skip)
 
-	scanner := bufio.NewScanner(gzreader)
+	scanner := bufio.NewScanner(obj)
 	w3cLog := models.W3CLog{}
+	var buf []byte // reused for encoding of every line
+	thresholds := s.thresholds(namespace)
+	shards := s.shards(namespace)
+	var burst errorBurst
+	var order []string
+	summary := s.newFileSummary()
+	usage := newFieldUsage()
+	var malformed []string // lines dead-lettered with the file
+	var unrouted []string  // lines of unknown edges dead-lettered with --unknown-edge=deadletter
+	counts := s.aggregate.file(lf.Distribution)
 
+	// push adds a line to the batch within the rate limits and checkpoints
+	// the lines shipped
+	push := func(route int, extra map[string]string, ts time.Time, line string, metadata map[string]string) error {
+		if err := s.backfill.wait(ctx); err != nil {
+			return err
+		}
+		if err := s.slowStart.wait(ctx); err != nil {
+			return err
+		}
+		if err := policy.wait(ctx); err != nil {
+			return err
+		}
+		if err := b.AddTo(route, extra, ts, line, metadata); errors.Is(err, loki.ErrDeadline) {
+			if err := s.checkpoint(fn, &shipped, skip+b.Shipped()); err != nil {
+				return err
+			}
+			counts.confirm(shipped)
+			return fmt.Errorf("%w after %d of the lines", err, shipped)
+		} else if err != nil {
+			return fmt.Errorf("failed to send batch: %w", err)
+		}
+		if err := s.checkpoint(fn, &shipped, skip+b.Shipped()); err != nil {
+			return err
+		}
+		counts.confirm(shipped)
+		return nil
+	}
+
+	var fileLine int // lines of the file including directives
 	for scanner.Scan() {
 		line := scanner.Text()
+		fileLine++
 
 		if strings.HasPrefix(line, "#Fields:") {
 			// Found the header line
 			parts := strings.Fields(line)
 			// The header starts after "#Fields:"
 			w3cLog.HeaderFields = parts[1:]
+			if !s.functionLog(fn) { // function logs have fixed fields
+				if err := s.checkSchema(w3cLog.HeaderFields); err != nil {
+					return nil, err
+				}
+			}
+			usage.header(w3cLog.HeaderFields)
+			order = fieldOrder(s.opts.FieldOrder, w3cLog.HeaderFields)
+			s.publishSchema(order)
 			continue
 		}
 
@@ -166,46 +909,262 @@ func (s *Parser) parseFile(ctx context.Context, fn string) error {
 			continue
 		}
 
+		lineCount++
+		if lineCount <= skip {
+			continue
+		}
+
 		// This is a data line, use the custom parser
 		entry, err := parseDataLine(line, w3cLog.HeaderFields)
 		if err != nil {
-			return fmt.Errorf("error parsing data line: %w", err)
+			if s.opts.Strict && s.opts.Format != "raw" {
+				return nil, fmt.Errorf("%w %d: %w", ErrMalformedLine, lineCount, err)
+			}
+			// a line of another field set than its header skips the labels,
+			// transforms and routes of its fields: it is filtered by the
+			// values at the positions of the header, scrubbed as a whole and
+			// shipped with malformed="true" metadata only by a route set for
+			// malformed lines, otherwise it is moved to the dead-letter prefix
+			s.malformed.Add(1)
+			s.logger.Debug("malformed line", "key", fn, "line", lineCount, "err", err)
+			if s.malformedFiltered(line, w3cLog.HeaderFields) {
+				b.Skip()
+				continue
+			}
+			route := s.malformedRoute()
+			if route == 0 {
+				malformed = append(malformed, line)
+				b.Skip()
+				continue
+			}
+			if err := push(route, nil, s.clock.Now(), s.scrubLine(line), map[string]string{"malformed": "true"}); err != nil {
+				return nil, err
+			}
+			continue
 		}
-
-		jsonData, err := json.Marshal(entry)
-		if err != nil {
-			log.Fatalf("Error marshaling map to JSON: %v", err)
+		summary.add(entry)
+		usage.add(entry)
+		// hashed before prepare pseudonymizes or anonymizes the address, erase
+		// requests hash the client IP as it was logged
+		var ipHash string
+		if s.opts.GDPR {
+			ipHash = s.hashIP(entry["c-ip"])
 		}
-
-		// Convert the byte slice to a human-readable string and print
-		jsonString := string(jsonData)
-		// fmt.Println("JSON String (Compact):")
-		// fmt.Println(jsonString)
-
-		ts := time.Now()
-		if err = b.Add(ts, jsonString); err != nil {
-			return fmt.Errorf("failed to send batch: %w", err)
+		route, ok := s.prepare(entry, policy)
+		if !ok {
+			if route == deadLetterRoute {
+				unrouted = append(unrouted, line)
+			}
+			b.Skip()
+			continue
+		}
+		ts, ok := s.timestamp(entry)
+		if !ok {
+			b.Skip() // older than the max age
+			continue
+		}
+		tagAnomalies(entry, thresholds, &burst)
+		counts.add(lineCount, entry)
+		streamLabels, metadata := resolveLabels(fn, entry, s.streamLabels(entry)), s.metadata(entry, ipHash)
+		metadata = s.deliveryHourMetadata(lf, metadata)
+		metadata = s.provenanceMetadata(fn, fileLine, metadata)
+		s.dropFields(entry, policy)
+		if s.opts.Format == "raw" {
+			// rebuilt from the prepared entry, never the line as it was read
+			buf = appendRaw(buf[:0], rawLine(w3cLog.HeaderFields, entry), entry, s.opts.RawTimestamp)
+		} else {
+			buf = s.encode(buf[:0], entry, order)
 		}
 
+		if s.opts.LokiMaxLineSize > 0 && len(buf) > s.opts.LokiMaxLineSize {
+			s.oversized.Add(1)
+			s.logger.Debug("line exceeds Loki's max line size", "key", fn, "line", lineCount, "size", len(buf))
+		}
+		if err := push(route, shard(streamLabels, buf, shards), ts, string(buf), metadata); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return err
+		return nil, err
+	}
+	if err := obj.check(lineCount); err != nil {
+		s.truncated.Add(1)
+		return nil, err
+	}
+
+	if lineCount == 0 {
+		s.emptyFile(ctx, fn, lf, obj.versionID)
+		return obj.versionID, nil
 	}
 
-	fmt.Printf("Parsed %s\n", fn)
+	s.logger.Info("parsed file", "key", fn) // through the logger, stdout belongs to the TUI
+
+	if err := s.deadLetterLines(ctx, fn, w3cLog.HeaderFields, malformed); err != nil {
+		return nil, err
+	}
+	if err := s.deadLetterUnrouted(ctx, fn, w3cLog.HeaderFields, unrouted); err != nil {
+		return nil, err
+	}
 
 	if err = b.Flush(); err != nil {
-		return fmt.Errorf("failed to flush batch: %w", err)
+		return nil, fmt.Errorf("failed to flush batch: %w", err)
+	}
+	if err = s.checkpoint(fn, &shipped, skip+b.Shipped()); err != nil {
+		return nil, err
+	}
+	counts.confirm(shipped)
+	// the file may only be deleted once Loki accepted every line of it
+	if pending := b.Pending(); pending > 0 || shipped != lineCount {
+		s.unconfirmed.Add(1)
+		return nil, fmt.Errorf("%w: %d of %d lines confirmed, %d pending", ErrUnconfirmed, shipped, lineCount, pending)
+	}
+	s.shipSummary(fn, obj.etag, summary, skip, labels, opts)
+	s.fieldFiles.record(usage)
+	s.slo.observe(obj.modified)
+	s.stats.filesOK.Add(1)
+	s.progress.Store(time.Now().UnixNano())
+	s.stats.lines.Add(int64(lineCount - skip))
+	s.volume.add(namespace, lineCount-skip)
+	if obj.size != nil {
+		s.stats.bytes.Add(*obj.size)
+	}
+	if !lf.Hour.IsZero() { // conforming file name
+		s.lag.Store(int64(time.Since(lf.Hour.Add(time.Hour)).Seconds()))
 	}
 	s.logger.Debug("shipped file", "key", fn, "labels", fmt.Sprintf("%v", labels), "lines", lineCount, "duration", time.Since(start), "lines/s", fmt.Sprintf("%.2f", float64(lineCount)/time.Since(start).Seconds()))
-	return nil
+	return obj.versionID, nil
+
+}
+
+// streamLabels returns the labels splitting the entry into its own stream
+func (s *Parser) streamLabels(entry models.LogEntry) map[string]string {
+	labels := s.fieldLabels(entry)
+	if len(s.hosts) == 0 {
+		return labels
+	}
+	host := entry["x-host-header"]
+	if host == "" || host == "-" {
+		host = entry["cs(Host)"]
+	}
+	if !s.hosts[host] {
+		return labels // bounded by the allowlist to keep stream cardinality low
+	}
+	if labels == nil {
+		labels = make(map[string]string, 1)
+	}
+	labels["host"] = host
+	return labels
+}
 
+// prepare filters and transforms a parsed entry and returns its route, ok is
+// false if the line is dropped, or dead-lettered for deadLetterRoute
+func (s *Parser) prepare(entry models.LogEntry, policy *policy) (route int, ok bool) {
+	if s.filterIP(entry) {
+		return 0, false
+	}
+	if s.dropList != nil && s.dropList.dropped(entry) {
+		s.dropListed.Add(1)
+		return 0, false
+	}
+	if s.opts.Scrub {
+		scrub(entry)
+	}
+	s.transform(entry)
+	s.enrich(entry)
+	if s.evalExprs(entry) || policy.filtered(entry, expr.NewDeadline(s.clock, s.opts.ExprTimeout)) {
+		return 0, false
+	}
+	route = s.route(entry)
+	if route == deadLetterRoute {
+		return route, false
+	}
+	if s.dropCountry(entry, route) {
+		return route, false
+	}
+	// after enrichment and filters, which need the values in clear
+	s.pseudonymize(entry)
+	return route, true
+}
+
+// Alive reports whether the parser made progress (scan, flush or shipped
+// file) within the given duration and was not stopped
+func (s *Parser) Alive(within time.Duration) bool {
+	return !s.stop.Load() && time.Since(time.Unix(0, s.progress.Load())) < within
+}
+
+// checkpoint records the shipped line offset of a file when it moved forward
+func (s *Parser) checkpoint(fn string, shipped *int, lines int) error {
+	if lines == *shipped {
+		return nil
+	}
+	*shipped = lines
+	s.progress.Store(time.Now().UnixNano())
+	if err := s.offsets.set(fn, lines); err != nil {
+		return fmt.Errorf("failed to update checkpoint: %w", err)
+	}
+	return nil
 }
 
 func (s *Parser) Metrics() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprintf(w, "cloudfront_logs_shipper_queue_length %d\n", len(s.queue))
+		ws := s.WorkerStats()
+		fmt.Fprintf(w, "cloudfront_logs_shipper_queue_length %d\n", ws.Queued)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_queue_capacity %d\n", ws.QueueCapacity)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_workers %d\n", ws.Workers)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_workers_busy %d\n", ws.Busy)
+		s.overflow.writeMetrics(w)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_shipping_lag_seconds %d\n", s.lag.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_schema_drift_total %d\n", s.schemaDrift.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_malformed_lines_total %d\n", s.malformed.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_malformed_lines_deadlettered_total %d\n", s.deadLines.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_empty_files_total{action=%q} %d\n", s.opts.EmptyFiles, s.emptyCount.Load())
+		if s.opts.NoListBucket {
+			fmt.Fprintf(w, "cloudfront_logs_shipper_denied_reads_total %d\n", s.deniedReads.Load())
+		}
+		s.fieldFiles.writeMetrics(w)
+		s.transfers.writeMetrics(w, s.query != nil)
+		s.slo.writeMetrics(w)
+		s.deletes.writeMetrics(w)
+		s.objectLock.writeMetrics(w)
+		s.checksums.writeMetrics(w)
+		s.reconciled.writeMetrics(w)
+		s.activity.writeMetrics(w)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_unconfirmed_files_total %d\n", s.unconfirmed.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_incomplete_reads_total %d\n", s.truncated.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_file_deadlines_total %d\n", s.deadlines.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_file_summary_failures_total %d\n", s.summaryFails.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_oversized_lines_total %d\n", s.oversized.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_old_entries_total{action=%q} %d\n", s.opts.OldEntries, s.tooOld.Load())
+		loki.WriteRestampedMetrics(w)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_loki_connections_opened_total %d\n", loki.ConnectionsOpened())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_ip_filtered_lines_total %d\n", s.ipFiltered.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_drop_list_lines_total %d\n", s.dropListed.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_unknown_edge_lines_total{action=%q} %d\n", s.opts.UnknownEdge, s.unknownEdges.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_enrichment_errors_total %d\n", s.enrichErrors.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_expression_errors_total %d\n", s.exprErrors.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_expression_filtered_lines_total %d\n", s.exprFiltered.Load())
+		fmt.Fprintf(w, "cloudfront_logs_shipper_excluded_files_total %d\n", s.excludedKeys.Load())
+		s.fence.writeMetrics(w)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_replayed_files_skipped_total %d\n", s.replays.skippedTotal())
+		loki.WriteShippedMetrics(w)
+		loki.WriteRejectedMetrics(w)
+		loki.WriteEndpointMetrics(w)
+		loki.WriteStreamMetrics(w)
+		s.gaps.writeMetrics(w)
+		s.volume.writeMetrics(w)
+		s.onboarding.writeMetrics(w)
+		s.events.writeMetrics(w)
+		s.slowStart.writeMetrics(w)
+		s.alerts.writeMetrics(w)
+		s.pseudonyms.writeMetrics(w)
+		s.listLatency.writeMetrics(w)
+		s.objectAge.writeMetrics(w)
+		s.objectSize.writeMetrics(w)
+		s.filesPerScan.writeMetrics(w)
+		s.fileDuration.writeMetrics(w)
+		s.interval.writeMetrics(w)
+		s.leases.writeMetrics(w)
 	})
 }
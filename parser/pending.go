@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// queueMagic starts a queue file of a block of keys in the records of the
+// spill file, a queue file of the former JSON format is converted on save
+const queueMagic = "CFQUEUE1"
+
+// pending is the set of queued but not yet processed keys, so keys are not
+// queued twice by consecutive scans and can be restored after a restart,
+// keys map to the time they were queued or restored
+type pending struct {
+	mu    sync.Mutex
+	path  string // optional file to persist the set, in memory only if empty
+	keys  map[string]time.Time
+	dirty bool
+}
+
+func newPending(path string, logger *slog.Logger) (*pending, error) {
+	p := &pending{
+		path: path,
+		keys: make(map[string]time.Time),
+	}
+	if path == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue file %s: %w", path, err)
+	}
+	var keys []string
+	if bytes.HasPrefix(data, []byte(queueMagic)) {
+		// written atomically, a corrupted record is left out and the keys
+		// are listed again by a scan
+		var valid int64
+		keys, valid, _, _ = readSpillRecords(data, len(queueMagic))
+		if size := int64(len(data)); size > valid {
+			logger.Warn("skipping corrupted records of queue file", "path", path, "keys", len(keys), "bytes", size-valid)
+			p.dirty = true
+		}
+	} else {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("failed to parse queue file %s: %w", path, err)
+		}
+		p.dirty = true // converted on save
+	}
+	now := time.Now()
+	for _, key := range keys {
+		p.keys[key] = now
+	}
+	return p, nil
+}
+
+// add returns false if the key is already pending
+func (p *pending) add(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.keys[key]; ok {
+		return false
+	}
+	p.keys[key] = time.Now()
+	p.dirty = true
+	return true
+}
+
+func (p *pending) has(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.keys[key]
+	return ok
+}
+
+func (p *pending) remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.keys, key)
+	p.dirty = true
+}
+
+// expire removes the keys queued before t
+func (p *pending) expire(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, queued := range p.keys {
+		if queued.Before(t) {
+			delete(p.keys, key)
+			p.dirty = true
+		}
+	}
+}
+
+func (p *pending) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make([]string, 0, len(p.keys))
+	for key := range p.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// queuedAt returns the keys with the time they were queued
+func (p *pending) queuedAt() map[string]time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make(map[string]time.Time, len(p.keys))
+	for key, t := range p.keys {
+		keys[key] = t
+	}
+	return keys
+}
+
+// save writes the set atomically if it changed since the last save
+func (p *pending) save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.path == "" || !p.dirty {
+		return nil
+	}
+	keys := make([]string, 0, len(p.keys))
+	for key := range p.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if err := writeFile(p.path, appendSpillBlock([]byte(queueMagic), keys)); err != nil {
+		return err
+	}
+	p.dirty = false
+	return nil
+}
+
+// SaveQueue persists the queued keys to the queue file, if configured
+func (s *Parser) SaveQueue() error {
+	return s.pending.save()
+}
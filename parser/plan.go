@@ -0,0 +1,148 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// PlanResult is how a configuration ships a sample file
+type PlanResult struct {
+	Lines     int
+	Dropped   int
+	Malformed int            // lines moved to the dead-letter prefix
+	Unrouted  int            // lines of unknown edges moved to the dead-letter prefix
+	Streams   map[string]int // lines by target and stream labels
+	Targets   map[string]int // lines by target, the default Loki or a route
+}
+
+// Plan runs the filters, transforms and routing of opts over a sample file
+// without S3 or Loki. Key is the S3 key the sample is planned as, its
+// namespace selects the namespace options. Drop lists are not loaded.
+func Plan(opts models.Options, key string, r io.Reader, logger *slog.Logger) (*PlanResult, error) {
+	if !strings.Contains(key, "/") {
+		return nil, fmt.Errorf("key %q has no namespace (namespace/...)", key)
+	}
+	ipFilter, err := newIPFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+	userExprs, err := newUserExprs(opts)
+	if err != nil {
+		return nil, err
+	}
+	encode, err := newEncoder(opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &Parser{
+		opts:      opts,
+		logger:    logger,
+		encode:    encode,
+		ipFilter:  ipFilter,
+		userExprs: userExprs,
+		enrichers: registeredEnrichers(),
+		hosts:     make(map[string]bool),
+	}
+	for _, host := range opts.SplitHosts {
+		s.hosts[host] = true
+	}
+	if opts.PolicyFile != "" {
+		s.policies = &policies{}
+		if err := s.RefreshPolicies(); err != nil {
+			return nil, err
+		}
+	}
+
+	labels, namespace, _ := s.fileLabels(key)
+	policy := s.policy(namespace)
+	if tenant := s.namespaceTenant(namespace); tenant != "" {
+		opts.LokiTenant = tenant
+	}
+	bopts := policy.batchOptions(labels, opts)
+	targets := []string{"default"}
+	if bopts.LokiTenant != "" {
+		targets[0] += " tenant=" + bopts.LokiTenant
+	}
+	for _, route := range opts.Routes {
+		target := fmt.Sprintf("%s=%s %s", route.Field, route.Value, route.URL)
+		if route.Tenant != "" {
+			target += " tenant=" + route.Tenant
+		}
+		targets = append(targets, target)
+	}
+	shards := s.shards(namespace)
+
+	res := &PlanResult{Streams: make(map[string]int), Targets: make(map[string]int)}
+	var header, order []string
+	var buf []byte
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#Fields:") {
+			header = strings.Fields(line)[1:]
+			order = fieldOrder(opts.FieldOrder, header)
+			continue
+		}
+		if strings.HasPrefix(line, "#") || len(header) == 0 {
+			continue
+		}
+		res.Lines++
+		entry, err := parseDataLine(line, header)
+		if err != nil {
+			if s.opts.Strict && s.opts.Format != "raw" {
+				return nil, fmt.Errorf("error parsing data line %d: %w", res.Lines, err)
+			}
+			// filtered, routed or dead-lettered like when shipping
+			if s.malformedFiltered(line, header) {
+				res.Dropped++
+				continue
+			}
+			route := s.malformedRoute()
+			if route == 0 {
+				res.Malformed++
+				continue
+			}
+			res.Targets[targets[route]]++
+			res.Streams[targets[route]+" "+planLabels(labels)]++
+			continue
+		}
+		route, ok := s.prepare(entry, policy)
+		if route == deadLetterRoute {
+			res.Unrouted++
+			continue
+		}
+		if !ok {
+			res.Dropped++
+			continue
+		}
+		streamLabels := resolveLabels(key, entry, s.streamLabels(entry))
+		s.dropFields(entry, policy)
+		if opts.Format == "raw" {
+			buf = appendRaw(buf[:0], rawLine(header, entry), entry, opts.RawTimestamp)
+		} else {
+			buf = s.encode(buf[:0], entry, order)
+		}
+		stream := maps.Clone(labels)
+		maps.Copy(stream, shard(streamLabels, buf, shards))
+		res.Targets[targets[route]]++
+		res.Streams[targets[route]+" "+planLabels(stream)]++
+	}
+	return res, scanner.Err()
+}
+
+// planLabels formats labels sorted by name like a LogQL stream selector
+func planLabels(labels map[string]string) string {
+	names := slices.Sorted(maps.Keys(labels))
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, labels[name])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
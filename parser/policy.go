@@ -0,0 +1,252 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/nugored/cf-logs-loki-uploader/expr"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+	"golang.org/x/time/rate"
+)
+
+// policyFile is the per-namespace shipping policy, usually a mounted
+// Kubernetes ConfigMap so platform users can change it without a redeploy.
+// Named profiles bundle settings shared by namespaces, the settings of a
+// namespace extend or override those of its profile. The settings of the
+// --environment are the defaults of every namespace, listed or not:
+//
+//	{"environments": {"dev": {"sample": 0.05}},
+//	 "profiles": {"errors-only": {"filters": ["sc-status < 400"]}, "sampled-10pct": {"sample": 0.1}},
+//	 "namespaces": {"team-a": {"profile": "errors-only", "labels": {"team": "a"}, "tenant": "team-a",
+//	  "filters": ["sc-status == 200 && cs-method == \"HEAD\""], "max_lines_per_second": 500}}}
+type policyFile struct {
+	Environments map[string]policyConfig `json:"environments"`
+	Profiles     map[string]policyConfig `json:"profiles"`
+	Namespaces   map[string]policyConfig `json:"namespaces"`
+}
+
+type policyConfig struct {
+	Profile           string            `json:"profile"` // namespaces only
+	Labels            map[string]string `json:"labels"`
+	Tenant            string            `json:"tenant"`
+	Filters           []string          `json:"filters"` // lines are dropped when one is true
+	Sample            float64           `json:"sample"`  // fraction of the lines kept, all if 0
+	DropFields        []string          `json:"drop_fields"`
+	MaxLinesPerSecond int               `json:"max_lines_per_second"`
+}
+
+// withProfile returns the settings of a namespace on top of its profile
+func (c policyConfig) withProfile(profile policyConfig) policyConfig {
+	labels := maps.Clone(profile.Labels)
+	if labels == nil {
+		labels = make(map[string]string, len(c.Labels))
+	}
+	maps.Copy(labels, c.Labels)
+	c.Labels = labels
+	c.Filters = append(slices.Clone(profile.Filters), c.Filters...)
+	c.DropFields = append(slices.Clone(profile.DropFields), c.DropFields...)
+	if c.Tenant == "" {
+		c.Tenant = profile.Tenant
+	}
+	if c.Sample == 0 {
+		c.Sample = profile.Sample
+	}
+	if c.MaxLinesPerSecond == 0 {
+		c.MaxLinesPerSecond = profile.MaxLinesPerSecond
+	}
+	return c
+}
+
+// policy is the compiled policy of a namespace
+type policy struct {
+	labels  map[string]string
+	tenant  string
+	filters []*expr.Program
+	sample  float64 // fraction of the lines kept, all if 0
+	drop    []string
+	quota   *rate.Limiter // nil for no limit
+}
+
+// policies are the policies by namespace, replaced as a whole on changes
+type policies struct {
+	mu          sync.RWMutex
+	raw         []byte // content of the loaded file
+	byName      map[string]*policy
+	environment *policyConfig // defaults of namespaces without a policy, nil for none
+}
+
+// RefreshPolicies reloads the policy file when it changed, the previous
+// policies are kept if it is invalid
+func (s *Parser) RefreshPolicies() error {
+	if s.policies == nil {
+		return nil
+	}
+	data, err := os.ReadFile(s.opts.PolicyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file %s: %w", s.opts.PolicyFile, err)
+	}
+	s.policies.mu.RLock()
+	unchanged := bytes.Equal(data, s.policies.raw)
+	s.policies.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	var file policyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse policy file %s: %w", s.opts.PolicyFile, err)
+	}
+	for name, profile := range file.Profiles {
+		if profile.Profile != "" {
+			return fmt.Errorf("invalid profile %s: profiles do not nest", name)
+		}
+	}
+	var environment *policyConfig
+	if cfg, ok := file.Environments[s.opts.Environment]; ok && s.opts.Environment != "" {
+		if cfg.Profile != "" {
+			return fmt.Errorf("invalid environment %s: environments have no profile", s.opts.Environment)
+		}
+		if _, err := compilePolicy(cfg); err != nil {
+			return fmt.Errorf("invalid environment %s: %w", s.opts.Environment, err)
+		}
+		if s.opts.GDPR && relabelsCluster(cfg.Labels, s.opts.ClusterName) {
+			return fmt.Errorf("invalid environment %s: label cluster overrides --cluster with --gdpr", s.opts.Environment)
+		}
+		environment = &cfg
+	}
+	byName := make(map[string]*policy, len(file.Namespaces))
+	for ns, cfg := range file.Namespaces {
+		if cfg.Profile != "" {
+			profile, ok := file.Profiles[cfg.Profile]
+			if !ok {
+				return fmt.Errorf("invalid policy of namespace %s: unknown profile %q", ns, cfg.Profile)
+			}
+			cfg = cfg.withProfile(profile)
+		}
+		if environment != nil {
+			cfg = cfg.withProfile(*environment)
+		}
+		p, err := compilePolicy(cfg)
+		if err != nil {
+			return fmt.Errorf("invalid policy of namespace %s: %w", ns, err)
+		}
+		if s.opts.GDPR && relabelsCluster(cfg.Labels, s.opts.ClusterName) {
+			return fmt.Errorf("invalid policy of namespace %s: label cluster overrides --cluster with --gdpr", ns)
+		}
+		byName[ns] = p
+	}
+	s.policies.mu.Lock()
+	s.policies.raw = data
+	s.policies.byName = byName
+	s.policies.environment = environment
+	s.policies.mu.Unlock()
+	s.logger.Info("loaded namespace policies", "file", s.opts.PolicyFile, "namespaces", len(byName), "profiles", len(file.Profiles))
+	return nil
+}
+
+// compilePolicy returns the policy of namespace settings
+func compilePolicy(cfg policyConfig) (*policy, error) {
+	if cfg.Sample < 0 || cfg.Sample > 1 {
+		return nil, fmt.Errorf("sample must be between 0 and 1")
+	}
+	p := &policy{labels: cfg.Labels, tenant: cfg.Tenant, sample: cfg.Sample, drop: cfg.DropFields}
+	for _, filter := range cfg.Filters {
+		prog, err := expr.Compile(filter)
+		if err != nil {
+			return nil, err
+		}
+		p.filters = append(p.filters, prog)
+	}
+	if cfg.MaxLinesPerSecond > 0 {
+		p.quota = rate.NewLimiter(rate.Limit(cfg.MaxLinesPerSecond), cfg.MaxLinesPerSecond)
+	}
+	return p, nil
+}
+
+// policy returns the policy of a namespace, nil if it has none. Namespaces
+// without one get the environment defaults, compiled on first use so each
+// has its own quota.
+func (s *Parser) policy(namespace string) *policy {
+	if s.policies == nil {
+		return nil
+	}
+	s.policies.mu.RLock()
+	p, ok := s.policies.byName[namespace]
+	environment := s.policies.environment
+	s.policies.mu.RUnlock()
+	if ok || environment == nil {
+		return p
+	}
+	s.policies.mu.Lock()
+	defer s.policies.mu.Unlock()
+	if p, ok := s.policies.byName[namespace]; ok {
+		return p
+	}
+	if s.policies.environment == nil {
+		return nil // reloaded meanwhile
+	}
+	p, _ = compilePolicy(*s.policies.environment) // validated on load
+	s.policies.byName[namespace] = p
+	return p
+}
+
+// batchOptions applies the labels and tenant of a namespace policy to the
+// labels and options of a file's batch
+func (p *policy) batchOptions(labels map[string]string, opts models.Options) models.Options {
+	if p == nil {
+		return opts
+	}
+	maps.Copy(labels, p.labels)
+	if p.tenant != "" {
+		opts.LokiTenant = p.tenant
+	}
+	return opts
+}
+
+// filtered reports whether a filter or the sampling of the policy drops the
+// entry, failed expressions keep it
+func (p *policy) filtered(entry models.LogEntry, deadline expr.Deadline) bool {
+	if p == nil {
+		return false
+	}
+	if p.sample > 0 && !sampled(entry, p.sample) {
+		return true
+	}
+	for _, filter := range p.filters {
+		if drop, err := filter.Bool(entry, deadline); err == nil && drop {
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until a line of the namespace may be shipped within its quota
+func (p *policy) wait(ctx context.Context) error {
+	if p == nil || p.quota == nil {
+		return nil
+	}
+	return p.quota.Wait(ctx)
+}
+
+// sampled reports whether an entry is within the kept fraction, decided by
+// its request id so a request is kept or dropped by every replica and retry
+func sampled(entry models.LogEntry, fraction float64) bool {
+	if fraction >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(entry["x-edge-request-id"]))
+	// spread similar ids over the whole range (splitmix64 finalizer)
+	x := h.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x) < fraction*math.MaxUint64
+}
@@ -0,0 +1,200 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// pseudonymCacheSize bounds the tokens kept from a tokenization endpoint
+const pseudonymCacheSize = 100000
+
+// pseudonymizer replaces sensitive values by stable pseudonyms, an HMAC of
+// the value with a key kept across days, or the token of a tokenization
+// endpoint, so unique users can still be counted
+type pseudonymizer struct {
+	rules    []pseudonymRule
+	key      []byte // HMAC key, nil with a tokenization endpoint
+	url      string
+	timeout  time.Duration
+	mu       sync.Mutex
+	cache    map[string]string // tokens by value, cleared when full
+	failures atomic.Int64
+}
+
+// pseudonymRule pseudonymizes a whole field, or the first group of each
+// match of a regexp within it, e.g. the user id of /users/([^/]+)
+type pseudonymRule struct {
+	field string
+	re    *regexp.Regexp
+}
+
+// tokenRequest is POSTed as JSON to a tokenization endpoint, which answers
+// with a tokenResponse
+type tokenRequest struct {
+	Value string `json:"value"`
+}
+
+type tokenResponse struct {
+	Token string `json:"token"`
+}
+
+func newPseudonymizer(opts models.Options) (*pseudonymizer, error) {
+	if len(opts.PseudonymFields) == 0 {
+		return nil, nil
+	}
+	if (opts.PseudonymKeyFile == "") == (opts.PseudonymURL == "") {
+		return nil, fmt.Errorf("pseudonymizing fields needs either a pseudonym key file or a tokenization URL")
+	}
+	p := &pseudonymizer{url: opts.PseudonymURL, timeout: opts.PseudonymTimeout}
+	if !opts.LowMemory {
+		p.cache = make(map[string]string)
+	}
+	if opts.PseudonymKeyFile != "" {
+		key, err := os.ReadFile(opts.PseudonymKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pseudonym key: %w", err)
+		}
+		if p.key = bytes.TrimSpace(key); len(p.key) < 16 {
+			return nil, fmt.Errorf("pseudonym key must have at least 16 bytes")
+		}
+	}
+	for _, spec := range opts.PseudonymFields {
+		field, expr, ok := strings.Cut(spec, "=")
+		rule := pseudonymRule{field: field}
+		if ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pseudonym regexp %q: %w", expr, err)
+			}
+			if re.NumSubexp() < 1 {
+				return nil, fmt.Errorf("pseudonym regexp %q needs a group to replace", expr)
+			}
+			rule.re = re
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// pseudonymize replaces the configured values of the entry and reports
+// whether it changed, values are redacted if no token could be obtained
+func (s *Parser) pseudonymize(entry models.LogEntry) bool {
+	p := s.pseudonyms
+	if p == nil {
+		return false
+	}
+	changed := false
+	for _, rule := range p.rules {
+		v, ok := entry[rule.field]
+		if !ok || v == "-" || v == "" {
+			continue
+		}
+		if rule.re == nil {
+			entry[rule.field] = p.token(v)
+			changed = true
+			continue
+		}
+		matches := rule.re.FindAllStringSubmatchIndex(v, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			if m[2] < 0 {
+				continue // group not part of the match
+			}
+			b.WriteString(v[last:m[2]])
+			b.WriteString(p.token(v[m[2]:m[3]]))
+			last = m[3]
+		}
+		b.WriteString(v[last:])
+		entry[rule.field] = b.String()
+		changed = true
+	}
+	return changed
+}
+
+// token returns the pseudonym of a value
+func (p *pseudonymizer) token(v string) string {
+	if p.key != nil {
+		mac := hmac.New(sha256.New, p.key)
+		mac.Write([]byte(v))
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+	p.mu.Lock()
+	token, ok := p.cache[v]
+	p.mu.Unlock()
+	if ok {
+		return token
+	}
+	token, err := p.tokenize(v)
+	if err != nil {
+		p.failures.Add(1)
+		return "REDACTED" // never ship the value in clear
+	}
+	if p.cache == nil {
+		return token
+	}
+	p.mu.Lock()
+	if len(p.cache) >= pseudonymCacheSize {
+		clear(p.cache)
+	}
+	p.cache[v] = token
+	p.mu.Unlock()
+	return token
+}
+
+// tokenize asks the tokenization endpoint for the token of a value
+func (p *pseudonymizer) tokenize(v string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	body, err := json.Marshal(tokenRequest{Value: v})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("unexpected status %s: %s", resp.Status, msg)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+	if tr.Token == "" {
+		return "", fmt.Errorf("empty token")
+	}
+	return tr.Token, nil
+}
+
+func (p *pseudonymizer) writeMetrics(w io.Writer) {
+	if p == nil {
+		return
+	}
+	fmt.Fprintf(w, "cloudfront_logs_shipper_pseudonym_failures_total %d\n", p.failures.Load())
+}
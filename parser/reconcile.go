@@ -0,0 +1,153 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// reconcileSamples is the unprocessed keys logged by a reconciliation
+const reconcileSamples = 20
+
+// reconciliation is the result of the last comparison of the bucket with
+// the files shipped, kept and queued
+type reconciliation struct {
+	mu          sync.Mutex
+	runs        int64
+	last        time.Time
+	unprocessed map[string]int // files older than the age never processed, by top-level prefix
+	oldest      time.Time      // LastModified of the oldest unprocessed file
+}
+
+// Reconcile lists the whole bucket and reports the files older than the
+// reconcile age that were neither shipped nor kept on purpose nor queued,
+// files the scans missed, e.g. notifications lost in sqs ingest mode
+func (s *Parser) Reconcile() error {
+	ctx := context.Background()
+	prefixes := s.opts.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	cutoff := time.Now().Add(-s.opts.ReconcileAge)
+	unprocessed := make(map[string]int)
+	var samples []string
+	var oldest time.Time
+	var listed int
+	for _, prefix := range prefixes {
+		input := &s3.ListObjectsV2Input{Bucket: &s.opts.BucketName}
+		if prefix != "" {
+			input.Prefix = &prefix
+		}
+		pages := s3.NewListObjectsV2Paginator(s.s3Client, input)
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to list prefix %q: %w", prefix, err)
+			}
+			for _, obj := range page.Contents {
+				listed++
+				if !s.unprocessed(ctx, obj, cutoff) {
+					continue
+				}
+				var top string // empty for the bucket root
+				if i := strings.Index(*obj.Key, "/"); i >= 0 {
+					top = (*obj.Key)[:i]
+				}
+				unprocessed[top]++
+				if len(samples) < reconcileSamples {
+					samples = append(samples, *obj.Key)
+				}
+				if oldest.IsZero() || obj.LastModified.Before(oldest) {
+					oldest = *obj.LastModified
+				}
+			}
+		}
+	}
+
+	r := s.reconciled
+	r.mu.Lock()
+	r.runs++
+	r.last = time.Now()
+	r.unprocessed = unprocessed
+	r.oldest = oldest
+	r.mu.Unlock()
+
+	var total int
+	for _, n := range unprocessed {
+		total += n
+	}
+	if total == 0 {
+		s.logger.Info("bucket reconciled, no unprocessed files", "listed", listed, "older_than", s.opts.ReconcileAge)
+		return nil
+	}
+	s.logger.Warn("bucket reconciliation found files never processed", "files", total, "listed", listed, "older_than", s.opts.ReconcileAge, "oldest", oldest, "by_prefix", fmt.Sprintf("%v", unprocessed))
+	for _, key := range samples {
+		s.logger.Warn("unprocessed file", "key", key)
+	}
+	return nil
+}
+
+// unprocessed reports whether a listed file older than the cutoff should
+// have been shipped: files skipped on purpose, kept after shipping, or
+// still queued are not
+func (s *Parser) unprocessed(ctx context.Context, obj types.Object, cutoff time.Time) bool {
+	key := aws.ToString(obj.Key)
+	if key == "" || aws.ToInt64(obj.Size) == 0 || strings.HasSuffix(key, "/") {
+		return false
+	}
+	if obj.LastModified == nil || obj.LastModified.After(cutoff) {
+		return false
+	}
+	if s.excluded(key) || (s.fence != nil && key == s.fence.key) || strings.HasPrefix(key, s.opts.DeadLetterPrefix) {
+		return false
+	}
+	if !s.selected(obj) {
+		return false
+	}
+	if s.backfill.has(key) || s.empties.kept(key) || s.objectLock.kept(key) || s.pending.has(key) {
+		return false
+	}
+	if s.empties != nil || s.objectLock.active.Load() {
+		// kept by a previous run, the tag outlives the in-memory sets
+		tags, err := s.s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+			Bucket: &s.opts.BucketName,
+			Key:    &key,
+		})
+		if err == nil && slices.ContainsFunc(tags.TagSet, func(t types.Tag) bool { return aws.ToString(t.Key) == tagKey }) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *reconciliation) writeMetrics(w io.Writer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(w, "cloudfront_logs_shipper_reconcile_runs_total %d\n", r.runs)
+	if r.runs == 0 {
+		return
+	}
+	fmt.Fprintf(w, "cloudfront_logs_shipper_reconcile_last_run_timestamp_seconds %d\n", r.last.Unix())
+	prefixes := make([]string, 0, len(r.unprocessed))
+	for prefix := range r.unprocessed {
+		prefixes = append(prefixes, prefix)
+	}
+	slices.Sort(prefixes)
+	for _, prefix := range prefixes {
+		fmt.Fprintf(w, "cloudfront_logs_shipper_reconcile_unprocessed_files{prefix=%q} %d\n", prefix, r.unprocessed[prefix])
+	}
+	if !r.oldest.IsZero() {
+		fmt.Fprintf(w, "cloudfront_logs_shipper_reconcile_oldest_unprocessed_seconds %.0f\n", r.last.Sub(r.oldest).Seconds())
+	}
+}
@@ -0,0 +1,186 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replays is a rolling window of processed key and ETag pairs, bounded by
+// age and count, so files CloudFront re-delivers unchanged are not shipped
+// twice
+type replays struct {
+	mu      sync.Mutex
+	path    string // optional file to persist the window, in memory only if empty
+	window  time.Duration
+	max     int
+	queued  map[string]string // ETags of queued keys
+	seen    map[string]time.Time
+	order   []replay // oldest first
+	dirty   bool
+	skipped atomic.Int64
+}
+
+type replay struct {
+	Key  string    `json:"key"`
+	ETag string    `json:"etag"`
+	At   time.Time `json:"at"`
+}
+
+func newReplays(path string, window time.Duration, max int) (*replays, error) {
+	if window <= 0 || max <= 0 {
+		return nil, nil
+	}
+	r := &replays{
+		path:   path,
+		window: window,
+		max:    max,
+		queued: make(map[string]string),
+		seen:   make(map[string]time.Time),
+	}
+	if path == "" {
+		return r, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay file %s: %w", path, err)
+	}
+	var order []replay
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, fmt.Errorf("failed to parse replay file %s: %w", path, err)
+	}
+	for _, p := range order {
+		r.add(p)
+	}
+	r.expire(time.Now())
+	return r, nil
+}
+
+func replayID(key, etag string) string {
+	return key + "\x00" + etag
+}
+
+// add appends a processed pair, caller must hold the lock
+func (r *replays) add(p replay) {
+	r.seen[replayID(p.Key, p.ETag)] = p.At
+	r.order = append(r.order, p)
+}
+
+// expire drops the pairs older than the window or beyond the maximum count,
+// caller must hold the lock
+func (r *replays) expire(now time.Time) {
+	n := 0
+	for n < len(r.order) && (len(r.order)-n > r.max || now.Sub(r.order[n].At) > r.window) {
+		p := r.order[n]
+		id := replayID(p.Key, p.ETag)
+		if r.seen[id].Equal(p.At) {
+			delete(r.seen, id)
+		}
+		n++
+	}
+	if n > 0 {
+		r.order = r.order[n:]
+		r.dirty = true
+	}
+}
+
+// queue returns false for a key and ETag processed within the window,
+// otherwise remembers the ETag until the key is processed
+func (r *replays) queue(key, etag string) bool {
+	if r == nil || etag == "" {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(time.Now())
+	if _, ok := r.seen[replayID(key, etag)]; ok {
+		r.skipped.Add(1)
+		return false
+	}
+	r.queued[key] = etag
+	return true
+}
+
+// done records a queued key as processed
+func (r *replays) done(key string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	etag, ok := r.queued[key]
+	if !ok {
+		return // leased from a coordinator, which records it
+	}
+	delete(r.queued, key)
+	r.add(replay{Key: key, ETag: etag, At: time.Now()})
+	r.expire(time.Now())
+	r.dirty = true
+}
+
+// forget drops the ETag of a queued key which was not processed
+func (r *replays) forget(key string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.queued, key)
+}
+
+// save writes the window atomically if it changed since the last save
+func (r *replays) save() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.path == "" || !r.dirty {
+		return nil
+	}
+	data, err := json.Marshal(r.order)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+func (r *replays) skippedTotal() int64 {
+	if r == nil {
+		return 0
+	}
+	return r.skipped.Load()
+}
+
+// SaveReplays persists the replay window to the replay file, if configured
+func (s *Parser) SaveReplays() error {
+	return s.replays.save()
+}
+
+// skipReplay deletes a re-delivered file which was already shipped, it is
+// kept in backfill and shadow modes
+func (s *Parser) skipReplay(ctx context.Context, key string) {
+	s.logger.Info("skipping re-delivered file", "key", key)
+	if s.backfill != nil {
+		return
+	}
+	if err := s.deleteFile(ctx, key, nil); err != nil {
+		s.logger.Error("failed to delete re-delivered file", "key", key, "err", err)
+	}
+}
@@ -0,0 +1,42 @@
+package parser
+
+import (
+	"sync"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// LabelResolver returns stream labels of an entry of a file, e.g. a customer
+// ID or cost center looked up from the host, supplementing or overriding the
+// computed labels. It must not modify the entry and returns nil for none.
+type LabelResolver func(key string, entry models.LogEntry) map[string]string
+
+var (
+	resolversMu sync.RWMutex
+	resolvers   []LabelResolver
+)
+
+// RegisterLabelResolver adds a resolver called for each shipped entry after
+// the ones registered before, usually from the init function of a package
+// compiled in
+func RegisterLabelResolver(r LabelResolver) {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	resolvers = append(resolvers, r)
+}
+
+// resolveLabels adds the labels of the registered resolvers to the stream
+// labels of an entry
+func resolveLabels(key string, entry models.LogEntry, labels map[string]string) map[string]string {
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+	for _, r := range resolvers {
+		for k, v := range r(key, entry) {
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+			labels[k] = v
+		}
+	}
+	return labels
+}
@@ -0,0 +1,230 @@
+package parser
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// selectQuery pushes field selection and filtering into S3 Select, so only
+// the needed columns and lines of a file are transferred. Files are read as
+// tab separated values whose columns are the fields of their own #Fields
+// header in order.
+type selectQuery struct {
+	fields []string // columns selected, the header of the lines returned
+	where  string   // condition with {field} references, optional
+}
+
+// selectHeaderRange is the start of a file read for its #Fields header
+const selectHeaderRange = 64 << 10
+
+// selectFieldRef is a field in a where clause, e.g. {sc-status} >= '500'
+var selectFieldRef = regexp.MustCompile(`\{([^{}]+)\}`)
+
+func newSelectQuery(opts models.Options) (*selectQuery, error) {
+	if opts.S3SelectWhere == "" && len(opts.S3SelectFields) == 0 {
+		return nil, nil
+	}
+	q := &selectQuery{fields: opts.S3SelectFields, where: opts.S3SelectWhere}
+	if len(q.fields) == 0 {
+		q.fields = opts.ExpectedFields
+	} else if opts.Strict {
+		return nil, fmt.Errorf("s3-select-fields changes the header checked in strict mode")
+	}
+	if _, err := q.sql(opts.ExpectedFields); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// sql returns the query of a file with a header, its columns are numbered
+// in the order of the header
+func (q *selectQuery) sql(header []string) (string, error) {
+	columns := make(map[string]string, len(header))
+	for i, field := range header {
+		columns[field] = "s._" + strconv.Itoa(i+1)
+	}
+	selected := make([]string, len(q.fields))
+	for i, field := range q.fields {
+		column, ok := columns[field]
+		if !ok {
+			return "", fmt.Errorf("s3-select-fields: %q is not a field of the header", field)
+		}
+		selected[i] = column
+	}
+	sql := "SELECT " + strings.Join(selected, ", ") + " FROM S3Object s"
+	if q.where != "" {
+		var err error
+		where := selectFieldRef.ReplaceAllStringFunc(q.where, func(ref string) string {
+			column, ok := columns[ref[1:len(ref)-1]]
+			if !ok {
+				err = fmt.Errorf("s3-select-where: %s is not a field of the header", ref)
+			}
+			return column
+		})
+		if err != nil {
+			return "", err
+		}
+		sql += " WHERE " + where
+	}
+	return sql, nil
+}
+
+// selectHeader returns the #Fields header of a file read from its first
+// bytes, the expected fields if there is none
+func (s *Parser) selectHeader(ctx context.Context, fn string, compression types.CompressionType) ([]string, error) {
+	obj, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.opts.BucketName,
+		Key:    &fn,
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", selectHeaderRange-1)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header of %s: %w", fn, err)
+	}
+	defer obj.Body.Close()
+	var r io.Reader = obj.Body
+	if compression == types.CompressionTypeGzip {
+		gz, err := gzip.NewReader(obj.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header of %s: %w", fn, err)
+		}
+		r = gz
+	}
+	// the range ends within the file, the scanner stops on it
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields, ok := strings.CutPrefix(line, "#Fields:"); ok {
+			return strings.Fields(fields), nil
+		}
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+	}
+	return s.opts.ExpectedFields, nil
+}
+
+// selectObject runs the query on a file and returns the lines selected
+// after a #Fields header of the selected fields
+func (s *Parser) selectObject(ctx context.Context, fn string) (*object, error) {
+	head, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.opts.BucketName,
+		Key:    &fn,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey") {
+			return nil, errNoSuchKey
+		}
+		if s.deniedAsMissing(err) {
+			return nil, fmt.Errorf("%w: %w", errReadDenied, err)
+		}
+		return nil, fmt.Errorf("failed to head object %s: %w", fn, err)
+	}
+	var compression types.CompressionType
+	switch name := decoderName(s.opts.InputFormat, fn, aws.ToString(head.ContentType), aws.ToString(head.ContentEncoding)); name {
+	case "gzip":
+		compression = types.CompressionTypeGzip
+	case "plain":
+		compression = types.CompressionTypeNone
+	default:
+		return nil, fmt.Errorf("S3 Select does not support %s files", name)
+	}
+	// the columns are numbered by the header of each file
+	header, err := s.selectHeader(ctx, fn, compression)
+	if err != nil {
+		return nil, err
+	}
+	sql, err := s.query.sql(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select object %s: %w", fn, err)
+	}
+	out, err := s.s3Client.SelectObjectContent(ctx, &s3.SelectObjectContentInput{
+		Bucket:         &s.opts.BucketName,
+		Key:            &fn,
+		Expression:     &sql,
+		ExpressionType: types.ExpressionTypeSql,
+		InputSerialization: &types.InputSerialization{
+			CompressionType: compression,
+			CSV: &types.CSVInput{
+				FieldDelimiter: aws.String("\t"),
+				Comments:       aws.String("#"),
+				FileHeaderInfo: types.FileHeaderInfoNone,
+			},
+		},
+		OutputSerialization: &types.OutputSerialization{
+			CSV: &types.CSVOutput{
+				FieldDelimiter:  aws.String("\t"),
+				RecordDelimiter: aws.String("\n"),
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to select object %s: %w", fn, err)
+	}
+
+	stream := out.GetStream()
+	pr, pw := io.Pipe()
+	var ended atomic.Bool
+	var scanned, processed, returned atomic.Int64
+	go func() {
+		if _, err := io.WriteString(pw, "#Fields: "+strings.Join(s.query.fields, " ")+"\n"); err != nil {
+			return // reader closed
+		}
+		for event := range stream.Events() {
+			switch e := event.(type) {
+			case *types.SelectObjectContentEventStreamMemberRecords:
+				if _, err := pw.Write(e.Value.Payload); err != nil {
+					return
+				}
+			case *types.SelectObjectContentEventStreamMemberStats:
+				if d := e.Value.Details; d != nil {
+					scanned.Store(aws.ToInt64(d.BytesScanned))
+					processed.Store(aws.ToInt64(d.BytesProcessed))
+					returned.Store(aws.ToInt64(d.BytesReturned))
+				}
+			case *types.SelectObjectContentEventStreamMemberEnd:
+				ended.Store(true)
+			}
+		}
+		if err := stream.Err(); err != nil {
+			pw.CloseWithError(fmt.Errorf("failed to select object %s: %w", fn, err))
+			return
+		}
+		if !ended.Load() {
+			pw.CloseWithError(fmt.Errorf("%w: select of %s ended early", ErrIncompleteRead, fn))
+			return
+		}
+		pw.Close()
+	}()
+	// the rows returned are bounded like a decompressed file, S3 decompresses
+	// the object itself
+	returnedRows := &countingReader{r: pr}
+	return &object{
+		Reader:    s.sizeGuard(fn, &countingReader{}, returnedRows, head.ContentLength),
+		closers:   []io.Closer{pr, stream},
+		versionID: head.VersionId,
+		etag:      aws.ToString(head.ETag),
+		size:      head.ContentLength,
+		modified:  head.LastModified,
+		check: func(int) error {
+			if !ended.Load() {
+				return fmt.Errorf("%w: select of %s ended early", ErrIncompleteRead, fn)
+			}
+			return nil
+		},
+		transfer: func() transfer {
+			return transfer{downloaded: returned.Load(), decompressed: processed.Load(), scanned: scanned.Load()}
+		},
+	}, nil
+}
@@ -0,0 +1,136 @@
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// ErrSchemaDrift is returned in strict mode when a file header differs from
+// the expected fields
+var ErrSchemaDrift = errors.New("schema drift")
+
+// checkSchema compares a header with the expected fields in strict mode
+func (s *Parser) checkSchema(header []string) error {
+	if !s.opts.Strict || slices.Equal(header, s.opts.ExpectedFields) {
+		return nil
+	}
+	s.schemaDrift.Add(1)
+	var added, missing []string
+	for _, f := range header {
+		if !slices.Contains(s.opts.ExpectedFields, f) {
+			added = append(added, f)
+		}
+	}
+	for _, f := range s.opts.ExpectedFields {
+		if !slices.Contains(header, f) {
+			missing = append(missing, f)
+		}
+	}
+	if len(added) == 0 && len(missing) == 0 {
+		return fmt.Errorf("%w: fields reordered", ErrSchemaDrift)
+	}
+	return fmt.Errorf("%w: added %v, missing %v", ErrSchemaDrift, added, missing)
+}
+
+// fieldTypes are the types of the CloudFront fields which are not strings,
+// for derived fields and dashboards generated from published schemas
+var fieldTypes = map[string]SchemaField{
+	"date":               {Type: "date"},
+	"time":               {Type: "time"},
+	"sc-bytes":           {Type: "number", Unit: "bytes"},
+	"cs-bytes":           {Type: "number", Unit: "bytes"},
+	"sc-status":          {Type: "number"},
+	"c-ip":               {Type: "ip"},
+	"c-port":             {Type: "number"},
+	"time-taken":         {Type: "number", Unit: "s"},
+	"time-to-first-byte": {Type: "number", Unit: "s"},
+	"sc-content-len":     {Type: "number", Unit: "bytes"},
+	"sc-range-start":     {Type: "number", Unit: "bytes"},
+	"sc-range-end":       {Type: "number", Unit: "bytes"},
+}
+
+// Schema describes the fields of the lines shipped for a file header, the
+// version identifies the header together with the output format
+type Schema struct {
+	Version  string        `json:"version"`
+	Format   string        `json:"format"`
+	KeyStyle string        `json:"key_style,omitempty"`
+	Fields   []SchemaField `json:"fields"`
+}
+
+type SchemaField struct {
+	Field string `json:"field"`          // W3C name
+	Name  string `json:"name,omitempty"` // name in shipped lines, empty for raw lines
+	Type  string `json:"type"`
+	Unit  string `json:"unit,omitempty"`
+}
+
+// schemas remembers the schema versions published by this process
+type schemas struct {
+	mu        sync.Mutex
+	published map[string]bool
+}
+
+// newSchema returns the schema of the lines shipped for a header
+func newSchema(opts models.Options, order []string) Schema {
+	schema := Schema{Format: opts.Format, Fields: make([]SchemaField, 0, len(order))}
+	if opts.Format == "json" {
+		schema.KeyStyle = opts.KeyStyle
+	}
+	for _, f := range order {
+		field := fieldTypes[f]
+		if field.Type == "" {
+			field.Type = "string"
+		}
+		field.Field = f
+		switch {
+		case opts.Format == "raw":
+		case opts.Format != "json" || opts.KeyStyle == "w3c":
+			field.Name = f
+		case opts.KeyStyle == "snake":
+			field.Name = snakeKey(f)
+		case opts.KeyStyle == "camel":
+			field.Name = camelKey(f)
+		case opts.KeyStyle == "nested":
+			field.Name = strings.TrimPrefix(nestedKeys.name(f), ".")
+		}
+		schema.Fields = append(schema.Fields, field)
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s %s", schema.Format, schema.KeyStyle, strings.Join(order, " "))
+	schema.Version = hex.EncodeToString(hash.Sum(nil))[:12]
+	return schema
+}
+
+// publishSchema writes the schema of a header below --schema-url once per
+// version, failures are logged and retried with the next file of the header
+func (s *Parser) publishSchema(order []string) {
+	if s.schemas == nil {
+		return
+	}
+	schema := newSchema(s.opts, order)
+	s.schemas.mu.Lock()
+	defer s.schemas.mu.Unlock()
+	if s.schemas.published[schema.Version] {
+		return
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		s.logger.Error("unable to encode schema", "err", err)
+		return
+	}
+	if err := s.putObject(s.opts.SchemaURL, schema.Version+".json", data); err != nil {
+		s.logger.Error("unable to publish schema", "url", s.opts.SchemaURL, "version", schema.Version, "err", err)
+		return
+	}
+	s.schemas.published[schema.Version] = true
+	s.logger.Info("published schema", "version", schema.Version, "fields", len(schema.Fields))
+}
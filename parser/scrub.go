@@ -0,0 +1,55 @@
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// credentialParam matches credential-like parameters or headers, plain or URL
+// encoded, in query strings and logged headers
+var credentialParam = regexp.MustCompile(`(?i)((?:authorization|proxy-authorization|x-api-key|api[_-]?key|access[_-]?token|id[_-]?token|refresh[_-]?token|token|password|passwd|secret|session[_-]?id|x-amz-signature|x-amz-credential|x-amz-security-token)(?:=|%3D|:|%3A))([^&\s]+)`)
+
+// scrubbedFields may contain credentials
+var scrubbedFields = []string{"cs-uri-query", "cs(Referer)", "cs-headers"}
+
+// scrub hashes cookies and redacts credential-like values from the entry so
+// they never reach Loki, it reports whether anything was changed
+func scrub(entry models.LogEntry) bool {
+	changed := false
+	if cookie, ok := entry["cs(Cookie)"]; ok && cookie != "-" {
+		entry["cs(Cookie)"] = hashValue(cookie)
+		changed = true
+	}
+	for _, name := range scrubbedFields {
+		v, ok := entry[name]
+		if !ok || v == "-" || !credentialParam.MatchString(v) {
+			continue
+		}
+		entry[name] = credentialParam.ReplaceAllString(v, "${1}REDACTED")
+		changed = true
+	}
+	return changed
+}
+
+// hashValue replaces a value by a short hash keeping it correlatable
+func hashValue(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// rawLine rebuilds a W3C line from the entry after it was scrubbed
+func rawLine(header []string, entry models.LogEntry) string {
+	values := make([]string, len(header))
+	for i, name := range header {
+		v, ok := entry[name]
+		if !ok || v == "" {
+			v = "-"
+		}
+		values[i] = v
+	}
+	return strings.Join(values, "\t")
+}
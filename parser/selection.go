@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// validateSelection checks the key glob of the file selection
+func validateSelection(opts models.Options) error {
+	if opts.KeyGlob == "" {
+		return nil
+	}
+	if _, err := path.Match(opts.KeyGlob, ""); err != nil {
+		return fmt.Errorf("invalid key glob %q: %w", opts.KeyGlob, err)
+	}
+	return nil
+}
+
+// exclude is a pattern of keys of non-log artifacts, neither processed nor
+// deleted: a regexp with a re: prefix, or a glob matched against the key and
+// its base name, so _SUCCESS matches at any depth
+type exclude struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func newExcludes(patterns []string) ([]exclude, error) {
+	excludes := make([]exclude, 0, len(patterns))
+	for _, p := range patterns {
+		if expr, ok := strings.CutPrefix(p, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exclude regexp %q: %w", expr, err)
+			}
+			excludes = append(excludes, exclude{re: re})
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude glob %q: %w", p, err)
+		}
+		excludes = append(excludes, exclude{glob: p})
+	}
+	return excludes, nil
+}
+
+// excluded reports whether a key matches an exclude pattern
+func (s *Parser) excluded(key string) bool {
+	for _, e := range s.excludes {
+		if e.re != nil {
+			if e.re.MatchString(key) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(e.glob, key); ok {
+			return true
+		}
+		if ok, _ := path.Match(e.glob, path.Base(key)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selected reports whether an object matches the key glob, LastModified and
+// file name hour ranges, files without an hour in their name are not selected
+// by an hour range
+func (s *Parser) selected(obj types.Object) bool {
+	if s.opts.KeyGlob != "" {
+		if ok, _ := path.Match(s.opts.KeyGlob, *obj.Key); !ok {
+			return false
+		}
+	}
+	if !s.opts.ModifiedAfter.IsZero() || !s.opts.ModifiedBefore.IsZero() {
+		if obj.LastModified == nil || !inRange(*obj.LastModified, s.opts.ModifiedAfter, s.opts.ModifiedBefore) {
+			return false
+		}
+	}
+	if !s.opts.HourAfter.IsZero() || !s.opts.HourBefore.IsZero() {
+		lf, ok := parseLogFileName(*obj.Key)
+		if !ok || !inRange(lf.Hour, s.opts.HourAfter, s.opts.HourBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+// inRange reports whether t is within [after, before), zero bounds are open
+func inRange(t, after, before time.Time) bool {
+	if !after.IsZero() && t.Before(after) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
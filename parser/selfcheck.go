@@ -0,0 +1,96 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/nugored/cf-logs-loki-uploader/loki"
+)
+
+// probeKey is the key of a missing object the permission checks read and
+// delete, so no file is touched
+const probeKey = ".cloudfront-logs-shipper/permission-check"
+
+// selfCheck is the outcome of checking one permission, a note without an
+// error tells why it was not checked
+type selfCheck struct {
+	name string
+	err  error
+	note string
+}
+
+// SelfCheck verifies the S3 permissions the role and mode need and the Loki
+// credentials, it returns a report of everything missing
+func (s *Parser) SelfCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	lists := s.opts.IngestMode == "poll" && s.opts.Role != "worker" && s.opts.Role != "processor"
+	ships := s.opts.Role != "coordinator" && s.opts.Role != "scanner"
+
+	var checks []selfCheck
+	sample := probeKey
+	if lists {
+		maxKeys := int32(1)
+		out, err := s.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: &s.opts.BucketName, MaxKeys: &maxKeys})
+		checks = append(checks, selfCheck{name: "s3:ListBucket", err: err})
+		if err == nil && len(out.Contents) > 0 && out.Contents[0].Key != nil {
+			sample = *out.Contents[0].Key
+		}
+	}
+	switch {
+	case ships && s.opts.NoListBucket:
+		checks = append(checks, selfCheck{name: "s3:GetObject", note: "not checked without s3:ListBucket, missing objects are denied"})
+	case ships:
+		_, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &s.opts.BucketName, Key: &sample})
+		if err != nil && strings.Contains(err.Error(), "NotFound") {
+			err = nil
+		}
+		c := selfCheck{name: "s3:GetObject", err: err}
+		if err != nil && sample == probeKey {
+			c.note = "missing objects are denied without s3:ListBucket, see --no-list-bucket"
+		}
+		checks = append(checks, c)
+	}
+	switch {
+	case !ships || s.backfill != nil: // files are kept
+	case s.versioned && s.opts.PurgeVersions:
+		_, err := s.s3Client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{Bucket: &s.opts.BucketName, Prefix: &sample})
+		checks = append(checks, selfCheck{name: "s3:ListBucketVersions", err: err})
+		checks = append(checks, selfCheck{name: "s3:DeleteObjectVersion", note: "not checked, a probe would delete a version"})
+	case s.versioned:
+		checks = append(checks, selfCheck{name: "s3:DeleteObject", note: "not checked on versioned buckets, a probe would leave a delete marker"})
+	default:
+		key := probeKey
+		_, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &s.opts.BucketName, Key: &key})
+		checks = append(checks, selfCheck{name: "s3:DeleteObject", err: err})
+	}
+	if ships && s.opts.EmptyFiles == "tag" {
+		checks = append(checks, selfCheck{name: "s3:PutObjectTagging", note: "not checked, empty files are kept untagged when denied"})
+	}
+	if ships {
+		checks = append(checks, selfCheck{name: "loki push", err: loki.CheckPush(s.opts, s.logger)})
+	}
+
+	var missing []string
+	for _, c := range checks {
+		switch {
+		case c.err != nil:
+			line := fmt.Sprintf("%s: %v", c.name, c.err)
+			if c.note != "" {
+				line += " (" + c.note + ")"
+			}
+			missing = append(missing, line)
+		case c.note != "":
+			s.logger.Warn("permission not checked", "permission", c.name, "reason", c.note)
+		default:
+			s.logger.Info("permission checked", "permission", c.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions on %s:\n  %s", s.opts.BucketName, strings.Join(missing, "\n  "))
+	}
+	return nil
+}
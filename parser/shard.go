@@ -0,0 +1,30 @@
+package parser
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// shards returns the number of shards of the streams of a namespace
+func (s *Parser) shards(namespace string) int {
+	if k, ok := s.opts.NamespaceShards[namespace]; ok {
+		return k
+	}
+	return s.opts.Shards
+}
+
+// shard adds a __shard label to the extra stream labels, the hash of the line
+// modulo k, to spread a hot label set over k streams
+func shard(extra map[string]string, line []byte, k int) map[string]string {
+	if k <= 1 {
+		return extra
+	}
+	h := fnv.New32a()
+	h.Write(line)
+	labels := make(map[string]string, len(extra)+1)
+	for l, v := range extra {
+		labels[l] = v
+	}
+	labels["__shard"] = strconv.Itoa(int(h.Sum32() % uint32(k)))
+	return labels
+}
@@ -0,0 +1,118 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// slo tracks the delivery objective of shipping files within a latency of
+// their LastModified, by minute over the longest window for burn rates
+type slo struct {
+	mu      sync.Mutex
+	latency time.Duration
+	target  float64
+	windows []time.Duration
+	within  int64
+	late    int64
+	minutes []sloMinute // ring indexed by unix minute
+}
+
+type sloMinute struct {
+	minute int64
+	within int64
+	late   int64
+}
+
+// newSLO returns nil without --slo-latency
+func newSLO(opts models.Options) *slo {
+	if opts.SLOLatency <= 0 {
+		return nil
+	}
+	longest := time.Minute
+	for _, w := range opts.SLOWindows {
+		longest = max(longest, w)
+	}
+	return &slo{
+		latency: opts.SLOLatency,
+		target:  opts.SLOTarget,
+		windows: opts.SLOWindows,
+		minutes: make([]sloMinute, int(longest/time.Minute)),
+	}
+}
+
+// observe counts a shipped file against the objective, files without a
+// modification time are not counted
+func (o *slo) observe(modified *time.Time) {
+	if o == nil || modified == nil {
+		return
+	}
+	now := time.Now()
+	late := now.Sub(*modified) > o.latency
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	minute := now.Unix() / 60
+	m := &o.minutes[minute%int64(len(o.minutes))]
+	if m.minute != minute {
+		*m = sloMinute{minute: minute}
+	}
+	if late {
+		o.late++
+		m.late++
+	} else {
+		o.within++
+		m.within++
+	}
+}
+
+// ratio returns the files shipped within the latency and in total over the
+// last window
+func (o *slo) ratio(window time.Duration, now time.Time) (within, total int64) {
+	from := now.Unix()/60 - int64(window/time.Minute)
+	for _, m := range o.minutes {
+		if m.minute > from {
+			within += m.within
+			total += m.within + m.late
+		}
+	}
+	return within, total
+}
+
+func (o *slo) writeMetrics(w io.Writer) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintf(w, "cloudfront_logs_shipper_slo_target %g\n", o.target)
+	fmt.Fprintf(w, "cloudfront_logs_shipper_slo_latency_seconds %g\n", o.latency.Seconds())
+	fmt.Fprintf(w, "cloudfront_logs_shipper_slo_files_total{result=\"within\"} %d\n", o.within)
+	fmt.Fprintf(w, "cloudfront_logs_shipper_slo_files_total{result=\"late\"} %d\n", o.late)
+	now := time.Now()
+	for _, window := range o.windows {
+		within, total := o.ratio(window, now)
+		conformance, burn := 1.0, 0.0 // no files, no budget spent
+		if total > 0 {
+			conformance = float64(within) / float64(total)
+			burn = (1 - conformance) / (1 - o.target)
+		}
+		fmt.Fprintf(w, "cloudfront_logs_shipper_slo_conformance{window=%q} %g\n", windowName(window), conformance)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_slo_burn_rate{window=%q} %g\n", windowName(window), burn)
+	}
+}
+
+// windowName formats a window without zero units, 1h rather than 1h0m0s
+func windowName(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
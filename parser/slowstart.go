@@ -0,0 +1,120 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/loki"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+	"golang.org/x/time/rate"
+)
+
+// slowStart ramps the files shipped concurrently and the lines pushed per
+// second up over a period after startup and after Loki recovered from
+// throttling or failing, instead of pushing the whole backlog at once
+type slowStart struct {
+	ramp     time.Duration
+	workers  int
+	throttle *rate.Limiter // nil without an initial rate, doubled 8 times over the ramp
+
+	mu         sync.Mutex
+	initial    float64 // lines per second
+	start      time.Time
+	recoveries int64 // of Loki when the ramp started
+	active     int   // files being shipped
+	updated    time.Time
+}
+
+func newSlowStart(opts models.Options) *slowStart {
+	if opts.SlowStart <= 0 {
+		return nil
+	}
+	s := &slowStart{
+		ramp:       opts.SlowStart,
+		workers:    max(opts.Workers, 1),
+		initial:    float64(opts.SlowStartRate),
+		start:      time.Now(),
+		recoveries: loki.Recoveries(),
+	}
+	if opts.SlowStartRate > 0 {
+		s.throttle = rate.NewLimiter(rate.Limit(opts.SlowStartRate), opts.SlowStartRate)
+	}
+	return s
+}
+
+// level returns the progress of the ramp from 0 to 1, restarting it when
+// Loki recovered since, caller must hold the lock
+func (s *slowStart) level() float64 {
+	if r := loki.Recoveries(); r != s.recoveries {
+		s.recoveries = r
+		s.start = time.Now()
+	}
+	return min(float64(time.Since(s.start))/float64(s.ramp), 1)
+}
+
+// acquire blocks until another file may be shipped, the files shipped
+// concurrently grow from one to all workers over the ramp
+func (s *slowStart) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	for {
+		s.mu.Lock()
+		allowed := max(1, int(math.Ceil(float64(s.workers)*s.level())))
+		if s.active < allowed {
+			s.active++
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func (s *slowStart) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+}
+
+// wait blocks until a line may be pushed within the rate of the ramp, no
+// limit applies once it completed
+func (s *slowStart) wait(ctx context.Context) error {
+	if s == nil || s.throttle == nil {
+		return nil
+	}
+	s.mu.Lock()
+	level := s.level()
+	if level >= 1 {
+		s.mu.Unlock()
+		return nil
+	}
+	if time.Since(s.updated) > 100*time.Millisecond {
+		s.updated = time.Now()
+		limit := s.initial * math.Pow(2, 8*level)
+		s.throttle.SetLimit(rate.Limit(limit))
+		s.throttle.SetBurst(max(int(limit), 1))
+	}
+	s.mu.Unlock()
+	return s.throttle.Wait(ctx)
+}
+
+func (s *slowStart) writeMetrics(w io.Writer) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "cloudfront_logs_shipper_slow_start_progress %g\n", s.level())
+}
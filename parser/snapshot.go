@@ -0,0 +1,238 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxRecentErrors is the number of errors kept for snapshots
+const maxRecentErrors = 20
+
+// Snapshot is the run state dumped on panics and fatal errors, for
+// post-mortems without scraping interleaved log lines
+type Snapshot struct {
+	Time     time.Time       `json:"time"`
+	Reason   string          `json:"reason"`
+	Stack    string          `json:"stack,omitempty"`
+	Queued   []string        `json:"queued"`
+	InFlight []string        `json:"in_flight"`
+	Summary  Summary         `json:"summary"`
+	Errors   []SnapshotError `json:"last_errors"`
+}
+
+type SnapshotError struct {
+	Time  time.Time `json:"time"`
+	Key   string    `json:"key,omitempty"`
+	Error string    `json:"error"`
+}
+
+// runState tracks the files being shipped and the last errors
+type runState struct {
+	mu       sync.Mutex
+	started  time.Time
+	inFlight map[string]time.Time // started at
+	attempts map[string]int       // until a file is shipped
+	errors   []SnapshotError      // oldest first
+}
+
+func newRunState() *runState {
+	return &runState{
+		started:  time.Now(),
+		inFlight: make(map[string]time.Time),
+		attempts: make(map[string]int),
+	}
+}
+
+func (r *runState) begin(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inFlight[key] = time.Now()
+	r.attempts[key]++
+}
+
+func (r *runState) end(key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.inFlight, key)
+	if err == nil {
+		delete(r.attempts, key)
+	}
+}
+
+// attemptsOf returns the attempts to ship a file since the start
+func (r *runState) attemptsOf(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts[key]
+}
+
+// RecordError keeps an error for snapshots, key is empty for errors not
+// about a file
+func (s *Parser) RecordError(key string, err error) {
+	r := s.state
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append(r.errors, SnapshotError{Time: time.Now(), Key: key, Error: err.Error()})
+	if len(r.errors) > maxRecentErrors {
+		r.errors = r.errors[len(r.errors)-maxRecentErrors:]
+	}
+}
+
+// Snapshot returns the current run state
+func (s *Parser) Snapshot(reason string) Snapshot {
+	r := s.state
+	r.mu.Lock()
+	inFlight := make([]string, 0, len(r.inFlight))
+	for key := range r.inFlight {
+		inFlight = append(inFlight, key)
+	}
+	errors := append([]SnapshotError(nil), r.errors...)
+	r.mu.Unlock()
+	sort.Strings(inFlight)
+	return Snapshot{
+		Time:     time.Now(),
+		Reason:   reason,
+		Queued:   s.pending.list(),
+		InFlight: inFlight,
+		Summary:  s.Summary(time.Since(r.started)),
+		Errors:   errors,
+	}
+}
+
+// DumpSnapshot writes the run state as JSON to stderr, and to the snapshot
+// location in S3 if configured
+func (s *Parser) DumpSnapshot(reason string) {
+	s.dumpSnapshot(s.Snapshot(reason))
+}
+
+// OnPanic dumps a snapshot with the stack of a panic and panics again, it
+// must be deferred directly
+func (s *Parser) OnPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	snapshot := s.Snapshot(fmt.Sprintf("panic: %v", r))
+	snapshot.Stack = string(debug.Stack())
+	s.dumpSnapshot(snapshot)
+	panic(r)
+}
+
+func (s *Parser) dumpSnapshot(snapshot Snapshot) {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		s.logger.Error("unable to encode snapshot", "err", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", data)
+	if s.opts.SnapshotURL == "" {
+		return
+	}
+	if err := s.uploadSnapshot(data, snapshot.Time); err != nil {
+		s.logger.Error("unable to upload snapshot", "url", s.opts.SnapshotURL, "err", err)
+	}
+}
+
+// uploadSnapshot writes a snapshot below an s3://bucket/prefix/ location
+func (s *Parser) uploadSnapshot(data []byte, t time.Time) error {
+	host, _ := os.Hostname()
+	return s.putObject(s.opts.SnapshotURL, fmt.Sprintf("%s-%s.json", t.UTC().Format("20060102T150405Z"), host), data)
+}
+
+// putObject writes an object named name below an s3://bucket/prefix/
+// location
+func (s *Parser) putObject(location, name string, data []byte) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "s3" {
+		return fmt.Errorf("unsupported location %q (s3://bucket/prefix/)", location)
+	}
+	key := strings.TrimPrefix(u.Path, "/") + name
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &u.Host,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// InFlight returns the keys being shipped, oldest first
+func (s *Parser) InFlight() []QueuedFile {
+	now := time.Now()
+	st := s.state
+	st.mu.Lock()
+	files := make([]QueuedFile, 0, len(st.inFlight))
+	for key, since := range st.inFlight {
+		files = append(files, QueuedFile{Key: key, Since: since, Age: now.Sub(since).Seconds(), Attempts: st.attempts[key]})
+	}
+	st.mu.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Since.Before(files[j].Since) })
+	return files
+}
+
+// RecentErrors returns the last errors recorded, oldest first
+func (s *Parser) RecentErrors() []SnapshotError {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	return append([]SnapshotError(nil), s.state.errors...)
+}
+
+// QueuedFile is a queued or in-flight key of the queue endpoint
+type QueuedFile struct {
+	Key      string    `json:"key"`
+	Since    time.Time `json:"since"`
+	Age      float64   `json:"age_seconds"`
+	Attempts int       `json:"attempts"`
+}
+
+// QueueHandler lists the in-flight and queued keys, oldest first: in-flight
+// keys since their processing started, queued keys since they were queued
+// (or the restart that restored them), attempts are those of this process
+func (s *Parser) QueueHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		queued := s.pending.queuedAt()
+		now := time.Now()
+		st := s.state
+		st.mu.Lock()
+		inFlight := make([]QueuedFile, 0, len(st.inFlight))
+		for key, since := range st.inFlight {
+			inFlight = append(inFlight, QueuedFile{Key: key, Since: since, Age: now.Sub(since).Seconds(), Attempts: st.attempts[key]})
+			delete(queued, key)
+		}
+		waiting := make([]QueuedFile, 0, len(queued))
+		for key, since := range queued {
+			waiting = append(waiting, QueuedFile{Key: key, Since: since, Age: now.Sub(since).Seconds(), Attempts: st.attempts[key]})
+		}
+		st.mu.Unlock()
+		for _, files := range [][]QueuedFile{inFlight, waiting} {
+			sort.Slice(files, func(i, j int) bool { return files[i].Since.Before(files[j].Since) })
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Stats    WorkerStats  `json:"stats"`
+			InFlight []QueuedFile `json:"in_flight"`
+			Queued   []QueuedFile `json:"queued"`
+		}{s.WorkerStats(), inFlight, waiting})
+	})
+}
@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// stats are the counters of files and lines processed since start, and the
+// gauges of the workers
+type stats struct {
+	filesOK      atomic.Int64
+	filesFailed  atomic.Int64
+	filesSkipped atomic.Int64
+	lines        atomic.Int64
+	bytes        atomic.Int64
+	workers      atomic.Int64 // running
+	busy         atomic.Int64 // workers shipping a file
+}
+
+// WorkerStats is the state of the queue and workers, rendered by the metrics
+// and queue endpoints
+type WorkerStats struct {
+	Workers       int64 `json:"workers"`
+	Busy          int64 `json:"busy"`
+	Queued        int   `json:"queued"`
+	QueueCapacity int   `json:"queue_capacity"`
+}
+
+// WorkerStats returns the current state of the queue and workers
+func (s *Parser) WorkerStats() WorkerStats {
+	return WorkerStats{
+		Workers:       s.stats.workers.Load(),
+		Busy:          s.stats.busy.Load(),
+		Queued:        len(s.queue),
+		QueueCapacity: cap(s.queue),
+	}
+}
+
+// Summary is the machine-readable report of a processing run
+type Summary struct {
+	FilesOK      int64   `json:"files_ok"`
+	FilesFailed  int64   `json:"files_failed"`
+	FilesSkipped int64   `json:"files_skipped"`
+	Lines        int64   `json:"lines"`
+	Bytes        int64   `json:"bytes"`
+	Duration     float64 `json:"duration_seconds"`
+}
+
+// Summary returns the counters collected since the parser was created
+func (s *Parser) Summary(duration time.Duration) Summary {
+	return Summary{
+		FilesOK:      s.stats.filesOK.Load(),
+		FilesFailed:  s.stats.filesFailed.Load(),
+		FilesSkipped: s.stats.filesSkipped.Load(),
+		Lines:        s.stats.lines.Load(),
+		Bytes:        s.stats.bytes.Load(),
+		Duration:     duration.Seconds(),
+	}
+}
@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// eventTime returns the request time from the date and time fields (UTC),
+// or the epoch seconds of the timestamp field of real-time style logs
+func eventTime(entry models.LogEntry) (time.Time, bool) {
+	t, err := time.Parse("2006-01-02 15:04:05", entry["date"]+" "+entry["time"])
+	if err == nil {
+		return t, true
+	}
+	if v, ok := entry["timestamp"]; ok {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			return time.UnixMilli(int64(secs * 1000)).UTC(), true
+		}
+	}
+	if v, ok := entry["timestamp(ms)"]; ok {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.UnixMilli(ms).UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// timestamp returns the Loki timestamp of an entry with the configured
+// precision: its event time, or the ingestion time if it has none or it is
+// older than the max age and old entries are clamped. Ok is false if the
+// entry is too old and old entries are dropped.
+func (s *Parser) timestamp(entry models.LogEntry) (ts time.Time, ok bool) {
+	now := s.clock.Now()
+	ts, found := eventTime(entry)
+	switch {
+	case !found:
+		ts = now
+	case s.opts.EntryMaxAge > 0 && now.Sub(ts) > s.opts.EntryMaxAge:
+		s.tooOld.Add(1)
+		if s.opts.OldEntries == "drop" {
+			return ts, false
+		}
+		ts = now
+	}
+	if s.opts.TimestampPrecision == "s" {
+		return ts.Truncate(time.Second), true
+	}
+	return ts, true
+}
+
+// timeMetadata adds the request date and hour in the configured timezone
+func (s *Parser) timeMetadata(entry models.LogEntry, metadata map[string]string) map[string]string {
+	if s.location == nil {
+		return metadata
+	}
+	t, ok := eventTime(entry)
+	if !ok {
+		return metadata
+	}
+	if metadata == nil {
+		metadata = make(map[string]string, 2)
+	}
+	t = t.In(s.location)
+	metadata["date"] = t.Format("2006-01-02")
+	metadata["hour"] = t.Format("15")
+	return metadata
+}
+
+// deliveryHourMetadata adds the delivery hour of the file name, UTC, for
+// per-hour completeness checks
+func (s *Parser) deliveryHourMetadata(lf logFile, metadata map[string]string) map[string]string {
+	if !s.opts.DeliveryHour || lf.Hour.IsZero() {
+		return metadata
+	}
+	if metadata == nil {
+		metadata = make(map[string]string, 1)
+	}
+	metadata["delivery_hour"] = lf.Hour.Format("2006-01-02T15")
+	return metadata
+}
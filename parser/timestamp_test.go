@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/clock"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+func TestTimestamp(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		name  string
+		opts  models.Options
+		entry models.LogEntry
+		want  time.Time
+		ok    bool
+	}{
+		{
+			name:  "event time",
+			opts:  models.Options{EntryMaxAge: time.Hour, OldEntries: "clamp"},
+			entry: models.LogEntry{"date": "2024-05-01", "time": "11:30:00"},
+			want:  time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC),
+			ok:    true,
+		},
+		{
+			name:  "no event time",
+			entry: models.LogEntry{"date": "-", "time": "-"},
+			want:  now,
+			ok:    true,
+		},
+		{
+			name:  "clamped",
+			opts:  models.Options{EntryMaxAge: time.Hour, OldEntries: "clamp"},
+			entry: models.LogEntry{"date": "2024-05-01", "time": "10:59:59"},
+			want:  now,
+			ok:    true,
+		},
+		{
+			name:  "dropped",
+			opts:  models.Options{EntryMaxAge: time.Hour, OldEntries: "drop"},
+			entry: models.LogEntry{"date": "2024-05-01", "time": "10:59:59"},
+			want:  time.Date(2024, 5, 1, 10, 59, 59, 0, time.UTC),
+		},
+		{
+			name:  "seconds precision",
+			opts:  models.Options{TimestampPrecision: "s"},
+			entry: models.LogEntry{"timestamp": "1714564800.123"},
+			want:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			ok:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Parser{opts: tt.opts}
+			s.SetClock(clock.NewFake(now))
+			got, ok := s.timestamp(tt.entry)
+			if !got.Equal(tt.want) || ok != tt.ok {
+				t.Errorf("timestamp() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
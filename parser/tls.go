@@ -0,0 +1,46 @@
+package parser
+
+import (
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// legacyProtocols are TLS versions older than 1.2
+var legacyProtocols = map[string]bool{
+	"SSLv3":   true,
+	"TLSv1":   true,
+	"TLSv1.1": true,
+}
+
+// weakCiphers are the OpenSSL names of weak ciphers, those of the legacy
+// CloudFront security policies (SSLv3, TLSv1_2016) and other RC4, 3DES, DES
+// and NULL ciphers
+var weakCiphers = map[string]bool{
+	"RC4-MD5":                true,
+	"RC4-SHA":                true,
+	"ECDHE-RSA-RC4-SHA":      true,
+	"ECDHE-ECDSA-RC4-SHA":    true,
+	"DES-CBC3-SHA":           true,
+	"ECDHE-RSA-DES-CBC3-SHA": true,
+	"DES-CBC-SHA":            true,
+	"NULL-MD5":               true,
+	"NULL-SHA":               true,
+	"NULL-SHA256":            true,
+}
+
+// transformTLS flags requests made with a deprecated TLS version or a weak
+// cipher as tls_legacy, so deprecated client usage can be tracked in Loki.
+// Other requests get no field.
+func (s *Parser) transformTLS(entry models.LogEntry) {
+	protocol := entry["ssl-protocol"]
+	if protocol == "" || protocol == "-" {
+		return // plain HTTP
+	}
+	legacy := legacyProtocols[protocol]
+	if weakCiphers[entry["ssl-cipher"]] {
+		legacy = true
+		entry["tls_weak_cipher"] = "true"
+	}
+	if legacy {
+		entry["tls_legacy"] = "true"
+	}
+}
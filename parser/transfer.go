@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// transfer is the bytes of a file as billed by AWS: downloaded from S3, as
+// stored or returned by S3 Select, and read after decompression. S3 Select
+// also bills the bytes it scanned.
+type transfer struct {
+	downloaded   int64
+	decompressed int64
+	scanned      int64
+}
+
+// transfers accumulates the bytes of the files read by distribution, to
+// reconcile them with the CloudFront and S3 bills
+type transfers struct {
+	mu    sync.Mutex
+	bytes map[string]*transfer
+}
+
+func newTransfers() *transfers {
+	return &transfers{bytes: make(map[string]*transfer)}
+}
+
+// add counts the bytes of a file read whether it was shipped or not, they
+// were billed either way
+func (t *transfers) add(distribution string, b transfer) {
+	if distribution == "" {
+		distribution = "unknown" // nonconforming file name
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total, ok := t.bytes[distribution]
+	if !ok {
+		total = &transfer{}
+		t.bytes[distribution] = total
+	}
+	total.downloaded += b.downloaded
+	total.decompressed += b.decompressed
+	total.scanned += b.scanned
+}
+
+func (t *transfers) writeMetrics(w io.Writer, selected bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	distributions := make([]string, 0, len(t.bytes))
+	for d := range t.bytes {
+		distributions = append(distributions, d)
+	}
+	sort.Strings(distributions)
+	for _, d := range distributions {
+		b := t.bytes[d]
+		fmt.Fprintf(w, "cloudfront_logs_shipper_downloaded_bytes_total{distribution=%q} %d\n", d, b.downloaded)
+		fmt.Fprintf(w, "cloudfront_logs_shipper_decompressed_bytes_total{distribution=%q} %d\n", d, b.decompressed)
+		if selected {
+			fmt.Fprintf(w, "cloudfront_logs_shipper_select_scanned_bytes_total{distribution=%q} %d\n", d, b.scanned)
+		}
+	}
+}
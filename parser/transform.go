@@ -0,0 +1,58 @@
+package parser
+
+import (
+	"strconv"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// transform modifies the parsed entry before it is encoded and shipped
+func (s *Parser) transform(entry models.LogEntry) {
+	s.transformFLE(entry)
+	s.transformXFF(entry)
+	s.transformClientIP(entry)
+	s.transformTLS(entry)
+}
+
+// transformFLE drops the field-level encryption fields, by default only when
+// FLE is not used by the distribution
+func (s *Parser) transformFLE(entry models.LogEntry) {
+	switch s.opts.FLE {
+	case "keep":
+		return
+	case "auto":
+		if status, ok := entry["fle-status"]; ok && status != "-" {
+			return
+		}
+	}
+	delete(entry, "fle-status")
+	delete(entry, "fle-encrypted-fields")
+}
+
+// provenanceMetadata adds the object key and line number in the file of an
+// entry, so a line can be traced back to the object it came from
+func (s *Parser) provenanceMetadata(fn string, line int, metadata map[string]string) map[string]string {
+	if !s.opts.Provenance {
+		return metadata
+	}
+	if metadata == nil {
+		metadata = make(map[string]string, 2)
+	}
+	metadata["source_key"] = fn
+	metadata["source_line"] = strconv.Itoa(line)
+	return metadata
+}
+
+// metadata returns the structured metadata of the entry, with --gdpr the
+// request id and the hash of the original client IP are attached so lines can
+// be deleted by them, with --metadata-timezone the request date and hour
+func (s *Parser) metadata(entry models.LogEntry, ipHash string) map[string]string {
+	var metadata map[string]string
+	if s.opts.GDPR {
+		metadata = map[string]string{
+			"request_id": entry["x-edge-request-id"],
+			"c_ip_hash":  ipHash,
+		}
+	}
+	return s.fieldMetadata(entry, s.timeMetadata(entry, metadata))
+}
@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/expr"
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// userExprs are the user defined field assignments and filters, evaluated
+// after the built-in transforms and enrichers
+type userExprs struct {
+	sets    []fieldExpr
+	filters []*expr.Program // lines are dropped when one is true
+	timeout time.Duration   // per line
+}
+
+type fieldExpr struct {
+	field string
+	prog  *expr.Program
+}
+
+func newUserExprs(opts models.Options) (*userExprs, error) {
+	if len(opts.Sets) == 0 && len(opts.Filters) == 0 {
+		return nil, nil
+	}
+	u := &userExprs{timeout: opts.ExprTimeout}
+	for _, set := range opts.Sets {
+		field, src, ok := strings.Cut(set, "=")
+		if !ok || field == "" {
+			return nil, fmt.Errorf("invalid set %q (field=expression)", set)
+		}
+		prog, err := expr.Compile(src)
+		if err != nil {
+			return nil, err
+		}
+		u.sets = append(u.sets, fieldExpr{field: field, prog: prog})
+	}
+	for _, filter := range opts.Filters {
+		prog, err := expr.Compile(filter)
+		if err != nil {
+			return nil, err
+		}
+		u.filters = append(u.filters, prog)
+	}
+	return u, nil
+}
+
+// evalExprs applies the field assignments and reports whether a filter drops
+// the line. A failed or timed out expression leaves the field unchanged or
+// keeps the line.
+func (s *Parser) evalExprs(entry models.LogEntry) bool {
+	u := s.userExprs
+	if u == nil {
+		return false
+	}
+	deadline := expr.NewDeadline(s.clock, u.timeout)
+	for _, set := range u.sets {
+		v, err := set.prog.EvalString(entry, deadline)
+		if err != nil {
+			s.exprErrors.Add(1)
+			s.logger.Debug("expression failed", "expression", set.prog, "err", err)
+			continue
+		}
+		entry[set.field] = v
+	}
+	for _, filter := range u.filters {
+		drop, err := filter.Bool(entry, deadline)
+		if err != nil {
+			s.exprErrors.Add(1)
+			s.logger.Debug("expression failed", "expression", filter, "err", err)
+			continue
+		}
+		if drop {
+			s.exprFiltered.Add(1)
+			return true
+		}
+	}
+	return false
+}
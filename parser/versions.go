@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// detectVersioning reports whether versioning was ever enabled on the bucket,
+// in which case plain deletes only leave delete markers behind
+func (s *Parser) detectVersioning(ctx context.Context) bool {
+	out, err := s.s3Client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{
+		Bucket: &s.opts.BucketName,
+	})
+	if err != nil {
+		s.logger.Warn("unable to detect bucket versioning, assuming unversioned", "err", err)
+		return false
+	}
+	return out.Status == types.BucketVersioningStatusEnabled || out.Status == types.BucketVersioningStatusSuspended
+}
+
+// deleteFile removes a shipped file, on versioned buckets the processed version
+// (or every version with --purge-versions) is deleted instead of adding a marker
+func (s *Parser) deleteFile(ctx context.Context, key string, versionID *string) error {
+	if s.objectLock.active.Load() {
+		return s.tagProcessed(ctx, key, versionID, nil)
+	}
+	var err error
+	switch {
+	case s.versioned && s.opts.PurgeVersions:
+		err = s.purgeVersions(ctx, key)
+	case s.deletes != nil:
+		done := make(chan error, 1)
+		s.deletes.delete(key, s.deleteVersion(versionID), func(err error) { done <- err })
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			return ctx.Err() // the key may still be deleted, shipped again otherwise
+		}
+	default:
+		_, err = s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket:    &s.opts.BucketName,
+			Key:       &key,
+			VersionId: s.deleteVersion(versionID),
+		})
+	}
+	if err != nil && locked(err) {
+		return s.tagProcessed(ctx, key, versionID, err)
+	}
+	return err
+}
+
+// deleteShipped deletes a shipped file and settles it with the outcome, with
+// --delete-window the delete is queued and the worker moves on right away
+func (s *Parser) deleteShipped(ctx context.Context, key string, versionID *string) {
+	if s.deletes == nil || s.objectLock.active.Load() || s.versioned && s.opts.PurgeVersions {
+		s.deleted(key, s.deleteFile(ctx, key, versionID))
+		return
+	}
+	s.deletes.delete(key, s.deleteVersion(versionID), func(err error) {
+		if err != nil && locked(err) {
+			err = s.tagProcessed(ctx, key, versionID, err)
+		}
+		s.deleted(key, err)
+	})
+}
+
+// deleteVersion returns the version a delete removes, none on unversioned
+// buckets
+func (s *Parser) deleteVersion(versionID *string) *string {
+	if !s.versioned {
+		return nil
+	}
+	return versionID
+}
+
+func (s *Parser) purgeVersions(ctx context.Context, key string) error {
+	input := &s3.ListObjectVersionsInput{
+		Bucket: &s.opts.BucketName,
+		Prefix: &key,
+	}
+	for {
+		out, err := s.s3Client.ListObjectVersions(ctx, input)
+		if err != nil {
+			return err
+		}
+		var ids []*string
+		for _, v := range out.Versions {
+			if v.Key != nil && *v.Key == key {
+				ids = append(ids, v.VersionId)
+			}
+		}
+		for _, m := range out.DeleteMarkers {
+			if m.Key != nil && *m.Key == key {
+				ids = append(ids, m.VersionId)
+			}
+		}
+		for _, id := range ids {
+			if _, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket:    &s.opts.BucketName,
+				Key:       &key,
+				VersionId: id,
+			}); err != nil {
+				return err
+			}
+		}
+		if out.IsTruncated == nil || !*out.IsTruncated {
+			return nil
+		}
+		input.KeyMarker = out.NextKeyMarker
+		input.VersionIdMarker = out.NextVersionIdMarker
+	}
+}
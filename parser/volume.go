@@ -0,0 +1,124 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// volume compares the lines shipped per namespace in each interval with a
+// trailing baseline and warns on sharp spikes and drops, an early signal of
+// origin outages or misconfigured distributions
+type volume struct {
+	mu       sync.Mutex
+	factor   float64
+	alpha    float64            // weight of the last interval in the baseline
+	warmup   int                // intervals before a namespace is checked
+	current  map[string]int64   // lines of the running interval
+	last     map[string]int64   // lines of the last closed interval
+	baseline map[string]float64 // moving average of lines per interval
+	seen     map[string]int     // closed intervals
+	alerts   map[string]map[string]int64
+}
+
+func newVolume(opts models.Options) *volume {
+	factor, intervals := opts.VolumeFactor, opts.VolumeBaseline
+	if opts.VolumeInterval <= 0 || factor <= 1 || intervals <= 0 {
+		return nil
+	}
+	return &volume{
+		factor:   factor,
+		alpha:    2 / float64(intervals+1),
+		warmup:   (intervals + 1) / 2,
+		current:  make(map[string]int64),
+		last:     make(map[string]int64),
+		baseline: make(map[string]float64),
+		seen:     make(map[string]int),
+		alerts:   make(map[string]map[string]int64),
+	}
+}
+
+// add counts the lines shipped for a namespace
+func (v *volume) add(namespace string, lines int) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.current[namespace] += int64(lines)
+}
+
+// CheckVolume closes the running interval of the line volume per namespace
+// and warns about namespaces deviating from their baseline
+func (s *Parser) CheckVolume() {
+	s.volume.check(s.logger)
+}
+
+func (v *volume) check(logger *slog.Logger) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for ns := range v.current {
+		if _, ok := v.baseline[ns]; !ok {
+			v.baseline[ns] = 0
+		}
+	}
+	for ns, baseline := range v.baseline {
+		n := v.current[ns]
+		if v.seen[ns] >= v.warmup && baseline >= 1 {
+			switch {
+			case float64(n) >= v.factor*baseline:
+				v.alert(ns, "spike")
+				logger.Warn("namespace line volume spiked", "namespace", ns, "lines", n, "baseline", int64(baseline))
+			case n == 0:
+				v.alert(ns, "zero")
+				logger.Warn("namespace line volume dropped to zero", "namespace", ns, "baseline", int64(baseline))
+			case float64(n) <= baseline/v.factor:
+				v.alert(ns, "drop")
+				logger.Warn("namespace line volume dropped", "namespace", ns, "lines", n, "baseline", int64(baseline))
+			}
+		}
+		if v.seen[ns] == 0 {
+			v.baseline[ns] = float64(n)
+		} else {
+			v.baseline[ns] = v.alpha*float64(n) + (1-v.alpha)*baseline
+		}
+		v.seen[ns]++
+		v.last[ns] = n
+	}
+	clear(v.current)
+}
+
+// alert counts an alert of a kind, caller must hold the lock
+func (v *volume) alert(namespace, kind string) {
+	if v.alerts[namespace] == nil {
+		v.alerts[namespace] = make(map[string]int64)
+	}
+	v.alerts[namespace][kind]++
+}
+
+func (v *volume) writeMetrics(w io.Writer) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	namespaces := make([]string, 0, len(v.baseline))
+	for ns := range v.baseline {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		fmt.Fprintf(w, "cloudfront_logs_shipper_namespace_interval_lines{namespace=%q} %d\n", ns, v.last[ns])
+		fmt.Fprintf(w, "cloudfront_logs_shipper_namespace_baseline_lines{namespace=%q} %.1f\n", ns, v.baseline[ns])
+		for _, kind := range []string{"spike", "drop", "zero"} {
+			fmt.Fprintf(w, "cloudfront_logs_shipper_namespace_volume_alerts_total{namespace=%q,kind=%q} %d\n", ns, kind, v.alerts[ns][kind])
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package parser
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/nugored/cf-logs-loki-uploader/models"
+)
+
+// transformXFF splits x-forwarded-for into the first-hop client IP and the
+// chain of proxies it went through
+func (s *Parser) transformXFF(entry models.LogEntry) {
+	xff, ok := entry["x-forwarded-for"]
+	if !ok || xff == "-" || xff == "" {
+		return
+	}
+	xff = strings.ReplaceAll(xff, "%20", "")
+	hops := strings.Split(xff, ",")
+	for i, hop := range hops {
+		hops[i] = s.anonymizeIP(strings.TrimSpace(hop))
+	}
+	entry["x-forwarded-for-client"] = hops[0]
+	if len(hops) > 1 {
+		entry["x-forwarded-for-proxies"] = strings.Join(hops[1:], ",")
+	}
+	if s.opts.AnonymizeIPs {
+		entry["x-forwarded-for"] = strings.Join(hops, ",")
+	}
+}
+
+// transformClientIP anonymizes the client IP when enabled
+func (s *Parser) transformClientIP(entry models.LogEntry) {
+	if ip, ok := entry["c-ip"]; ok && s.opts.AnonymizeIPs {
+		entry["c-ip"] = s.anonymizeIP(ip)
+	}
+}
+
+// anonymizeIP zeroes the host part of an address (last octet for IPv4,
+// everything after /48 for IPv6) when --anonymize-ips is set
+func (s *Parser) anonymizeIP(ip string) string {
+	if !s.opts.AnonymizeIPs {
+		return ip
+	}
+	return zeroHost(ip)
+}
+
+// zeroHost zeroes the host part of an address, other values are kept
+func zeroHost(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.Addr().String()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/nugored/cf-logs-loki-uploader/parser"
+	"github.com/spf13/pflag"
+)
+
+// runPlan prints how a proposed configuration changes the streams, filters
+// and routes of a sample file compared to the current one, without S3 or Loki
+func runPlan(args []string) int {
+	fs := pflag.NewFlagSet("plan", pflag.ContinueOnError)
+	current := fs.StringP("current", "", "", "File of the current flags, split into words like a shell does (# for comments)")
+	proposed := fs.StringP("proposed", "", "", "File of the proposed flags, split into words like a shell does (# for comments)")
+	sample := fs.StringP("sample", "", "", "CloudFront log file to plan with, gzip, zstd or plain by extension (required)")
+	key := fs.StringP("key", "", "", "S3 key the sample is planned as, selecting namespace options (plan/<sample name> if empty)")
+	if err := fs.Parse(args); err != nil {
+		return exitFatal
+	}
+	logger := getLogger("info", os.Stdout)
+	if *sample == "" {
+		logger.Error("--sample is required")
+		return exitFatal
+	}
+	if *key == "" {
+		*key = "plan/" + path.Base(*sample)
+	}
+
+	var results [2]*parser.PlanResult
+	for i, file := range []string{*current, *proposed} {
+		res, err := planConfig(file, *key, *sample)
+		if err != nil {
+			logger.Error("unable to plan configuration", "config", file, "err", err)
+			return exitFatal
+		}
+		results[i] = res
+	}
+	cur, prop := results[0], results[1]
+
+	fmt.Printf("lines: %d\n", cur.Lines)
+	fmt.Printf("dropped: %s -> %s\n", percent(cur.Dropped, cur.Lines), percent(prop.Dropped, prop.Lines))
+	fmt.Printf("malformed, dead-lettered: %s -> %s\n", percent(cur.Malformed, cur.Lines), percent(prop.Malformed, prop.Lines))
+	fmt.Printf("unknown edges, dead-lettered: %s -> %s\n", percent(cur.Unrouted, cur.Lines), percent(prop.Unrouted, prop.Lines))
+	fmt.Printf("streams: %d -> %d\n", len(cur.Streams), len(prop.Streams))
+	for _, stream := range slices.Sorted(maps.Keys(prop.Streams)) {
+		if _, ok := cur.Streams[stream]; !ok {
+			fmt.Printf("+ %s (%d lines)\n", stream, prop.Streams[stream])
+		}
+	}
+	for _, stream := range slices.Sorted(maps.Keys(cur.Streams)) {
+		if _, ok := prop.Streams[stream]; !ok {
+			fmt.Printf("- %s (%d lines)\n", stream, cur.Streams[stream])
+		}
+	}
+	fmt.Println("routes:")
+	targets := slices.Sorted(maps.Keys(cur.Targets))
+	for target := range prop.Targets {
+		if _, ok := cur.Targets[target]; !ok {
+			targets = append(targets, target)
+		}
+	}
+	for _, target := range targets {
+		fmt.Printf("  %s: %d -> %d lines\n", target, cur.Targets[target], prop.Targets[target])
+	}
+	return exitClean
+}
+
+// planConfig plans the sample with the flags of a config file, the defaults
+// if the file is empty
+func planConfig(file, key, sample string) (*parser.PlanResult, error) {
+	var args []string
+	if file != "" {
+		var err error
+		if args, err = readArgs(file); err != nil {
+			return nil, err
+		}
+	}
+	fs := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	c := newCLI(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := c.convert(fs); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(sample)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := parser.Decode(c.opts.InputFormat, sample, "", "", f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return parser.Plan(c.opts, key, r, getLogger(*c.logLevel, os.Stdout))
+}
+
+// readArgs reads flags from a file, split into words like a shell does, so
+// a line may hold a flag and its value or several flags
+func readArgs(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for i, line := range strings.Split(string(data), "\n") {
+		words, err := splitWords(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, i+1, err)
+		}
+		args = append(args, words...)
+	}
+	return args, nil
+}
+
+// splitWords splits a line at unquoted blanks, with single quotes, double
+// quotes and backslash escapes as in a shell, up to a # starting a word
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case r == '#' && !inWord:
+			return words, nil
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
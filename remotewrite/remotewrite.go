@@ -0,0 +1,69 @@
+// Package remotewrite pushes samples to a Prometheus remote-write endpoint.
+package remotewrite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const timeout = 10 * time.Second
+
+type Client struct {
+	http *http.Client
+	URL  string
+}
+
+func NewClient(url string) *Client {
+	return &Client{
+		http: &http.Client{},
+		URL:  url,
+	}
+}
+
+// Push sends the time series, failed pushes are not retried as the next push
+// carries the updated cumulative values
+func (c *Client) Push(series []prompb.TimeSeries) error {
+	if len(series) == 0 {
+		return nil
+	}
+	req := prompb.WriteRequest{Timeseries: series}
+	buf, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.URL, bytes.NewReader(snappy.Encode(nil, buf)))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("User-Agent", "cloudfront-logs-shipper")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1024))
+		line := ""
+		if scanner.Scan() {
+			line = scanner.Text()
+		}
+		return fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package sqs sends, receives and deletes messages of an SQS queue, enough to
+// consume S3 event notifications.
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Client calls the SQS API of a queue with the credentials of the S3 client
+type Client struct {
+	sqs      *awssqs.Client
+	queueURL string
+}
+
+// Message is a received message, deleted or released by its receipt handle
+type Message struct {
+	ID            string
+	ReceiptHandle string
+	Body          string
+}
+
+// NewClient returns a client of a queue, the region defaults to the one of
+// the queue URL (https://sqs.<region>.amazonaws.com/<account>/<queue>)
+func NewClient(queueURL, region string, credentials aws.CredentialsProvider) (*Client, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid queue URL %q", queueURL)
+	}
+	if parts := strings.Split(u.Host, "."); len(parts) > 2 && parts[0] == "sqs" {
+		region = parts[1]
+	}
+	if region == "" {
+		return nil, fmt.Errorf("unable to determine the region of queue %q", queueURL)
+	}
+	return &Client{
+		sqs: awssqs.New(awssqs.Options{
+			Region:       region,
+			Credentials:  credentials,
+			BaseEndpoint: aws.String(u.Scheme + "://" + u.Host), // the host of the queue, e.g. a VPC endpoint
+			HTTPClient:   awshttp.NewBuildableClient().WithTimeout(time.Minute),
+		}),
+		queueURL: queueURL,
+	}, nil
+}
+
+// Receive waits up to wait for at most max messages, hidden from other
+// consumers for visibility
+func (c *Client) Receive(ctx context.Context, max int, wait, visibility time.Duration) ([]Message, error) {
+	out, err := c.sqs.ReceiveMessage(ctx, &awssqs.ReceiveMessageInput{
+		QueueUrl:            &c.queueURL,
+		MaxNumberOfMessages: int32(max),
+		WaitTimeSeconds:     int32(wait.Seconds()),
+		VisibilityTimeout:   int32(visibility.Seconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]Message, len(out.Messages))
+	for i, m := range out.Messages {
+		msgs[i] = Message{
+			ID:            aws.ToString(m.MessageId),
+			ReceiptHandle: aws.ToString(m.ReceiptHandle),
+			Body:          aws.ToString(m.Body),
+		}
+	}
+	return msgs, nil
+}
+
+// ChangeVisibility hides a received message for visibility from now on, 0
+// makes it visible again right away
+func (c *Client) ChangeVisibility(ctx context.Context, receiptHandle string, visibility time.Duration) error {
+	_, err := c.sqs.ChangeMessageVisibility(ctx, &awssqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &c.queueURL,
+		ReceiptHandle:     &receiptHandle,
+		VisibilityTimeout: int32(visibility.Seconds()),
+	})
+	return err
+}
+
+// Delete removes a received message from the queue
+func (c *Client) Delete(ctx context.Context, receiptHandle string) error {
+	_, err := c.sqs.DeleteMessage(ctx, &awssqs.DeleteMessageInput{
+		QueueUrl:      &c.queueURL,
+		ReceiptHandle: &receiptHandle,
+	})
+	return err
+}
+
+// SendBatch sends up to 10 messages and returns the indexes of the bodies
+// SQS failed to send
+func (c *Client) SendBatch(ctx context.Context, bodies []string) ([]int, error) {
+	entries := make([]types.SendMessageBatchRequestEntry, len(bodies))
+	for i := range bodies {
+		entries[i] = types.SendMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), MessageBody: &bodies[i]}
+	}
+	out, err := c.sqs.SendMessageBatch(ctx, &awssqs.SendMessageBatchInput{
+		QueueUrl: &c.queueURL,
+		Entries:  entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	failed := make([]int, 0, len(out.Failed))
+	for _, f := range out.Failed {
+		if i, err := strconv.Atoi(aws.ToString(f.Id)); err == nil {
+			failed = append(failed, i)
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nugored/cf-logs-loki-uploader/parser"
+	"github.com/prometheus/common/version"
+)
+
+const (
+	tuiRefresh = time.Second
+	tuiWindow  = 10 // refreshes the throughput is averaged over
+	tuiLogs    = 5  // log lines shown
+)
+
+// tuiLog keeps the last log lines for the status screen, logs would
+// otherwise scroll it away. Until the screen is drawn they are written to
+// stdout too, for errors at startup.
+type tuiLog struct {
+	mu     sync.Mutex
+	screen bool
+	lines  []string
+}
+
+func (l *tuiLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.screen {
+		if _, err := os.Stdout.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	l.lines = append(l.lines, strings.TrimRight(string(p), "\n"))
+	if len(l.lines) > tuiLogs {
+		l.lines = l.lines[len(l.lines)-tuiLogs:]
+	}
+	return len(p), nil
+}
+
+func (l *tuiLog) last() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+// runTUI redraws the queue, the files being shipped, the throughput and the
+// recent errors and logs in the terminal until the process exits
+func runTUI(p *parser.Parser, bucket string, logs *tuiLog, start time.Time) {
+	width := 120
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 20 {
+		width = n
+	}
+	logs.mu.Lock()
+	logs.screen = true
+	logs.mu.Unlock()
+	var samples []parser.Summary // of the last refreshes, oldest first
+	for range time.Tick(tuiRefresh) {
+		summary := p.Summary(time.Since(start))
+		samples = append(samples, summary)
+		if len(samples) > tuiWindow {
+			samples = samples[1:]
+		}
+		var screen bytes.Buffer
+		screen.WriteString("\x1b[H\x1b[2J") // home and clear
+		drawTUI(&screen, p, bucket, summary, samples, logs.last(), width)
+		_, _ = os.Stdout.Write(screen.Bytes())
+	}
+}
+
+func drawTUI(w io.Writer, p *parser.Parser, bucket string, summary parser.Summary, samples []parser.Summary, logs []string, width int) {
+	line := func(format string, args ...any) {
+		s := fmt.Sprintf(format, args...)
+		if len(s) > width {
+			s = s[:width-1] + "…"
+		}
+		fmt.Fprintln(w, s)
+	}
+	uptime := time.Duration(summary.Duration) * time.Second
+	line("cloudfront-logs-shipper %s  bucket %s  up %s", version.Version, bucket, uptime)
+	ws := p.WorkerStats()
+	line("queue %d/%d  workers %d  busy %d", ws.Queued, ws.QueueCapacity, ws.Workers, ws.Busy)
+	var lines, files float64
+	if first := samples[0]; len(samples) > 1 {
+		secs := summary.Duration - first.Duration
+		lines = float64(summary.Lines-first.Lines) / secs
+		files = float64(summary.FilesOK-first.FilesOK) / secs
+	}
+	line("shipped %d files, %d lines  failed %d  skipped %d  %.0f lines/s  %.1f files/s",
+		summary.FilesOK, summary.Lines, summary.FilesFailed, summary.FilesSkipped, lines, files)
+
+	line("")
+	line("in flight:")
+	for _, f := range p.InFlight() {
+		line("  %7s  %s (attempt %d)", time.Duration(f.Age*float64(time.Second)).Truncate(100*time.Millisecond), f.Key, f.Attempts)
+	}
+	line("")
+	line("recent errors:")
+	errs := p.RecentErrors()
+	if len(errs) > tuiLogs {
+		errs = errs[len(errs)-tuiLogs:]
+	}
+	for _, e := range errs {
+		line("  %s  %s %s", e.Time.Format(time.TimeOnly), e.Key, e.Error)
+	}
+	line("")
+	line("log:")
+	for _, l := range logs {
+		line("  %s", l)
+	}
+}